@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/skip2/go-qrcode"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
 	"maunium.net/go/mautrix/bridge/commands"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -24,6 +31,11 @@ func (br *SignalBridge) RegisterCommands() {
 	proc.AddHandlers(
 		cmdPing,
 		cmdLogin,
+		cmdDisappearingTimer,
+		cmdDebugSenderKey,
+		cmdAcceptSafetyNumber,
+		cmdSafetyNumber,
+		cmdVerify,
 	)
 }
 
@@ -147,6 +159,232 @@ func fnLogin(ce *WrappedCommandEvent) {
 	ce.User.Connect()
 }
 
+var cmdDisappearingTimer = &commands.FullHandler{
+	Func:    wrapCommand(fnDisappearingTimer),
+	Name:    "disappearing-timer",
+	Aliases: []string{"disappear-timer"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Set the disappearing message timer of this chat, e.g. `1d`, `8h` or `off`",
+		Args:        "<_time_|off>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnDisappearingTimer(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `$cmdprefix disappearing-timer <time|off>`")
+		return
+	}
+	expireTimer, err := parseDisappearingTimer(ce.Args[0])
+	if err != nil {
+		ce.Reply("Invalid timer: %v", err)
+		return
+	}
+	update := signalmeow.IncomingSignalMessageExpireTimerUpdate{
+		IncomingSignalMessageBase: signalmeow.IncomingSignalMessageBase{SenderUUID: ce.User.SignalID},
+		Timestamp:                 uint64(time.Now().UnixMilli()),
+		ExpireTimer:               expireTimer,
+	}
+	if ce.Portal.IsPrivateChat() {
+		content := &signalpb.Content{
+			DataMessage: signalmeow.DataMessageForExpireTimerUpdate(expireTimer),
+		}
+		update.RecipientUUID = ce.Portal.ChatID
+		update.Timestamp, err = ce.Portal.sendSignalMessage(context.Background(), content, ce.User, "")
+	} else {
+		// Group timers are part of the group state, so they're changed like the title
+		groupID := signalmeow.GroupID(ce.Portal.ChatID)
+		update.GroupID = &groupID
+		_, err = signalmeow.UpdateGroupDisappearingTimer(context.Background(), ce.User.SignalDevice, groupID, expireTimer)
+	}
+	if err != nil {
+		ce.Reply("Failed to send timer change to Signal: %s", groupChangeErrorMessage(err))
+		return
+	}
+	// The portal loop owns the timer, so apply the change there like one made on another device.
+	// That also posts the notice saying what the timer was set to.
+	sender := ce.Bridge.GetPuppetByCustomMXID(ce.User.MXID)
+	if sender == nil {
+		sender = ce.Bridge.GetPuppetBySignalID(ce.User.SignalID)
+	}
+	ce.Portal.signalMessages <- portalSignalMessage{
+		user:   ce.User,
+		msg:    update,
+		sender: sender,
+	}
+}
+
+var cmdAcceptSafetyNumber = &commands.FullHandler{
+	Func: wrapCommand(fnAcceptSafetyNumber),
+	Name: "accept-safety-number",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Accept the changed safety number of the contact in this private chat, so messages can be sent to them again",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnAcceptSafetyNumber(ce *WrappedCommandEvent) {
+	if !ce.Portal.IsPrivateChat() {
+		ce.Reply("This command can only be used in private chats")
+		return
+	}
+	err := signalmeow.AcknowledgeIdentityChange(context.Background(), ce.User.SignalDevice, ce.Portal.ChatID)
+	if err != nil {
+		ce.Reply("Failed to accept the safety number: %v", err)
+		return
+	}
+	ce.Reply("Accepted the new safety number, messages will be sent to this contact again")
+}
+
+// The Signal user a command is about: the argument if there is one, otherwise the other side of the private chat
+func (ce *WrappedCommandEvent) signalUserFromArgs() (string, bool) {
+	if len(ce.Args) > 0 {
+		if signalID, ok := ce.Bridge.ParsePuppetMXID(id.UserID(ce.Args[0])); ok {
+			return signalID, true
+		}
+		return strings.ToLower(ce.Args[0]), true
+	} else if ce.Portal != nil && ce.Portal.IsPrivateChat() {
+		return ce.Portal.ChatID, true
+	}
+	return "", false
+}
+
+var cmdSafetyNumber = &commands.FullHandler{
+	Func: wrapCommand(fnSafetyNumber),
+	Name: "safety-number",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Show the safety number with a Signal user, to compare it with theirs",
+		Args:        "[_Signal ID or Matrix user_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnSafetyNumber(ce *WrappedCommandEvent) {
+	signalID, ok := ce.signalUserFromArgs()
+	if !ok {
+		ce.Reply("**Usage:** `$cmdprefix safety-number <Signal ID or Matrix user>`, or without arguments in a private chat portal")
+		return
+	}
+	safetyNumber, err := signalmeow.GetSafetyNumber(context.Background(), ce.User.SignalDevice, signalID)
+	if err != nil {
+		ce.Reply("Failed to get safety number: %v", err)
+		return
+	}
+	// The official apps show it as 3 rows of 4 groups of 5 digits
+	var rows []string
+	for row := safetyNumber.DisplayString; len(row) > 0; {
+		var groups []string
+		for i := 0; i < 4 && len(row) > 0; i++ {
+			groupLength := 5
+			if len(row) < groupLength {
+				groupLength = len(row)
+			}
+			groups = append(groups, row[:groupLength])
+			row = row[groupLength:]
+		}
+		rows = append(rows, strings.Join(groups, " "))
+	}
+	verified := "not verified"
+	if safetyNumber.Verified {
+		verified = "verified"
+	}
+	ce.Reply("Safety number with `%s` (%s):\n\n```\n%s\n```", signalID, verified, strings.Join(rows, "\n"))
+
+	url, ok := ce.User.uploadQR(ce, string(safetyNumber.Scannable))
+	if !ok {
+		return
+	}
+	_, err = ce.Bot.SendMessageEvent(ce.RoomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    "safety-number.png",
+		URL:     url.CUString(),
+	})
+	if err != nil {
+		ce.Log.Errorln("Failed to send safety number QR code:", err)
+	}
+}
+
+var cmdVerify = &commands.FullHandler{
+	Func: wrapCommand(fnVerify),
+	Name: "verify",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Mark the safety number with a Signal user as verified, after comparing it with `safety-number`. Use `--clear` to unverify",
+		Args:        "[--clear] [_Signal ID or Matrix user_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnVerify(ce *WrappedCommandEvent) {
+	verified := true
+	if len(ce.Args) > 0 && ce.Args[0] == "--clear" {
+		verified = false
+		ce.Args = ce.Args[1:]
+	}
+	signalID, ok := ce.signalUserFromArgs()
+	if !ok {
+		ce.Reply("**Usage:** `$cmdprefix verify [--clear] <Signal ID or Matrix user>`, or without a user in a private chat portal")
+		return
+	}
+	err := signalmeow.SetIdentityVerified(context.Background(), ce.User.SignalDevice, signalID, verified)
+	if err != nil {
+		ce.Reply("Failed to update verification state: %v", err)
+	} else if verified {
+		ce.Reply("Marked `%s` as verified", signalID)
+	} else {
+		ce.Reply("Marked `%s` as not verified", signalID)
+	}
+}
+
+var cmdDebugSenderKey = &commands.FullHandler{
+	Func: wrapCommand(fnDebugSenderKey),
+	Name: "debug-sender-key",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Show which sender key this group uses and which member devices have it",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnDebugSenderKey(ce *WrappedCommandEvent) {
+	if ce.Portal.IsPrivateChat() {
+		ce.Reply("Sender keys are only used in groups")
+		return
+	}
+	state, err := signalmeow.GetSenderKeyDistributionState(context.Background(), ce.User.SignalDevice, signalmeow.GroupID(ce.Portal.ChatID))
+	if err != nil {
+		ce.Reply("Failed to get sender key state: %v", err)
+		return
+	} else if state == nil {
+		ce.Reply("No sender key has been sent to this group yet")
+		return
+	}
+	devices := make(map[string][]string)
+	var members []string
+	for _, device := range state.SharedWith {
+		if _, ok := devices[device.Uuid]; !ok {
+			members = append(members, device.Uuid)
+		}
+		devices[device.Uuid] = append(devices[device.Uuid], strconv.Itoa(device.DeviceID))
+	}
+	sort.Strings(members)
+	lines := []string{
+		fmt.Sprintf("Distribution ID: `%s`", state.DistributionID),
+		fmt.Sprintf("Checked at group revision: %d", state.Revision),
+		fmt.Sprintf("Shared with %d devices of %d members:", len(state.SharedWith), len(members)),
+	}
+	for _, member := range members {
+		lines = append(lines, fmt.Sprintf("* `%s`: devices %s", member, strings.Join(devices[member], ", ")))
+	}
+	ce.Reply(strings.Join(lines, "\n"))
+}
+
 func (user *User) sendQR(ce *WrappedCommandEvent, code string, prevEvent id.EventID) id.EventID {
 	url, ok := user.uploadQR(ce, code)
 	if !ok {
@@ -47,6 +47,8 @@ type BridgeConfig struct {
 	DeletePortalOnChannelDelete bool `yaml:"delete_portal_on_channel_delete"`
 	FederateRooms               bool `yaml:"federate_rooms"`
 
+	IdentityChangePolicy string `yaml:"identity_change_policy"`
+
 	MessageHandlingTimeout struct {
 		ErrorAfterStr string `yaml:"error_after"`
 		DeadlineStr   string `yaml:"deadline"`
@@ -89,6 +91,11 @@ func (bc *BridgeConfig) EnableMessageErrorNotices() bool {
 	return bc.MessageErrorNotices
 }
 
+// BlockOnIdentityChange returns whether sending to a contact should stop until their new safety number is accepted
+func (bc *BridgeConfig) BlockOnIdentityChange() bool {
+	return bc.IdentityChangePolicy == "block"
+}
+
 func boolToInt(val bool) int {
 	if val {
 		return 1
@@ -129,6 +136,11 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	switch bc.IdentityChangePolicy {
+	case "", "trust", "block":
+	default:
+		return fmt.Errorf("invalid identity_change_policy %q, must be trust or block", bc.IdentityChangePolicy)
+	}
 
 	return nil
 }
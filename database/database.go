@@ -15,10 +15,15 @@ import (
 type Database struct {
 	*dbutil.Database
 
-	User    *UserQuery
-	Portal  *PortalQuery
-	Puppet  *PuppetQuery
-	Message *MessageQuery
+	User     *UserQuery
+	Portal   *PortalQuery
+	Puppet   *PuppetQuery
+	Message  *MessageQuery
+	Reaction *ReactionQuery
+
+	DisappearingMessage *DisappearingMessageQuery
+	Outbox              *OutboxQuery
+	LastRead            *LastReadQuery
 }
 
 func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
@@ -40,6 +45,22 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("Message"),
 	}
+	db.Reaction = &ReactionQuery{
+		db:  db,
+		log: log.Sub("Reaction"),
+	}
+	db.DisappearingMessage = &DisappearingMessageQuery{
+		db:  db,
+		log: log.Sub("DisappearingMessage"),
+	}
+	db.Outbox = &OutboxQuery{
+		db:  db,
+		log: log.Sub("Outbox"),
+	}
+	db.LastRead = &LastReadQuery{
+		db:  db,
+		log: log.Sub("LastRead"),
+	}
 	return db
 }
 
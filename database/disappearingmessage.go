@@ -0,0 +1,137 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type DisappearingMessageQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (dmq *DisappearingMessageQuery) New() *DisappearingMessage {
+	return &DisappearingMessage{
+		db:  dmq.db,
+		log: dmq.log,
+	}
+}
+
+// NewWithValues creates a disappearing message that hasn't started counting down yet, unless expireAt is set
+func (dmq *DisappearingMessageQuery) NewWithValues(roomID id.RoomID, eventID id.EventID, expireIn time.Duration, expireAt time.Time) *DisappearingMessage {
+	dm := dmq.New()
+	dm.RoomID = roomID
+	dm.EventID = eventID
+	dm.ExpireIn = expireIn
+	dm.ExpireAt = expireAt
+	return dm
+}
+
+type DisappearingMessage struct {
+	db  *Database
+	log log.Logger
+
+	RoomID   id.RoomID
+	EventID  id.EventID
+	ExpireIn time.Duration
+	ExpireAt time.Time // Zero until the timer is started
+}
+
+const (
+	getUpcomingDisappearingMessagesQuery = `
+		SELECT mx_room, mxid, expire_in, expire_at FROM disappearing_message
+		WHERE expire_at IS NOT NULL AND expire_at <= $1
+	`
+	getUnscheduledDisappearingMessagesForRoomQuery = `
+		SELECT mx_room, mxid, expire_in, expire_at FROM disappearing_message
+		WHERE expire_at IS NULL AND mx_room=$1
+	`
+)
+
+func (dm *DisappearingMessage) Insert(txn dbutil.Execable) {
+	if txn == nil {
+		txn = dm.db
+	}
+	var expireAt sql.NullInt64
+	if !dm.ExpireAt.IsZero() {
+		expireAt = sql.NullInt64{Int64: dm.ExpireAt.UnixMilli(), Valid: true}
+	}
+	_, err := txn.Exec(`
+		INSERT INTO disappearing_message (mx_room, mxid, expire_in, expire_at)
+		VALUES ($1, $2, $3, $4)
+	`,
+		dm.RoomID, dm.EventID, dm.ExpireIn.Milliseconds(), expireAt)
+	if err != nil {
+		dm.log.Warnfln("Failed to insert disappearing message %s/%s: %v", dm.RoomID, dm.EventID, err)
+	}
+}
+
+// StartTimer starts counting down from now, if the timer wasn't already started
+func (dm *DisappearingMessage) StartTimer() {
+	if !dm.ExpireAt.IsZero() {
+		return
+	}
+	dm.ExpireAt = time.Now().Add(dm.ExpireIn)
+	_, err := dm.db.Exec(`
+		UPDATE disappearing_message SET expire_at=$1 WHERE mx_room=$2 AND mxid=$3
+	`,
+		dm.ExpireAt.UnixMilli(), dm.RoomID, dm.EventID)
+	if err != nil {
+		dm.log.Warnfln("Failed to start timer of disappearing message %s/%s: %v", dm.RoomID, dm.EventID, err)
+	}
+}
+
+func (dm *DisappearingMessage) Delete() {
+	_, err := dm.db.Exec(`
+		DELETE FROM disappearing_message WHERE mx_room=$1 AND mxid=$2
+	`,
+		dm.RoomID, dm.EventID)
+	if err != nil {
+		dm.log.Warnfln("Failed to delete disappearing message %s/%s: %v", dm.RoomID, dm.EventID, err)
+	}
+}
+
+func (dm *DisappearingMessage) Scan(row dbutil.Scannable) *DisappearingMessage {
+	var expireIn int64
+	var expireAt sql.NullInt64
+	err := row.Scan(&dm.RoomID, &dm.EventID, &expireIn, &expireAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			dm.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	dm.ExpireIn = time.Duration(expireIn) * time.Millisecond
+	if expireAt.Valid {
+		dm.ExpireAt = time.UnixMilli(expireAt.Int64)
+	}
+	return dm
+}
+
+func (dmq *DisappearingMessageQuery) getAll(query string, args ...interface{}) (messages []*DisappearingMessage) {
+	rows, err := dmq.db.Query(query, args...)
+	if err != nil || rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		if dm := dmq.New().Scan(rows); dm != nil {
+			messages = append(messages, dm)
+		}
+	}
+	return
+}
+
+// GetUpcomingScheduled returns all the messages that will expire within the given duration, including already expired ones
+func (dmq *DisappearingMessageQuery) GetUpcomingScheduled(duration time.Duration) []*DisappearingMessage {
+	return dmq.getAll(getUpcomingDisappearingMessagesQuery, time.Now().Add(duration).UnixMilli())
+}
+
+// GetUnscheduledForRoom returns the messages in the room whose timer hasn't been started yet
+func (dmq *DisappearingMessageQuery) GetUnscheduledForRoom(roomID id.RoomID) []*DisappearingMessage {
+	return dmq.getAll(getUnscheduledDisappearingMessagesForRoomQuery, roomID)
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+)
+
+type LastReadQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// Get returns the timestamp of the newest message the user has sent a read receipt for, or the zero time if there isn't one
+func (lrq *LastReadQuery) Get(userID id.UserID, key PortalKey) time.Time {
+	var timestamp int64
+	err := lrq.db.QueryRow(`
+		SELECT timestamp FROM last_read WHERE user_mxid=$1 AND signal_chat_id=$2 AND signal_receiver=$3
+	`, userID, key.ChatID, key.Receiver).Scan(&timestamp)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			lrq.log.Warnfln("Failed to get last read timestamp of %s in %s: %v", userID, key, err)
+		}
+		return time.Time{}
+	}
+	return time.UnixMilli(timestamp)
+}
+
+func (lrq *LastReadQuery) Set(userID id.UserID, key PortalKey, timestamp time.Time) {
+	_, err := lrq.db.Exec(`
+		INSERT INTO last_read (user_mxid, signal_chat_id, signal_receiver, timestamp)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_mxid, signal_chat_id, signal_receiver) DO UPDATE SET timestamp=excluded.timestamp
+	`, userID, key.ChatID, key.Receiver, timestamp.UnixMilli())
+	if err != nil {
+		lrq.log.Warnfln("Failed to save last read timestamp of %s in %s: %v", userID, key, err)
+	}
+}
@@ -30,29 +30,37 @@ type Message struct {
 	MXRoom         id.RoomID
 	Sender         string
 	Timestamp      time.Time
+	PartIndex      int // Index of this event if the Signal message was split into multiple Matrix events
 	SignalChatID   string
 	SignalReceiver string
 }
 
 const (
 	getAllMessagesQuery = `
-		SELECT mxid, mx_room, sender, timestamp, signal_chat_id, signal_receiver
+		SELECT mxid, mx_room, sender, timestamp, part_index, signal_chat_id, signal_receiver FROM message
 		WHERE signal_chat_id=$1 AND signal_receiver=$2
 	`
 	getMessageByMXIDQuery = `
-		SELECT mxid, mx_room, sender, timestamp, signal_chat_id, signal_receiver
+		SELECT mxid, mx_room, sender, timestamp, part_index, signal_chat_id, signal_receiver FROM message
 		WHERE mxid=$1
 	`
 	getMessagesBySignalIDQuery = `
-        SELECT mxid, mx_room, sender, timestamp, signal_chat_id, signal_receiver FROM message
+        SELECT mxid, mx_room, sender, timestamp, part_index, signal_chat_id, signal_receiver FROM message
         WHERE sender=$1 AND timestamp=$2 AND signal_chat_id=$3 AND signal_receiver=$4
+        ORDER BY part_index
+	`
+	getMessagesBetweenQuery = `
+		SELECT mxid, mx_room, sender, timestamp, part_index, signal_chat_id, signal_receiver FROM message
+		WHERE signal_chat_id=$1 AND signal_receiver=$2 AND timestamp>$3 AND timestamp<=$4
+		ORDER BY timestamp, part_index
 	`
 	findBySenderAndTimestampQuery = `
-		SELECT mxid, mx_room, sender, timestamp, signal_chat_id, signal_receiver FROM message
+		SELECT mxid, mx_room, sender, timestamp, part_index, signal_chat_id, signal_receiver FROM message
 		WHERE sender=$1 AND timestamp=$2
+		ORDER BY part_index
 	`
 	getFirstBeforeQuery = `
-		SELECT mxid, mx_room, sender, timestamp, signal_chat_id, signal_receiver FROM message
+		SELECT mxid, mx_room, sender, timestamp, part_index, signal_chat_id, signal_receiver FROM message
 		WHERE mx_room=$1 AND timestamp <= $2
 		ORDER BY timestamp DESC
 		LIMIT 1
@@ -64,11 +72,11 @@ func (msg *Message) Insert(txn dbutil.Execable) {
 		txn = msg.db
 	}
 	_, err := txn.Exec(`
-		INSERT INTO message (mxid, mx_room, sender, timestamp, signal_chat_id, signal_receiver)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO message (mxid, mx_room, sender, timestamp, part_index, signal_chat_id, signal_receiver)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 	`,
-		msg.MXID.String(), msg.MXRoom, msg.Sender, msg.Timestamp.UnixMilli(), msg.SignalChatID, msg.SignalReceiver)
-	msg.log.Debugfln("Inserting message", msg.MXID, msg.MXRoom, msg.Sender, msg.Timestamp.UnixMilli(), msg.SignalChatID, msg.SignalReceiver)
+		msg.MXID.String(), msg.MXRoom, msg.Sender, msg.Timestamp.UnixMilli(), msg.PartIndex, msg.SignalChatID, msg.SignalReceiver)
+	msg.log.Debugfln("Inserting message", msg.MXID, msg.MXRoom, msg.Sender, msg.Timestamp.UnixMilli(), msg.PartIndex, msg.SignalChatID, msg.SignalReceiver)
 	if err != nil {
 		msg.log.Warnfln("Failed to insert %s, %s: %v", msg.SignalChatID, msg.MXID, err)
 	}
@@ -80,9 +88,9 @@ func (msg *Message) Delete(txn dbutil.Execable) {
 	}
 	_, err := txn.Exec(`
         DELETE FROM message
-        WHERE sender=$1 AND timestamp=$2 AND signal_chat_id=$3 AND signal_receiver=$4
+        WHERE sender=$1 AND timestamp=$2 AND part_index=$3 AND signal_chat_id=$4 AND signal_receiver=$5
 	`,
-		msg.Sender, msg.Timestamp.UnixMilli(), msg.SignalChatID, msg.SignalReceiver)
+		msg.Sender, msg.Timestamp.UnixMilli(), msg.PartIndex, msg.SignalChatID, msg.SignalReceiver)
 	if err != nil {
 		msg.log.Warnfln("Failed to delete %s, %s: %v", msg.SignalChatID, msg.MXID, err)
 	}
@@ -90,7 +98,7 @@ func (msg *Message) Delete(txn dbutil.Execable) {
 
 func (msg *Message) Scan(row dbutil.Scannable) *Message {
 	var ts int64
-	err := row.Scan(&msg.MXID, &msg.MXRoom, &msg.Sender, &ts, &msg.SignalChatID, &msg.SignalReceiver)
+	err := row.Scan(&msg.MXID, &msg.MXRoom, &msg.Sender, &ts, &msg.PartIndex, &msg.SignalChatID, &msg.SignalReceiver)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			msg.log.Errorln("Database scan failed:", err)
@@ -134,10 +142,34 @@ func (mq *MessageQuery) GetByMXID(mxid id.EventID) *Message {
 	return mq.maybeScan(mq.db.QueryRow(getMessageByMXIDQuery, mxid))
 }
 
+// GetBySignalID returns the first part of the given Signal message
 func (mq *MessageQuery) GetBySignalID(sender string, timestamp time.Time, chatID string, receiver string) *Message {
 	return mq.maybeScan(mq.db.QueryRow(getMessagesBySignalIDQuery, sender, timestamp.UnixMilli(), chatID, receiver))
 }
 
+func (mq *MessageQuery) GetAllPartsBySignalID(sender string, timestamp time.Time, chatID string, receiver string) (messages []*Message) {
+	rows, err := mq.db.Query(getMessagesBySignalIDQuery, sender, timestamp.UnixMilli(), chatID, receiver)
+	if err != nil || rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		messages = append(messages, mq.New().Scan(rows))
+	}
+	return
+}
+
+// GetAllBetween returns the messages in the chat sent after the first timestamp, up to and including the second one
+func (mq *MessageQuery) GetAllBetween(chatID string, receiver string, after time.Time, upTo time.Time) (messages []*Message) {
+	rows, err := mq.db.Query(getMessagesBetweenQuery, chatID, receiver, after.UnixMilli(), upTo.UnixMilli())
+	if err != nil || rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		messages = append(messages, mq.New().Scan(rows))
+	}
+	return
+}
+
 func (mq *MessageQuery) FindByTimestamps(timestamps []time.Time) []*Message {
 	var messages []*Message
 	var rows dbutil.Rows
@@ -145,7 +177,7 @@ func (mq *MessageQuery) FindByTimestamps(timestamps []time.Time) []*Message {
 
 	if mq.db.Dialect == dbutil.Postgres {
 		rows, err = mq.db.Query(`
-			SELECT mxid, mx_room, sender, timestamp, signal_chat_id, signal_receiver FROM message
+			SELECT mxid, mx_room, sender, timestamp, part_index, signal_chat_id, signal_receiver FROM message
 			WHERE timestamp=ANY($1)
 			`, timestamps)
 	} else {
@@ -154,7 +186,7 @@ func (mq *MessageQuery) FindByTimestamps(timestamps []time.Time) []*Message {
 			placeholders += "?"
 		}
 		rows, err = mq.db.Query(`
-			SELECT mxid, mx_room, sender, timestamp, signal_chat_id, signal_receiver FROM message
+			SELECT mxid, mx_room, sender, timestamp, part_index, signal_chat_id, signal_receiver FROM message
 			WHERE timestamp IN ($1)
 			`, timestamps)
 	}
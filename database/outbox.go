@@ -0,0 +1,133 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type OutboxQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (oq *OutboxQuery) New() *OutboxMessage {
+	return &OutboxMessage{
+		db:  oq.db,
+		log: oq.log,
+	}
+}
+
+// OutboxMessage is a Matrix message that hasn't reached every recipient on Signal yet
+type OutboxMessage struct {
+	db  *Database
+	log log.Logger
+
+	MXID           id.EventID
+	MXRoom         id.RoomID
+	SenderMXID     id.UserID
+	SignalChatID   string
+	SignalReceiver string
+	Content        []byte // Serialized signalpb.Content
+	Timestamp      uint64 // The Signal timestamp, retries must reuse it so recipients don't get duplicates
+	// Signal users that still need the message, nil if it hasn't been sent to anyone yet
+	Recipients  []string
+	Sent        bool // Whether it reached at least one recipient and is in the message table
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+const (
+	outboxColumns        = `mxid, mx_room, sender_mxid, signal_chat_id, signal_receiver, content, timestamp, recipients, sent, attempts, next_attempt, last_error`
+	getDueOutboxQuery    = `SELECT ` + outboxColumns + ` FROM outbox WHERE next_attempt<=$1 ORDER BY timestamp`
+	getOutboxByMXIDQuery = `SELECT ` + outboxColumns + ` FROM outbox WHERE mxid=$1`
+)
+
+func (om *OutboxMessage) recipientsJSON() sql.NullString {
+	if om.Recipients == nil {
+		return sql.NullString{}
+	}
+	data, _ := json.Marshal(om.Recipients)
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+func (om *OutboxMessage) Insert() {
+	_, err := om.db.Exec(`
+		INSERT INTO outbox (`+outboxColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`,
+		om.MXID, om.MXRoom, om.SenderMXID, om.SignalChatID, om.SignalReceiver, om.Content, int64(om.Timestamp),
+		om.recipientsJSON(), om.Sent, om.Attempts, om.NextAttempt.UnixMilli(), om.LastError)
+	if err != nil {
+		om.log.Warnfln("Failed to insert outbox message %s: %v", om.MXID, err)
+	}
+}
+
+func (om *OutboxMessage) Update() {
+	_, err := om.db.Exec(`
+		UPDATE outbox SET recipients=$1, sent=$2, attempts=$3, next_attempt=$4, last_error=$5 WHERE mxid=$6
+	`,
+		om.recipientsJSON(), om.Sent, om.Attempts, om.NextAttempt.UnixMilli(), om.LastError, om.MXID)
+	if err != nil {
+		om.log.Warnfln("Failed to update outbox message %s: %v", om.MXID, err)
+	}
+}
+
+func (om *OutboxMessage) Delete() {
+	_, err := om.db.Exec("DELETE FROM outbox WHERE mxid=$1", om.MXID)
+	if err != nil {
+		om.log.Warnfln("Failed to delete outbox message %s: %v", om.MXID, err)
+	}
+}
+
+func (om *OutboxMessage) Scan(row dbutil.Scannable) *OutboxMessage {
+	var timestamp, nextAttempt int64
+	var recipients sql.NullString
+	err := row.Scan(
+		&om.MXID, &om.MXRoom, &om.SenderMXID, &om.SignalChatID, &om.SignalReceiver, &om.Content, &timestamp,
+		&recipients, &om.Sent, &om.Attempts, &nextAttempt, &om.LastError,
+	)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			om.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	om.Timestamp = uint64(timestamp)
+	om.NextAttempt = time.UnixMilli(nextAttempt)
+	if recipients.Valid {
+		err = json.Unmarshal([]byte(recipients.String), &om.Recipients)
+		if err != nil {
+			om.log.Warnfln("Failed to parse recipients of outbox message %s: %v", om.MXID, err)
+		}
+		if om.Recipients == nil {
+			om.Recipients = []string{}
+		}
+	}
+	return om
+}
+
+// GetDue returns the messages whose next attempt is due, oldest first
+func (oq *OutboxQuery) GetDue() (messages []*OutboxMessage) {
+	rows, err := oq.db.Query(getDueOutboxQuery, time.Now().UnixMilli())
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if om := oq.New().Scan(rows); om != nil {
+			messages = append(messages, om)
+		}
+	}
+	return
+}
+
+func (oq *OutboxQuery) GetByMXID(mxid id.EventID) *OutboxMessage {
+	return oq.New().Scan(oq.db.QueryRow(getOutboxByMXIDQuery, mxid))
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type ReactionQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (rq *ReactionQuery) New() *Reaction {
+	return &Reaction{
+		db:  rq.db,
+		log: rq.log,
+	}
+}
+
+type Reaction struct {
+	db  *Database
+	log log.Logger
+
+	MXID           id.EventID
+	MXRoom         id.RoomID
+	SignalChatID   string
+	SignalReceiver string
+
+	Author       string    // Signal UUID of whoever reacted
+	MsgAuthor    string    // Signal UUID of the author of the message that was reacted to
+	MsgTimestamp time.Time // Sent timestamp of the message that was reacted to
+	Emoji        string
+}
+
+const (
+	getReactionByMXIDQuery = `
+		SELECT mxid, mx_room, signal_chat_id, signal_receiver, author, msg_author, msg_timestamp, emoji FROM reaction
+		WHERE mxid=$1
+	`
+	getReactionBySignalIDQuery = `
+		SELECT mxid, mx_room, signal_chat_id, signal_receiver, author, msg_author, msg_timestamp, emoji FROM reaction
+		WHERE msg_author=$1 AND msg_timestamp=$2 AND author=$3 AND signal_chat_id=$4 AND signal_receiver=$5
+	`
+)
+
+func (r *Reaction) Insert(txn dbutil.Execable) {
+	if txn == nil {
+		txn = r.db
+	}
+	_, err := txn.Exec(`
+		INSERT INTO reaction (mxid, mx_room, signal_chat_id, signal_receiver, author, msg_author, msg_timestamp, emoji)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`,
+		r.MXID.String(), r.MXRoom, r.SignalChatID, r.SignalReceiver, r.Author, r.MsgAuthor, r.MsgTimestamp.UnixMilli(), r.Emoji)
+	if err != nil {
+		r.log.Warnfln("Failed to insert reaction %s to %s/%d: %v", r.MXID, r.MsgAuthor, r.MsgTimestamp.UnixMilli(), err)
+	}
+}
+
+func (r *Reaction) Delete(txn dbutil.Execable) {
+	if txn == nil {
+		txn = r.db
+	}
+	_, err := txn.Exec(`
+		DELETE FROM reaction
+		WHERE msg_author=$1 AND msg_timestamp=$2 AND author=$3 AND signal_chat_id=$4 AND signal_receiver=$5
+	`,
+		r.MsgAuthor, r.MsgTimestamp.UnixMilli(), r.Author, r.SignalChatID, r.SignalReceiver)
+	if err != nil {
+		r.log.Warnfln("Failed to delete reaction %s: %v", r.MXID, err)
+	}
+}
+
+func (r *Reaction) Scan(row dbutil.Scannable) *Reaction {
+	var ts int64
+	err := row.Scan(&r.MXID, &r.MXRoom, &r.SignalChatID, &r.SignalReceiver, &r.Author, &r.MsgAuthor, &ts, &r.Emoji)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			r.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	if ts != 0 {
+		r.MsgTimestamp = time.UnixMilli(ts)
+	}
+	return r
+}
+
+func (rq *ReactionQuery) maybeScan(row *sql.Row) *Reaction {
+	if row == nil {
+		return nil
+	}
+	return rq.New().Scan(row)
+}
+
+func (rq *ReactionQuery) GetByMXID(mxid id.EventID) *Reaction {
+	return rq.maybeScan(rq.db.QueryRow(getReactionByMXIDQuery, mxid))
+}
+
+func (rq *ReactionQuery) GetBySignalID(msgAuthor string, msgTimestamp time.Time, author string, chatID string, receiver string) *Reaction {
+	return rq.maybeScan(rq.db.QueryRow(getReactionBySignalIDQuery, msgAuthor, msgTimestamp.UnixMilli(), author, chatID, receiver))
+}
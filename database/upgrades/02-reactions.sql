@@ -0,0 +1,19 @@
+-- v1 -> v2: Add reaction table
+
+CREATE TABLE reaction (
+    mxid    TEXT NOT NULL,
+    mx_room TEXT NOT NULL,
+
+    signal_chat_id  TEXT NOT NULL,
+    signal_receiver TEXT NOT NULL,
+
+    author        UUID NOT NULL,
+    msg_author    UUID NOT NULL,
+    msg_timestamp BIGINT NOT NULL,
+    emoji         TEXT NOT NULL,
+
+    PRIMARY KEY (signal_chat_id, signal_receiver, msg_author, msg_timestamp, author),
+    FOREIGN KEY (signal_chat_id, signal_receiver) REFERENCES portal(chat_id, receiver) ON DELETE CASCADE,
+    FOREIGN KEY (author) REFERENCES puppet(uuid) ON DELETE CASCADE,
+    UNIQUE (mxid, mx_room)
+);
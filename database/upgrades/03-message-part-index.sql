@@ -0,0 +1,22 @@
+-- v2 -> v3: Add part index to messages so one Signal message can become multiple Matrix events
+
+CREATE TABLE message_new (
+    mxid    TEXT NOT NULL,
+    mx_room TEXT NOT NULL,
+    sender          UUID,
+    timestamp       BIGINT,
+    part_index      INTEGER NOT NULL DEFAULT 0,
+    signal_chat_id  TEXT,
+    signal_receiver TEXT,
+
+    PRIMARY KEY (sender, timestamp, part_index, signal_chat_id, signal_receiver),
+    FOREIGN KEY (signal_chat_id, signal_receiver) REFERENCES portal(chat_id, receiver) ON DELETE CASCADE,
+    FOREIGN KEY (sender) REFERENCES puppet(uuid) ON DELETE CASCADE,
+    UNIQUE (mxid, mx_room)
+);
+
+INSERT INTO message_new (mxid, mx_room, sender, timestamp, part_index, signal_chat_id, signal_receiver)
+SELECT mxid, mx_room, sender, timestamp, 0, signal_chat_id, signal_receiver FROM message;
+
+DROP TABLE message;
+ALTER TABLE message_new RENAME TO message;
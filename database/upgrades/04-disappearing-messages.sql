@@ -0,0 +1,10 @@
+-- v3 -> v4: Add disappearing message table
+
+CREATE TABLE disappearing_message (
+    mx_room   TEXT NOT NULL,
+    mxid      TEXT NOT NULL,
+    expire_in BIGINT NOT NULL,
+    expire_at BIGINT,
+
+    PRIMARY KEY (mx_room, mxid)
+);
@@ -0,0 +1,19 @@
+-- v4 -> v5: Add outbox for messages that haven't been fully sent to Signal yet
+
+CREATE TABLE outbox (
+    mxid            TEXT PRIMARY KEY,
+    mx_room         TEXT NOT NULL,
+    sender_mxid     TEXT NOT NULL,
+    signal_chat_id  TEXT NOT NULL,
+    signal_receiver TEXT NOT NULL,
+    content         bytea NOT NULL,
+    timestamp       BIGINT NOT NULL,
+    -- JSON list of the Signal users that still need the message, null until the first attempt
+    recipients      TEXT,
+    sent            BOOLEAN NOT NULL DEFAULT false,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt    BIGINT NOT NULL,
+    last_error      TEXT NOT NULL DEFAULT '',
+
+    FOREIGN KEY (signal_chat_id, signal_receiver) REFERENCES portal(chat_id, receiver) ON DELETE CASCADE
+);
@@ -0,0 +1,11 @@
+-- v5 -> v6: Remember how far each user has read in each chat, so read receipts aren't sent twice
+
+CREATE TABLE last_read (
+    user_mxid       TEXT NOT NULL,
+    signal_chat_id  TEXT NOT NULL,
+    signal_receiver TEXT NOT NULL,
+    timestamp       BIGINT NOT NULL,
+
+    PRIMARY KEY (user_mxid, signal_chat_id, signal_receiver),
+    FOREIGN KEY (signal_chat_id, signal_receiver) REFERENCES portal(chat_id, receiver) ON DELETE CASCADE
+);
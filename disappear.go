@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+
+	"go.mau.fi/mautrix-signal/database"
+)
+
+// Messages expiring within this window get a goroutine sleeping until they expire,
+// anything later is picked up by the next round of SleepAndDeleteUpcoming
+const disappearingScheduleWindow = 1 * time.Hour
+
+// MarkDisappearing stores the event so it gets redacted once its timer runs out.
+// If startsAt is zero the timer only starts when ScheduleDisappearing is called, i.e. when the message is read.
+func (portal *Portal) MarkDisappearing(txn dbutil.Execable, eventID id.EventID, expiresIn time.Duration, startsAt time.Time) {
+	if expiresIn == 0 || eventID == "" {
+		return
+	}
+	var expireAt time.Time
+	if !startsAt.IsZero() {
+		expireAt = startsAt.Add(expiresIn)
+	}
+	msg := portal.bridge.DB.DisappearingMessage.NewWithValues(portal.MXID, eventID, expiresIn, expireAt)
+	msg.Insert(txn)
+	if !expireAt.IsZero() && expireAt.Before(time.Now().Add(disappearingScheduleWindow)) {
+		go portal.sleepAndDelete(msg)
+	}
+}
+
+// ScheduleDisappearing starts the timers of all the messages in the room that were waiting to be read
+func (portal *Portal) ScheduleDisappearing() {
+	if portal.MXID == "" {
+		return
+	}
+	for _, msg := range portal.bridge.DB.DisappearingMessage.GetUnscheduledForRoom(portal.MXID) {
+		msg.StartTimer()
+		if msg.ExpireAt.Before(time.Now().Add(disappearingScheduleWindow)) {
+			go portal.sleepAndDelete(msg)
+		}
+	}
+}
+
+// SleepAndDeleteUpcoming runs forever, so disappearing messages still disappear after the bridge is restarted
+func (br *SignalBridge) SleepAndDeleteUpcoming() {
+	for {
+		for _, msg := range br.DB.DisappearingMessage.GetUpcomingScheduled(disappearingScheduleWindow) {
+			portal := br.GetPortalByMXID(msg.RoomID)
+			if portal == nil {
+				msg.Delete()
+			} else {
+				go portal.sleepAndDelete(msg)
+			}
+		}
+		time.Sleep(disappearingScheduleWindow)
+	}
+}
+
+func (portal *Portal) sleepAndDelete(msg *database.DisappearingMessage) {
+	if _, alreadySleeping := portal.bridge.disappearingMessagesSleeping.LoadOrStore(msg.EventID, struct{}{}); alreadySleeping {
+		return
+	}
+	defer portal.bridge.disappearingMessagesSleeping.Delete(msg.EventID)
+
+	time.Sleep(time.Until(msg.ExpireAt))
+	_, err := portal.MainIntent().RedactEvent(msg.RoomID, msg.EventID)
+	if err != nil {
+		portal.log.Warn().Err(err).Msgf("Failed to redact disappearing message %s", msg.EventID)
+	} else {
+		portal.log.Debug().Msgf("Redacted disappearing message %s", msg.EventID)
+	}
+	msg.Delete()
+	if dbMessage := portal.bridge.DB.Message.GetByMXID(msg.EventID); dbMessage != nil {
+		dbMessage.Delete(nil)
+	}
+}
+
+// Formats a Signal expire timer in seconds the way Signal clients show it, e.g. "1 week" or "30 seconds"
+func formatDisappearingTimer(expireTimer uint32) string {
+	units := []struct {
+		seconds uint32
+		name    string
+	}{
+		{7 * 24 * 60 * 60, "week"},
+		{24 * 60 * 60, "day"},
+		{60 * 60, "hour"},
+		{60, "minute"},
+		{1, "second"},
+	}
+	for _, unit := range units {
+		if expireTimer%unit.seconds == 0 {
+			count := expireTimer / unit.seconds
+			if count == 1 {
+				return fmt.Sprintf("1 %s", unit.name)
+			}
+			return fmt.Sprintf("%d %ss", count, unit.name)
+		}
+	}
+	return fmt.Sprintf("%d seconds", expireTimer)
+}
+
+// Parses a timer like "off", "30s", "8h", "1d" or "4w" into seconds
+func parseDisappearingTimer(input string) (uint32, error) {
+	input = strings.ToLower(strings.TrimSpace(input))
+	if input == "off" || input == "0" {
+		return 0, nil
+	}
+	var duration time.Duration
+	var err error
+	if strings.HasSuffix(input, "d") || strings.HasSuffix(input, "w") {
+		var count int
+		count, err = strconv.Atoi(input[:len(input)-1])
+		duration = time.Duration(count) * 24 * time.Hour
+		if strings.HasSuffix(input, "w") {
+			duration *= 7
+		}
+	} else {
+		duration, err = time.ParseDuration(input)
+	}
+	if err != nil || duration < time.Second || duration.Seconds() > float64(^uint32(0)) {
+		return 0, fmt.Errorf("invalid timer %q", input)
+	}
+	return uint32(duration.Seconds()), nil
+}
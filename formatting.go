@@ -0,0 +1,289 @@
+package main
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// Signal puts this in the body wherever there's a mention, and the BodyRange says who it is
+const signalMentionPlaceholder = "\uFFFC"
+
+var signalStyleTags = []struct {
+	style signalpb.BodyRange_Style
+	open  string
+	close string
+}{
+	{signalpb.BodyRange_BOLD, "<strong>", "</strong>"},
+	{signalpb.BodyRange_ITALIC, "<em>", "</em>"},
+	{signalpb.BodyRange_STRIKETHROUGH, "<del>", "</del>"},
+	{signalpb.BodyRange_MONOSPACE, "<code>", "</code>"},
+	{signalpb.BodyRange_SPOILER, "<span data-mx-spoiler>", "</span>"},
+}
+
+// ** Signal -> Matrix **
+
+// Turns the BodyRanges of a Signal message into pills and formatted_body HTML.
+// BodyRange offsets count UTF-16 code units, so all the slicing happens on the UTF-16 encoded body.
+func (portal *Portal) applySignalFormatting(content *event.MessageEventContent, bodyRanges []*signalpb.BodyRange) {
+	if len(bodyRanges) == 0 {
+		return
+	}
+	utf16Body := utf16.Encode([]rune(content.Body))
+	bodyLength := uint32(len(utf16Body))
+
+	boundarySet := map[uint32]struct{}{0: {}, bodyLength: {}}
+	mentions := map[uint32]*signalpb.BodyRange{}
+	var styles []*signalpb.BodyRange
+	for _, bodyRange := range bodyRanges {
+		start, end := bodyRange.GetStart(), bodyRange.GetStart()+bodyRange.GetLength()
+		if bodyRange.GetLength() == 0 || end > bodyLength {
+			portal.log.Warn().Msgf("Ignoring invalid body range %d+%d in message of length %d", bodyRange.GetStart(), bodyRange.GetLength(), bodyLength)
+			continue
+		}
+		boundarySet[start] = struct{}{}
+		boundarySet[end] = struct{}{}
+		if bodyRange.GetMentionUuid() != "" {
+			mentions[start] = bodyRange
+		} else {
+			styles = append(styles, bodyRange)
+		}
+	}
+	boundaries := make([]uint32, 0, len(boundarySet))
+	for boundary := range boundarySet {
+		boundaries = append(boundaries, boundary)
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+
+	// Every segment between two boundaries has a fixed set of styles, so wrap each one separately
+	var plain, formatted strings.Builder
+	for i := 0; i < len(boundaries)-1; i++ {
+		start, end := boundaries[i], boundaries[i+1]
+		var text, htmlText string
+		if mention, ok := mentions[start]; ok {
+			mxid, name := portal.signalMentionTarget(mention.GetMentionUuid())
+			text = name
+			htmlText = `<a href="` + mxid.URI().MatrixToURL() + `">` + html.EscapeString(name) + `</a>`
+			// Skip over whatever the mention covered
+			end = start + mention.GetLength()
+			for i+1 < len(boundaries)-1 && boundaries[i+1] < end {
+				i++
+			}
+		} else {
+			text = string(utf16.Decode(utf16Body[start:end]))
+			htmlText = strings.ReplaceAll(html.EscapeString(text), "\n", "<br/>")
+		}
+		for j := len(signalStyleTags) - 1; j >= 0; j-- {
+			tag := signalStyleTags[j]
+			for _, style := range styles {
+				if style.GetStyle() == tag.style && style.GetStart() <= start && style.GetStart()+style.GetLength() >= end {
+					htmlText = tag.open + htmlText + tag.close
+					break
+				}
+			}
+		}
+		plain.WriteString(text)
+		formatted.WriteString(htmlText)
+	}
+
+	content.Body = plain.String()
+	content.Format = event.FormatHTML
+	content.FormattedBody = formatted.String()
+}
+
+// Mentions point at the double puppet if there is one, otherwise at the ghost
+func (portal *Portal) signalMentionTarget(signalID string) (id.UserID, string) {
+	name := signalID
+	puppet := portal.bridge.GetPuppetBySignalID(signalID)
+	if puppet != nil && puppet.Name != "" {
+		name = puppet.Name
+	}
+	// Logged in users are mentioned as their real Matrix account, whether or not they have double puppeting
+	if user := portal.bridge.GetUserBySignalID(signalID); user != nil && user.IsLoggedIn() {
+		return user.MXID, name
+	}
+	if puppet == nil {
+		return portal.bridge.FormatPuppetMXID(signalID), name
+	}
+	return puppet.MXID, name
+}
+
+// ** Matrix -> Signal **
+
+type matrixFormattingParser struct {
+	portal *Portal
+	body   strings.Builder
+	length uint32 // Length of the body so far in UTF-16 code units
+	ranges []*signalpb.BodyRange
+	inPre  bool
+}
+
+// Turns Matrix HTML into a plain body with BodyRanges for pills and styles
+func (portal *Portal) parseMatrixFormatting(formattedBody string) (string, []*signalpb.BodyRange, error) {
+	context := &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := xhtml.ParseFragment(strings.NewReader(formattedBody), context)
+	if err != nil {
+		return "", nil, err
+	}
+	parser := &matrixFormattingParser{portal: portal}
+	for _, node := range nodes {
+		parser.walk(node)
+	}
+	return parser.finish()
+}
+
+func (p *matrixFormattingParser) appendText(text string) {
+	p.body.WriteString(text)
+	p.length += uint32(len(utf16.Encode([]rune(text))))
+}
+
+func (p *matrixFormattingParser) ensureNewline() {
+	if p.length > 0 && !strings.HasSuffix(p.body.String(), "\n") {
+		p.appendText("\n")
+	}
+}
+
+func isBlockTag(tag string) bool {
+	switch tag {
+	case "p", "div", "blockquote", "pre", "ul", "ol", "li", "h1", "h2", "h3", "h4", "h5", "h6", "hr":
+		return true
+	}
+	return false
+}
+
+func styleForTag(node *xhtml.Node) (signalpb.BodyRange_Style, bool) {
+	switch node.Data {
+	case "strong", "b":
+		return signalpb.BodyRange_BOLD, true
+	case "em", "i":
+		return signalpb.BodyRange_ITALIC, true
+	case "del", "s", "strike":
+		return signalpb.BodyRange_STRIKETHROUGH, true
+	case "code":
+		return signalpb.BodyRange_MONOSPACE, true
+	case "span", "font":
+		for _, attr := range node.Attr {
+			if attr.Key == "data-mx-spoiler" {
+				return signalpb.BodyRange_SPOILER, true
+			}
+		}
+	}
+	return signalpb.BodyRange_NONE, false
+}
+
+func getAttribute(node *xhtml.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func (p *matrixFormattingParser) walk(node *xhtml.Node) {
+	switch node.Type {
+	case xhtml.TextNode:
+		// Whitespace between block elements is just HTML source formatting
+		if !p.inPre && strings.TrimSpace(node.Data) == "" && strings.Contains(node.Data, "\n") {
+			return
+		}
+		p.appendText(node.Data)
+		return
+	case xhtml.ElementNode:
+	default:
+		return
+	}
+
+	switch node.Data {
+	case "mx-reply":
+		return
+	case "br":
+		p.appendText("\n")
+		return
+	case "a":
+		if signalID := p.portal.signalIDForMatrixPill(getAttribute(node, "href")); signalID != "" {
+			mentionStart, mentionLength := p.length, uint32(1)
+			p.ranges = append(p.ranges, &signalpb.BodyRange{
+				Start:           &mentionStart,
+				Length:          &mentionLength,
+				AssociatedValue: &signalpb.BodyRange_MentionUuid{MentionUuid: signalID},
+			})
+			p.appendText(signalMentionPlaceholder)
+			return
+		}
+	}
+
+	isBlock := isBlockTag(node.Data)
+	if isBlock {
+		p.ensureNewline()
+	}
+	if node.Data == "li" {
+		p.appendText("• ")
+	}
+	if node.Data == "pre" {
+		p.inPre = true
+		defer func() { p.inPre = false }()
+	}
+	start := p.length
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		p.walk(child)
+	}
+	if style, ok := styleForTag(node); ok && p.length > start {
+		rangeStart, rangeLength := start, p.length-start
+		p.ranges = append(p.ranges, &signalpb.BodyRange{
+			Start:           &rangeStart,
+			Length:          &rangeLength,
+			AssociatedValue: &signalpb.BodyRange_Style_{Style: style},
+		})
+	}
+	if isBlock {
+		p.ensureNewline()
+	}
+}
+
+func (p *matrixFormattingParser) finish() (string, []*signalpb.BodyRange, error) {
+	body := strings.TrimRight(p.body.String(), "\n")
+	length := uint32(len(utf16.Encode([]rune(body))))
+	// Trimming the trailing newlines may have cut the end off some ranges
+	ranges := p.ranges[:0]
+	for _, bodyRange := range p.ranges {
+		if bodyRange.GetStart() >= length {
+			continue
+		}
+		if bodyRange.GetStart()+bodyRange.GetLength() > length {
+			newLength := length - bodyRange.GetStart()
+			bodyRange.Length = &newLength
+		}
+		ranges = append(ranges, bodyRange)
+	}
+	return body, ranges, nil
+}
+
+// Figures out which Signal user a matrix.to pill points at, if any
+func (portal *Portal) signalIDForMatrixPill(href string) string {
+	if href == "" {
+		return ""
+	}
+	uri, err := id.ParseMatrixURIOrMatrixToURL(href)
+	if err != nil || uri.Sigil1 != '@' {
+		return ""
+	}
+	userID := uri.UserID()
+	if signalID, ok := portal.bridge.ParsePuppetMXID(userID); ok {
+		return signalID
+	}
+	// Logged in users are on Signal themselves, whether or not they have double puppeting
+	if user := portal.bridge.GetUserByMXIDIfExists(userID); user != nil && user.IsLoggedIn() {
+		return user.SignalID
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+)
+
+func avatarHash(avatar []byte) string {
+	hash := sha256.Sum256(avatar)
+	return hex.EncodeToString(hash[:])
+}
+
+// Downloads the Signal group avatar and sets it as the room avatar, unless it's the one we already have
+func (portal *Portal) updateGroupAvatar(user *User, group *signalmeow.Group, intent *appservice.IntentAPI) {
+	var hash string
+	var avatarURL id.ContentURI
+	if group.Avatar != "" {
+		avatar, err := signalmeow.DownloadGroupAvatar(context.Background(), user.SignalDevice, group)
+		if err != nil {
+			portal.log.Error().Err(err).Msg("Failed to download group avatar")
+			return
+		}
+		hash = avatarHash(avatar)
+		if hash == portal.AvatarHash && portal.AvatarSet {
+			return
+		}
+		resp, err := portal.MainIntent().UploadBytes(avatar, http.DetectContentType(avatar))
+		if err != nil {
+			portal.log.Error().Err(err).Msg("Failed to upload group avatar")
+			return
+		}
+		avatarURL = resp.ContentURI
+	} else if portal.AvatarHash == "" && portal.AvatarURL.IsEmpty() {
+		return
+	}
+
+	portal.AvatarHash = hash
+	portal.AvatarURL = avatarURL
+	if portal.MXID != "" {
+		portal.AvatarSet = portal.withGroupChangeIntent(intent, "set room avatar", func(intent *appservice.IntentAPI) error {
+			_, err := intent.SetRoomAvatar(portal.MXID, avatarURL)
+			return err
+		})
+	}
+	err := portal.Update()
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to save portal after avatar change")
+	}
+}
+
+func (portal *Portal) HandleMatrixMeta(brSender bridge.User, evt *event.Event) {
+	sender := brSender.(*User)
+	if !sender.IsLoggedIn() {
+		return
+	}
+	portal.matrixMessages <- portalMatrixMessage{user: sender, evt: evt}
+}
+
+func (portal *Portal) handleMatrixRoomAvatar(sender *User, evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.RoomAvatarEventContent)
+	if !ok || portal.IsPrivateChat() || content.URL == portal.AvatarURL {
+		return
+	}
+	var avatar []byte
+	if !content.URL.IsEmpty() {
+		var err error
+		avatar, err = portal.MainIntent().DownloadBytes(content.URL)
+		if err != nil {
+			portal.log.Error().Err(err).Msg("Failed to download new room avatar")
+			portal.sendGroupChangeError("change the group avatar", err)
+			return
+		}
+	}
+	_, err := signalmeow.UpdateGroupAvatar(context.Background(), sender.SignalDevice, signalmeow.GroupID(portal.ChatID), avatar)
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to change group avatar on Signal")
+		portal.sendGroupChangeError("change the group avatar", err)
+		_, err = portal.MainIntent().SetRoomAvatar(portal.MXID, portal.AvatarURL)
+		if err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to revert room avatar")
+		}
+		return
+	}
+	portal.AvatarURL = content.URL
+	portal.AvatarHash = ""
+	if len(avatar) > 0 {
+		portal.AvatarHash = avatarHash(avatar)
+	}
+	portal.AvatarSet = true
+	err = portal.Update()
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to save portal after avatar change")
+	}
+}
+
+// Room state changes don't have message statuses, so failures get a notice instead
+func (portal *Portal) sendGroupChangeError(action string, err error) {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("Failed to %s on Signal: %s", action, groupChangeErrorMessage(err)),
+	}
+	_, err = portal.sendMainIntentMessage(content)
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to send group change error notice")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+)
+
+// The reverse of groupMemberMXID, returns "" for Matrix users who aren't on Signal
+func (portal *Portal) groupMemberSignalID(user *User, mxid id.UserID) string {
+	if mxid == user.MXID {
+		return user.SignalID
+	}
+	signalID, ok := portal.bridge.ParsePuppetMXID(mxid)
+	if !ok {
+		return ""
+	}
+	return signalID
+}
+
+// The bridge module's membership handling doesn't include bans or the event itself,
+// which is needed for message statuses, so member events are routed here instead
+func (br *SignalBridge) HandleMatrixMembership(evt *event.Event) {
+	portal, user := br.groupPortalForMatrixEvent(evt)
+	if portal == nil {
+		return
+	}
+	if id.UserID(evt.GetStateKey()) == evt.Sender || !br.IsGhost(id.UserID(evt.GetStateKey())) {
+		return
+	}
+	portal.matrixMessages <- portalMatrixMessage{user: user, evt: evt}
+}
+
+func (portal *Portal) handleMatrixMembership(sender *User, evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.MemberEventContent)
+	if !ok || portal.IsPrivateChat() {
+		return
+	}
+	prevMembership := event.MembershipLeave
+	if evt.Unsigned.PrevContent != nil {
+		err := evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+		if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+			portal.log.Warn().Err(err).Msg("Failed to parse previous membership")
+		}
+		prevMembership = evt.Unsigned.PrevContent.AsMember().Membership
+	}
+	if prevMembership == content.Membership {
+		return
+	}
+	target := id.UserID(evt.GetStateKey())
+	signalID := portal.groupMemberSignalID(sender, target)
+	if signalID == "" {
+		return
+	}
+
+	ctx := context.Background()
+	groupID := signalmeow.GroupID(portal.ChatID)
+	var err error
+	switch content.Membership {
+	case event.MembershipInvite:
+		var change *signalmeow.GroupChange
+		change, err = signalmeow.AddGroupMember(ctx, sender.SignalDevice, groupID, signalID)
+		// Users with a known profile key are added right away instead of being invited
+		if change != nil && (len(change.AddMembers) > 0 || len(change.PromoteRequestingMembers) > 0) {
+			portal.bridgeGroupJoin(sender, signalID)
+		}
+	case event.MembershipBan:
+		_, err = signalmeow.BanGroupMember(ctx, sender.SignalDevice, groupID, signalID)
+	case event.MembershipLeave:
+		if prevMembership == event.MembershipBan {
+			_, err = signalmeow.UnbanGroupMember(ctx, sender.SignalDevice, groupID, signalID)
+		} else {
+			_, err = signalmeow.RemoveGroupMember(ctx, sender.SignalDevice, groupID, signalID)
+		}
+	default:
+		return
+	}
+	if err != nil {
+		portal.log.Error().Err(err).
+			Str("target", target.String()).
+			Str("membership", string(content.Membership)).
+			Msg("Failed to bridge membership change to Signal")
+		portal.sendStatusEventWithStatus(evt.ID, event.MessageStatusFail, err)
+		portal.revertMatrixMembership(sender, target, signalID, prevMembership, content.Membership)
+	} else {
+		portal.sendStatusEvent(evt.ID, nil)
+	}
+}
+
+// Puts the Matrix membership back to what it was, since the change didn't happen on Signal
+func (portal *Portal) revertMatrixMembership(sender *User, target id.UserID, signalID string, prevMembership, membership event.Membership) {
+	intent := portal.MainIntent()
+	if membership == event.MembershipBan && prevMembership != event.MembershipLeave {
+		_, err := intent.UnbanUser(portal.MXID, &mautrix.ReqUnbanUser{UserID: target})
+		if err != nil {
+			portal.log.Warn().Err(err).Msgf("Failed to unban %s after failed ban", target)
+			return
+		}
+	}
+	var err error
+	switch prevMembership {
+	case event.MembershipJoin:
+		_, err = intent.InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: target})
+		if err == nil {
+			portal.bridgeGroupJoin(sender, signalID)
+		}
+	case event.MembershipInvite:
+		_, err = intent.InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: target})
+	case event.MembershipKnock:
+		portal.bridgeGroupKnock(sender, signalID)
+	case event.MembershipBan:
+		_, err = intent.BanUser(portal.MXID, &mautrix.ReqBanUser{UserID: target})
+	case event.MembershipLeave:
+		if membership == event.MembershipBan {
+			_, err = intent.UnbanUser(portal.MXID, &mautrix.ReqUnbanUser{UserID: target})
+		} else {
+			_, err = intent.KickUser(portal.MXID, &mautrix.ReqKickUser{UserID: target})
+		}
+	}
+	if err != nil {
+		portal.log.Warn().Err(err).Msgf("Failed to revert membership of %s", target)
+	}
+}
+
+// Only crossing the admin level changes the Signal role, so other power level tweaks are left alone
+func (portal *Portal) bridgeMatrixRoleChanges(sender *User, prevLevels, levels *event.PowerLevelsEventContent) error {
+	changed := make(map[id.UserID]struct{})
+	for userID := range prevLevels.Users {
+		changed[userID] = struct{}{}
+	}
+	for userID := range levels.Users {
+		changed[userID] = struct{}{}
+	}
+	for userID := range changed {
+		wasAdmin := prevLevels.GetUserLevel(userID) >= groupAdminPowerLevel
+		isAdmin := levels.GetUserLevel(userID) >= groupAdminPowerLevel
+		signalID := portal.groupMemberSignalID(sender, userID)
+		if wasAdmin == isAdmin || signalID == "" {
+			continue
+		}
+		role := signalmeow.GroupMember_DEFAULT
+		if isAdmin {
+			role = signalmeow.GroupMember_ADMINISTRATOR
+		}
+		_, err := signalmeow.UpdateGroupMemberRole(context.Background(), sender.SignalDevice, signalmeow.GroupID(portal.ChatID), signalID, role)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+)
+
+func (portal *Portal) handleMatrixRoomName(sender *User, evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.RoomNameEventContent)
+	if !ok || portal.IsPrivateChat() || content.Name == portal.Name {
+		return
+	}
+	_, err := signalmeow.UpdateGroupTitle(context.Background(), sender.SignalDevice, signalmeow.GroupID(portal.ChatID), content.Name)
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to change group title on Signal")
+		portal.sendGroupChangeError("change the group name", err)
+		_, err = portal.MainIntent().SetRoomName(portal.MXID, portal.Name)
+		if err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to revert room name")
+		}
+		return
+	}
+	portal.Name = content.Name
+	portal.NameSet = true
+	err = portal.Update()
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to save portal after name change")
+	}
+	portal.UpdateBridgeInfo()
+}
+
+func (portal *Portal) handleMatrixRoomTopic(sender *User, evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.TopicEventContent)
+	if !ok || portal.IsPrivateChat() || content.Topic == portal.Topic {
+		return
+	}
+	_, err := signalmeow.UpdateGroupDescription(context.Background(), sender.SignalDevice, signalmeow.GroupID(portal.ChatID), content.Topic)
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to change group description on Signal")
+		portal.sendGroupChangeError("change the group description", err)
+		_, err = portal.MainIntent().SetRoomTopic(portal.MXID, portal.Topic)
+		if err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to revert room topic")
+		}
+		return
+	}
+	portal.Topic = content.Topic
+	err = portal.Update()
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to save portal after topic change")
+	}
+}
+
+// The group settings that are represented in the room's power levels
+type groupPowerLevelSettings struct {
+	announcementsOnly bool
+	attributesAccess  signalmeow.AccessControl
+	membersAccess     signalmeow.AccessControl
+}
+
+func accessForLevel(level int) signalmeow.AccessControl {
+	if level >= groupAdminPowerLevel {
+		return signalmeow.AccessControl_ADMINISTRATOR
+	}
+	return signalmeow.AccessControl_MEMBER
+}
+
+func levelForAccess(access signalmeow.AccessControl) int {
+	if access == signalmeow.AccessControl_ADMINISTRATOR {
+		return groupAdminPowerLevel
+	}
+	return 0
+}
+
+func groupSettingsFromPowerLevels(levels *event.PowerLevelsEventContent) groupPowerLevelSettings {
+	return groupPowerLevelSettings{
+		announcementsOnly: levels.GetEventLevel(event.EventMessage) >= groupAdminPowerLevel,
+		attributesAccess:  accessForLevel(levels.GetEventLevel(event.StateRoomName)),
+		membersAccess:     accessForLevel(levels.Invite()),
+	}
+}
+
+// Sets the power levels needed for sending messages, changing the room info and inviting to match the Signal group
+func applyGroupSettingsToPowerLevels(levels *event.PowerLevelsEventContent, group *signalmeow.Group) bool {
+	if levels.Events == nil {
+		levels.Events = make(map[string]int)
+	}
+	messageLevel := 0
+	if group.AnnouncementsOnly {
+		messageLevel = groupAdminPowerLevel
+	}
+	changed := false
+	if levels.EventsDefault != messageLevel {
+		levels.EventsDefault = messageLevel
+		changed = true
+	}
+	changed = levels.EnsureEventLevel(event.EventMessage, messageLevel) || changed
+	attributesLevel := levelForAccess(group.AttributesAccess())
+	for _, evtType := range []event.Type{event.StateRoomName, event.StateTopic, event.StateRoomAvatar} {
+		changed = levels.EnsureEventLevel(evtType, attributesLevel) || changed
+	}
+	membersLevel := levelForAccess(group.MembersAccess())
+	if levels.Invite() != membersLevel {
+		levels.InvitePtr = &membersLevel
+		changed = true
+	}
+	return changed
+}
+
+func (portal *Portal) bridgeGroupSettings(intent *appservice.IntentAPI, group *signalmeow.Group) {
+	levels, err := portal.MainIntent().PowerLevels(portal.MXID)
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to get power levels to apply group settings")
+		return
+	}
+	if applyGroupSettingsToPowerLevels(levels, group) {
+		portal.withGroupChangeIntent(intent, "update power levels", func(intent *appservice.IntentAPI) error {
+			_, err := intent.SetPowerLevels(portal.MXID, levels)
+			return err
+		})
+	}
+}
+
+// Filters out events the bridge sent itself, like the bridge module does for the events it handles
+func (br *SignalBridge) groupPortalForMatrixEvent(evt *event.Event) (*Portal, *User) {
+	if evt.Sender == br.Bot.UserID || br.IsGhost(evt.Sender) {
+		return nil, nil
+	}
+	portal := br.GetPortalByMXID(evt.RoomID)
+	if portal == nil || portal.IsPrivateChat() {
+		return nil, nil
+	}
+	user := br.GetUserByMXID(evt.Sender)
+	if user == nil || user.GetPermissionLevel() < bridgeconfig.PermissionLevelUser || !user.IsLoggedIn() {
+		return nil, nil
+	} else if val, ok := evt.Content.Raw[appservice.DoublePuppetKey]; ok && val == br.Name && user.GetIDoublePuppet() != nil {
+		return nil, nil
+	}
+	return portal, user
+}
+
+// The bridge module doesn't pass power level changes to portals, so they're routed here
+func (br *SignalBridge) HandleMatrixPowerLevels(evt *event.Event) {
+	portal, user := br.groupPortalForMatrixEvent(evt)
+	if portal == nil {
+		return
+	}
+	portal.matrixMessages <- portalMatrixMessage{user: user, evt: evt}
+}
+
+// Only settings whose power levels were changed in this event are sent to Signal,
+// so that unrelated changes don't overwrite group settings the room never mirrored
+func (portal *Portal) handleMatrixPowerLevels(sender *User, evt *event.Event) {
+	levels, ok := evt.Content.Parsed.(*event.PowerLevelsEventContent)
+	if !ok || portal.IsPrivateChat() || evt.Unsigned.PrevContent == nil {
+		return
+	}
+	err := evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		portal.log.Warn().Err(err).Msg("Failed to parse previous power levels")
+		return
+	}
+	prevLevels := evt.Unsigned.PrevContent.AsPowerLevels()
+	prev := groupSettingsFromPowerLevels(prevLevels)
+	current := groupSettingsFromPowerLevels(levels)
+
+	ctx := context.Background()
+	groupID := signalmeow.GroupID(portal.ChatID)
+	failed := false
+	err = portal.bridgeMatrixRoleChanges(sender, prevLevels, levels)
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to change member roles on Signal")
+		portal.sendGroupChangeError("change member roles", err)
+		failed = true
+	}
+	if !failed && prev.announcementsOnly != current.announcementsOnly {
+		_, err = signalmeow.UpdateGroupAnnouncementsOnly(ctx, sender.SignalDevice, groupID, current.announcementsOnly)
+		if err != nil {
+			portal.log.Error().Err(err).Msg("Failed to change group announcement mode on Signal")
+			portal.sendGroupChangeError("change who can send messages", err)
+			failed = true
+		}
+	}
+	var accessControl signalmeow.GroupAccessControl
+	if prev.attributesAccess != current.attributesAccess {
+		accessControl.Attributes = current.attributesAccess
+	}
+	if prev.membersAccess != current.membersAccess {
+		accessControl.Members = current.membersAccess
+	}
+	if !failed && (accessControl.Attributes != signalmeow.AccessControl_UNKNOWN || accessControl.Members != signalmeow.AccessControl_UNKNOWN) {
+		_, err = signalmeow.UpdateGroupAccessControl(ctx, sender.SignalDevice, groupID, accessControl)
+		if err != nil {
+			portal.log.Error().Err(err).Msg("Failed to change group permissions on Signal")
+			portal.sendGroupChangeError("change the group permissions", err)
+			failed = true
+		}
+	}
+	if failed {
+		// Some of the changes may have gone through, so reset the room to whatever the group has now
+		group, err := signalmeow.RetrieveGroupByID(ctx, sender.SignalDevice, groupID)
+		if err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to get group to revert power levels")
+			return
+		}
+		portal.bridgeGroupSettings(portal.MainIntent(), group)
+		roles := make([]*signalmeow.GroupMemberRoleChange, 0, len(group.Members))
+		for _, member := range group.Members {
+			roles = append(roles, &signalmeow.GroupMemberRoleChange{UserId: member.UserId, Role: member.Role})
+		}
+		portal.bridgeGroupRoles(sender, portal.MainIntent(), roles)
+	}
+}
+
+// Turns the generic forbidden error into something that tells the user why
+func groupChangeErrorMessage(err error) string {
+	if errors.Is(err, signalmeow.ErrGroupChangeForbidden) {
+		return "you don't have permission to do that in the Signal group, ask a group admin"
+	}
+	return err.Error()
+}
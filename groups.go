@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+)
+
+// Signal group admins get this power level, which stays below the bridge bot so it can still manage the room
+const groupAdminPowerLevel = 50
+
+func (portal *Portal) handleSignalGroupChange(user *User, sender *Puppet, msg signalmeow.IncomingSignalMessageGroupChange) {
+	if portal.IsPrivateChat() {
+		return
+	}
+	change := msg.Change
+	// Changes without a known source are applied by the bridge bot
+	intent := portal.MainIntent()
+	var senderID string
+	if sender != nil {
+		intent = sender.IntentFor(portal)
+		senderID = sender.SignalID
+	}
+	if intent == nil {
+		portal.log.Error().Msg("Failed to get group change intent")
+		return
+	}
+	err := intent.EnsureJoined(portal.MXID)
+	if err != nil {
+		portal.log.Warn().Err(err).Msgf("Failed to ensure %s is joined before applying group change", intent.UserID)
+	}
+
+	infoChanged := false
+	if change.ModifyTitle != nil && portal.Name != *change.ModifyTitle {
+		portal.Name = *change.ModifyTitle
+		portal.NameSet = portal.withGroupChangeIntent(intent, "set room name", func(intent *appservice.IntentAPI) error {
+			_, err := intent.SetRoomName(portal.MXID, portal.Name)
+			return err
+		})
+		infoChanged = true
+	}
+	if change.ModifyDescription != nil && portal.Topic != *change.ModifyDescription {
+		portal.Topic = *change.ModifyDescription
+		portal.withGroupChangeIntent(intent, "set room topic", func(intent *appservice.IntentAPI) error {
+			_, err := intent.SetRoomTopic(portal.MXID, portal.Topic)
+			return err
+		})
+		infoChanged = true
+	}
+	if infoChanged {
+		err = portal.Update()
+		if err != nil {
+			portal.log.Error().Err(err).Msg("Failed to save portal after group info change")
+		}
+		portal.UpdateBridgeInfo()
+	}
+
+	var roles []*signalmeow.GroupMemberRoleChange
+	for _, member := range change.AddMembers {
+		portal.bridgeGroupJoin(user, member.UserId)
+		roles = append(roles, &signalmeow.GroupMemberRoleChange{UserId: member.UserId, Role: member.Role})
+	}
+	for _, member := range change.PromotePendingMembers {
+		portal.bridgeGroupJoin(user, member.UserId)
+	}
+	for _, member := range change.PromoteRequestingMembers {
+		portal.bridgeGroupJoin(user, member.UserId)
+		roles = append(roles, member)
+	}
+	for _, pending := range change.AddPendingMembers {
+		portal.bridgeGroupInvite(user, intent, pending.UserId)
+	}
+	// Removing yourself is leaving or declining an invite, removing someone else is a kick or a revoked invite
+	var removed []string
+	removed = append(removed, change.DeletePendingMembers...)
+	removed = append(removed, change.DeleteMembers...)
+	for _, userID := range removed {
+		if userID == senderID {
+			portal.bridgeGroupLeave(user, userID)
+		} else {
+			portal.bridgeGroupKick(user, intent, userID)
+		}
+	}
+	for _, requesting := range change.AddRequestingMembers {
+		portal.bridgeGroupKnock(user, requesting.UserId)
+	}
+	// Cancelling a request leaves, an admin denying it kicks
+	for _, userID := range change.DeleteRequestingMembers {
+		if userID == senderID {
+			portal.bridgeGroupLeave(user, userID)
+		} else {
+			portal.bridgeGroupKick(user, intent, userID)
+		}
+	}
+	for _, banned := range change.AddBannedMembers {
+		portal.bridgeGroupBan(user, intent, banned.UserId)
+	}
+	for _, userID := range change.DeleteBannedMembers {
+		portal.bridgeGroupUnban(user, intent, userID)
+	}
+	roles = append(roles, change.ModifyMemberRoles...)
+	portal.bridgeGroupRoles(user, intent, roles)
+
+	settingsChanged := change.ModifyAnnouncementsOnly != nil || change.ModifyAttributesAccess != nil || change.ModifyMemberAccess != nil
+	if change.ModifyAvatar != nil || settingsChanged {
+		group, err := signalmeow.RetrieveGroupByID(context.Background(), user.SignalDevice, signalmeow.GroupID(portal.ChatID))
+		if err != nil {
+			portal.log.Error().Err(err).Msg("Failed to get group to apply group change")
+		} else {
+			if change.ModifyAvatar != nil {
+				portal.updateGroupAvatar(user, group, intent)
+			}
+			if settingsChanged {
+				portal.bridgeGroupSettings(intent, group)
+			}
+		}
+	}
+
+	if change.ModifyDisappearingMessagesTimer != nil {
+		portal.handleSignalExpireTimerUpdate(intent, signalmeow.IncomingSignalMessageExpireTimerUpdate{
+			IncomingSignalMessageBase: msg.IncomingSignalMessageBase,
+			Timestamp:                 msg.Timestamp,
+			ExpireTimer:               *change.ModifyDisappearingMessagesTimer,
+		})
+	}
+}
+
+// Brings a newly created group portal in line with the full state of the Signal group
+func (portal *Portal) syncSignalGroup(user *User) {
+	group, err := signalmeow.RetrieveGroupByID(context.Background(), user.SignalDevice, signalmeow.GroupID(portal.ChatID))
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to get group to sync portal")
+		return
+	}
+	var roles []*signalmeow.GroupMemberRoleChange
+	for _, member := range group.Members {
+		// The logged-in user was already invited when the room was created
+		if member.UserId != user.SignalID {
+			portal.bridgeGroupJoin(user, member.UserId)
+		}
+		roles = append(roles, &signalmeow.GroupMemberRoleChange{UserId: member.UserId, Role: member.Role})
+	}
+	for _, pending := range group.PendingMembers {
+		inviter := portal.groupMemberIntent(user, pending.AddedByUserId)
+		if inviter == nil {
+			inviter = portal.MainIntent()
+		}
+		portal.bridgeGroupInvite(user, inviter, pending.UserId)
+	}
+	for _, requesting := range group.RequestingMembers {
+		portal.bridgeGroupKnock(user, requesting.UserId)
+	}
+	for _, banned := range group.BannedMembers {
+		portal.bridgeGroupBan(user, portal.MainIntent(), banned.UserId)
+	}
+	portal.bridgeGroupRoles(user, portal.MainIntent(), roles)
+	portal.bridgeGroupSettings(portal.MainIntent(), group)
+	portal.updateGroupAvatar(user, group, portal.MainIntent())
+
+	if uint32(portal.ExpirationTime) != group.DisappearingMessagesTimer {
+		portal.ExpirationTime = int(group.DisappearingMessagesTimer)
+		err = portal.Update()
+		if err != nil {
+			portal.log.Error().Err(err).Msg("Failed to save disappearing message timer")
+		}
+	}
+}
+
+// Signal lets members do things that need more power in Matrix than puppets have,
+// so fall back to the bridge bot when the puppet isn't allowed to
+func (portal *Portal) withGroupChangeIntent(intent *appservice.IntentAPI, action string, fn func(intent *appservice.IntentAPI) error) bool {
+	err := fn(intent)
+	if err != nil && intent.UserID != portal.MainIntent().UserID {
+		portal.log.Debug().Err(err).Msgf("Failed to %s as %s, retrying as bridge bot", action, intent.UserID)
+		err = fn(portal.MainIntent())
+	}
+	if err != nil {
+		portal.log.Warn().Err(err).Msgf("Failed to %s", action)
+		return false
+	}
+	return true
+}
+
+// Our own Signal account is the logged-in Matrix user, everyone else is a puppet
+func (portal *Portal) groupMemberMXID(user *User, signalID string) id.UserID {
+	if signalID == user.SignalID {
+		return user.MXID
+	}
+	puppet := portal.bridge.GetPuppetBySignalID(signalID)
+	if puppet == nil {
+		return ""
+	}
+	return puppet.MXID
+}
+
+// Returns nil for the logged-in user when double puppeting isn't set up
+func (portal *Portal) groupMemberIntent(user *User, signalID string) *appservice.IntentAPI {
+	if signalID == user.SignalID {
+		return portal.bridge.GetPuppetByCustomMXID(user.MXID).CustomIntent()
+	}
+	puppet := portal.bridge.GetPuppetBySignalID(signalID)
+	if puppet == nil {
+		return nil
+	}
+	return puppet.IntentFor(portal)
+}
+
+func (portal *Portal) bridgeGroupJoin(user *User, signalID string) {
+	if signalID == user.SignalID {
+		portal.ensureUserInvited(user)
+		return
+	}
+	memberIntent := portal.groupMemberIntent(user, signalID)
+	if memberIntent == nil {
+		return
+	}
+	err := memberIntent.EnsureJoined(portal.MXID)
+	if err != nil {
+		portal.log.Warn().Err(err).Msgf("Failed to join %s to the room", memberIntent.UserID)
+	}
+}
+
+func (portal *Portal) bridgeGroupInvite(user *User, intent *appservice.IntentAPI, signalID string) {
+	target := portal.groupMemberMXID(user, signalID)
+	if target == "" {
+		return
+	}
+	if target != user.MXID {
+		err := portal.bridge.AS.Intent(target).EnsureRegistered()
+		if err != nil {
+			portal.log.Warn().Err(err).Msgf("Failed to register %s before inviting", target)
+		}
+	}
+	portal.withGroupChangeIntent(intent, "invite "+target.String(), func(intent *appservice.IntentAPI) error {
+		_, err := intent.InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: target})
+		return err
+	})
+}
+
+func (portal *Portal) bridgeGroupLeave(user *User, signalID string) {
+	memberIntent := portal.groupMemberIntent(user, signalID)
+	if memberIntent != nil {
+		_, err := memberIntent.LeaveRoom(portal.MXID)
+		if err == nil {
+			return
+		}
+		portal.log.Debug().Err(err).Msgf("Failed to leave room as %s, kicking instead", memberIntent.UserID)
+	}
+	portal.bridgeGroupKick(user, portal.MainIntent(), signalID)
+}
+
+func (portal *Portal) bridgeGroupKick(user *User, intent *appservice.IntentAPI, signalID string) {
+	target := portal.groupMemberMXID(user, signalID)
+	if target == "" {
+		return
+	}
+	portal.withGroupChangeIntent(intent, "kick "+target.String(), func(intent *appservice.IntentAPI) error {
+		_, err := intent.KickUser(portal.MXID, &mautrix.ReqKickUser{UserID: target})
+		return err
+	})
+}
+
+func (portal *Portal) bridgeGroupRoles(user *User, intent *appservice.IntentAPI, roles []*signalmeow.GroupMemberRoleChange) {
+	if len(roles) == 0 {
+		return
+	}
+	levels, err := portal.MainIntent().PowerLevels(portal.MXID)
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to get power levels to apply group role changes")
+		return
+	}
+	changed := false
+	for _, role := range roles {
+		target := portal.groupMemberMXID(user, role.UserId)
+		if target == "" {
+			continue
+		}
+		level := 0
+		if role.Role == signalmeow.GroupMember_ADMINISTRATOR {
+			level = groupAdminPowerLevel
+		}
+		if levels.GetUserLevel(target) != level {
+			levels.SetUserLevel(target, level)
+			changed = true
+		}
+	}
+	if changed {
+		portal.withGroupChangeIntent(intent, "update power levels", func(intent *appservice.IntentAPI) error {
+			_, err := intent.SetPowerLevels(portal.MXID, levels)
+			return err
+		})
+	}
+}
+
+// Join requests are bridged as knocks. The room only allows knocking while the ghost knocks,
+// since a pending knock stays around after the join rule is changed back.
+func (portal *Portal) bridgeGroupKnock(user *User, signalID string) {
+	if signalID == user.SignalID {
+		return
+	}
+	memberIntent := portal.groupMemberIntent(user, signalID)
+	if memberIntent == nil {
+		return
+	}
+	var joinRules event.JoinRulesEventContent
+	err := portal.MainIntent().StateEvent(portal.MXID, event.StateJoinRules, "", &joinRules)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to get join rules to bridge a join request")
+		return
+	}
+	if joinRules.JoinRule != event.JoinRuleKnock {
+		_, err = portal.MainIntent().SendStateEvent(portal.MXID, event.StateJoinRules, "", &event.JoinRulesEventContent{JoinRule: event.JoinRuleKnock})
+		if err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to allow knocking to bridge a join request")
+			return
+		}
+		defer func() {
+			_, err := portal.MainIntent().SendStateEvent(portal.MXID, event.StateJoinRules, "", &joinRules)
+			if err != nil {
+				portal.log.Warn().Err(err).Msg("Failed to restore join rules after bridging a join request")
+			}
+		}()
+	}
+	err = memberIntent.EnsureRegistered()
+	if err != nil {
+		portal.log.Warn().Err(err).Msgf("Failed to register %s before knocking", memberIntent.UserID)
+		return
+	}
+	_, err = memberIntent.MakeRequest(http.MethodPost, memberIntent.BuildClientURL("v3", "knock", portal.MXID), struct{}{}, nil)
+	if err != nil {
+		portal.log.Warn().Err(err).Msgf("Failed to knock as %s", memberIntent.UserID)
+	}
+}
+
+func (portal *Portal) bridgeGroupBan(user *User, intent *appservice.IntentAPI, signalID string) {
+	target := portal.groupMemberMXID(user, signalID)
+	if target == "" {
+		return
+	}
+	portal.withGroupChangeIntent(intent, "ban "+target.String(), func(intent *appservice.IntentAPI) error {
+		_, err := intent.BanUser(portal.MXID, &mautrix.ReqBanUser{UserID: target})
+		return err
+	})
+}
+
+func (portal *Portal) bridgeGroupUnban(user *User, intent *appservice.IntentAPI, signalID string) {
+	target := portal.groupMemberMXID(user, signalID)
+	if target == "" {
+		return
+	}
+	portal.withGroupChangeIntent(intent, "unban "+target.String(), func(intent *appservice.IntentAPI) error {
+		_, err := intent.UnbanUser(portal.MXID, &mautrix.ReqUnbanUser{UserID: target})
+		return err
+	})
+}
@@ -57,6 +57,9 @@ type SignalBridge struct {
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsByNumber     map[string]*Puppet
 	puppetsLock         sync.Mutex
+
+	disappearingMessagesSleeping sync.Map
+	outboxSending                sync.Map
 }
 
 var _ bridge.ChildOverride = (*SignalBridge)(nil)
@@ -76,9 +79,14 @@ func (br *SignalBridge) GetConfigPtr() interface{} {
 func (br *SignalBridge) Init() {
 	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
 	br.RegisterCommands()
+	br.EventProcessor.On(event.StatePowerLevels, br.HandleMatrixPowerLevels)
+	br.EventProcessor.On(event.StateMember, br.HandleMatrixMembership)
 
 	br.DB = database.New(br.Bridge.DB, br.Log.Sub("Database"))
 	br.MeowStore = signalmeow.NewStoreWithDB(br.DB.RawDB, br.DB.Dialect.String())
+	if br.Config.Bridge.BlockOnIdentityChange() {
+		br.MeowStore.IdentityTrustPolicy = signalmeow.IdentityBlockUntilAcknowledged
+	}
 	//signalLog = br.ZLog.With().Str("component", "discordgo").Logger()
 
 	// TODO move this to mautrix-go?
@@ -99,6 +107,8 @@ func (br *SignalBridge) Start() {
 		os.Exit(15)
 	}
 	go br.StartUsers()
+	go br.SleepAndDeleteUpcoming()
+	go br.RunOutbox()
 }
 
 func (br *SignalBridge) Stop() {
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/database"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const (
+	outboxMaxAttempts    = 10
+	outboxInitialBackoff = 10 * time.Second
+	outboxMaxBackoff     = 1 * time.Hour
+	outboxPollInterval   = 10 * time.Second
+	outboxSendTimeout    = 2 * time.Minute
+)
+
+// Stores the message so RunOutbox can retry it if the first attempt doesn't reach everyone
+func (portal *Portal) addToOutbox(sender *User, eventID id.EventID, msg *signalpb.Content) (*database.OutboxMessage, error) {
+	content, err := signalmeow.SerializeContent(msg)
+	if err != nil {
+		return nil, err
+	}
+	entry := portal.bridge.DB.Outbox.New()
+	entry.MXID = eventID
+	entry.MXRoom = portal.MXID
+	entry.SenderMXID = sender.MXID
+	entry.SignalChatID = portal.ChatID
+	entry.SignalReceiver = portal.Receiver
+	entry.Content = content
+	entry.Timestamp = msg.GetDataMessage().GetTimestamp()
+	// Leave the first attempt some time before the outbox loop considers it due
+	entry.NextAttempt = time.Now().Add(outboxSendTimeout)
+	entry.Insert()
+	return entry, nil
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxInitialBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+// Sends the outbox message to everyone who still needs it, and either removes it from the outbox
+// or schedules the next attempt. evt is only set for the first attempt, which is made straight from the Matrix event.
+// Returns how long Signal wants us to wait if we got rate limited.
+func (portal *Portal) attemptOutboxSend(ctx context.Context, sender *User, entry *database.OutboxMessage, msg *signalpb.Content, evt *event.Event) (retryAfter time.Duration) {
+	if _, alreadySending := portal.bridge.outboxSending.LoadOrStore(entry.MXID, struct{}{}); alreadySending {
+		return 0
+	}
+	defer portal.bridge.outboxSending.Delete(entry.MXID)
+
+	entry.Attempts++
+	var failed []signalmeow.FailedSendResult
+	var sentToAny bool
+	var err error
+	if portal.IsPrivateChat() {
+		result := signalmeow.SendMessage(ctx, sender.SignalDevice, portal.ChatID, msg)
+		if result.WasSuccessful {
+			sentToAny = true
+		} else {
+			failed = append(failed, *result.FailedSendResult)
+		}
+	} else {
+		groupID := signalmeow.GroupID(portal.ChatID)
+		var result *signalmeow.GroupMessageSendResult
+		if entry.Recipients == nil {
+			result, err = signalmeow.SendGroupMessage(ctx, sender.SignalDevice, groupID, msg)
+		} else {
+			result, err = signalmeow.SendGroupMessageToMembers(ctx, sender.SignalDevice, groupID, msg, entry.Recipients)
+		}
+		if err == nil {
+			sentToAny = len(result.SuccessfullySentTo) > 0
+			failed = result.FailedToSendTo
+		}
+	}
+
+	if sentToAny && !entry.Sent {
+		entry.Sent = true
+		portal.storeMessageInDB(entry.MXID, sender.SignalID, entry.Timestamp)
+		portal.MarkDisappearing(nil, entry.MXID, time.Duration(portal.ExpirationTime)*time.Second, time.Now())
+		if evt != nil {
+			go portal.sendMessageMetrics(evt, nil, "")
+		} else {
+			portal.sendDeliveryReceipt(entry.MXID)
+			portal.sendStatusEvent(entry.MXID, nil)
+		}
+	}
+	if err == nil && len(failed) == 0 {
+		portal.log.Debug().Msgf("Sent event %s to everyone after %d attempts", entry.MXID, entry.Attempts)
+		entry.Delete()
+		return 0
+	}
+
+	if err == nil {
+		entry.Recipients = make([]string, 0, len(failed))
+		for _, failure := range failed {
+			entry.Recipients = append(entry.Recipients, failure.RecipientUuid)
+			var rateLimitErr *signalmeow.RateLimitedError
+			if errors.As(failure.Error, &rateLimitErr) && rateLimitErr.RetryAfter > retryAfter {
+				retryAfter = rateLimitErr.RetryAfter
+			}
+		}
+		err = failed[0].Error
+		portal.log.Warn().Err(err).Msgf("Failed to send event %s to %d recipients (attempt %d)", entry.MXID, len(failed), entry.Attempts)
+	} else {
+		portal.log.Warn().Err(err).Msgf("Failed to send event %s (attempt %d)", entry.MXID, entry.Attempts)
+	}
+	entry.LastError = err.Error()
+
+	if entry.Attempts >= outboxMaxAttempts {
+		portal.log.Error().Err(err).Msgf("Giving up on sending event %s after %d attempts", entry.MXID, entry.Attempts)
+		entry.Delete()
+		if !entry.Sent {
+			if evt != nil {
+				go portal.sendMessageMetrics(evt, err, "Error sending")
+			} else {
+				portal.sendStatusEventWithStatus(entry.MXID, event.MessageStatusFail, err)
+			}
+		}
+		return retryAfter
+	}
+
+	backoff := outboxBackoff(entry.Attempts)
+	if retryAfter > backoff {
+		backoff = retryAfter
+	}
+	entry.NextAttempt = time.Now().Add(backoff)
+	entry.Update()
+	if !entry.Sent {
+		portal.sendStatusEventWithStatus(entry.MXID, event.MessageStatusRetriable, err)
+	}
+	return retryAfter
+}
+
+// RunOutbox runs forever, retrying the messages in the outbox when they're due, including after restarts
+func (br *SignalBridge) RunOutbox() {
+	log := br.ZLog.With().Str("component", "outbox").Logger()
+	for {
+		var pause time.Duration
+		for _, entry := range br.DB.Outbox.GetDue() {
+			portal := br.GetPortalByMXID(entry.MXRoom)
+			if portal == nil {
+				log.Warn().Msgf("Dropping outbox message %s, portal %s is gone", entry.MXID, entry.MXRoom)
+				entry.Delete()
+				continue
+			}
+			msg, err := signalmeow.DeserializeContent(entry.Content)
+			if err != nil {
+				log.Err(err).Msgf("Dropping outbox message %s, failed to parse content", entry.MXID)
+				entry.Delete()
+				continue
+			}
+			user := br.GetUserByMXIDIfExists(entry.SenderMXID)
+			if user == nil || !user.IsLoggedIn() || user.SignalDevice == nil {
+				// Not an attempt, just wait for the user to come back
+				entry.NextAttempt = time.Now().Add(outboxInitialBackoff)
+				entry.Update()
+				continue
+			}
+			// The send changes the portal's messages, so it has to happen in the portal's loop
+			result := make(chan time.Duration, 1)
+			portal.outboxRetries <- portalOutboxRetry{entry: entry, msg: msg, sender: user, result: result}
+			pause = <-result
+			if pause > 0 {
+				log.Warn().Msgf("Rate limited by Signal, pausing the outbox for %s", pause)
+				break
+			}
+		}
+		if pause < outboxPollInterval {
+			pause = outboxPollInterval
+		}
+		time.Sleep(pause)
+	}
+}
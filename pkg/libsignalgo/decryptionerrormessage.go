@@ -93,6 +93,9 @@ func (dem *DecryptionErrorMessage) GetRatchetKey() (*PublicKey, error) {
 	signalFfiError := C.signal_decryption_error_message_get_ratchet_key(&pk, dem.ptr)
 	if signalFfiError != nil {
 		return nil, wrapError(signalFfiError)
+	} else if pk == nil {
+		// Only set for errors in 1:1 sessions, not for sender key messages
+		return nil, nil
 	}
 	return wrapPublicKey(pk), nil
 }
@@ -21,6 +21,7 @@ func GenerateRandomness() (Randomness, error) {
 type GroupMasterKey [C.SignalGROUP_MASTER_KEY_LEN]byte
 type GroupSecretParams [C.SignalGROUP_SECRET_PARAMS_LEN]byte
 type GroupPublicParams [C.SignalGROUP_PUBLIC_PARAMS_LEN]byte
+type GroupIdentifier [C.SignalGROUP_IDENTIFIER_LEN]byte
 
 type UUIDCiphertext [C.SignalUUID_CIPHERTEXT_LEN]byte
 type ProfileKeyCiphertext [C.SignalPROFILE_KEY_CIPHERTEXT_LEN]byte
@@ -66,6 +67,17 @@ func (gsp *GroupSecretParams) GetPublicParams() (*GroupPublicParams, error) {
 	return &groupPublicParams, nil
 }
 
+func (gpp *GroupPublicParams) GetGroupIdentifier() (*GroupIdentifier, error) {
+	var groupIdentifier [C.SignalGROUP_IDENTIFIER_LEN]C.uchar
+	signalFfiError := C.signal_group_public_params_get_group_identifier(&groupIdentifier, (*[C.SignalGROUP_PUBLIC_PARAMS_LEN]C.uint8_t)(unsafe.Pointer(gpp)))
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result GroupIdentifier
+	copy(result[:], C.GoBytes(unsafe.Pointer(&groupIdentifier), C.int(C.SignalGROUP_IDENTIFIER_LEN)))
+	return &result, nil
+}
+
 func (gsp *GroupSecretParams) DecryptBlobWithPadding(blob []byte) ([]byte, error) {
 	var plaintext C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
 	borrowedBlob := BytesToBuffer(blob)
@@ -80,6 +92,25 @@ func (gsp *GroupSecretParams) DecryptBlobWithPadding(blob []byte) ([]byte, error
 	return CopySignalOwnedBufferToBytes(plaintext), nil
 }
 
+func (gsp *GroupSecretParams) EncryptBlobWithPadding(blob []byte, paddingLen uint32) ([]byte, error) {
+	randomness, err := GenerateRandomness()
+	if err != nil {
+		return nil, err
+	}
+	var ciphertext C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	signalFfiError := C.signal_group_secret_params_encrypt_blob_with_padding_deterministic(
+		&ciphertext,
+		(*[C.SignalGROUP_SECRET_PARAMS_LEN]C.uint8_t)(unsafe.Pointer(gsp)),
+		(*[C.SignalRANDOMNESS_LEN]C.uint8_t)(unsafe.Pointer(&randomness)),
+		BytesToBuffer(blob),
+		C.uint32_t(paddingLen),
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return CopySignalOwnedBufferToBytes(ciphertext), nil
+}
+
 func (gsp *GroupSecretParams) DecryptUUID(ciphertextUUID UUIDCiphertext) (*UUID, error) {
 	uuid := [C.SignalUUID_LEN]C.uchar{}
 	signalFfiError := C.signal_group_secret_params_decrypt_uuid(
@@ -110,3 +141,34 @@ func (gsp *GroupSecretParams) DecryptProfileKey(ciphertextProfileKey ProfileKeyC
 	copy(result[:], C.GoBytes(unsafe.Pointer(&profileKey), C.int(C.SignalPROFILE_KEY_LEN)))
 	return &result, nil
 }
+
+func (gsp *GroupSecretParams) EncryptUUID(uuid UUID) (*UUIDCiphertext, error) {
+	ciphertext := [C.SignalUUID_CIPHERTEXT_LEN]C.uchar{}
+	signalFfiError := C.signal_group_secret_params_encrypt_uuid(
+		&ciphertext,
+		(*[C.SignalGROUP_SECRET_PARAMS_LEN]C.uint8_t)(unsafe.Pointer(gsp)),
+		(*[C.SignalUUID_LEN]C.uint8_t)(unsafe.Pointer(&uuid)),
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result UUIDCiphertext
+	copy(result[:], C.GoBytes(unsafe.Pointer(&ciphertext), C.int(C.SignalUUID_CIPHERTEXT_LEN)))
+	return &result, nil
+}
+
+func (gsp *GroupSecretParams) EncryptProfileKey(profileKey ProfileKey, uuid UUID) (*ProfileKeyCiphertext, error) {
+	ciphertext := [C.SignalPROFILE_KEY_CIPHERTEXT_LEN]C.uchar{}
+	signalFfiError := C.signal_group_secret_params_encrypt_profile_key(
+		&ciphertext,
+		(*[C.SignalGROUP_SECRET_PARAMS_LEN]C.uint8_t)(unsafe.Pointer(gsp)),
+		(*[C.SignalPROFILE_KEY_LEN]C.uchar)(unsafe.Pointer(&profileKey)),
+		(*[C.SignalUUID_LEN]C.uint8_t)(unsafe.Pointer(&uuid)),
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result ProfileKeyCiphertext
+	copy(result[:], C.GoBytes(unsafe.Pointer(&ciphertext), C.int(C.SignalPROFILE_KEY_CIPHERTEXT_LEN)))
+	return &result, nil
+}
@@ -0,0 +1,57 @@
+package libsignalgo_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+)
+
+func TestGroupBlobEncryptionRoundTrip(t *testing.T) {
+	setupLogging()
+
+	groupSecretParams, err := libsignalgo.GenerateGroupSecretParams()
+	assert.NoError(t, err)
+
+	plaintext := []byte("group title")
+	ciphertext, err := groupSecretParams.EncryptBlobWithPadding(plaintext, 16)
+	assert.NoError(t, err)
+	assert.NotEqual(t, plaintext, ciphertext)
+
+	decrypted, err := groupSecretParams.DecryptBlobWithPadding(ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+}
+
+func TestGroupUUIDEncryptionRoundTrip(t *testing.T) {
+	setupLogging()
+
+	groupSecretParams, err := libsignalgo.GenerateGroupSecretParams()
+	assert.NoError(t, err)
+
+	uuid := libsignalgo.UUID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	ciphertext, err := groupSecretParams.EncryptUUID(uuid)
+	assert.NoError(t, err)
+
+	decrypted, err := groupSecretParams.DecryptUUID(*ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, uuid, *decrypted)
+}
+
+func TestGroupProfileKeyEncryptionRoundTrip(t *testing.T) {
+	setupLogging()
+
+	groupSecretParams, err := libsignalgo.GenerateGroupSecretParams()
+	assert.NoError(t, err)
+
+	uuid := libsignalgo.UUID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	var profileKey libsignalgo.ProfileKey
+	copy(profileKey[:], []byte("0123456789abcdef0123456789abcdef"))
+	ciphertext, err := groupSecretParams.EncryptProfileKey(profileKey, uuid)
+	assert.NoError(t, err)
+
+	decrypted, err := groupSecretParams.DecryptProfileKey(*ciphertext, uuid)
+	assert.NoError(t, err)
+	assert.Equal(t, profileKey, *decrypted)
+}
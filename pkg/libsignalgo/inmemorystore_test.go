@@ -32,6 +32,9 @@ type InMemorySignalProtocolStore struct {
 	senderKeyMap    map[SenderKeyName]*libsignalgo.SenderKeyRecord
 	sessionMap      map[AddressKey]*libsignalgo.SessionRecord
 	signedPreKeyMap map[uint32]*libsignalgo.SignedPreKeyRecord
+
+	kyberPreKeyMap   map[uint32]*libsignalgo.KyberPreKeyRecord
+	usedKyberPreKeys map[uint32]bool
 }
 
 func NewInMemorySignalProtocolStore() *InMemorySignalProtocolStore {
@@ -54,6 +57,9 @@ func NewInMemorySignalProtocolStore() *InMemorySignalProtocolStore {
 		senderKeyMap:    make(map[SenderKeyName]*libsignalgo.SenderKeyRecord),
 		sessionMap:      make(map[AddressKey]*libsignalgo.SessionRecord),
 		signedPreKeyMap: make(map[uint32]*libsignalgo.SignedPreKeyRecord),
+
+		kyberPreKeyMap:   make(map[uint32]*libsignalgo.KyberPreKeyRecord),
+		usedKyberPreKeys: make(map[uint32]bool),
 	}
 }
 
@@ -200,6 +206,22 @@ func (ps *InMemorySignalProtocolStore) StoreSignedPreKey(id uint32, signedPreKey
 	return nil
 }
 
+// Implementation of the KyberPreKeyStore interface
+
+func (ps *InMemorySignalProtocolStore) LoadKyberPreKey(id uint32, ctx context.Context) (*libsignalgo.KyberPreKeyRecord, error) {
+	return ps.kyberPreKeyMap[id], nil
+}
+
+func (ps *InMemorySignalProtocolStore) StoreKyberPreKey(id uint32, kyberPreKeyRecord *libsignalgo.KyberPreKeyRecord, ctx context.Context) error {
+	ps.kyberPreKeyMap[id] = kyberPreKeyRecord
+	return nil
+}
+
+func (ps *InMemorySignalProtocolStore) MarkKyberPreKeyUsed(id uint32, ctx context.Context) error {
+	ps.usedKyberPreKeys[id] = true
+	return nil
+}
+
 type BadInMemorySignalProtocolStore struct {
 	*InMemorySignalProtocolStore
 }
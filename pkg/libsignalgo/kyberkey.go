@@ -0,0 +1,125 @@
+package libsignalgo
+
+/*
+#cgo LDFLAGS: -lsignal_ffi -ldl
+#include "./libsignal-ffi.h"
+*/
+import "C"
+import "runtime"
+
+type KyberKeyPair struct {
+	ptr *C.SignalKyberKeyPair
+}
+
+func wrapKyberKeyPair(ptr *C.SignalKyberKeyPair) *KyberKeyPair {
+	keyPair := &KyberKeyPair{ptr: ptr}
+	runtime.SetFinalizer(keyPair, (*KyberKeyPair).Destroy)
+	return keyPair
+}
+
+func KyberKeyPairGenerate() (*KyberKeyPair, error) {
+	var kp *C.SignalKyberKeyPair
+	signalFfiError := C.signal_kyber_key_pair_generate(&kp)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberKeyPair(kp), nil
+}
+
+func (kp *KyberKeyPair) Destroy() error {
+	runtime.SetFinalizer(kp, nil)
+	return wrapError(C.signal_kyber_key_pair_destroy(kp.ptr))
+}
+
+func (kp *KyberKeyPair) GetPublicKey() (*KyberPublicKey, error) {
+	var pub *C.SignalKyberPublicKey
+	signalFfiError := C.signal_kyber_key_pair_get_public_key(&pub, kp.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberPublicKey(pub), nil
+}
+
+func (kp *KyberKeyPair) GetSecretKey() (*KyberSecretKey, error) {
+	var secret *C.SignalKyberSecretKey
+	signalFfiError := C.signal_kyber_key_pair_get_secret_key(&secret, kp.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberSecretKey(secret), nil
+}
+
+type KyberPublicKey struct {
+	ptr *C.SignalKyberPublicKey
+}
+
+func wrapKyberPublicKey(ptr *C.SignalKyberPublicKey) *KyberPublicKey {
+	publicKey := &KyberPublicKey{ptr: ptr}
+	runtime.SetFinalizer(publicKey, (*KyberPublicKey).Destroy)
+	return publicKey
+}
+
+func DeserializeKyberPublicKey(keyData []byte) (*KyberPublicKey, error) {
+	var pk *C.SignalKyberPublicKey
+	signalFfiError := C.signal_kyber_public_key_deserialize(&pk, BytesToBuffer(keyData))
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberPublicKey(pk), nil
+}
+
+func (pk *KyberPublicKey) Destroy() error {
+	runtime.SetFinalizer(pk, nil)
+	return wrapError(C.signal_kyber_public_key_destroy(pk.ptr))
+}
+
+func (pk *KyberPublicKey) Serialize() ([]byte, error) {
+	var serialized C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	signalFfiError := C.signal_kyber_public_key_serialize(&serialized, pk.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return CopySignalOwnedBufferToBytes(serialized), nil
+}
+
+func (pk *KyberPublicKey) Equals(other *KyberPublicKey) (bool, error) {
+	var equals C.bool
+	signalFfiError := C.signal_kyber_public_key_equals(&equals, pk.ptr, other.ptr)
+	if signalFfiError != nil {
+		return false, wrapError(signalFfiError)
+	}
+	return bool(equals), nil
+}
+
+type KyberSecretKey struct {
+	ptr *C.SignalKyberSecretKey
+}
+
+func wrapKyberSecretKey(ptr *C.SignalKyberSecretKey) *KyberSecretKey {
+	secretKey := &KyberSecretKey{ptr: ptr}
+	runtime.SetFinalizer(secretKey, (*KyberSecretKey).Destroy)
+	return secretKey
+}
+
+func DeserializeKyberSecretKey(keyData []byte) (*KyberSecretKey, error) {
+	var sk *C.SignalKyberSecretKey
+	signalFfiError := C.signal_kyber_secret_key_deserialize(&sk, BytesToBuffer(keyData))
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberSecretKey(sk), nil
+}
+
+func (sk *KyberSecretKey) Destroy() error {
+	runtime.SetFinalizer(sk, nil)
+	return wrapError(C.signal_kyber_secret_key_destroy(sk.ptr))
+}
+
+func (sk *KyberSecretKey) Serialize() ([]byte, error) {
+	var serialized C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	signalFfiError := C.signal_kyber_secret_key_serialize(&serialized, sk.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return CopySignalOwnedBufferToBytes(serialized), nil
+}
@@ -0,0 +1,116 @@
+package libsignalgo
+
+/*
+#cgo LDFLAGS: -lsignal_ffi -ldl
+#include "./libsignal-ffi.h"
+*/
+import "C"
+import (
+	"runtime"
+	"time"
+)
+
+type KyberPreKeyRecord struct {
+	ptr *C.SignalKyberPreKeyRecord
+}
+
+func wrapKyberPreKeyRecord(ptr *C.SignalKyberPreKeyRecord) *KyberPreKeyRecord {
+	kpkr := &KyberPreKeyRecord{ptr: ptr}
+	runtime.SetFinalizer(kpkr, (*KyberPreKeyRecord).Destroy)
+	return kpkr
+}
+
+func NewKyberPreKeyRecord(id uint32, timestamp time.Time, keyPair *KyberKeyPair, signature []byte) (*KyberPreKeyRecord, error) {
+	var kpkr *C.SignalKyberPreKeyRecord
+	signalFfiError := C.signal_kyber_pre_key_record_new(&kpkr, C.uint32_t(id), C.uint64_t(timestamp.UnixMilli()), keyPair.ptr, BytesToBuffer(signature))
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberPreKeyRecord(kpkr), nil
+}
+
+func DeserializeKyberPreKeyRecord(serialized []byte) (*KyberPreKeyRecord, error) {
+	var kpkr *C.SignalKyberPreKeyRecord
+	signalFfiError := C.signal_kyber_pre_key_record_deserialize(&kpkr, BytesToBuffer(serialized))
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberPreKeyRecord(kpkr), nil
+}
+
+func (kpkr *KyberPreKeyRecord) Clone() (*KyberPreKeyRecord, error) {
+	var cloned *C.SignalKyberPreKeyRecord
+	signalFfiError := C.signal_kyber_pre_key_record_clone(&cloned, kpkr.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberPreKeyRecord(cloned), nil
+}
+
+func (kpkr *KyberPreKeyRecord) Destroy() error {
+	// Like the other prekey records, ownership is passed to libsignal in the load callback
+	return nil
+}
+
+func (kpkr *KyberPreKeyRecord) Serialize() ([]byte, error) {
+	var serialized C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	signalFfiError := C.signal_kyber_pre_key_record_serialize(&serialized, kpkr.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return CopySignalOwnedBufferToBytes(serialized), nil
+}
+
+func (kpkr *KyberPreKeyRecord) GetSignature() ([]byte, error) {
+	var signature C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	signalFfiError := C.signal_kyber_pre_key_record_get_signature(&signature, kpkr.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return CopySignalOwnedBufferToBytes(signature), nil
+}
+
+func (kpkr *KyberPreKeyRecord) GetID() (uint, error) {
+	var id C.uint32_t
+	signalFfiError := C.signal_kyber_pre_key_record_get_id(&id, kpkr.ptr)
+	if signalFfiError != nil {
+		return 0, wrapError(signalFfiError)
+	}
+	return uint(id), nil
+}
+
+func (kpkr *KyberPreKeyRecord) GetTimestamp() (time.Time, error) {
+	var ts C.uint64_t
+	signalFfiError := C.signal_kyber_pre_key_record_get_timestamp(&ts, kpkr.ptr)
+	if signalFfiError != nil {
+		return time.Time{}, wrapError(signalFfiError)
+	}
+	return time.UnixMilli(int64(ts)), nil
+}
+
+func (kpkr *KyberPreKeyRecord) GetPublicKey() (*KyberPublicKey, error) {
+	var pub *C.SignalKyberPublicKey
+	signalFfiError := C.signal_kyber_pre_key_record_get_public_key(&pub, kpkr.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberPublicKey(pub), nil
+}
+
+func (kpkr *KyberPreKeyRecord) GetSecretKey() (*KyberSecretKey, error) {
+	var secret *C.SignalKyberSecretKey
+	signalFfiError := C.signal_kyber_pre_key_record_get_secret_key(&secret, kpkr.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberSecretKey(secret), nil
+}
+
+func (kpkr *KyberPreKeyRecord) GetKeyPair() (*KyberKeyPair, error) {
+	var kp *C.SignalKyberKeyPair
+	signalFfiError := C.signal_kyber_pre_key_record_get_key_pair(&kp, kpkr.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapKyberKeyPair(kp), nil
+}
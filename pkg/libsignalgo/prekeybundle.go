@@ -83,6 +83,36 @@ func NewPreKeyBundle(registrationID uint32, deviceID uint32, preKeyID uint32, pr
 	return wrapPreKeyBundle(pkb), nil
 }
 
+// NewPreKeyBundleWithKyberPreKey creates a PQXDH bundle. preKey can be nil if the server ran out of one-time prekeys.
+func NewPreKeyBundleWithKyberPreKey(registrationID uint32, deviceID uint32, preKeyID uint32, preKey *PublicKey, signedPreKeyID uint32, signedPreKey *PublicKey, signedPreKeySignature []byte, identityKey *IdentityKey, kyberPreKeyID uint32, kyberPreKey *KyberPublicKey, kyberPreKeySignature []byte) (*PreKeyBundle, error) {
+	var pkb *C.SignalPreKeyBundle
+	var zero uint32 = 0
+	var preKeyPtr *C.SignalPublicKey
+	if preKey != nil {
+		preKeyPtr = preKey.ptr
+	} else {
+		preKeyID = ^zero
+	}
+	signalFfiError := C.signal_pre_key_bundle_new(
+		&pkb,
+		C.uint32_t(registrationID),
+		C.uint32_t(deviceID),
+		C.uint32_t(preKeyID),
+		preKeyPtr,
+		C.uint32_t(signedPreKeyID),
+		signedPreKey.ptr,
+		BytesToBuffer(signedPreKeySignature),
+		identityKey.publicKey.ptr,
+		C.uint32_t(kyberPreKeyID),
+		kyberPreKey.ptr,
+		BytesToBuffer(kyberPreKeySignature),
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return wrapPreKeyBundle(pkb), nil
+}
+
 func (pkb *PreKeyBundle) Clone() (*PreKeyBundle, error) {
 	var cloned *C.SignalPreKeyBundle
 	signalFfiError := C.signal_pre_key_bundle_clone(&cloned, pkb.ptr)
@@ -105,3 +135,24 @@ func (pkb *PreKeyBundle) GetIdentityKey() (*IdentityKey, error) {
 	}
 	return NewIdentityKeyFromPublicKey(wrapPublicKey(pk))
 }
+
+func (pkb *PreKeyBundle) GetKyberPreKeyPublic() (*KyberPublicKey, error) {
+	var pk *C.SignalKyberPublicKey
+	signalFfiError := C.signal_pre_key_bundle_get_kyber_pre_key_public(&pk, pkb.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	if pk == nil {
+		return nil, nil
+	}
+	return wrapKyberPublicKey(pk), nil
+}
+
+func (pkb *PreKeyBundle) GetKyberPreKeySignature() ([]byte, error) {
+	var signature C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	signalFfiError := C.signal_pre_key_bundle_get_kyber_pre_key_signature(&signature, pkb.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return CopySignalOwnedBufferToBytes(signature), nil
+}
@@ -0,0 +1,84 @@
+package libsignalgo
+
+/*
+#cgo LDFLAGS: -lsignal_ffi -ldl
+#include "./libsignal-ffi.h"
+*/
+import "C"
+import (
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// Proves to the group server that a profile key belongs to a user, needed to add them to a group as a full member
+type ExpiringProfileKeyCredential [C.SignalEXPIRING_PROFILE_KEY_CREDENTIAL_LEN]byte
+
+func ReceiveExpiringProfileKeyCredential(
+	serverPublicParams ServerPublicParams,
+	requestContext *ProfileKeyCredentialRequestContext,
+	response ProfileKeyCredentialResponse,
+	currentTime time.Time,
+) (*ExpiringProfileKeyCredential, error) {
+	if len(response) != C.SignalEXPIRING_PROFILE_KEY_CREDENTIAL_RESPONSE_LEN {
+		return nil, fmt.Errorf("invalid profile key credential response length %d", len(response))
+	}
+	c_result := [C.SignalEXPIRING_PROFILE_KEY_CREDENTIAL_LEN]C.uchar{}
+	c_serverPublicParams := (*[C.SignalSERVER_PUBLIC_PARAMS_LEN]C.uchar)(unsafe.Pointer(&serverPublicParams[0]))
+	c_requestContext := (*[C.SignalPROFILE_KEY_CREDENTIAL_REQUEST_CONTEXT_LEN]C.uchar)(unsafe.Pointer(requestContext))
+	c_response := (*[C.SignalEXPIRING_PROFILE_KEY_CREDENTIAL_RESPONSE_LEN]C.uchar)(unsafe.Pointer(&response[0]))
+
+	signalFfiError := C.signal_server_public_params_receive_expiring_profile_key_credential(
+		&c_result,
+		c_serverPublicParams,
+		c_requestContext,
+		c_response,
+		C.uint64_t(currentTime.Unix()),
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result ExpiringProfileKeyCredential
+	copy(result[:], C.GoBytes(unsafe.Pointer(&c_result), C.int(C.SignalEXPIRING_PROFILE_KEY_CREDENTIAL_LEN)))
+	return &result, nil
+}
+
+func (epkc *ExpiringProfileKeyCredential) ExpirationTime() (time.Time, error) {
+	var expiration C.uint64_t
+	signalFfiError := C.signal_expiring_profile_key_credential_get_expiration_time(
+		&expiration,
+		(*[C.SignalEXPIRING_PROFILE_KEY_CREDENTIAL_LEN]C.uchar)(unsafe.Pointer(epkc)),
+	)
+	if signalFfiError != nil {
+		return time.Time{}, wrapError(signalFfiError)
+	}
+	return time.Unix(int64(expiration), 0), nil
+}
+
+func CreateExpiringProfileKeyCredentialPresentation(
+	serverPublicParams ServerPublicParams,
+	groupSecretParams GroupSecretParams,
+	credential ExpiringProfileKeyCredential,
+) (ProfileKeyCredentialPresentation, error) {
+	randomness, err := GenerateRandomness()
+	if err != nil {
+		return nil, err
+	}
+	var c_result C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	c_serverPublicParams := (*[C.SignalSERVER_PUBLIC_PARAMS_LEN]C.uchar)(unsafe.Pointer(&serverPublicParams[0]))
+	c_randomness := (*[C.SignalRANDOMNESS_LEN]C.uchar)(unsafe.Pointer(&randomness[0]))
+	c_groupSecretParams := (*[C.SignalGROUP_SECRET_PARAMS_LEN]C.uchar)(unsafe.Pointer(&groupSecretParams[0]))
+	c_credential := (*[C.SignalEXPIRING_PROFILE_KEY_CREDENTIAL_LEN]C.uchar)(unsafe.Pointer(&credential[0]))
+
+	signalFfiError := C.signal_server_public_params_create_expiring_profile_key_credential_presentation_deterministic(
+		&c_result,
+		c_serverPublicParams,
+		c_randomness,
+		c_groupSecretParams,
+		c_credential,
+	)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return ProfileKeyCredentialPresentation(CopySignalOwnedBufferToBytes(c_result)), nil
+}
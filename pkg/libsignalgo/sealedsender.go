@@ -6,6 +6,7 @@ package libsignalgo
 */
 import "C"
 import (
+	"errors"
 	"runtime"
 	"time"
 
@@ -63,11 +64,55 @@ func SealedSenderEncrypt(messageContent *UnidentifiedSenderMessageContent, forRe
 	return CopySignalOwnedBufferToBytes(encrypted), nil
 }
 
+// SealedSenderMultiRecipientEncrypt encrypts the content for every recipient device at once,
+// every address in forRecipients needs an existing session in sessionStore.
 func SealedSenderMultiRecipientEncrypt(messageContent *UnidentifiedSenderMessageContent, forRecipients []*Address, identityStore IdentityKeyStore, sessionStore SessionStore, ctx *CallbackContext) ([]byte, error) {
+	if len(forRecipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	recipientSessions := make([]*SessionRecord, len(forRecipients))
+	for i, address := range forRecipients {
+		session, err := sessionStore.LoadSession(address, ctx.Ctx)
+		if err != nil {
+			return nil, err
+		} else if session == nil {
+			return nil, errors.New("no session for recipient")
+		}
+		recipientSessions[i] = session
+	}
 	contextPointer := gopointer.Save(ctx)
 	defer gopointer.Unref(contextPointer)
 
-	panic("not implemented")
+	addressPointers := make([]*C.SignalProtocolAddress, len(forRecipients))
+	for i, address := range forRecipients {
+		addressPointers[i] = address.ptr
+	}
+	sessionPointers := make([]*C.SignalSessionRecord, len(recipientSessions))
+	for i, session := range recipientSessions {
+		sessionPointers[i] = session.ptr
+	}
+
+	var encrypted C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	signalFfiError := C.signal_sealed_sender_multi_recipient_encrypt(
+		&encrypted,
+		C.SignalBorrowedSliceOfProtocolAddress{
+			base:   &addressPointers[0],
+			length: C.uintptr_t(len(addressPointers)),
+		},
+		C.SignalBorrowedSliceOfSessionRecord{
+			base:   &sessionPointers[0],
+			length: C.uintptr_t(len(sessionPointers)),
+		},
+		messageContent.ptr,
+		wrapIdentityKeyStore(identityStore),
+		contextPointer,
+	)
+	runtime.KeepAlive(forRecipients)
+	runtime.KeepAlive(recipientSessions)
+	if signalFfiError != nil {
+		return nil, wrapCallbackError(signalFfiError, ctx)
+	}
+	return CopySignalOwnedBufferToBytes(encrypted), nil
 }
 
 type SealedSenderResult struct {
@@ -230,18 +275,19 @@ func (usmc *UnidentifiedSenderMessageContent) GetContents() ([]byte, error) {
 	return CopySignalOwnedBufferToBytes(contents), nil
 }
 
-//func (usmc *UnidentifiedSenderMessageContent) GetGroupID() ([]byte, error) {
-//	var groupID *C.uchar
-//	var length C.ulong
-//	signalFfiError := C.signal_unidentified_sender_message_content_get_group_id(&groupID, &length, usmc.ptr)
-//	if signalFfiError != nil {
-//		return nil, wrapError(signalFfiError)
-//	}
-//	if groupID == nil {
-//		return nil, nil
-//	}
-//	return CopyBufferToBytes(groupID, length), nil
-//}
+// GetGroupID returns the group identifier the message was sent to, or nil if it wasn't a group message
+func (usmc *UnidentifiedSenderMessageContent) GetGroupID() ([]byte, error) {
+	var groupID C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	signalFfiError := C.signal_unidentified_sender_message_content_get_group_id_or_empty(&groupID, usmc.ptr)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	groupIDBytes := CopySignalOwnedBufferToBytes(groupID)
+	if len(groupIDBytes) == 0 {
+		return nil, nil
+	}
+	return groupIDBytes, nil
+}
 
 func (usmc *UnidentifiedSenderMessageContent) GetSenderCertificate() (*SenderCertificate, error) {
 	var senderCertificate *C.SignalSenderCertificate
@@ -0,0 +1,25 @@
+package libsignalgo
+
+/*
+#cgo LDFLAGS: -lsignal_ffi -ldl
+#include "./libsignal-ffi.h"
+*/
+import "C"
+import (
+	"unsafe"
+)
+
+type NotarySignature [C.SignalSIGNATURE_LEN]byte
+
+// Checks that the message was signed by the server, used for group changes that arrive from other clients
+func (spp *ServerPublicParams) VerifySignature(message []byte, signature NotarySignature) error {
+	signalFfiError := C.signal_server_public_params_verify_signature(
+		(*[C.SignalSERVER_PUBLIC_PARAMS_LEN]C.uchar)(unsafe.Pointer(spp)),
+		BytesToBuffer(message),
+		(*[C.SignalSIGNATURE_LEN]C.uint8_t)(unsafe.Pointer(&signature)),
+	)
+	if signalFfiError != nil {
+		return wrapError(signalFfiError)
+	}
+	return nil
+}
@@ -108,7 +108,7 @@ func TestSessionCipher(t *testing.T) {
 	bobCiphertext, err := libsignalgo.DeserializePreKeyMessage(aliceCiphertextSerialized)
 	assert.NoError(t, err)
 
-	bobPlaintext, err := libsignalgo.DecryptPreKey(bobCiphertext, aliceAddress, bobStore, bobStore, bobStore, bobStore, ctx)
+	bobPlaintext, err := libsignalgo.DecryptPreKey(bobCiphertext, aliceAddress, bobStore, bobStore, bobStore, bobStore, bobStore, ctx)
 	assert.NoError(t, err)
 	assert.Equal(t, alicePlaintext, bobPlaintext)
 
@@ -129,6 +129,88 @@ func TestSessionCipher(t *testing.T) {
 	assert.Equal(t, bobPlaintext2, alicePlaintext2)
 }
 
+func TestSessionCipherWithKyberPreKey(t *testing.T) {
+	ctx := libsignalgo.NewEmptyCallbackContext()
+	aliceAddress, err := libsignalgo.NewAddress("+14151111111", 1)
+	assert.NoError(t, err)
+	bobAddress, err := libsignalgo.NewAddress("+14151111112", 1)
+	assert.NoError(t, err)
+
+	aliceStore := NewInMemorySignalProtocolStore()
+	bobStore := NewInMemorySignalProtocolStore()
+
+	bobIdentityKeyPair, err := bobStore.GetIdentityKeyPair(ctx.Ctx)
+	require.NoError(t, err)
+	bobIdentityKey, err := libsignalgo.NewIdentityKeyFromPublicKey(bobIdentityKeyPair.GetPublicKey())
+	require.NoError(t, err)
+
+	bobSignedPreKey, err := libsignalgo.GeneratePrivateKey()
+	require.NoError(t, err)
+	bobSignedPreKeyPublicKey, err := bobSignedPreKey.GetPublicKey()
+	require.NoError(t, err)
+	bobSignedPreKeyPublicSerialized, err := bobSignedPreKeyPublicKey.Serialize()
+	require.NoError(t, err)
+	bobSignedPreKeySignature, err := bobIdentityKeyPair.GetPrivateKey().Sign(bobSignedPreKeyPublicSerialized)
+	require.NoError(t, err)
+
+	bobKyberKeyPair, err := libsignalgo.KyberKeyPairGenerate()
+	require.NoError(t, err)
+	bobKyberPublicKey, err := bobKyberKeyPair.GetPublicKey()
+	require.NoError(t, err)
+	bobKyberPublicSerialized, err := bobKyberPublicKey.Serialize()
+	require.NoError(t, err)
+	bobKyberSignature, err := bobIdentityKeyPair.GetPrivateKey().Sign(bobKyberPublicSerialized)
+	require.NoError(t, err)
+
+	var signedPreKeyID uint32 = 3006
+	var kyberPreKeyID uint32 = 8888
+
+	bobRegistrationID, err := bobStore.GetLocalRegistrationID(ctx.Ctx)
+	require.NoError(t, err)
+	bobBundle, err := libsignalgo.NewPreKeyBundleWithKyberPreKey(
+		bobRegistrationID,
+		9,
+		0,
+		nil,
+		signedPreKeyID,
+		bobSignedPreKeyPublicKey,
+		bobSignedPreKeySignature,
+		bobIdentityKey,
+		kyberPreKeyID,
+		bobKyberPublicKey,
+		bobKyberSignature,
+	)
+	require.NoError(t, err)
+	bundleKyberSignature, err := bobBundle.GetKyberPreKeySignature()
+	require.NoError(t, err)
+	assert.Equal(t, bobKyberSignature, bundleKyberSignature)
+
+	err = libsignalgo.ProcessPreKeyBundle(bobBundle, bobAddress, aliceStore, aliceStore, ctx)
+	require.NoError(t, err)
+
+	signedPreKeyRecord, err := libsignalgo.NewSignedPreKeyRecordFromPrivateKey(signedPreKeyID, time.UnixMilli(42000), bobSignedPreKey, bobSignedPreKeySignature)
+	require.NoError(t, err)
+	err = bobStore.StoreSignedPreKey(signedPreKeyID, signedPreKeyRecord, ctx.Ctx)
+	require.NoError(t, err)
+	kyberPreKeyRecord, err := libsignalgo.NewKyberPreKeyRecord(kyberPreKeyID, time.UnixMilli(42000), bobKyberKeyPair, bobKyberSignature)
+	require.NoError(t, err)
+	err = bobStore.StoreKyberPreKey(kyberPreKeyID, kyberPreKeyRecord, ctx.Ctx)
+	require.NoError(t, err)
+
+	alicePlaintext := []byte{8, 6, 7, 5, 3, 0, 9}
+	aliceCiphertext, err := libsignalgo.Encrypt(alicePlaintext, bobAddress, aliceStore, aliceStore, ctx)
+	require.NoError(t, err)
+	aliceCiphertextSerialized, err := aliceCiphertext.Serialize()
+	require.NoError(t, err)
+	bobCiphertext, err := libsignalgo.DeserializePreKeyMessage(aliceCiphertextSerialized)
+	require.NoError(t, err)
+
+	bobPlaintext, err := libsignalgo.DecryptPreKey(bobCiphertext, aliceAddress, bobStore, bobStore, bobStore, bobStore, bobStore, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, alicePlaintext, bobPlaintext)
+	assert.Contains(t, bobStore.usedKyberPreKeys, kyberPreKeyID)
+}
+
 // From SessionTests.swift:testSessionCipherWithBadStore
 func TestSessionCipherWithBadStore(t *testing.T) {
 	ctx := libsignalgo.NewEmptyCallbackContext()
@@ -154,7 +236,7 @@ func TestSessionCipherWithBadStore(t *testing.T) {
 	assert.NoError(t, err)
 	bobCiphertext, err := libsignalgo.DeserializePreKeyMessage(aliceCiphertextSerialized)
 	assert.NoError(t, err)
-	_, err = libsignalgo.DecryptPreKey(bobCiphertext, aliceAddress, bobStore, bobStore, bobStore, bobStore, ctx)
+	_, err = libsignalgo.DecryptPreKey(bobCiphertext, aliceAddress, bobStore, bobStore, bobStore, bobStore, bobStore, ctx)
 	require.Error(t, err)
 	assert.Equal(t, "Test error", err.Error())
 }
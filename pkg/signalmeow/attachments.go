@@ -0,0 +1,424 @@
+package signalmeow
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"mime/multipart"
+	"strconv"
+	"time"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	attachmentKeyLength = 64 // 32 bytes of AES key followed by 32 bytes of HMAC key
+	attachmentIVLength  = 16
+	attachmentMACLength = 32
+)
+
+var (
+	ErrInvalidAttachmentKey    = errors.New("invalid attachment key length")
+	ErrInvalidAttachmentLength = errors.New("attachment is too short")
+	ErrInvalidAttachmentDigest = errors.New("attachment digest doesn't match")
+	ErrInvalidAttachmentMAC    = errors.New("attachment MAC doesn't match")
+	ErrInvalidAttachmentPad    = errors.New("invalid attachment padding")
+)
+
+// Figures out which CDN an attachment lives on and where on that CDN it is
+func attachmentHostAndPath(attachmentPointer *signalpb.AttachmentPointer) (string, string, error) {
+	switch attachmentPointer.GetCdnNumber() {
+	case 0:
+		if attachmentPointer.GetCdnId() != 0 {
+			return web.CDN1UrlHost, "/attachments/" + strconv.FormatUint(attachmentPointer.GetCdnId(), 10), nil
+		}
+		// Some clients don't set cdnNumber for CDN 2 attachments, so fall back to the key if there is one
+		if attachmentPointer.GetCdnKey() != "" {
+			return web.CDN2UrlHost, "/attachments/" + attachmentPointer.GetCdnKey(), nil
+		}
+		return "", "", errors.New("attachment pointer has no CDN ID or key")
+	case 2:
+		return web.CDN2UrlHost, "/attachments/" + attachmentPointer.GetCdnKey(), nil
+	case 3:
+		return web.CDN3UrlHost, "/attachments/" + attachmentPointer.GetCdnKey(), nil
+	default:
+		return "", "", fmt.Errorf("unknown CDN number %d", attachmentPointer.GetCdnNumber())
+	}
+}
+
+// DownloadAttachment fetches the encrypted blob for an attachment from the Signal CDN
+// and returns the decrypted plaintext
+func DownloadAttachment(ctx context.Context, attachmentPointer *signalpb.AttachmentPointer) ([]byte, error) {
+	host, path, err := attachmentHostAndPath(attachmentPointer)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := web.SendHTTPRequest("GET", path, &web.HTTPReqOpt{Host: host})
+	if err != nil {
+		log.Printf("DownloadAttachment SendHTTPRequest error: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Printf("DownloadAttachment bad status: %v", resp.StatusCode)
+		return nil, fmt.Errorf("unexpected status code %d downloading attachment", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("DownloadAttachment ReadAll error: %v", err)
+		return nil, err
+	}
+	return decryptAttachment(body, attachmentPointer.GetKey(), attachmentPointer.GetDigest(), attachmentPointer.GetSize())
+}
+
+// Attachments are laid out as IV || AES-256-CBC(plaintext + padding) || HMAC-SHA256(IV || ciphertext),
+// and the digest is the SHA-256 of that whole blob
+func decryptAttachment(body, key, digest []byte, size uint32) ([]byte, error) {
+	if len(key) != attachmentKeyLength {
+		return nil, ErrInvalidAttachmentKey
+	}
+	if len(body) < attachmentIVLength+aes.BlockSize+attachmentMACLength {
+		return nil, ErrInvalidAttachmentLength
+	}
+	if len(digest) > 0 {
+		calculatedDigest := sha256.Sum256(body)
+		if !hmac.Equal(calculatedDigest[:], digest) {
+			return nil, ErrInvalidAttachmentDigest
+		}
+	}
+
+	aesKey, macKey := key[:32], key[32:]
+	macStart := len(body) - attachmentMACLength
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(body[:macStart])
+	if !hmac.Equal(mac.Sum(nil), body[macStart:]) {
+		return nil, ErrInvalidAttachmentMAC
+	}
+
+	iv := body[:attachmentIVLength]
+	ciphertext := body[attachmentIVLength:macStart]
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrInvalidAttachmentLength
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	// Strip PKCS#7 padding
+	padLength := int(plaintext[len(plaintext)-1])
+	if padLength == 0 || padLength > aes.BlockSize || padLength > len(plaintext) {
+		return nil, ErrInvalidAttachmentPad
+	}
+	if !bytes.Equal(plaintext[len(plaintext)-padLength:], bytes.Repeat([]byte{byte(padLength)}, padLength)) {
+		return nil, ErrInvalidAttachmentPad
+	}
+	plaintext = plaintext[:len(plaintext)-padLength]
+
+	// Signal clients pad the plaintext with zeroes before encrypting, so cut it back down to the real size
+	if size > 0 && int(size) <= len(plaintext) {
+		plaintext = plaintext[:size]
+	}
+	return plaintext, nil
+}
+
+// Uploading
+
+type AttachmentUploadOptions struct {
+	ContentType string
+	FileName    string
+	Width       uint32
+	Height      uint32
+	Caption     string
+	Flags       uint32 // Bitmask of signalpb.AttachmentPointer_Flags
+}
+
+// UploadAttachment encrypts the given plaintext with a fresh key, uploads it to the Signal CDN
+// and returns an AttachmentPointer that can be put in a DataMessage
+func UploadAttachment(ctx context.Context, d *Device, plaintext []byte, opts AttachmentUploadOptions) (*signalpb.AttachmentPointer, error) {
+	keys := make([]byte, attachmentKeyLength)
+	if _, err := rand.Read(keys); err != nil {
+		return nil, err
+	}
+	iv := make([]byte, attachmentIVLength)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	body, digest, err := encryptAttachment(plaintext, keys, iv)
+	if err != nil {
+		log.Printf("encryptAttachment error: %v", err)
+		return nil, err
+	}
+
+	attachmentPointer := &signalpb.AttachmentPointer{
+		ContentType:     proto.String(opts.ContentType),
+		Key:             keys,
+		Size:            proto.Uint32(uint32(len(plaintext))),
+		Digest:          digest,
+		UploadTimestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+	}
+	if opts.FileName != "" {
+		attachmentPointer.FileName = proto.String(opts.FileName)
+	}
+	if opts.Width != 0 && opts.Height != 0 {
+		attachmentPointer.Width = proto.Uint32(opts.Width)
+		attachmentPointer.Height = proto.Uint32(opts.Height)
+	}
+	if opts.Caption != "" {
+		attachmentPointer.Caption = proto.String(opts.Caption)
+	}
+	if opts.Flags != 0 {
+		attachmentPointer.Flags = proto.Uint32(opts.Flags)
+	}
+
+	err = uploadAttachmentV3(ctx, d, body, attachmentPointer)
+	if err != nil {
+		// Fall back to the legacy CDN 0 upload form
+		log.Printf("uploadAttachmentV3 error, trying v2: %v", err)
+		err = uploadAttachmentV2(ctx, d, body, attachmentPointer)
+	}
+	if err != nil {
+		log.Printf("UploadAttachment error: %v", err)
+		return nil, err
+	}
+	return attachmentPointer, nil
+}
+
+type attachmentV3UploadForm struct {
+	Cdn                  uint32            `json:"cdn"`
+	Key                  string            `json:"key"`
+	Headers              map[string]string `json:"headers"`
+	SignedUploadLocation string            `json:"signedUploadLocation"`
+}
+
+func uploadAttachmentV3(ctx context.Context, d *Device, body []byte, attachmentPointer *signalpb.AttachmentPointer) error {
+	username, password := d.Data.BasicAuthCreds()
+	opts := &web.HTTPReqOpt{Username: &username, Password: &password}
+	resp, err := web.SendHTTPRequest("GET", "/v3/attachments/form/upload", opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error fetching upload form: %v", resp.StatusCode)
+	}
+	var form attachmentV3UploadForm
+	err = json.NewDecoder(resp.Body).Decode(&form)
+	if err != nil {
+		return err
+	}
+
+	switch form.Cdn {
+	case 2:
+		err = uploadToCDN2(form, body)
+	case 3:
+		err = uploadToCDN3(form, body)
+	default:
+		err = fmt.Errorf("unsupported CDN number %d in upload form", form.Cdn)
+	}
+	if err != nil {
+		return err
+	}
+	attachmentPointer.AttachmentIdentifier = &signalpb.AttachmentPointer_CdnKey{CdnKey: form.Key}
+	attachmentPointer.CdnNumber = proto.Uint32(form.Cdn)
+	return nil
+}
+
+// CDN 2 is a resumable upload: one request to open the upload session, one to send the data
+func uploadToCDN2(form attachmentV3UploadForm, body []byte) error {
+	headers := map[string]string{}
+	for key, value := range form.Headers {
+		headers[key] = value
+	}
+	headers["Content-Type"] = "application/octet-stream"
+	resp, err := web.SendHTTPRequest("POST", "", &web.HTTPReqOpt{OverrideURL: form.SignedUploadLocation, Headers: headers})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error opening CDN 2 upload: %v", resp.StatusCode)
+	}
+	uploadLocation := resp.Header.Get("Location")
+	if uploadLocation == "" {
+		return errors.New("CDN 2 upload response is missing Location header")
+	}
+
+	resp, err = web.SendHTTPRequest("PUT", "", &web.HTTPReqOpt{
+		OverrideURL: uploadLocation,
+		Body:        body,
+		Headers:     map[string]string{"Content-Type": "application/octet-stream"},
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error uploading to CDN 2: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// CDN 3 speaks TUS, which lets us create the upload and send the data in one request
+func uploadToCDN3(form attachmentV3UploadForm, body []byte) error {
+	headers := map[string]string{}
+	for key, value := range form.Headers {
+		headers[key] = value
+	}
+	headers["Tus-Resumable"] = "1.0.0"
+	headers["Upload-Length"] = strconv.Itoa(len(body))
+	headers["Content-Type"] = "application/offset+octet-stream"
+	resp, err := web.SendHTTPRequest("POST", "", &web.HTTPReqOpt{
+		OverrideURL: form.SignedUploadLocation,
+		Body:        body,
+		Headers:     headers,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error uploading to CDN 3: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+type attachmentV2UploadForm struct {
+	ACL                string `json:"acl"`
+	Key                string `json:"key"`
+	Policy             string `json:"policy"`
+	Algorithm          string `json:"algorithm"`
+	Credential         string `json:"credential"`
+	Date               string `json:"date"`
+	Signature          string `json:"signature"`
+	AttachmentID       uint64 `json:"attachmentId"`
+	AttachmentIDString string `json:"attachmentIdString"`
+}
+
+func uploadAttachmentV2(ctx context.Context, d *Device, body []byte, attachmentPointer *signalpb.AttachmentPointer) error {
+	username, password := d.Data.BasicAuthCreds()
+	opts := &web.HTTPReqOpt{Username: &username, Password: &password}
+	resp, err := web.SendHTTPRequest("GET", "/v2/attachments/form/upload", opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error fetching v2 upload form: %v", resp.StatusCode)
+	}
+	var form attachmentV2UploadForm
+	err = json.NewDecoder(resp.Body).Decode(&form)
+	if err != nil {
+		return err
+	}
+	attachmentID := form.AttachmentID
+	if form.AttachmentIDString != "" {
+		attachmentID, err = strconv.ParseUint(form.AttachmentIDString, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	fields := [][2]string{
+		{"acl", form.ACL},
+		{"key", form.Key},
+		{"policy", form.Policy},
+		{"Content-Type", "application/octet-stream"},
+		{"x-amz-algorithm", form.Algorithm},
+		{"x-amz-credential", form.Credential},
+		{"x-amz-date", form.Date},
+		{"x-amz-signature", form.Signature},
+	}
+	err = uploadToCDN0("/attachments/", fields, body)
+	if err != nil {
+		return err
+	}
+	attachmentPointer.AttachmentIdentifier = &signalpb.AttachmentPointer_CdnId{CdnId: attachmentID}
+	attachmentPointer.CdnNumber = proto.Uint32(0)
+	return nil
+}
+
+// CDN 0 is S3, which wants a multipart form with the policy fields before the file
+func uploadToCDN0(path string, fields [][2]string, body []byte) error {
+	var multipartBody bytes.Buffer
+	writer := multipart.NewWriter(&multipartBody)
+	for _, field := range fields {
+		if err := writer.WriteField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+	fileWriter, err := writer.CreateFormFile("file", "file")
+	if err != nil {
+		return err
+	}
+	if _, err = fileWriter.Write(body); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	uploadResp, err := web.SendHTTPRequest("POST", path, &web.HTTPReqOpt{
+		Host:    web.CDN1UrlHost,
+		Body:    multipartBody.Bytes(),
+		Headers: map[string]string{"Content-Type": writer.FormDataContentType()},
+	})
+	if err != nil {
+		return err
+	}
+	uploadResp.Body.Close()
+	if uploadResp.StatusCode < 200 || uploadResp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error uploading to CDN 0: %v", uploadResp.StatusCode)
+	}
+	return nil
+}
+
+// Signal pads attachments to a set of bucket sizes so the ciphertext length leaks less about the content
+func paddedAttachmentSize(size int) int {
+	if size <= 541 {
+		return 541
+	}
+	return int(math.Floor(math.Pow(1.05, math.Ceil(math.Log(float64(size))/math.Log(1.05)))))
+}
+
+// Returns IV || ciphertext || MAC and the digest of all of that, the inverse of decryptAttachment
+func encryptAttachment(plaintext, key, iv []byte) ([]byte, []byte, error) {
+	if len(key) != attachmentKeyLength {
+		return nil, nil, ErrInvalidAttachmentKey
+	}
+	aesKey, macKey := key[:32], key[32:]
+
+	padded := make([]byte, paddedAttachmentSize(len(plaintext)))
+	copy(padded, plaintext)
+	padLength := aes.BlockSize - len(padded)%aes.BlockSize
+	padded = append(padded, bytes.Repeat([]byte{byte(padLength)}, padLength)...)
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	body := make([]byte, attachmentIVLength+len(padded), attachmentIVLength+len(padded)+attachmentMACLength)
+	copy(body, iv)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(body[attachmentIVLength:], padded)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(body)
+	body = mac.Sum(body)
+
+	digest := sha256.Sum256(body)
+	return body, digest[:], nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"strings"
+	"sync"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
@@ -32,14 +34,18 @@ func (d *DeviceData) BasicAuthCreds() (string, string) {
 // and other data that is used to communicate with the Signal servers and other clients.
 type DeviceConnection struct {
 	// cached data (not persisted)
-	SenderCertificate *libsignalgo.SenderCertificate
-	GroupCredentials  *GroupCredentials
-	GroupCache        *GroupCache
-	ProfileCache      *ProfileCache
+	SenderCertificate     *libsignalgo.SenderCertificate
+	senderCertificateLock sync.Mutex
+	GroupCredentials      *GroupCredentials
+	GroupCache            *GroupCache
+	ProfileCache          *ProfileCache
+	SendLog               *SendLog
 	// Network interfaces
 	AuthedWS   *web.SignalWebsocket
 	UnauthedWS *web.SignalWebsocket
 
+	preKeyMaintenanceStarted bool
+
 	IncomingSignalMessageHandler func(IncomingSignalMessage) error
 }
 
@@ -67,3 +73,59 @@ func (d *DeviceConnection) ConnectUnauthedWS(ctx context.Context, data DeviceDat
 	d.UnauthedWS = unauthedWS
 	return nil
 }
+
+// Called by the identity store when a contact's identity key changes, so the user can be told about it
+func (d *Device) handleIdentityChange(theirUuid string) {
+	if d.Connection.IncomingSignalMessageHandler == nil {
+		return
+	}
+	// The store calls this from inside libsignal callbacks, so don't make it wait for the handler
+	go d.Connection.IncomingSignalMessageHandler(IncomingSignalMessageIdentityChange{
+		IncomingSignalMessageBase: IncomingSignalMessageBase{
+			SenderUUID:    theirUuid,
+			RecipientUUID: d.Data.AciUuid,
+		},
+		Timestamp: currentMessageTimestamp(),
+	})
+}
+
+// AcknowledgeIdentityChange trusts the new identity key of a contact, which is needed before sending to them
+// again when the store uses IdentityBlockUntilAcknowledged
+func AcknowledgeIdentityChange(ctx context.Context, d *Device, theirUuid string) error {
+	return d.IdentityStoreExtras.AcknowledgeIdentityChange(theirUuid, ctx)
+}
+
+// The stores for whichever of our identities an envelope was addressed to
+type identityStores struct {
+	isPni              bool
+	SessionStore       libsignalgo.SessionStore
+	SessionStoreExtras SessionStoreExtras
+	IdentityStore      libsignalgo.IdentityKeyStore
+	PreKeyStore        libsignalgo.PreKeyStore
+	SignedPreKeyStore  libsignalgo.SignedPreKeyStore
+	KyberPreKeyStore   libsignalgo.KyberPreKeyStore
+}
+
+// Picks the PNI stores for envelopes sent to our phone number identity, and the ACI stores for everything else
+// (including envelopes without a destination, which old senders and the server don't always set)
+func (d *Device) storesForDestination(destinationUuid string) *identityStores {
+	if destinationUuid != "" && d.Data.PniUuid != "" && strings.EqualFold(destinationUuid, d.Data.PniUuid) {
+		return &identityStores{
+			isPni:              true,
+			SessionStore:       d.PniSessionStore,
+			SessionStoreExtras: d.PniSessionStoreExtras,
+			IdentityStore:      d.PniIdentityStore,
+			PreKeyStore:        d.PniPreKeyStore,
+			SignedPreKeyStore:  d.PniSignedPreKeyStore,
+			KyberPreKeyStore:   d.PniKyberPreKeyStore,
+		}
+	}
+	return &identityStores{
+		SessionStore:       d.SessionStore,
+		SessionStoreExtras: d.SessionStoreExtras,
+		IdentityStore:      d.IdentityStore,
+		PreKeyStore:        d.PreKeyStore,
+		SignedPreKeyStore:  d.SignedPreKeyStore,
+		KyberPreKeyStore:   d.KyberPreKeyStore,
+	}
+}
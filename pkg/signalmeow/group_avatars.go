@@ -0,0 +1,112 @@
+package signalmeow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+	"google.golang.org/protobuf/proto"
+)
+
+// DownloadGroupAvatar fetches the group's avatar from the CDN and decrypts it, returns nil if the group has no avatar
+func DownloadGroupAvatar(ctx context.Context, d *Device, group *Group) ([]byte, error) {
+	if group.Avatar == "" {
+		return nil, nil
+	}
+	resp, err := web.SendHTTPRequest("GET", "/"+group.Avatar, &web.HTTPReqOpt{Host: web.CDN1UrlHost})
+	if err != nil {
+		log.Printf("DownloadGroupAvatar SendHTTPRequest error: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status code %d downloading group avatar", resp.StatusCode)
+	}
+	encryptedAvatar, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyFromGroupID(group.GroupID))
+	if err != nil {
+		return nil, err
+	}
+	blob, err := decryptGroupAttributeBlob(groupSecretParams, encryptedAvatar)
+	if err != nil {
+		return nil, err
+	}
+	return blob.GetAvatar(), nil
+}
+
+// Encrypts the avatar and uploads it to the group CDN, returning the key to put in the group
+func uploadGroupAvatar(ctx context.Context, d *Device, groupID GroupID, avatar []byte) (string, error) {
+	encryptedAvatar, err := encryptGroupAttributeBlob(groupID, &signalpb.GroupAttributeBlob{Content: &signalpb.GroupAttributeBlob_Avatar{Avatar: avatar}})
+	if err != nil {
+		return "", err
+	}
+
+	groupAuth, err := GetAuthorizationForToday(ctx, d, masterKeyFromGroupID(groupID))
+	if err != nil {
+		return "", err
+	}
+	opts := &web.HTTPReqOpt{Username: &groupAuth.Username, Password: &groupAuth.Password, RequestPB: true, Host: web.StorageUrlHost}
+	resp, err := web.SendHTTPRequest("GET", "/v1/groups/avatar/form", opts)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("HTTP error fetching group avatar upload form: %v", resp.StatusCode)
+	}
+	formBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	form := &signalpb.AvatarUploadAttributes{}
+	err = proto.Unmarshal(formBytes, form)
+	if err != nil {
+		return "", err
+	}
+	if form.Key == "" {
+		return "", errors.New("group avatar upload form has no key")
+	}
+
+	fields := [][2]string{
+		{"key", form.Key},
+		{"Content-Type", "application/octet-stream"},
+		{"acl", form.Acl},
+		{"x-amz-algorithm", form.Algorithm},
+		{"x-amz-credential", form.Credential},
+		{"x-amz-date", form.Date},
+		{"policy", form.Policy},
+		{"x-amz-signature", form.Signature},
+	}
+	err = uploadToCDN0("/", fields, encryptedAvatar)
+	if err != nil {
+		return "", err
+	}
+	return form.Key, nil
+}
+
+// UpdateGroupAvatar replaces the group's avatar, or removes it if avatar is empty
+func UpdateGroupAvatar(ctx context.Context, d *Device, groupID GroupID, avatar []byte) (*GroupChange, error) {
+	_, err := groupWithAccess(ctx, d, groupID, attributesAccess)
+	if err != nil {
+		return nil, err
+	}
+	var avatarKey string
+	if len(avatar) > 0 {
+		avatarKey, err = uploadGroupAvatar(ctx, d, groupID, avatar)
+		if err != nil {
+			log.Printf("uploadGroupAvatar error: %v", err)
+			return nil, err
+		}
+	}
+	return patchGroup(ctx, d, groupID, &signalpb.GroupChange_Actions{
+		ModifyAvatar: &signalpb.GroupChange_Actions_ModifyAvatarAction{Avatar: avatarKey},
+	})
+}
@@ -0,0 +1,591 @@
+package signalmeow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+	"google.golang.org/protobuf/proto"
+)
+
+// The newest change format we understand, the server won't send changes that need a newer one
+const maxSupportedGroupChangeEpoch = 5
+
+var (
+	ErrGroupChangeForbidden = errors.New("not allowed to make this change to the group")
+	ErrGroupChangeConflict  = errors.New("the group changed at the same time, try again")
+)
+
+type GroupMemberRoleChange struct {
+	UserId string
+	Role   GroupMemberRole
+}
+
+// A decrypted GroupChange.Actions, moving a group from Revision-1 to Revision
+type GroupChange struct {
+	SourceUUID string // ACI of whoever made the change, empty if the server didn't say
+	Revision   uint32
+
+	AddMembers               []*GroupMember
+	DeleteMembers            []string
+	ModifyMemberRoles        []*GroupMemberRoleChange
+	ModifyMemberProfileKeys  []*GroupMember // Only UserId and ProfileKey are set
+	AddPendingMembers        []*PendingMember
+	DeletePendingMembers     []string
+	PromotePendingMembers    []*GroupMember // Invites that were accepted, only UserId and ProfileKey are set
+	AddRequestingMembers     []*RequestingMember
+	DeleteRequestingMembers  []string
+	PromoteRequestingMembers []*GroupMemberRoleChange
+	AddBannedMembers         []*BannedMember
+	DeleteBannedMembers      []string
+
+	ModifyTitle                     *string
+	ModifyDescription               *string
+	ModifyAvatar                    *string
+	ModifyDisappearingMessagesTimer *uint32
+	ModifyAnnouncementsOnly         *bool
+	ModifyAttributesAccess          *AccessControl
+	ModifyMemberAccess              *AccessControl
+	ModifyAddFromInviteLinkAccess   *AccessControl
+	ModifyInviteLinkPassword        []byte // nil if unchanged
+}
+
+func decryptGroupChange(encryptedChange *signalpb.GroupChange, groupID GroupID, verifySignature bool) (*GroupChange, error) {
+	// Changes that come from other clients have to be checked, the ones we fetch from the server don't
+	if verifySignature {
+		if len(encryptedChange.ServerSignature) != len(libsignalgo.NotarySignature{}) {
+			return nil, errors.New("group change has no valid server signature")
+		}
+		serverParams := serverPublicParams()
+		err := serverParams.VerifySignature(encryptedChange.Actions, libsignalgo.NotarySignature(encryptedChange.ServerSignature))
+		if err != nil {
+			return nil, fmt.Errorf("group change server signature is invalid: %w", err)
+		}
+	}
+
+	actions := &signalpb.GroupChange_Actions{}
+	err := proto.Unmarshal(encryptedChange.Actions, actions)
+	if err != nil {
+		return nil, err
+	}
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyFromGroupID(groupID))
+	if err != nil {
+		return nil, err
+	}
+
+	change := &GroupChange{Revision: actions.Revision}
+	if len(actions.SourceUuid) > 0 {
+		change.SourceUUID, err = decryptUserID(groupSecretParams, actions.SourceUuid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, action := range actions.AddMembers {
+		member, err := decryptMember(groupSecretParams, action.GetAdded())
+		if err != nil {
+			return nil, err
+		}
+		change.AddMembers = append(change.AddMembers, member)
+	}
+	for _, action := range actions.DeleteMembers {
+		userID, err := decryptUserID(groupSecretParams, action.DeletedUserId)
+		if err != nil {
+			return nil, err
+		}
+		change.DeleteMembers = append(change.DeleteMembers, userID)
+	}
+	for _, action := range actions.ModifyMemberRoles {
+		userID, err := decryptUserID(groupSecretParams, action.UserId)
+		if err != nil {
+			return nil, err
+		}
+		change.ModifyMemberRoles = append(change.ModifyMemberRoles, &GroupMemberRoleChange{UserId: userID, Role: GroupMemberRole(action.Role)})
+	}
+	for _, action := range actions.ModifyMemberProfileKeys {
+		member, err := decryptProfileKeyChange(groupSecretParams, action.UserId, action.ProfileKey)
+		if err != nil {
+			return nil, err
+		}
+		change.ModifyMemberProfileKeys = append(change.ModifyMemberProfileKeys, member)
+	}
+	for _, action := range actions.AddPendingMembers {
+		pendingMember, err := decryptPendingMember(groupSecretParams, action.GetAdded())
+		if err != nil {
+			return nil, err
+		}
+		change.AddPendingMembers = append(change.AddPendingMembers, pendingMember)
+	}
+	for _, action := range actions.DeletePendingMembers {
+		userID, err := decryptUserID(groupSecretParams, action.DeletedUserId)
+		if err != nil {
+			return nil, err
+		}
+		change.DeletePendingMembers = append(change.DeletePendingMembers, userID)
+	}
+	for _, action := range actions.PromotePendingMembers {
+		member, err := decryptProfileKeyChange(groupSecretParams, action.UserId, action.ProfileKey)
+		if err != nil {
+			return nil, err
+		}
+		change.PromotePendingMembers = append(change.PromotePendingMembers, member)
+	}
+	// Someone invited by phone number accepting, the invite was for their PNI but they join with their ACI
+	for _, action := range actions.PromotePendingPniAciMembers {
+		member, err := decryptProfileKeyChange(groupSecretParams, action.UserId, action.ProfileKey)
+		if err != nil {
+			return nil, err
+		}
+		pni, err := decryptUserID(groupSecretParams, action.Pni)
+		if err != nil {
+			return nil, err
+		}
+		change.DeletePendingMembers = append(change.DeletePendingMembers, pni)
+		change.PromotePendingMembers = append(change.PromotePendingMembers, member)
+	}
+	for _, action := range actions.AddRequestingMembers {
+		requestingMember, err := decryptRequestingMember(groupSecretParams, action.GetAdded())
+		if err != nil {
+			return nil, err
+		}
+		change.AddRequestingMembers = append(change.AddRequestingMembers, requestingMember)
+	}
+	for _, action := range actions.DeleteRequestingMembers {
+		userID, err := decryptUserID(groupSecretParams, action.DeletedUserId)
+		if err != nil {
+			return nil, err
+		}
+		change.DeleteRequestingMembers = append(change.DeleteRequestingMembers, userID)
+	}
+	for _, action := range actions.AddBannedMembers {
+		bannedMember, err := decryptBannedMember(groupSecretParams, action.GetAdded())
+		if err != nil {
+			return nil, err
+		}
+		change.AddBannedMembers = append(change.AddBannedMembers, bannedMember)
+	}
+	for _, action := range actions.DeleteBannedMembers {
+		userID, err := decryptUserID(groupSecretParams, action.DeletedUserId)
+		if err != nil {
+			return nil, err
+		}
+		change.DeleteBannedMembers = append(change.DeleteBannedMembers, userID)
+	}
+	for _, action := range actions.PromoteRequestingMembers {
+		userID, err := decryptUserID(groupSecretParams, action.UserId)
+		if err != nil {
+			return nil, err
+		}
+		change.PromoteRequestingMembers = append(change.PromoteRequestingMembers, &GroupMemberRoleChange{UserId: userID, Role: GroupMemberRole(action.Role)})
+	}
+	if actions.ModifyTitle != nil {
+		title, err := decryptGroupTitle(groupSecretParams, actions.ModifyTitle.Title)
+		if err != nil {
+			return nil, err
+		}
+		change.ModifyTitle = &title
+	}
+	if actions.ModifyDescription != nil {
+		description, err := decryptGroupDescription(groupSecretParams, actions.ModifyDescription.Description)
+		if err != nil {
+			return nil, err
+		}
+		change.ModifyDescription = &description
+	}
+	if actions.ModifyAvatar != nil {
+		change.ModifyAvatar = &actions.ModifyAvatar.Avatar
+	}
+	if actions.ModifyDisappearingMessagesTimer != nil {
+		timer, err := decryptGroupTimer(groupSecretParams, actions.ModifyDisappearingMessagesTimer.Timer)
+		if err != nil {
+			return nil, err
+		}
+		change.ModifyDisappearingMessagesTimer = &timer
+	}
+	if actions.ModifyAnnouncementsOnly != nil {
+		change.ModifyAnnouncementsOnly = &actions.ModifyAnnouncementsOnly.AnnouncementsOnly
+	}
+	if actions.ModifyAttributesAccess != nil {
+		access := AccessControl(actions.ModifyAttributesAccess.AttributesAccess)
+		change.ModifyAttributesAccess = &access
+	}
+	if actions.ModifyMemberAccess != nil {
+		access := AccessControl(actions.ModifyMemberAccess.MembersAccess)
+		change.ModifyMemberAccess = &access
+	}
+	if actions.ModifyAddFromInviteLinkAccess != nil {
+		access := AccessControl(actions.ModifyAddFromInviteLinkAccess.AddFromInviteLinkAccess)
+		change.ModifyAddFromInviteLinkAccess = &access
+	}
+	if actions.ModifyInviteLinkPassword != nil {
+		change.ModifyInviteLinkPassword = actions.ModifyInviteLinkPassword.InviteLinkPassword
+		if change.ModifyInviteLinkPassword == nil {
+			change.ModifyInviteLinkPassword = []byte{}
+		}
+	}
+	return change, nil
+}
+
+func decryptProfileKeyChange(groupSecretParams libsignalgo.GroupSecretParams, encryptedUserID []byte, encryptedProfileKey []byte) (*GroupMember, error) {
+	userID, err := decryptUserID(groupSecretParams, encryptedUserID)
+	if err != nil {
+		return nil, err
+	}
+	profileKey, err := decryptProfileKey(groupSecretParams, encryptedProfileKey, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &GroupMember{UserId: userID, ProfileKey: *profileKey}, nil
+}
+
+func (group *Group) findMember(userID string) (int, *GroupMember) {
+	for i, member := range group.Members {
+		if member.UserId == userID {
+			return i, member
+		}
+	}
+	return -1, nil
+}
+
+func (group *Group) addMember(member *GroupMember) {
+	if i, _ := group.findMember(member.UserId); i >= 0 {
+		group.Members[i] = member
+	} else {
+		group.Members = append(group.Members, member)
+	}
+}
+
+func (group *Group) removePendingMember(userID string) *PendingMember {
+	for i, pendingMember := range group.PendingMembers {
+		if pendingMember.UserId == userID {
+			group.PendingMembers = append(group.PendingMembers[:i], group.PendingMembers[i+1:]...)
+			return pendingMember
+		}
+	}
+	return nil
+}
+
+func (group *Group) removeRequestingMember(userID string) *RequestingMember {
+	for i, requestingMember := range group.RequestingMembers {
+		if requestingMember.UserId == userID {
+			group.RequestingMembers = append(group.RequestingMembers[:i], group.RequestingMembers[i+1:]...)
+			return requestingMember
+		}
+	}
+	return nil
+}
+
+func (group *Group) removeBannedMember(userID string) {
+	for i, bannedMember := range group.BannedMembers {
+		if bannedMember.UserId == userID {
+			group.BannedMembers = append(group.BannedMembers[:i], group.BannedMembers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (group *Group) applyChange(change *GroupChange) {
+	for _, member := range change.AddMembers {
+		group.addMember(member)
+	}
+	for _, userID := range change.DeleteMembers {
+		if i, _ := group.findMember(userID); i >= 0 {
+			group.Members = append(group.Members[:i], group.Members[i+1:]...)
+		}
+	}
+	for _, roleChange := range change.ModifyMemberRoles {
+		if _, member := group.findMember(roleChange.UserId); member != nil {
+			member.Role = roleChange.Role
+		}
+	}
+	for _, profileKeyChange := range change.ModifyMemberProfileKeys {
+		if _, member := group.findMember(profileKeyChange.UserId); member != nil {
+			member.ProfileKey = profileKeyChange.ProfileKey
+		}
+	}
+	for _, pendingMember := range change.AddPendingMembers {
+		group.removePendingMember(pendingMember.UserId)
+		group.PendingMembers = append(group.PendingMembers, pendingMember)
+	}
+	// Accepted invites keep the role they were invited with
+	for _, promoted := range change.PromotePendingMembers {
+		role := GroupMember_DEFAULT
+		if pendingMember := group.removePendingMember(promoted.UserId); pendingMember != nil {
+			role = pendingMember.Role
+		}
+		group.addMember(&GroupMember{
+			UserId:           promoted.UserId,
+			Role:             role,
+			ProfileKey:       promoted.ProfileKey,
+			JoinedAtRevision: change.Revision,
+		})
+	}
+	for _, userID := range change.DeletePendingMembers {
+		group.removePendingMember(userID)
+	}
+	for _, requestingMember := range change.AddRequestingMembers {
+		group.removeRequestingMember(requestingMember.UserId)
+		group.RequestingMembers = append(group.RequestingMembers, requestingMember)
+	}
+	for _, promoted := range change.PromoteRequestingMembers {
+		member := &GroupMember{
+			UserId:           promoted.UserId,
+			Role:             promoted.Role,
+			JoinedAtRevision: change.Revision,
+		}
+		if requestingMember := group.removeRequestingMember(promoted.UserId); requestingMember != nil {
+			member.ProfileKey = requestingMember.ProfileKey
+		}
+		group.addMember(member)
+	}
+	for _, userID := range change.DeleteRequestingMembers {
+		group.removeRequestingMember(userID)
+	}
+	for _, bannedMember := range change.AddBannedMembers {
+		group.removeBannedMember(bannedMember.UserId)
+		group.BannedMembers = append(group.BannedMembers, bannedMember)
+	}
+	for _, userID := range change.DeleteBannedMembers {
+		group.removeBannedMember(userID)
+	}
+	if change.ModifyTitle != nil {
+		group.Title = *change.ModifyTitle
+	}
+	if change.ModifyDescription != nil {
+		group.Description = *change.ModifyDescription
+	}
+	if change.ModifyAvatar != nil {
+		group.Avatar = *change.ModifyAvatar
+	}
+	if change.ModifyDisappearingMessagesTimer != nil {
+		group.DisappearingMessagesTimer = *change.ModifyDisappearingMessagesTimer
+	}
+	if change.ModifyAnnouncementsOnly != nil {
+		group.AnnouncementsOnly = *change.ModifyAnnouncementsOnly
+	}
+	if change.ModifyAttributesAccess != nil || change.ModifyMemberAccess != nil || change.ModifyAddFromInviteLinkAccess != nil {
+		if group.AccessControl == nil {
+			group.AccessControl = &GroupAccessControl{}
+		}
+		if change.ModifyAttributesAccess != nil {
+			group.AccessControl.Attributes = *change.ModifyAttributesAccess
+		}
+		if change.ModifyMemberAccess != nil {
+			group.AccessControl.Members = *change.ModifyMemberAccess
+		}
+		if change.ModifyAddFromInviteLinkAccess != nil {
+			group.AccessControl.AddFromInviteLink = *change.ModifyAddFromInviteLinkAccess
+		}
+	}
+	if change.ModifyInviteLinkPassword != nil {
+		group.InviteLinkPassword = change.ModifyInviteLinkPassword
+	}
+	group.Revision = change.Revision
+}
+
+// Fetches every change to the group from fromRevision onwards, following the server's pagination
+func fetchGroupChanges(ctx context.Context, d *Device, groupID GroupID, fromRevision uint32) ([]*GroupChange, error) {
+	masterKey := masterKeyFromGroupID(groupID)
+	groupAuth, err := GetAuthorizationForToday(ctx, d, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	opts := &web.HTTPReqOpt{Username: &groupAuth.Username, Password: &groupAuth.Password, RequestPB: true, Host: web.StorageUrlHost}
+
+	var changes []*GroupChange
+	for {
+		path := fmt.Sprintf("/v1/groups/logs/%d?maxSupportedChangeEpoch=%d&includeFirstState=false&includeLastState=false", fromRevision, maxSupportedGroupChangeEpoch)
+		response, err := web.SendHTTPRequest("GET", path, opts)
+		if err != nil {
+			log.Printf("fetchGroupChanges SendHTTPRequest error: %v", err)
+			return nil, err
+		}
+		// 206 means there are more changes than fit in one response
+		if response.StatusCode != 200 && response.StatusCode != 206 {
+			return nil, fmt.Errorf("fetchGroupChanges SendHTTPRequest bad status: %v", response.StatusCode)
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		encryptedChanges := &signalpb.GroupChanges{}
+		err = proto.Unmarshal(body, encryptedChanges)
+		if err != nil {
+			return nil, err
+		}
+		for _, changeState := range encryptedChanges.GetGroupChanges() {
+			if changeState.GetGroupChange() == nil {
+				continue
+			}
+			change, err := decryptGroupChange(changeState.GetGroupChange(), groupID, false)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+		}
+		if response.StatusCode == 200 || len(changes) == 0 || changes[len(changes)-1].Revision < fromRevision {
+			break
+		}
+		fromRevision = changes[len(changes)-1].Revision + 1
+	}
+	return changes, nil
+}
+
+// Sends a change to the server, applies it to the cached group and tells the other members about it
+func patchGroup(ctx context.Context, d *Device, groupID GroupID, actions *signalpb.GroupChange_Actions) (*GroupChange, error) {
+	group, err := RetrieveGroupByID(ctx, d, groupID)
+	if err != nil {
+		return nil, err
+	}
+	actions.Revision = group.Revision + 1
+	actionsBytes, err := proto.Marshal(actions)
+	if err != nil {
+		return nil, err
+	}
+	groupAuth, err := GetAuthorizationForToday(ctx, d, masterKeyFromGroupID(groupID))
+	if err != nil {
+		return nil, err
+	}
+	opts := &web.HTTPReqOpt{Body: actionsBytes, Username: &groupAuth.Username, Password: &groupAuth.Password, RequestPB: true, Host: web.StorageUrlHost}
+	response, err := web.SendHTTPRequest("PATCH", "/v1/groups", opts)
+	if err != nil {
+		log.Printf("patchGroup SendHTTPRequest error: %v", err)
+		return nil, err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case 200:
+	case 403:
+		return nil, ErrGroupChangeForbidden
+	case 409:
+		// Someone else got that revision first, so our copy of the group is outdated
+		groupCache(d).invalidate(groupID)
+		return nil, ErrGroupChangeConflict
+	default:
+		return nil, fmt.Errorf("patchGroup SendHTTPRequest bad status: %v", response.StatusCode)
+	}
+	signedChangeBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	signedChange := &signalpb.GroupChange{}
+	err = proto.Unmarshal(signedChangeBytes, signedChange)
+	if err != nil {
+		return nil, err
+	}
+	change, err := decryptGroupChange(signedChange, groupID, false)
+	if err != nil {
+		return nil, err
+	}
+	groupCache(d).applyChanges(groupID, []*GroupChange{change})
+	storeGroupChangeProfileKeys(ctx, d, change)
+
+	// Other members only find out about the change from a message that carries it
+	timestamp := currentMessageTimestamp()
+	content := contentFromDataMessage(&signalpb.DataMessage{
+		Timestamp: &timestamp,
+		GroupV2:   &signalpb.GroupContextV2{GroupChange: signedChangeBytes},
+	})
+	_, err = sendGroupMessage(ctx, d, groupID, content, nil)
+	if err != nil {
+		log.Printf("Failed to send group change to members: %v", err)
+	}
+	// Removed members aren't in the group anymore, so they need their own copy to find out
+	var removed []string
+	for _, userID := range change.DeleteMembers {
+		if userID != d.Data.AciUuid {
+			removed = append(removed, userID)
+		}
+	}
+	if len(removed) > 0 && err == nil {
+		_, failed := sendToRecipients(ctx, d, removed, timestamp, content)
+		for _, failure := range failed {
+			log.Printf("Failed to send group change to removed member %s: %v", failure.RecipientUuid, failure.Error)
+		}
+	}
+	return change, nil
+}
+
+// Brings the cached group up to date with the revision in a message, and returns the changes
+// that got it there so they can be bridged. Falls back to fetching the whole group.
+func updateGroupFromContext(ctx context.Context, d *Device, groupContext *signalpb.GroupContextV2) ([]*GroupChange, error) {
+	cache := groupCache(d)
+	groupID := groupIDFromMasterKey(libsignalgo.GroupMasterKey(groupContext.GetMasterKey()))
+	revision := groupContext.GetRevision()
+
+	// A change that comes with the message only needs to be checked and decrypted
+	var messageChange *GroupChange
+	if len(groupContext.GetGroupChange()) > 0 {
+		encryptedChange := &signalpb.GroupChange{}
+		err := proto.Unmarshal(groupContext.GetGroupChange(), encryptedChange)
+		if err == nil {
+			messageChange, err = decryptGroupChange(encryptedChange, groupID, true)
+		}
+		if err != nil {
+			log.Printf("Couldn't decrypt group change in message: %v", err)
+			messageChange = nil
+		}
+	}
+
+	cache.lock.RLock()
+	group, ok := cache.groups[string(groupID)]
+	cache.lock.RUnlock()
+	if !ok {
+		// Nothing to apply the change to, so get the whole group (which already includes it)
+		_, err := RetrieveGroupByID(ctx, d, groupID)
+		if err != nil || messageChange == nil {
+			return nil, err
+		}
+		return []*GroupChange{messageChange}, nil
+	}
+	if revision <= group.Revision {
+		return nil, nil
+	}
+
+	var changes []*GroupChange
+	if messageChange != nil && messageChange.Revision == group.Revision+1 && revision == messageChange.Revision {
+		changes = []*GroupChange{messageChange}
+	} else {
+		// We missed some changes, get them from the server
+		var err error
+		changes, err = fetchGroupChanges(ctx, d, groupID, group.Revision+1)
+		if err != nil {
+			log.Printf("fetchGroupChanges error, refetching whole group: %v", err)
+			cache.invalidate(groupID)
+			_, err = RetrieveGroupByID(ctx, d, groupID)
+			return nil, err
+		}
+	}
+
+	// Another goroutine may have applied some of these already, so only the ones it skips are new
+	applied := cache.applyChanges(groupID, changes)
+	for _, change := range applied {
+		storeGroupChangeProfileKeys(ctx, d, change)
+	}
+	return applied, nil
+}
+
+// Store the profile keys in case they're new
+func storeGroupChangeProfileKeys(ctx context.Context, d *Device, change *GroupChange) {
+	var members []*GroupMember
+	members = append(members, change.AddMembers...)
+	members = append(members, change.ModifyMemberProfileKeys...)
+	members = append(members, change.PromotePendingMembers...)
+	for _, requestingMember := range change.AddRequestingMembers {
+		members = append(members, &GroupMember{UserId: requestingMember.UserId, ProfileKey: requestingMember.ProfileKey})
+	}
+	for _, member := range members {
+		if member.ProfileKey == (libsignalgo.ProfileKey{}) {
+			continue
+		}
+		err := d.ProfileKeyStore.StoreProfileKey(member.UserId, member.ProfileKey, ctx)
+		if err != nil {
+			log.Printf("StoreProfileKey error: %v", err)
+		}
+	}
+}
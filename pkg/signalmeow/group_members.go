@@ -0,0 +1,237 @@
+package signalmeow
+
+import (
+	"context"
+	"log"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func encryptUserID(groupSecretParams libsignalgo.GroupSecretParams, userID string) ([]byte, error) {
+	uuid, err := convertUUIDToByteUUID(userID)
+	if err != nil {
+		return nil, err
+	}
+	encryptedUserID, err := groupSecretParams.EncryptUUID(*uuid)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedUserID[:], nil
+}
+
+func (group *Group) findPendingMember(userID string) *PendingMember {
+	for _, pendingMember := range group.PendingMembers {
+		if pendingMember.UserId == userID {
+			return pendingMember
+		}
+	}
+	return nil
+}
+
+func (group *Group) findRequestingMember(userID string) *RequestingMember {
+	for _, requestingMember := range group.RequestingMembers {
+		if requestingMember.UserId == userID {
+			return requestingMember
+		}
+	}
+	return nil
+}
+
+func (group *Group) isBanned(userID string) bool {
+	for _, bannedMember := range group.BannedMembers {
+		if bannedMember.UserId == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// AddGroupMember adds the user to the group, or approves their join request if they've asked to join.
+// Users whose profile key we don't know can't be added directly, so they're invited instead.
+func AddGroupMember(ctx context.Context, d *Device, groupID GroupID, userID string) (*GroupChange, error) {
+	group, err := RetrieveGroupByID(ctx, d, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if _, member := group.findMember(userID); member != nil {
+		return nil, nil
+	}
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyFromGroupID(groupID))
+	if err != nil {
+		return nil, err
+	}
+	encryptedUserID, err := encryptUserID(groupSecretParams, userID)
+	if err != nil {
+		return nil, err
+	}
+	actions := &signalpb.GroupChange_Actions{}
+	if group.isBanned(userID) {
+		if !group.IsAdmin(d.Data.AciUuid) {
+			return nil, ErrGroupChangeForbidden
+		}
+		actions.DeleteBannedMembers = []*signalpb.GroupChange_Actions_DeleteBannedMemberAction{{DeletedUserId: encryptedUserID}}
+	}
+	if group.findRequestingMember(userID) != nil {
+		if !group.IsAdmin(d.Data.AciUuid) {
+			return nil, ErrGroupChangeForbidden
+		}
+		actions.PromoteRequestingMembers = []*signalpb.GroupChange_Actions_PromoteRequestingMemberAction{{
+			UserId: encryptedUserID,
+			Role:   signalpb.Member_DEFAULT,
+		}}
+		return patchGroup(ctx, d, groupID, actions)
+	}
+	if group.findPendingMember(userID) != nil {
+		// They've already been invited and only they can accept it, but a ban would stop them from joining
+		if len(actions.DeleteBannedMembers) > 0 {
+			return patchGroup(ctx, d, groupID, actions)
+		}
+		return nil, nil
+	}
+	if !group.HasAccess(d.Data.AciUuid, group.MembersAccess()) {
+		return nil, ErrGroupChangeForbidden
+	}
+
+	credential, err := profileKeyCredentialForSignalID(ctx, d, userID)
+	if err != nil {
+		log.Printf("Couldn't get profile key credential for %s, inviting instead: %v", userID, err)
+	}
+	if credential != nil {
+		presentation, err := libsignalgo.CreateExpiringProfileKeyCredentialPresentation(serverPublicParams(), groupSecretParams, *credential)
+		if err != nil {
+			return nil, err
+		}
+		actions.AddMembers = []*signalpb.GroupChange_Actions_AddMemberAction{{
+			Added: &signalpb.Member{Role: signalpb.Member_DEFAULT, Presentation: presentation},
+		}}
+	} else {
+		actions.AddPendingMembers = []*signalpb.GroupChange_Actions_AddPendingMemberAction{{
+			Added: &signalpb.PendingMember{Member: &signalpb.Member{UserId: encryptedUserID, Role: signalpb.Member_DEFAULT}},
+		}}
+	}
+	return patchGroup(ctx, d, groupID, actions)
+}
+
+// RemoveGroupMember removes a member, revokes an invite or denies a join request, depending on what the user is in the group
+func RemoveGroupMember(ctx context.Context, d *Device, groupID GroupID, userID string) (*GroupChange, error) {
+	group, err := RetrieveGroupByID(ctx, d, groupID)
+	if err != nil {
+		return nil, err
+	}
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyFromGroupID(groupID))
+	if err != nil {
+		return nil, err
+	}
+	encryptedUserID, err := encryptUserID(groupSecretParams, userID)
+	if err != nil {
+		return nil, err
+	}
+	// Anyone can leave and members can revoke their own invites, everything else is for admins
+	isAdmin := group.IsAdmin(d.Data.AciUuid)
+	actions := &signalpb.GroupChange_Actions{}
+	if _, member := group.findMember(userID); member != nil {
+		if userID != d.Data.AciUuid && !isAdmin {
+			return nil, ErrGroupChangeForbidden
+		}
+		actions.DeleteMembers = []*signalpb.GroupChange_Actions_DeleteMemberAction{{DeletedUserId: encryptedUserID}}
+	} else if pendingMember := group.findPendingMember(userID); pendingMember != nil {
+		if pendingMember.AddedByUserId != d.Data.AciUuid && !isAdmin {
+			return nil, ErrGroupChangeForbidden
+		}
+		actions.DeletePendingMembers = []*signalpb.GroupChange_Actions_DeletePendingMemberAction{{DeletedUserId: encryptedUserID}}
+	} else if group.findRequestingMember(userID) != nil {
+		if !isAdmin {
+			return nil, ErrGroupChangeForbidden
+		}
+		actions.DeleteRequestingMembers = []*signalpb.GroupChange_Actions_DeleteRequestingMemberAction{{DeletedUserId: encryptedUserID}}
+	} else {
+		return nil, nil
+	}
+	return patchGroup(ctx, d, groupID, actions)
+}
+
+// BanGroupMember bans the user and removes them from the group if they're in it
+func BanGroupMember(ctx context.Context, d *Device, groupID GroupID, userID string) (*GroupChange, error) {
+	group, err := RetrieveGroupByID(ctx, d, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !group.IsAdmin(d.Data.AciUuid) {
+		return nil, ErrGroupChangeForbidden
+	} else if group.isBanned(userID) {
+		return nil, nil
+	}
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyFromGroupID(groupID))
+	if err != nil {
+		return nil, err
+	}
+	encryptedUserID, err := encryptUserID(groupSecretParams, userID)
+	if err != nil {
+		return nil, err
+	}
+	actions := &signalpb.GroupChange_Actions{
+		AddBannedMembers: []*signalpb.GroupChange_Actions_AddBannedMemberAction{{
+			Added: &signalpb.BannedMember{UserId: encryptedUserID},
+		}},
+	}
+	if _, member := group.findMember(userID); member != nil {
+		actions.DeleteMembers = []*signalpb.GroupChange_Actions_DeleteMemberAction{{DeletedUserId: encryptedUserID}}
+	} else if group.findPendingMember(userID) != nil {
+		actions.DeletePendingMembers = []*signalpb.GroupChange_Actions_DeletePendingMemberAction{{DeletedUserId: encryptedUserID}}
+	} else if group.findRequestingMember(userID) != nil {
+		actions.DeleteRequestingMembers = []*signalpb.GroupChange_Actions_DeleteRequestingMemberAction{{DeletedUserId: encryptedUserID}}
+	}
+	return patchGroup(ctx, d, groupID, actions)
+}
+
+func UnbanGroupMember(ctx context.Context, d *Device, groupID GroupID, userID string) (*GroupChange, error) {
+	group, err := RetrieveGroupByID(ctx, d, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !group.IsAdmin(d.Data.AciUuid) {
+		return nil, ErrGroupChangeForbidden
+	} else if !group.isBanned(userID) {
+		return nil, nil
+	}
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyFromGroupID(groupID))
+	if err != nil {
+		return nil, err
+	}
+	encryptedUserID, err := encryptUserID(groupSecretParams, userID)
+	if err != nil {
+		return nil, err
+	}
+	return patchGroup(ctx, d, groupID, &signalpb.GroupChange_Actions{
+		DeleteBannedMembers: []*signalpb.GroupChange_Actions_DeleteBannedMemberAction{{DeletedUserId: encryptedUserID}},
+	})
+}
+
+func UpdateGroupMemberRole(ctx context.Context, d *Device, groupID GroupID, userID string, role GroupMemberRole) (*GroupChange, error) {
+	group, err := RetrieveGroupByID(ctx, d, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !group.IsAdmin(d.Data.AciUuid) {
+		return nil, ErrGroupChangeForbidden
+	}
+	_, member := group.findMember(userID)
+	if member == nil || member.Role == role {
+		return nil, nil
+	}
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyFromGroupID(groupID))
+	if err != nil {
+		return nil, err
+	}
+	encryptedUserID, err := encryptUserID(groupSecretParams, userID)
+	if err != nil {
+		return nil, err
+	}
+	return patchGroup(ctx, d, groupID, &signalpb.GroupChange_Actions{
+		ModifyMemberRoles: []*signalpb.GroupChange_Actions_ModifyMemberRoleAction{{
+			UserId: encryptedUserID,
+			Role:   signalpb.Member_Role(role),
+		}},
+	})
+}
@@ -0,0 +1,120 @@
+package signalmeow
+
+import (
+	"context"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"google.golang.org/protobuf/proto"
+)
+
+func encryptGroupAttributeBlob(groupID GroupID, blob *signalpb.GroupAttributeBlob) ([]byte, error) {
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyFromGroupID(groupID))
+	if err != nil {
+		return nil, err
+	}
+	blobBytes, err := proto.Marshal(blob)
+	if err != nil {
+		return nil, err
+	}
+	return groupSecretParams.EncryptBlobWithPadding(blobBytes, 0)
+}
+
+// Fails early with ErrGroupChangeForbidden instead of waiting for the server to refuse the change
+func groupWithAccess(ctx context.Context, d *Device, groupID GroupID, requiredAccess func(group *Group) AccessControl) (*Group, error) {
+	group, err := RetrieveGroupByID(ctx, d, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !group.HasAccess(d.Data.AciUuid, requiredAccess(group)) {
+		return nil, ErrGroupChangeForbidden
+	}
+	return group, nil
+}
+
+func attributesAccess(group *Group) AccessControl {
+	return group.AttributesAccess()
+}
+
+func adminAccess(group *Group) AccessControl {
+	return AccessControl_ADMINISTRATOR
+}
+
+func UpdateGroupTitle(ctx context.Context, d *Device, groupID GroupID, title string) (*GroupChange, error) {
+	_, err := groupWithAccess(ctx, d, groupID, attributesAccess)
+	if err != nil {
+		return nil, err
+	}
+	encryptedTitle, err := encryptGroupAttributeBlob(groupID, &signalpb.GroupAttributeBlob{Content: &signalpb.GroupAttributeBlob_Title{Title: title}})
+	if err != nil {
+		return nil, err
+	}
+	return patchGroup(ctx, d, groupID, &signalpb.GroupChange_Actions{
+		ModifyTitle: &signalpb.GroupChange_Actions_ModifyTitleAction{Title: encryptedTitle},
+	})
+}
+
+func UpdateGroupDescription(ctx context.Context, d *Device, groupID GroupID, description string) (*GroupChange, error) {
+	_, err := groupWithAccess(ctx, d, groupID, attributesAccess)
+	if err != nil {
+		return nil, err
+	}
+	encryptedDescription, err := encryptGroupAttributeBlob(groupID, &signalpb.GroupAttributeBlob{Content: &signalpb.GroupAttributeBlob_Description{Description: description}})
+	if err != nil {
+		return nil, err
+	}
+	return patchGroup(ctx, d, groupID, &signalpb.GroupChange_Actions{
+		ModifyDescription: &signalpb.GroupChange_Actions_ModifyDescriptionAction{Description: encryptedDescription},
+	})
+}
+
+// UpdateGroupDisappearingTimer sets the group's disappearing message timer in seconds, 0 turns it off
+func UpdateGroupDisappearingTimer(ctx context.Context, d *Device, groupID GroupID, timer uint32) (*GroupChange, error) {
+	_, err := groupWithAccess(ctx, d, groupID, attributesAccess)
+	if err != nil {
+		return nil, err
+	}
+	encryptedTimer, err := encryptGroupAttributeBlob(groupID, &signalpb.GroupAttributeBlob{Content: &signalpb.GroupAttributeBlob_DisappearingMessagesDuration{DisappearingMessagesDuration: timer}})
+	if err != nil {
+		return nil, err
+	}
+	return patchGroup(ctx, d, groupID, &signalpb.GroupChange_Actions{
+		ModifyDisappearingMessagesTimer: &signalpb.GroupChange_Actions_ModifyDisappearingMessagesTimerAction{Timer: encryptedTimer},
+	})
+}
+
+// UpdateGroupAnnouncementsOnly changes whether only admins can send messages
+func UpdateGroupAnnouncementsOnly(ctx context.Context, d *Device, groupID GroupID, announcementsOnly bool) (*GroupChange, error) {
+	_, err := groupWithAccess(ctx, d, groupID, adminAccess)
+	if err != nil {
+		return nil, err
+	}
+	return patchGroup(ctx, d, groupID, &signalpb.GroupChange_Actions{
+		ModifyAnnouncementsOnly: &signalpb.GroupChange_Actions_ModifyAnnouncementsOnlyAction{AnnouncementsOnly: announcementsOnly},
+	})
+}
+
+// UpdateGroupAccessControl changes who can do what in the group, fields left as AccessControl_UNKNOWN aren't changed
+func UpdateGroupAccessControl(ctx context.Context, d *Device, groupID GroupID, accessControl GroupAccessControl) (*GroupChange, error) {
+	_, err := groupWithAccess(ctx, d, groupID, adminAccess)
+	if err != nil {
+		return nil, err
+	}
+	actions := &signalpb.GroupChange_Actions{}
+	if accessControl.Attributes != AccessControl_UNKNOWN {
+		actions.ModifyAttributesAccess = &signalpb.GroupChange_Actions_ModifyAttributesAccessControlAction{
+			AttributesAccess: signalpb.AccessControl_AccessRequired(accessControl.Attributes),
+		}
+	}
+	if accessControl.Members != AccessControl_UNKNOWN {
+		actions.ModifyMemberAccess = &signalpb.GroupChange_Actions_ModifyMembersAccessControlAction{
+			MembersAccess: signalpb.AccessControl_AccessRequired(accessControl.Members),
+		}
+	}
+	if accessControl.AddFromInviteLink != AccessControl_UNKNOWN {
+		actions.ModifyAddFromInviteLinkAccess = &signalpb.GroupChange_Actions_ModifyAddFromInviteLinkAccessControlAction{
+			AddFromInviteLinkAccess: signalpb.AccessControl_AccessRequired(accessControl.AddFromInviteLink),
+		}
+	}
+	return patchGroup(ctx, d, groupID, actions)
+}
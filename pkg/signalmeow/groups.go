@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"sync"
 	"time"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
@@ -33,22 +34,101 @@ type GroupMember struct {
 	JoinedAtRevision uint32
 	//Presentation     []byte
 }
+
+// Someone who was invited but hasn't accepted yet
+type PendingMember struct {
+	UserId        string // ACI or PNI of the invited user
+	Role          GroupMemberRole
+	AddedByUserId string
+	Timestamp     uint64
+}
+
+// Someone who asked to join with an invite link and is waiting for an admin to approve
+type RequestingMember struct {
+	UserId     string
+	ProfileKey libsignalgo.ProfileKey
+	Timestamp  uint64
+}
+
+type BannedMember struct {
+	UserId    string
+	Timestamp uint64
+}
+
+type AccessControl int32
+
+const (
+	// Note: right now we assume these match the equivalent values in the protobuf (signalpb.AccessControl_AccessRequired)
+	AccessControl_UNKNOWN       AccessControl = 0
+	AccessControl_ANY           AccessControl = 1
+	AccessControl_MEMBER        AccessControl = 2
+	AccessControl_ADMINISTRATOR AccessControl = 3
+	AccessControl_UNSATISFIABLE AccessControl = 4
+)
+
+type GroupAccessControl struct {
+	Attributes        AccessControl // Who can change the title, description, avatar and timer
+	Members           AccessControl // Who can add members
+	AddFromInviteLink AccessControl // ANY joins directly, ADMINISTRATOR needs approval, UNSATISFIABLE disables the link
+}
+
 type Group struct {
 	GroupID GroupID
 
-	Title             string
-	Avatar            string
-	Members           []*GroupMember
-	Description       string
-	AnnouncementsOnly bool
-	Revision          uint32
+	Title                     string
+	Avatar                    string
+	Members                   []*GroupMember
+	Description               string
+	AnnouncementsOnly         bool
+	Revision                  uint32
+	DisappearingMessagesTimer uint32 // In seconds, 0 if messages don't disappear
+	AccessControl             *GroupAccessControl
+	PendingMembers            []*PendingMember
+	RequestingMembers         []*RequestingMember
+	InviteLinkPassword        []byte
+	BannedMembers             []*BannedMember
 	//PublicKey                 *libsignalgo.PublicKey
-	//DisappearingMessagesTimer []byte
-	//AccessControl             *AccessControl
-	//PendingMembers            []*PendingMember
-	//RequestingMembers         []*RequestingMember
-	//InviteLinkPassword        []byte
-	//BannedMembers             []*BannedMember
+}
+
+func (group *Group) memberRole(userID string) GroupMemberRole {
+	for _, member := range group.Members {
+		if member.UserId == userID {
+			return member.Role
+		}
+	}
+	return GroupMember_UNKNOWN
+}
+
+func (group *Group) IsAdmin(userID string) bool {
+	return group.memberRole(userID) == GroupMember_ADMINISTRATOR
+}
+
+// Whether the user has the access level needed for something, e.g. AttributesAccess() for changing the title
+func (group *Group) HasAccess(userID string, required AccessControl) bool {
+	switch required {
+	case AccessControl_ANY, AccessControl_MEMBER:
+		return group.memberRole(userID) != GroupMember_UNKNOWN
+	case AccessControl_ADMINISTRATOR:
+		return group.IsAdmin(userID)
+	default:
+		return false
+	}
+}
+
+// Who can change the title, description, avatar and timer
+func (group *Group) AttributesAccess() AccessControl {
+	if group.AccessControl == nil || group.AccessControl.Attributes == AccessControl_UNKNOWN {
+		return AccessControl_MEMBER
+	}
+	return group.AccessControl.Attributes
+}
+
+// Who can add and invite members
+func (group *Group) MembersAccess() AccessControl {
+	if group.AccessControl == nil || group.AccessControl.Members == AccessControl_UNKNOWN {
+		return AccessControl_MEMBER
+	}
+	return group.AccessControl.Members
 }
 
 type GroupAuth struct {
@@ -199,9 +279,27 @@ func groupIDFromMasterKey(masterKey libsignalgo.GroupMasterKey) GroupID {
 	return GroupID(base64.StdEncoding.EncodeToString(masterKey[:]))
 }
 
+// The group identifier is what Signal itself uses to refer to a group in places
+// that can't include the master key, like typing messages
+func groupIdentifierFromGroupID(groupID GroupID) (*libsignalgo.GroupIdentifier, error) {
+	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyFromGroupID(groupID))
+	if err != nil {
+		return nil, err
+	}
+	groupPublicParams, err := groupSecretParams.GetPublicParams()
+	if err != nil {
+		return nil, err
+	}
+	return groupPublicParams.GetGroupIdentifier()
+}
+
 func decryptGroup(encryptedGroup *signalpb.Group, groupID GroupID) (*Group, error) {
 	decryptedGroup := &Group{
-		GroupID: groupID,
+		GroupID:            groupID,
+		Revision:           encryptedGroup.Revision,
+		AnnouncementsOnly:  encryptedGroup.AnnouncementsOnly,
+		AccessControl:      accessControlFromProto(encryptedGroup.AccessControl),
+		InviteLinkPassword: encryptedGroup.InviteLinkPassword,
 	}
 
 	groupSecretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKeyFromGroupID(groupID))
@@ -210,12 +308,16 @@ func decryptGroup(encryptedGroup *signalpb.Group, groupID GroupID) (*Group, erro
 		return nil, err
 	}
 
-	title, err := groupSecretParams.DecryptBlobWithPadding(encryptedGroup.Title)
+	decryptedGroup.Title, err = decryptGroupTitle(groupSecretParams, encryptedGroup.Title)
+	if err != nil {
+		log.Printf("decryptGroupTitle error: %v", err)
+		return nil, err
+	}
+	decryptedGroup.Description, err = decryptGroupDescription(groupSecretParams, encryptedGroup.Description)
 	if err != nil {
-		log.Printf("DecryptBlobWithPadding Title error: %v", err)
+		log.Printf("decryptGroupDescription error: %v", err)
 		return nil, err
 	}
-	decryptedGroup.Title = string(title)
 
 	// TODO: Not sure how to decrypt avatar yet
 	//avatarBytes, err := base64.StdEncoding.DecodeString(encryptedGroup.Avatar)
@@ -233,29 +335,186 @@ func decryptGroup(encryptedGroup *signalpb.Group, groupID GroupID) (*Group, erro
 		if member == nil {
 			continue
 		}
-		encryptedUserID := libsignalgo.UUIDCiphertext(member.UserId)
-		userID, err := groupSecretParams.DecryptUUID(encryptedUserID)
+		decryptedMember, err := decryptMember(groupSecretParams, member)
 		if err != nil {
-			log.Printf("DecryptUUID UserId error: %v", err)
 			return nil, err
 		}
-		encryptedProfileKey := libsignalgo.ProfileKeyCiphertext(member.ProfileKey)
-		profileKey, err := groupSecretParams.DecryptProfileKey(encryptedProfileKey, *userID)
+		decryptedGroup.Members = append(decryptedGroup.Members, decryptedMember)
+	}
+	decryptedGroup.DisappearingMessagesTimer, err = decryptGroupTimer(groupSecretParams, encryptedGroup.DisappearingMessagesTimer)
+	if err != nil {
+		log.Printf("decryptGroupTimer error: %v", err)
+		return nil, err
+	}
+	for _, pendingMember := range encryptedGroup.PendingMembers {
+		decryptedPendingMember, err := decryptPendingMember(groupSecretParams, pendingMember)
 		if err != nil {
-			log.Printf("DecryptProfileKey ProfileKey error: %v", err)
+			log.Printf("decryptPendingMember error: %v", err)
+			return nil, err
+		}
+		decryptedGroup.PendingMembers = append(decryptedGroup.PendingMembers, decryptedPendingMember)
+	}
+	for _, requestingMember := range encryptedGroup.RequestingMembers {
+		decryptedRequestingMember, err := decryptRequestingMember(groupSecretParams, requestingMember)
+		if err != nil {
+			log.Printf("decryptRequestingMember error: %v", err)
+			return nil, err
+		}
+		decryptedGroup.RequestingMembers = append(decryptedGroup.RequestingMembers, decryptedRequestingMember)
+	}
+	for _, bannedMember := range encryptedGroup.BannedMembers {
+		decryptedBannedMember, err := decryptBannedMember(groupSecretParams, bannedMember)
+		if err != nil {
+			log.Printf("decryptBannedMember error: %v", err)
 			return nil, err
 		}
-		decryptedGroup.Members = append(decryptedGroup.Members, &GroupMember{
-			UserId:           convertByteUUIDToUUID(*userID),
-			ProfileKey:       *profileKey,
-			Role:             GroupMemberRole(member.Role),
-			JoinedAtRevision: member.JoinedAtRevision,
-		})
+		decryptedGroup.BannedMembers = append(decryptedGroup.BannedMembers, decryptedBannedMember)
 	}
 
 	return decryptedGroup, nil
 }
 
+func accessControlFromProto(accessControl *signalpb.AccessControl) *GroupAccessControl {
+	if accessControl == nil {
+		return nil
+	}
+	return &GroupAccessControl{
+		Attributes:        AccessControl(accessControl.Attributes),
+		Members:           AccessControl(accessControl.Members),
+		AddFromInviteLink: AccessControl(accessControl.AddFromInviteLink),
+	}
+}
+
+func decryptUserID(groupSecretParams libsignalgo.GroupSecretParams, encryptedUserID []byte) (string, error) {
+	if len(encryptedUserID) != len(libsignalgo.UUIDCiphertext{}) {
+		return "", fmt.Errorf("bad encrypted user ID length %d", len(encryptedUserID))
+	}
+	userID, err := groupSecretParams.DecryptUUID(libsignalgo.UUIDCiphertext(encryptedUserID))
+	if err != nil {
+		return "", err
+	}
+	return convertByteUUIDToUUID(*userID), nil
+}
+
+func decryptProfileKey(groupSecretParams libsignalgo.GroupSecretParams, encryptedProfileKey []byte, userID string) (*libsignalgo.ProfileKey, error) {
+	if len(encryptedProfileKey) != len(libsignalgo.ProfileKeyCiphertext{}) {
+		return nil, fmt.Errorf("bad encrypted profile key length %d", len(encryptedProfileKey))
+	}
+	uuidBytes, err := convertUUIDToByteUUID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return groupSecretParams.DecryptProfileKey(libsignalgo.ProfileKeyCiphertext(encryptedProfileKey), *uuidBytes)
+}
+
+func decryptMember(groupSecretParams libsignalgo.GroupSecretParams, member *signalpb.Member) (*GroupMember, error) {
+	userID, err := decryptUserID(groupSecretParams, member.UserId)
+	if err != nil {
+		log.Printf("DecryptUUID UserId error: %v", err)
+		return nil, err
+	}
+	decryptedMember := &GroupMember{
+		UserId:           userID,
+		Role:             GroupMemberRole(member.Role),
+		JoinedAtRevision: member.JoinedAtRevision,
+	}
+	// Invited members don't have a profile key until they accept
+	if len(member.ProfileKey) > 0 {
+		profileKey, err := decryptProfileKey(groupSecretParams, member.ProfileKey, userID)
+		if err != nil {
+			log.Printf("DecryptProfileKey ProfileKey error: %v", err)
+			return nil, err
+		}
+		decryptedMember.ProfileKey = *profileKey
+	}
+	return decryptedMember, nil
+}
+
+func decryptPendingMember(groupSecretParams libsignalgo.GroupSecretParams, pendingMember *signalpb.PendingMember) (*PendingMember, error) {
+	userID, err := decryptUserID(groupSecretParams, pendingMember.GetMember().GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	addedBy, err := decryptUserID(groupSecretParams, pendingMember.GetAddedByUserId())
+	if err != nil {
+		return nil, err
+	}
+	return &PendingMember{
+		UserId:        userID,
+		Role:          GroupMemberRole(pendingMember.GetMember().GetRole()),
+		AddedByUserId: addedBy,
+		Timestamp:     pendingMember.GetTimestamp(),
+	}, nil
+}
+
+func decryptRequestingMember(groupSecretParams libsignalgo.GroupSecretParams, requestingMember *signalpb.RequestingMember) (*RequestingMember, error) {
+	userID, err := decryptUserID(groupSecretParams, requestingMember.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	profileKey, err := decryptProfileKey(groupSecretParams, requestingMember.GetProfileKey(), userID)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestingMember{
+		UserId:     userID,
+		ProfileKey: *profileKey,
+		Timestamp:  requestingMember.GetTimestamp(),
+	}, nil
+}
+
+func decryptBannedMember(groupSecretParams libsignalgo.GroupSecretParams, bannedMember *signalpb.BannedMember) (*BannedMember, error) {
+	userID, err := decryptUserID(groupSecretParams, bannedMember.GetUserId())
+	if err != nil {
+		return nil, err
+	}
+	return &BannedMember{
+		UserId:    userID,
+		Timestamp: bannedMember.GetTimestamp(),
+	}, nil
+}
+
+// Titles, descriptions and timers are GroupAttributeBlobs, encrypted with the group secret params
+func decryptGroupAttributeBlob(groupSecretParams libsignalgo.GroupSecretParams, encryptedBlob []byte) (*signalpb.GroupAttributeBlob, error) {
+	blob := &signalpb.GroupAttributeBlob{}
+	if len(encryptedBlob) == 0 {
+		return blob, nil
+	}
+	decryptedBlob, err := groupSecretParams.DecryptBlobWithPadding(encryptedBlob)
+	if err != nil {
+		return nil, err
+	}
+	err = proto.Unmarshal(decryptedBlob, blob)
+	if err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+func decryptGroupTitle(groupSecretParams libsignalgo.GroupSecretParams, encryptedTitle []byte) (string, error) {
+	blob, err := decryptGroupAttributeBlob(groupSecretParams, encryptedTitle)
+	if err != nil {
+		return "", err
+	}
+	return blob.GetTitle(), nil
+}
+
+func decryptGroupTimer(groupSecretParams libsignalgo.GroupSecretParams, encryptedTimer []byte) (uint32, error) {
+	blob, err := decryptGroupAttributeBlob(groupSecretParams, encryptedTimer)
+	if err != nil {
+		return 0, err
+	}
+	return blob.GetDisappearingMessagesDuration(), nil
+}
+
+func decryptGroupDescription(groupSecretParams libsignalgo.GroupSecretParams, encryptedDescription []byte) (string, error) {
+	blob, err := decryptGroupAttributeBlob(groupSecretParams, encryptedDescription)
+	if err != nil {
+		return "", err
+	}
+	return blob.GetDescription(), nil
+}
+
 func printGroupMember(member *GroupMember) {
 	if member == nil {
 		log.Printf("GroupMember is nil")
@@ -327,34 +586,119 @@ func fetchGroupByID(ctx context.Context, d *Device, groupID GroupID) (*Group, er
 			//return nil, err
 		}
 	}
+	for _, member := range group.RequestingMembers {
+		err = d.ProfileKeyStore.StoreProfileKey(member.UserId, member.ProfileKey, ctx)
+		if err != nil {
+			log.Printf("DecryptGroup StoreProfileKey error: %v", err)
+		}
+	}
 	return group, nil
 }
 
+// The returned group is shared with other goroutines, so it must not be modified
 func RetrieveGroupByID(ctx context.Context, d *Device, groupID GroupID) (*Group, error) {
-	if d.Connection.GroupCache == nil {
-		d.Connection.GroupCache = &GroupCache{
-			groups:      make(map[string]*Group),
-			lastFetched: make(map[string]time.Time),
-		}
-	}
+	cache := groupCache(d)
 
-	lastFetched, ok := d.Connection.GroupCache.lastFetched[string(groupID)]
-	if ok && time.Since(lastFetched) < 1*time.Hour {
-		group, ok := d.Connection.GroupCache.groups[string(groupID)]
-		if ok {
-			return group, nil
-		}
+	cache.lock.RLock()
+	lastFetched, ok := cache.lastFetched[string(groupID)]
+	group := cache.groups[string(groupID)]
+	cache.lock.RUnlock()
+	if ok && group != nil && time.Since(lastFetched) < 1*time.Hour {
+		return group, nil
 	}
 	group, err := fetchGroupByID(ctx, d, groupID)
 	if err != nil {
 		return nil, err
 	}
-	d.Connection.GroupCache.groups[string(groupID)] = group
-	d.Connection.GroupCache.lastFetched[string(groupID)] = time.Now()
+	groupIdentifier, err := groupIdentifierFromGroupID(groupID)
+	if err != nil {
+		log.Printf("groupIdentifierFromGroupID error: %v", err)
+	}
+	cache.lock.Lock()
+	cache.groups[string(groupID)] = group
+	cache.lastFetched[string(groupID)] = time.Now()
+	if groupIdentifier != nil {
+		cache.groupIDsByIdentifier[*groupIdentifier] = groupID
+	}
+	cache.lock.Unlock()
 	return group, nil
 }
 
+// Only works for groups we've already fetched, since the identifier can't be turned back into a master key
+func groupIDForIdentifier(d *Device, groupIdentifier []byte) (GroupID, bool) {
+	cache := groupCache(d)
+	if len(groupIdentifier) != len(libsignalgo.GroupIdentifier{}) {
+		return "", false
+	}
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	groupID, ok := cache.groupIDsByIdentifier[libsignalgo.GroupIdentifier(groupIdentifier)]
+	return groupID, ok
+}
+
+func groupCache(d *Device) *GroupCache {
+	cacheInitLock.Lock()
+	defer cacheInitLock.Unlock()
+	if d.Connection.GroupCache == nil {
+		d.Connection.GroupCache = &GroupCache{
+			groups:               make(map[string]*Group),
+			lastFetched:          make(map[string]time.Time),
+			groupIDsByIdentifier: make(map[libsignalgo.GroupIdentifier]GroupID),
+		}
+	}
+	return d.Connection.GroupCache
+}
+
 type GroupCache struct {
-	groups      map[string]*Group
-	lastFetched map[string]time.Time
+	lock                 sync.RWMutex
+	groups               map[string]*Group
+	lastFetched          map[string]time.Time
+	groupIDsByIdentifier map[libsignalgo.GroupIdentifier]GroupID
+}
+
+// Makes the next RetrieveGroupByID fetch the group from the server
+func (cache *GroupCache) invalidate(groupID GroupID) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	delete(cache.lastFetched, string(groupID))
+}
+
+// Applies the changes that are newer than the cached group to a copy of it, and replaces the cached group with the copy.
+// Returns the changes that were applied, none if the group isn't cached.
+func (cache *GroupCache) applyChanges(groupID GroupID, changes []*GroupChange) []*GroupChange {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	group, ok := cache.groups[string(groupID)]
+	if !ok {
+		return nil
+	}
+	var applied []*GroupChange
+	updated := group.clone()
+	for _, change := range changes {
+		if change.Revision <= updated.Revision {
+			continue
+		}
+		updated.applyChange(change)
+		applied = append(applied, change)
+	}
+	cache.groups[string(groupID)] = updated
+	return applied
+}
+
+// Copies everything applyChange modifies, so the original can still be read while the copy is changed
+func (group *Group) clone() *Group {
+	cloned := *group
+	cloned.Members = make([]*GroupMember, len(group.Members))
+	for i, member := range group.Members {
+		memberCopy := *member
+		cloned.Members[i] = &memberCopy
+	}
+	cloned.PendingMembers = append([]*PendingMember(nil), group.PendingMembers...)
+	cloned.RequestingMembers = append([]*RequestingMember(nil), group.RequestingMembers...)
+	cloned.BannedMembers = append([]*BannedMember(nil), group.BannedMembers...)
+	if group.AccessControl != nil {
+		accessControl := *group.AccessControl
+		cloned.AccessControl = &accessControl
+	}
+	return &cloned
 }
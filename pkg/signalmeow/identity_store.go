@@ -1,6 +1,7 @@
 package signalmeow
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"errors"
@@ -11,13 +12,45 @@ import (
 )
 
 var _ libsignalgo.IdentityKeyStore = (*SQLStore)(nil)
+var _ IdentityStoreExtras = (*SQLStore)(nil)
+
+// IdentityTrustPolicy decides what happens when a contact's identity key changes, e.g. because they reinstalled Signal
+type IdentityTrustPolicy int
+
+const (
+	// IdentityTrustOnFirstUse trusts the new key right away, like the official apps do
+	IdentityTrustOnFirstUse IdentityTrustPolicy = iota
+	// IdentityBlockUntilAcknowledged refuses to send to the contact until the change is acknowledged
+	IdentityBlockUntilAcknowledged
+)
 
 const (
-	getIdentityKeyPairQuery       = `SELECT aci_identity_key_pair FROM signalmeow_device WHERE aci_uuid=$1`
-	getRegistrationLocalIDQuery   = `SELECT registration_id FROM signalmeow_device WHERE aci_uuid=$1`
-	insertIdentityKeyQuery        = `INSERT OR REPLACE INTO signalmeow_identity_keys (our_aci_uuid, their_aci_uuid, their_device_id, key, trust_level) VALUES ($1, $2, $3, $4, $5)`
-	getIdentityKeyTrustLevelQuery = `SELECT trust_level FROM signalmeow_identity_keys WHERE our_aci_uuid=$1 AND their_aci_uuid=$2 AND their_device_id=$3`
-	getIdentityKeyQuery           = `SELECT key FROM signalmeow_identity_keys WHERE our_aci_uuid=$1 AND their_aci_uuid=$2 AND their_device_id=$3`
+	trustLevelUntrusted         = "UNTRUSTED"
+	trustLevelTrustedUnverified = "TRUSTED_UNVERIFIED"
+	trustLevelTrustedVerified   = "TRUSTED_VERIFIED"
+)
+
+type IdentityStoreExtras interface {
+	// AcknowledgeIdentityChange trusts the changed identity key of the contact, so we can send to them again
+	AcknowledgeIdentityChange(theirUuid string, ctx context.Context) error
+	// IdentityKeyForUUID returns the identity key we know for the contact and whether it has been verified.
+	// If we've never talked to them, nil is returned.
+	IdentityKeyForUUID(theirUuid string, ctx context.Context) (*libsignalgo.IdentityKey, bool, error)
+	// SetIdentityVerified marks the identity key of the contact as verified or not, if it's still the key we know.
+	// Returns false if we know a different key for them.
+	SetIdentityVerified(theirUuid string, identityKey []byte, verified bool, ctx context.Context) (bool, error)
+}
+
+const (
+	getIdentityKeyPairQuery     = `SELECT aci_identity_key_pair FROM signalmeow_device WHERE aci_uuid=$1`
+	getRegistrationLocalIDQuery = `SELECT registration_id FROM signalmeow_device WHERE aci_uuid=$1`
+	insertIdentityKeyQuery      = `INSERT OR REPLACE INTO signalmeow_identity_keys (our_aci_uuid, their_aci_uuid, their_device_id, key, trust_level) VALUES ($1, $2, $3, $4, $5)`
+	getIdentityKeyQuery         = `SELECT key FROM signalmeow_identity_keys WHERE our_aci_uuid=$1 AND their_aci_uuid=$2 AND their_device_id=$3`
+	// Identity keys belong to the account, so fall back to another device's key if we don't have one for this device yet
+	getKnownIdentityKeyQuery       = `SELECT key, trust_level FROM signalmeow_identity_keys WHERE our_aci_uuid=$1 AND their_aci_uuid=$2 ORDER BY their_device_id=$3 DESC LIMIT 1`
+	getTrustLevelForKeyQuery       = `SELECT trust_level FROM signalmeow_identity_keys WHERE our_aci_uuid=$1 AND their_aci_uuid=$2 AND key=$3 LIMIT 1`
+	setIdentityTrustLevelQuery     = `UPDATE signalmeow_identity_keys SET trust_level=$4 WHERE our_aci_uuid=$1 AND their_aci_uuid=$2 AND key=$3`
+	acknowledgeIdentityChangeQuery = `UPDATE signalmeow_identity_keys SET trust_level='` + trustLevelTrustedUnverified + `' WHERE our_aci_uuid=$1 AND their_aci_uuid=$2 AND trust_level='` + trustLevelUntrusted + `'`
 )
 
 func scanIdentityKeyPair(row scannable) (*libsignalgo.IdentityKeyPair, error) {
@@ -66,8 +99,45 @@ func (s *SQLStore) GetLocalRegistrationID(ctx context.Context) (uint32, error) {
 	return uint32(regID.Int64), nil
 }
 
+// Returns the identity key we know for the address and its trust level, or nil if we've never seen the contact
+func (s *SQLStore) knownIdentityKey(theirUuid string, deviceId uint) ([]byte, string, error) {
+	var key []byte
+	var trustLevel string
+	err := s.db.QueryRow(getKnownIdentityKeyQuery, s.AciUuid, theirUuid, deviceId).Scan(&key, &trustLevel)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", nil
+	}
+	return key, trustLevel, err
+}
+
+// Stores a changed identity key as trusted or untrusted depending on the policy,
+// and reports the change once per contact rather than once per device
+func (s *SQLStore) saveChangedIdentityKey(theirUuid string, deviceId uint, key []byte) (string, error) {
+	var trustLevel string
+	err := s.db.QueryRow(getTrustLevelForKeyQuery, s.AciUuid, theirUuid, key).Scan(&trustLevel)
+	alreadySeen := err == nil
+	if errors.Is(err, sql.ErrNoRows) {
+		trustLevel = trustLevelTrustedUnverified
+		if s.IdentityTrustPolicy == IdentityBlockUntilAcknowledged {
+			trustLevel = trustLevelUntrusted
+		}
+	} else if err != nil {
+		return "", err
+	}
+	_, err = s.db.Exec(insertIdentityKeyQuery, s.AciUuid, theirUuid, deviceId, key, trustLevel)
+	if err != nil {
+		return "", err
+	}
+	if !alreadySeen {
+		log.Printf("Identity key of %v changed, new trust level: %v", theirUuid, trustLevel)
+		if s.identityChangeHandler != nil {
+			s.identityChangeHandler(theirUuid)
+		}
+	}
+	return trustLevel, nil
+}
+
 func (s *SQLStore) SaveIdentityKey(address *libsignalgo.Address, identityKey *libsignalgo.IdentityKey, ctx context.Context) error {
-	trustLevel := "TRUSTED_UNVERIFIED" // TODO: this should be hard coded here
 	serialized, err := identityKey.Serialize()
 	if err != nil {
 		log.Println("error serializing identityKey:", err)
@@ -83,19 +153,33 @@ func (s *SQLStore) SaveIdentityKey(address *libsignalgo.Address, identityKey *li
 		log.Println("error getting deviceId:", err)
 		return err
 	}
+	knownKey, trustLevel, err := s.knownIdentityKey(theirUuid, deviceId)
+	if err != nil {
+		log.Println("error getting known identity key:", err)
+		return err
+	}
+	if knownKey != nil && !bytes.Equal(knownKey, serialized) {
+		_, err = s.saveChangedIdentityKey(theirUuid, deviceId, serialized)
+		if err != nil {
+			log.Println("error saving changed identity:", err)
+		}
+		return err
+	} else if knownKey == nil {
+		trustLevel = trustLevelTrustedUnverified
+	}
 	_, err = s.db.Exec(insertIdentityKeyQuery, s.AciUuid, theirUuid, deviceId, serialized, trustLevel)
 	if err != nil {
 		log.Println("error inserting identity:", err)
 	}
 	return err
 }
+
 func (s *SQLStore) IsTrustedIdentity(
 	address *libsignalgo.Address,
 	identityKey *libsignalgo.IdentityKey,
 	direction libsignalgo.SignalDirection,
 	ctx context.Context,
 ) (bool, error) {
-	// TODO: this should check direction, and probably some other stuff (though whisperfish is pretty basic)
 	theirUuid, err := address.Name()
 	if err != nil {
 		log.Println("error getting theirUuid:", err)
@@ -108,10 +192,14 @@ func (s *SQLStore) IsTrustedIdentity(
 		log.Println("RETURNING NOT TRUSTED")
 		return false, err
 	}
-	var trustLevel string
-	err = s.db.QueryRow(getIdentityKeyTrustLevelQuery, s.AciUuid, theirUuid, deviceId).Scan(&trustLevel)
-	// If no rows, they are a new identity, so trust by default
-	if errors.Is(err, sql.ErrNoRows) {
+	serialized, err := identityKey.Serialize()
+	if err != nil {
+		log.Println("error serializing identityKey:", err)
+		return false, err
+	}
+	knownKey, trustLevel, err := s.knownIdentityKey(theirUuid, deviceId)
+	// If we've never seen them, they are a new identity, so trust by default
+	if err == nil && knownKey == nil {
 		log.Println("no rows, TRUSTING BY DEFAULT")
 		return true, nil
 	} else if err != nil {
@@ -119,13 +207,30 @@ func (s *SQLStore) IsTrustedIdentity(
 		log.Println("RETURNING NOT TRUSTED")
 		return false, err
 	}
-	trusted := trustLevel == "TRUSTED_UNVERIFIED" || trustLevel == "TRUSTED_VERIFIED"
+	if !bytes.Equal(knownKey, serialized) {
+		trustLevel, err = s.saveChangedIdentityKey(theirUuid, deviceId, serialized)
+		if err != nil {
+			log.Println("error saving changed identity:", err)
+			log.Println("RETURNING NOT TRUSTED")
+			return false, err
+		}
+	}
+	// Refusing to decrypt wouldn't stop them from sending, so only sending is blocked
+	if direction == libsignalgo.SignalDirectionReceiving {
+		return true, nil
+	}
+	trusted := trustLevel == trustLevelTrustedUnverified || trustLevel == trustLevelTrustedVerified
 	if !trusted {
 		log.Println("RETURNING NOT TRUSTED")
 	}
 	return trusted, nil
 }
 
+func (s *SQLStore) AcknowledgeIdentityChange(theirUuid string, ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, acknowledgeIdentityChangeQuery, s.AciUuid, theirUuid)
+	return err
+}
+
 func (s *SQLStore) GetIdentityKey(address *libsignalgo.Address, ctx context.Context) (*libsignalgo.IdentityKey, error) {
 	theirUuid, err := address.Name()
 	if err != nil {
@@ -144,3 +249,37 @@ func (s *SQLStore) GetIdentityKey(address *libsignalgo.Address, ctx context.Cont
 	}
 	return key, err
 }
+
+func (s *SQLStore) IdentityKeyForUUID(theirUuid string, ctx context.Context) (*libsignalgo.IdentityKey, bool, error) {
+	// Prefer the primary device, though all devices should have the same key
+	key, trustLevel, err := s.knownIdentityKey(theirUuid, 1)
+	if err != nil || key == nil {
+		return nil, false, err
+	}
+	identityKey, err := libsignalgo.DeserializeIdentityKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	return identityKey, trustLevel == trustLevelTrustedVerified, nil
+}
+
+func (s *SQLStore) SetIdentityVerified(theirUuid string, identityKey []byte, verified bool, ctx context.Context) (bool, error) {
+	trustLevel := trustLevelTrustedUnverified
+	if verified {
+		trustLevel = trustLevelTrustedVerified
+	}
+	knownKey, _, err := s.knownIdentityKey(theirUuid, 1)
+	if err != nil {
+		return false, err
+	} else if knownKey == nil {
+		// Verified on another device before we ever talked to them, remember the key for when we do
+		_, err = s.db.ExecContext(ctx, insertIdentityKeyQuery, s.AciUuid, theirUuid, 1, identityKey, trustLevel)
+		return err == nil, err
+	}
+	result, err := s.db.ExecContext(ctx, setIdentityTrustLevelQuery, s.AciUuid, theirUuid, identityKey, trustLevel)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
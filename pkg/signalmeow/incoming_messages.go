@@ -1,5 +1,9 @@
 package signalmeow
 
+import (
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
 // Below is a lot of boilerplate to have a nice ADTish type for incoming messages
 
 type IncomingSignalMessageType int
@@ -8,15 +12,26 @@ const (
 	IncomingSignalMessageTypeText IncomingSignalMessageType = iota
 	IncomingSignalMessageTypeTyping
 	IncomingSignalMessageTypeReceipt
+	IncomingSignalMessageTypeAttachment
+	IncomingSignalMessageTypeReaction
+	IncomingSignalMessageTypeDelete
+	IncomingSignalMessageTypeExpireTimerUpdate
+	IncomingSignalMessageTypeDecryptionError
+	IncomingSignalMessageTypeIdentityChange
+	IncomingSignalMessageTypeGroupChange
 )
 
 type IncomingSignalMessage interface {
 	MessageType() IncomingSignalMessageType
+	Base() IncomingSignalMessageBase
 }
 type IncomingSignalMessageText struct {
 	IncomingSignalMessageBase
-	Timestamp uint64
-	Content   string
+	Timestamp  uint64
+	Content    string
+	BodyRanges []*signalpb.BodyRange       // Mentions and styles, with offsets in UTF-16 code units
+	Quote      *IncomingSignalMessageQuote // Set if this is a reply to another message
+	ExpiresIn  uint32                      // Disappearing message timer in seconds, 0 if the message doesn't disappear
 }
 
 func (IncomingSignalMessageText) MessageType() IncomingSignalMessageType {
@@ -51,9 +66,114 @@ func (IncomingSignalMessageReceipt) MessageType() IncomingSignalMessageType {
 	return IncomingSignalMessageTypeReceipt
 }
 
+type IncomingSignalMessageAttachment struct {
+	IncomingSignalMessageBase
+	Timestamp   uint64
+	Pointer     *signalpb.AttachmentPointer // Not downloaded yet, so a big file doesn't hold up receiving, see DownloadAttachment
+	Filename    string
+	ContentType string
+	Caption     string
+	Size        uint64
+	Width       uint32
+	Height      uint32
+	BlurHash    string
+	Flags       uint32                      // Bitmask of signalpb.AttachmentPointer_Flags
+	Quote       *IncomingSignalMessageQuote // Set if this is a reply to another message
+	ExpiresIn   uint32                      // Disappearing message timer in seconds, 0 if the message doesn't disappear
+}
+
+func (IncomingSignalMessageAttachment) MessageType() IncomingSignalMessageType {
+	return IncomingSignalMessageTypeAttachment
+}
+
+func (a IncomingSignalMessageAttachment) IsVoiceMessage() bool {
+	return a.Flags&uint32(signalpb.AttachmentPointer_VOICE_MESSAGE) != 0
+}
+
+func (a IncomingSignalMessageAttachment) IsGif() bool {
+	return a.Flags&uint32(signalpb.AttachmentPointer_GIF) != 0
+}
+
+type IncomingSignalMessageReaction struct {
+	IncomingSignalMessageBase
+	Timestamp              uint64
+	Emoji                  string
+	Remove                 bool
+	TargetAuthorUUID       string // ACI of the author of the message being reacted to
+	TargetMessageTimestamp uint64 // Sent timestamp of the message being reacted to
+}
+
+func (IncomingSignalMessageReaction) MessageType() IncomingSignalMessageType {
+	return IncomingSignalMessageTypeReaction
+}
+
+type IncomingSignalMessageDelete struct {
+	IncomingSignalMessageBase
+	Timestamp              uint64
+	TargetMessageTimestamp uint64 // Sent timestamp of the message being deleted, the author is always the sender
+}
+
+func (IncomingSignalMessageDelete) MessageType() IncomingSignalMessageType {
+	return IncomingSignalMessageTypeDelete
+}
+
+type IncomingSignalMessageExpireTimerUpdate struct {
+	IncomingSignalMessageBase
+	Timestamp   uint64
+	ExpireTimer uint32 // New disappearing message timer in seconds, 0 turns disappearing messages off
+}
+
+func (IncomingSignalMessageExpireTimerUpdate) MessageType() IncomingSignalMessageType {
+	return IncomingSignalMessageTypeExpireTimerUpdate
+}
+
+// A message we couldn't decrypt, the sender has been asked to send it again
+type IncomingSignalMessageDecryptionError struct {
+	IncomingSignalMessageBase
+	Timestamp uint64
+}
+
+func (IncomingSignalMessageDecryptionError) MessageType() IncomingSignalMessageType {
+	return IncomingSignalMessageTypeDecryptionError
+}
+
+// The identity key (and so the safety number) of the sender changed, usually because they reinstalled Signal
+type IncomingSignalMessageIdentityChange struct {
+	IncomingSignalMessageBase
+	Timestamp uint64
+}
+
+func (IncomingSignalMessageIdentityChange) MessageType() IncomingSignalMessageType {
+	return IncomingSignalMessageTypeIdentityChange
+}
+
+// A change to a group's members or info, already applied to the cached group.
+// SenderUUID is whoever made the change.
+type IncomingSignalMessageGroupChange struct {
+	IncomingSignalMessageBase
+	Timestamp uint64
+	Change    *GroupChange
+}
+
+func (IncomingSignalMessageGroupChange) MessageType() IncomingSignalMessageType {
+	return IncomingSignalMessageTypeGroupChange
+}
+
+// Not a message on its own, this is attached to the first part of a message that quotes another one
+type IncomingSignalMessageQuote struct {
+	TargetMessageTimestamp uint64 // Sent timestamp of the message being quoted
+	TargetAuthorUUID       string // ACI of the author of the message being quoted
+	Text                   string // The quoted text, so the reply makes sense even if we don't know the original
+	AttachmentFilenames    []string
+}
+
 type IncomingSignalMessageBase struct {
 	// When uniquely identifiying a chat, use GroupID if it is not nil, otherwise use SenderUUID.
 	SenderUUID    string   // Always the UUID of the sender of the message
 	RecipientUUID string   // Usually our UUID, unless this is a message we sent on another device
 	GroupID       *GroupID // Unique identifier for the group chat, or nil for 1:1 chats
 }
+
+func (b IncomingSignalMessageBase) Base() IncomingSignalMessageBase {
+	return b
+}
@@ -19,6 +19,9 @@ type GeneratedPreKeys struct {
 	PreKeys      []libsignalgo.PreKeyRecord
 	SignedPreKey libsignalgo.SignedPreKeyRecord
 	IdentityKey  []uint8
+
+	KyberPreKeys          []*libsignalgo.KyberPreKeyRecord
+	KyberLastResortPreKey *libsignalgo.KyberPreKeyRecord
 }
 
 func GenerateAndRegisterPreKeys(device *Device, uuidKind UUIDKind) error {
@@ -39,6 +42,25 @@ func GenerateAndRegisterPreKeys(device *Device, uuidKind UUIDKind) error {
 	signedPreKey := GenerateSignedPreKey(0, uuidKind, identityKeyPair)
 	device.PreKeyStoreExtras.SaveSignedPreKey(uuidKind, signedPreKey, false)
 
+	kyberPreKeys, err := GenerateKyberPreKeys(1, preKeyBatchSize, identityKeyPair)
+	if err != nil {
+		log.Printf("Error generating kyber prekeys: %v", err)
+		return err
+	}
+	kyberLastResortPreKeys, err := GenerateKyberPreKeys(preKeyBatchSize+1, 1, identityKeyPair)
+	if err != nil {
+		log.Printf("Error generating last-resort kyber prekey: %v", err)
+		return err
+	}
+	err = device.KyberPreKeyStoreExtras.SaveKyberPreKeys(uuidKind, kyberPreKeys, false)
+	if err != nil {
+		return err
+	}
+	err = device.KyberPreKeyStoreExtras.SaveKyberPreKeys(uuidKind, kyberLastResortPreKeys, true)
+	if err != nil {
+		return err
+	}
+
 	// Register prekeys
 	identityKey, err := identityKeyPair.GetPublicKey().Serialize()
 	if err != nil {
@@ -49,6 +71,9 @@ func GenerateAndRegisterPreKeys(device *Device, uuidKind UUIDKind) error {
 		PreKeys:      *preKeys,
 		SignedPreKey: *signedPreKey,
 		IdentityKey:  identityKey,
+
+		KyberPreKeys:          kyberPreKeys,
+		KyberLastResortPreKey: kyberLastResortPreKeys[0],
 	}
 	preKeyUsername := device.Data.Number
 	if device.Data.AciUuid != "" {
@@ -66,6 +91,8 @@ func GenerateAndRegisterPreKeys(device *Device, uuidKind UUIDKind) error {
 	err = device.PreKeyStoreExtras.MarkPreKeysAsUploaded(uuidKind, lastPreKeyId)
 	signedId, err := signedPreKey.GetID()
 	err = device.PreKeyStoreExtras.MarkSignedPreKeysAsUploaded(uuidKind, signedId)
+	err = device.KyberPreKeyStoreExtras.MarkKyberPreKeysAsUploaded(uuidKind, preKeyBatchSize+1, false)
+	err = device.KyberPreKeyStoreExtras.MarkKyberPreKeysAsUploaded(uuidKind, preKeyBatchSize+1, true)
 
 	if err != nil {
 		log.Printf("Error marking prekeys as uploaded: %v", err)
@@ -118,36 +145,55 @@ func GenerateSignedPreKey(startSignedKeyId uint32, uuidKind UUIDKind, identityKe
 	return signedPreKey
 }
 
+// GenerateKyberPreKeys generates count kyber prekeys starting at startKeyId, signed with our identity key
+func GenerateKyberPreKeys(startKeyId uint32, count uint32, identityKeyPair *libsignalgo.IdentityKeyPair) ([]*libsignalgo.KyberPreKeyRecord, error) {
+	generatedPreKeys := make([]*libsignalgo.KyberPreKeyRecord, 0, count)
+	timestamp := time.Now()
+	for i := startKeyId; i < startKeyId+count; i++ {
+		keyPair, err := libsignalgo.KyberKeyPairGenerate()
+		if err != nil {
+			return nil, fmt.Errorf("error generating kyber key pair: %w", err)
+		}
+		publicKey, err := keyPair.GetPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		serializedPublicKey, err := publicKey.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		signature, err := identityKeyPair.GetPrivateKey().Sign(serializedPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("error signing kyber public key: %w", err)
+		}
+		preKey, err := libsignalgo.NewKyberPreKeyRecord(i, timestamp, keyPair, signature)
+		if err != nil {
+			return nil, fmt.Errorf("error creating kyber prekey record: %w", err)
+		}
+		generatedPreKeys = append(generatedPreKeys, preKey)
+	}
+	return generatedPreKeys, nil
+}
+
 func RegisterPreKeys(generatedPreKeys *GeneratedPreKeys, uuidKind UUIDKind, username string, password string) error {
 	// Convert generated prekeys to JSON
 	preKeysJson := []map[string]interface{}{}
 	for _, preKey := range generatedPreKeys.PreKeys {
-		id, _ := preKey.GetID()
-		publicKey, _ := preKey.GetPublicKey()
-		serializedKey, _ := publicKey.Serialize()
-		preKeyJson := map[string]interface{}{
-			"keyId":     id,
-			"publicKey": base64.StdEncoding.EncodeToString(serializedKey),
-		}
-		preKeysJson = append(preKeysJson, preKeyJson)
-	}
-
-	// Convert signed prekey to JSON
-	id, _ := generatedPreKeys.SignedPreKey.GetID()
-	publicKey, _ := generatedPreKeys.SignedPreKey.GetPublicKey()
-	serializedKey, _ := publicKey.Serialize()
-	signature, _ := generatedPreKeys.SignedPreKey.GetSignature()
-	signedPreKeyJson := map[string]interface{}{
-		"keyId":     id,
-		"publicKey": serializedKey,
-		"signature": base64.StdEncoding.EncodeToString(signature),
+		preKeysJson = append(preKeysJson, preKeyJSON(&preKey))
 	}
+	signedPreKeyJson := signedPreKeyJSON(&generatedPreKeys.SignedPreKey)
 	identityKey := generatedPreKeys.IdentityKey
 	register_json := map[string]interface{}{
 		"preKeys":      preKeysJson,
 		"signedPreKey": signedPreKeyJson,
 		"identityKey":  base64.StdEncoding.EncodeToString(identityKey),
 	}
+	if len(generatedPreKeys.KyberPreKeys) > 0 {
+		register_json["pqPreKeys"] = kyberPreKeysJSON(generatedPreKeys.KyberPreKeys)
+	}
+	if generatedPreKeys.KyberLastResortPreKey != nil {
+		register_json["pqLastResortPreKey"] = kyberPreKeyJSON(generatedPreKeys.KyberLastResortPreKey)
+	}
 
 	// Send request
 	keysPath := "/v2/keys?identity=" + string(uuidKind)
@@ -169,6 +215,122 @@ func RegisterPreKeys(generatedPreKeys *GeneratedPreKeys, uuidKind UUIDKind, user
 	return err
 }
 
+func preKeyJSON(preKey *libsignalgo.PreKeyRecord) map[string]interface{} {
+	id, _ := preKey.GetID()
+	publicKey, _ := preKey.GetPublicKey()
+	serializedKey, _ := publicKey.Serialize()
+	return map[string]interface{}{
+		"keyId":     id,
+		"publicKey": base64.StdEncoding.EncodeToString(serializedKey),
+	}
+}
+
+func signedPreKeyJSON(signedPreKey *libsignalgo.SignedPreKeyRecord) map[string]interface{} {
+	id, _ := signedPreKey.GetID()
+	publicKey, _ := signedPreKey.GetPublicKey()
+	serializedKey, _ := publicKey.Serialize()
+	signature, _ := signedPreKey.GetSignature()
+	return map[string]interface{}{
+		"keyId":     id,
+		"publicKey": serializedKey,
+		"signature": base64.StdEncoding.EncodeToString(signature),
+	}
+}
+
+func kyberPreKeyJSON(preKey *libsignalgo.KyberPreKeyRecord) map[string]interface{} {
+	id, _ := preKey.GetID()
+	publicKey, _ := preKey.GetPublicKey()
+	serializedKey, _ := publicKey.Serialize()
+	signature, _ := preKey.GetSignature()
+	return map[string]interface{}{
+		"keyId":     id,
+		"publicKey": base64.StdEncoding.EncodeToString(serializedKey),
+		"signature": base64.StdEncoding.EncodeToString(signature),
+	}
+}
+
+func kyberPreKeysJSON(preKeys []*libsignalgo.KyberPreKeyRecord) []map[string]interface{} {
+	preKeysJson := make([]map[string]interface{}, 0, len(preKeys))
+	for _, preKey := range preKeys {
+		preKeysJson = append(preKeysJson, kyberPreKeyJSON(preKey))
+	}
+	return preKeysJson
+}
+
+type preKeyCountResponse struct {
+	Count   int `json:"count"`
+	PQCount int `json:"pqCount"`
+}
+
+// Asks the server how many one-time EC and kyber prekeys it still has for us
+func getServerPreKeyCount(device *Device, uuidKind UUIDKind) (*preKeyCountResponse, error) {
+	username, password := device.Data.BasicAuthCreds()
+	opts := &web.HTTPReqOpt{Username: &username, Password: &password}
+	resp, err := web.SendHTTPRequest("GET", "/v2/keys?identity="+string(uuidKind), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("HTTP error fetching prekey count: %v", resp.Status)
+	}
+	var counts preKeyCountResponse
+	err = json.NewDecoder(resp.Body).Decode(&counts)
+	if err != nil {
+		return nil, err
+	}
+	return &counts, nil
+}
+
+// Holds whichever keys should be uploaded, anything left empty is kept as it is on the server
+type preKeyUpload struct {
+	PreKeys               []*libsignalgo.PreKeyRecord
+	SignedPreKey          *libsignalgo.SignedPreKeyRecord
+	KyberPreKeys          []*libsignalgo.KyberPreKeyRecord
+	KyberLastResortPreKey *libsignalgo.KyberPreKeyRecord
+}
+
+func uploadPreKeys(device *Device, uuidKind UUIDKind, upload *preKeyUpload) error {
+	identityKey, err := identityKeyPairForKind(device, uuidKind).GetPublicKey().Serialize()
+	if err != nil {
+		return err
+	}
+	requestJson := map[string]interface{}{
+		"identityKey": base64.StdEncoding.EncodeToString(identityKey),
+	}
+	if len(upload.PreKeys) > 0 {
+		preKeysJson := make([]map[string]interface{}, 0, len(upload.PreKeys))
+		for _, preKey := range upload.PreKeys {
+			preKeysJson = append(preKeysJson, preKeyJSON(preKey))
+		}
+		requestJson["preKeys"] = preKeysJson
+	}
+	if upload.SignedPreKey != nil {
+		requestJson["signedPreKey"] = signedPreKeyJSON(upload.SignedPreKey)
+	}
+	if len(upload.KyberPreKeys) > 0 {
+		requestJson["pqPreKeys"] = kyberPreKeysJSON(upload.KyberPreKeys)
+	}
+	if upload.KyberLastResortPreKey != nil {
+		requestJson["pqLastResortPreKey"] = kyberPreKeyJSON(upload.KyberLastResortPreKey)
+	}
+	jsonBytes, err := json.Marshal(requestJson)
+	if err != nil {
+		return err
+	}
+	username, password := device.Data.BasicAuthCreds()
+	opts := &web.HTTPReqOpt{Body: jsonBytes, Username: &username, Password: &password}
+	resp, err := web.SendHTTPRequest("PUT", "/v2/keys?identity="+string(uuidKind), opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error uploading prekeys: %v", resp.Status)
+	}
+	return nil
+}
+
 type prekeyResponse struct {
 	IdentityKey string         `json:"identityKey"`
 	Devices     []prekeyDevice `json:"devices"`
@@ -276,7 +438,39 @@ func FetchAndProcessPreKey(ctx context.Context, device *Device, theirUuid string
 		}
 
 		var preKeyBundle *libsignalgo.PreKeyBundle
-		if publicKey == nil {
+		if d.PQPreKey != nil {
+			// Post-quantum (PQXDH) bundle, works with or without a one-time EC prekey
+			var rawKyberPublicKey, rawKyberSignature []byte
+			var kyberPublicKey *libsignalgo.KyberPublicKey
+			rawKyberPublicKey, err = addBase64PaddingAndDecode(d.PQPreKey.PublicKey)
+			if err != nil {
+				log.Printf("Error decoding kyber public key: %v", err)
+				return err
+			}
+			kyberPublicKey, err = libsignalgo.DeserializeKyberPublicKey(rawKyberPublicKey)
+			if err != nil {
+				log.Printf("Error deserializing kyber public key: %v", err)
+				return err
+			}
+			rawKyberSignature, err = addBase64PaddingAndDecode(d.PQPreKey.Signature)
+			if err != nil {
+				log.Printf("Error decoding kyber signature: %v", err)
+				return err
+			}
+			preKeyBundle, err = libsignalgo.NewPreKeyBundleWithKyberPreKey(
+				uint32(d.RegistrationID),
+				uint32(d.DeviceID),
+				preKeyId,
+				publicKey,
+				uint32(d.SignedPreKey.KeyID),
+				signedPublicKey,
+				rawSignature,
+				identityKey,
+				uint32(d.PQPreKey.KeyID),
+				kyberPublicKey,
+				rawKyberSignature,
+			)
+		} else if publicKey == nil {
 			// There is no prekey, use the signed method
 			preKeyBundle, err = libsignalgo.NewPreKeyBundleWithoutPrekey(
 				uint32(d.RegistrationID),
@@ -0,0 +1,179 @@
+package signalmeow
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+)
+
+var _ libsignalgo.KyberPreKeyStore = (*SQLStore)(nil)
+var _ KyberPreKeyStoreExtras = (*SQLStore)(nil)
+
+// Kyber prekeys come in two flavours: one-time keys that are deleted once used, and a last-resort key
+// that the server hands out when it runs out of one-time keys, which stays around until it's rotated
+type KyberPreKeyStoreExtras interface {
+	KyberPreKey(uuidKind UUIDKind, preKeyId int) (*libsignalgo.KyberPreKeyRecord, error)
+	SaveKyberPreKeys(uuidKind UUIDKind, preKeys []*libsignalgo.KyberPreKeyRecord, lastResort bool) error
+	GetNextKyberPreKeyID(uuidKind UUIDKind) (uint, error)
+	MarkKyberPreKeysAsUploaded(uuidKind UUIDKind, upToID uint, lastResort bool) error
+	GetUnuploadedKyberPreKeys(uuidKind UUIDKind) ([]*libsignalgo.KyberPreKeyRecord, error)
+	ActiveLastResortKyberPreKey(uuidKind UUIDKind) (*libsignalgo.KyberPreKeyRecord, error)
+	DeleteLastResortKyberPreKeysOlderThan(uuidKind UUIDKind, cutoff time.Time, keepID uint) (int, error)
+}
+
+// libsignalgo.KyberPreKeyStore implementation
+func (s *SQLStore) LoadKyberPreKey(id uint32, ctx context.Context) (*libsignalgo.KyberPreKeyRecord, error) {
+	return s.KyberPreKey(UUID_KIND_ACI, int(id))
+}
+func (s *SQLStore) StoreKyberPreKey(id uint32, kyberPreKeyRecord *libsignalgo.KyberPreKeyRecord, ctx context.Context) error {
+	return s.SaveKyberPreKeys(UUID_KIND_ACI, []*libsignalgo.KyberPreKeyRecord{kyberPreKeyRecord}, false)
+}
+func (s *SQLStore) MarkKyberPreKeyUsed(id uint32, ctx context.Context) error {
+	// Last-resort keys can be used any number of times, so this only removes one-time keys
+	_, err := s.db.Exec(deleteOneTimeKyberPreKeyQuery, s.AciUuid, id, UUID_KIND_ACI)
+	return err
+}
+
+const (
+	getKyberPreKeyQuery               = `SELECT key_id, key_pair FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1 AND key_id=$2 AND uuid_kind=$3`
+	insertKyberPreKeyQuery            = `INSERT INTO signalmeow_kyber_pre_keys (aci_uuid, key_id, uuid_kind, key_pair, is_last_resort, uploaded) VALUES ($1, $2, $3, $4, $5, false)`
+	deleteKyberPreKeyQuery            = `DELETE FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1 AND key_id=$2 AND uuid_kind=$3`
+	deleteOneTimeKyberPreKeyQuery     = `DELETE FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1 AND key_id=$2 AND uuid_kind=$3 AND is_last_resort=false`
+	getLastKyberPreKeyIDQuery         = `SELECT MAX(key_id) FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2`
+	markKyberPreKeysAsUploadedQuery   = `UPDATE signalmeow_kyber_pre_keys SET uploaded=true WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_last_resort=$3 AND key_id<=$4`
+	getUnuploadedKyberPreKeysQuery    = `SELECT key_id, key_pair FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_last_resort=false AND uploaded=false ORDER BY key_id`
+	getActiveLastResortKyberQuery     = `SELECT key_id, key_pair FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_last_resort=true AND uploaded=true ORDER BY key_id DESC LIMIT 1`
+	getAllLastResortKyberPreKeysQuery = `SELECT key_id, key_pair FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_last_resort=true`
+)
+
+func scanKyberPreKey(row scannable) (*libsignalgo.KyberPreKeyRecord, error) {
+	var id uint
+	var record []byte
+	err := row.Scan(&id, &record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return libsignalgo.DeserializeKyberPreKeyRecord(record)
+}
+
+func (s *SQLStore) KyberPreKey(uuidKind UUIDKind, preKeyId int) (*libsignalgo.KyberPreKeyRecord, error) {
+	return scanKyberPreKey(s.db.QueryRow(getKyberPreKeyQuery, s.AciUuid, preKeyId, uuidKind))
+}
+
+// SaveKyberPreKeys stores a batch of new kyber prekeys as not uploaded, either all of them or none
+func (s *SQLStore) SaveKyberPreKeys(uuidKind UUIDKind, preKeys []*libsignalgo.KyberPreKeyRecord, lastResort bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, preKey := range preKeys {
+		id, err := preKey.GetID()
+		if err != nil {
+			return err
+		}
+		serialized, err := preKey.Serialize()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(insertKyberPreKeyQuery, s.AciUuid, id, uuidKind, serialized, lastResort)
+		if err != nil {
+			return fmt.Errorf("failed to insert kyber prekey %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) GetNextKyberPreKeyID(uuidKind UUIDKind) (uint, error) {
+	var lastKeyID sql.NullInt64
+	err := s.db.QueryRow(getLastKyberPreKeyIDQuery, s.AciUuid, uuidKind).Scan(&lastKeyID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query next kyber prekey ID: %w", err)
+	}
+	return uint(lastKeyID.Int64) + 1, nil
+}
+
+func (s *SQLStore) MarkKyberPreKeysAsUploaded(uuidKind UUIDKind, upToID uint, lastResort bool) error {
+	_, err := s.db.Exec(markKyberPreKeysAsUploadedQuery, s.AciUuid, uuidKind, lastResort, upToID)
+	return err
+}
+
+func (s *SQLStore) GetUnuploadedKyberPreKeys(uuidKind UUIDKind) ([]*libsignalgo.KyberPreKeyRecord, error) {
+	res, err := s.db.Query(getUnuploadedKyberPreKeysQuery, s.AciUuid, uuidKind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query existing kyber prekeys: %w", err)
+	}
+	defer res.Close()
+	newKeys := []*libsignalgo.KyberPreKeyRecord{}
+	for res.Next() {
+		key, err := scanKyberPreKey(res)
+		if err != nil {
+			return nil, err
+		} else if key != nil {
+			newKeys = append(newKeys, key)
+		}
+	}
+	return newKeys, nil
+}
+
+// ActiveLastResortKyberPreKey returns the most recently uploaded last-resort kyber prekey, or nil if there isn't one
+func (s *SQLStore) ActiveLastResortKyberPreKey(uuidKind UUIDKind) (*libsignalgo.KyberPreKeyRecord, error) {
+	return scanKyberPreKey(s.db.QueryRow(getActiveLastResortKyberQuery, s.AciUuid, uuidKind))
+}
+
+// DeleteLastResortKyberPreKeysOlderThan removes last-resort kyber prekeys generated before the cutoff,
+// except the one with keepID. Returns how many were deleted.
+func (s *SQLStore) DeleteLastResortKyberPreKeysOlderThan(uuidKind UUIDKind, cutoff time.Time, keepID uint) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(getAllLastResortKyberPreKeysQuery, s.AciUuid, uuidKind)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query last-resort kyber prekeys: %w", err)
+	}
+	var expired []uint
+	for rows.Next() {
+		var id uint
+		var record []byte
+		err = rows.Scan(&id, &record)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if id == keepID {
+			continue
+		}
+		preKey, err := libsignalgo.DeserializeKyberPreKeyRecord(record)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		timestamp, err := preKey.GetTimestamp()
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if timestamp.Before(cutoff) {
+			expired = append(expired, id)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, id := range expired {
+		_, err = tx.Exec(deleteKyberPreKeyQuery, s.AciUuid, id, uuidKind)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete kyber prekey %d: %w", id, err)
+		}
+	}
+	return len(expired), tx.Commit()
+}
@@ -0,0 +1,119 @@
+package signalmeow
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+)
+
+// pniSQLStore is the view of a SQLStore used for our PNI identity, which is what people who only know
+// our phone number send to. Contact identity keys are shared with the ACI store, everything tied to
+// our own identity (key pair, registration ID, prekeys and sessions) is separate.
+type pniSQLStore struct {
+	*SQLStore
+}
+
+var _ libsignalgo.PreKeyStore = (*pniSQLStore)(nil)
+var _ libsignalgo.SignedPreKeyStore = (*pniSQLStore)(nil)
+var _ libsignalgo.KyberPreKeyStore = (*pniSQLStore)(nil)
+var _ libsignalgo.IdentityKeyStore = (*pniSQLStore)(nil)
+var _ libsignalgo.SessionStore = (*pniSQLStore)(nil)
+var _ SessionStoreExtras = (*pniSQLStore)(nil)
+var _ PniSignatureStore = (*SQLStore)(nil)
+
+const (
+	getPniIdentityKeyPairQuery     = `SELECT pni_identity_key_pair FROM signalmeow_device WHERE aci_uuid=$1`
+	getPniRegistrationLocalIDQuery = `SELECT pni_registration_id FROM signalmeow_device WHERE aci_uuid=$1`
+)
+
+func (s *pniSQLStore) GetIdentityKeyPair(ctx context.Context) (*libsignalgo.IdentityKeyPair, error) {
+	keyPair, err := scanIdentityKeyPair(s.db.QueryRow(getPniIdentityKeyPairQuery, s.AciUuid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PNI identity key pair: %w", err)
+	}
+	return keyPair, nil
+}
+
+func (s *pniSQLStore) GetLocalRegistrationID(ctx context.Context) (uint32, error) {
+	var regID sql.NullInt64
+	err := s.db.QueryRow(getPniRegistrationLocalIDQuery, s.AciUuid).Scan(&regID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get PNI registration ID: %w", err)
+	}
+	return uint32(regID.Int64), nil
+}
+
+func (s *pniSQLStore) LoadPreKey(id uint32, ctx context.Context) (*libsignalgo.PreKeyRecord, error) {
+	return s.PreKey(UUID_KIND_PNI, int(id))
+}
+func (s *pniSQLStore) StorePreKey(id uint32, preKeyRecord *libsignalgo.PreKeyRecord, ctx context.Context) error {
+	return s.SavePreKey(UUID_KIND_PNI, preKeyRecord, false)
+}
+func (s *pniSQLStore) RemovePreKey(id uint32, ctx context.Context) error {
+	return s.DeletePreKey(UUID_KIND_PNI, int(id))
+}
+
+func (s *pniSQLStore) LoadSignedPreKey(id uint32, ctx context.Context) (*libsignalgo.SignedPreKeyRecord, error) {
+	return s.SignedPreKey(UUID_KIND_PNI, int(id))
+}
+func (s *pniSQLStore) StoreSignedPreKey(id uint32, signedPreKeyRecord *libsignalgo.SignedPreKeyRecord, ctx context.Context) error {
+	return s.SaveSignedPreKey(UUID_KIND_PNI, signedPreKeyRecord, false)
+}
+
+func (s *pniSQLStore) LoadKyberPreKey(id uint32, ctx context.Context) (*libsignalgo.KyberPreKeyRecord, error) {
+	return s.KyberPreKey(UUID_KIND_PNI, int(id))
+}
+func (s *pniSQLStore) StoreKyberPreKey(id uint32, kyberPreKeyRecord *libsignalgo.KyberPreKeyRecord, ctx context.Context) error {
+	return s.SaveKyberPreKeys(UUID_KIND_PNI, []*libsignalgo.KyberPreKeyRecord{kyberPreKeyRecord}, false)
+}
+func (s *pniSQLStore) MarkKyberPreKeyUsed(id uint32, ctx context.Context) error {
+	_, err := s.db.Exec(deleteOneTimeKyberPreKeyQuery, s.AciUuid, id, UUID_KIND_PNI)
+	return err
+}
+
+func (s *pniSQLStore) LoadSession(address *libsignalgo.Address, ctx context.Context) (*libsignalgo.SessionRecord, error) {
+	return s.loadSession(pniSessionQueries, address)
+}
+func (s *pniSQLStore) StoreSession(address *libsignalgo.Address, record *libsignalgo.SessionRecord, ctx context.Context) error {
+	return s.storeSession(pniSessionQueries, address, record, ctx)
+}
+func (s *pniSQLStore) RemoveSession(address *libsignalgo.Address, ctx context.Context) error {
+	return s.removeSession(pniSessionQueries, address)
+}
+func (s *pniSQLStore) AllSessionsForUUID(theirUuid string, ctx context.Context) ([]*libsignalgo.Address, []*libsignalgo.SessionRecord, error) {
+	return s.allSessionsForUUID(pniSessionQueries, theirUuid)
+}
+
+// PniSignatureStore remembers which contacts have only messaged our PNI, so our replies to them
+// include a PniSignatureMessage proving that our ACI and PNI belong to the same account
+type PniSignatureStore interface {
+	SetPniSignatureNeeded(theirUuid string, needed bool, ctx context.Context) error
+	IsPniSignatureNeeded(theirUuid string, ctx context.Context) (bool, error)
+}
+
+const (
+	insertPniSignatureNeededQuery = `INSERT OR IGNORE INTO signalmeow_pni_signature_needed (our_aci_uuid, their_aci_uuid) VALUES ($1, $2)` // SQLite specific
+	deletePniSignatureNeededQuery = `DELETE FROM signalmeow_pni_signature_needed WHERE our_aci_uuid=$1 AND their_aci_uuid=$2`
+	getPniSignatureNeededQuery    = `SELECT 1 FROM signalmeow_pni_signature_needed WHERE our_aci_uuid=$1 AND their_aci_uuid=$2`
+)
+
+func (s *SQLStore) SetPniSignatureNeeded(theirUuid string, needed bool, ctx context.Context) (err error) {
+	if needed {
+		_, err = s.db.Exec(insertPniSignatureNeededQuery, s.AciUuid, theirUuid)
+	} else {
+		_, err = s.db.Exec(deletePniSignatureNeededQuery, s.AciUuid, theirUuid)
+	}
+	return err
+}
+
+func (s *SQLStore) IsPniSignatureNeeded(theirUuid string, ctx context.Context) (bool, error) {
+	var needed int
+	err := s.db.QueryRow(getPniSignatureNeededQuery, s.AciUuid, theirUuid).Scan(&needed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
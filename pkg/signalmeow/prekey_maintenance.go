@@ -0,0 +1,248 @@
+package signalmeow
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+)
+
+const (
+	// Upload more one-time prekeys when the server has fewer than this many left
+	preKeyMinimumCount  = 10
+	preKeyBatchSize     = 100
+	preKeyCheckInterval = 6 * time.Hour
+
+	signedPreKeyRotationInterval = 2 * 24 * time.Hour
+	// Old signed prekeys are kept around for a while, so messages encrypted to them can still be decrypted
+	signedPreKeyGracePeriod = 30 * 24 * time.Hour
+)
+
+// Keeps the prekeys of both our identities up to date on the server until the context is cancelled
+func runPreKeyMaintenance(ctx context.Context, d *Device) {
+	for {
+		for _, uuidKind := range []UUIDKind{UUID_KIND_ACI, UUID_KIND_PNI} {
+			if uuidKind == UUID_KIND_PNI && d.Data.PniIdentityKeyPair == nil {
+				continue
+			}
+			err := maintainPreKeys(d, uuidKind)
+			if err != nil {
+				log.Printf("Prekey maintenance for %v failed: %v", uuidKind, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(preKeyCheckInterval):
+		}
+	}
+}
+
+func maintainPreKeys(d *Device, uuidKind UUIDKind) error {
+	counts, err := getServerPreKeyCount(d, uuidKind)
+	if err != nil {
+		return fmt.Errorf("failed to get prekey count: %w", err)
+	}
+	if counts.Count < preKeyMinimumCount {
+		log.Printf("Server has %d %v prekeys left, uploading more", counts.Count, uuidKind)
+		err = refillPreKeys(d, uuidKind, preKeyBatchSize-counts.Count)
+		if err != nil {
+			return fmt.Errorf("failed to refill prekeys: %w", err)
+		}
+	}
+	if counts.PQCount < preKeyMinimumCount {
+		log.Printf("Server has %d %v kyber prekeys left, uploading more", counts.PQCount, uuidKind)
+		err = refillKyberPreKeys(d, uuidKind, preKeyBatchSize-counts.PQCount)
+		if err != nil {
+			return fmt.Errorf("failed to refill kyber prekeys: %w", err)
+		}
+	}
+
+	activeSignedPreKey, err := d.PreKeyStoreExtras.ActiveSignedPreKey(uuidKind)
+	if err != nil {
+		return fmt.Errorf("failed to get active signed prekey: %w", err)
+	}
+	needsRotation := activeSignedPreKey == nil
+	if activeSignedPreKey != nil {
+		generatedAt, err := activeSignedPreKey.GetTimestamp()
+		if err != nil {
+			return err
+		}
+		needsRotation = time.Since(generatedAt) > signedPreKeyRotationInterval
+	}
+	if needsRotation {
+		log.Printf("Rotating %v signed prekey", uuidKind)
+		activeSignedPreKey, err = rotateSignedPreKey(d, uuidKind)
+		if err != nil {
+			return fmt.Errorf("failed to rotate signed prekey: %w", err)
+		}
+	}
+
+	activeID, err := activeSignedPreKey.GetID()
+	if err != nil {
+		return err
+	}
+	deleted, err := d.PreKeyStoreExtras.DeleteSignedPreKeysOlderThan(uuidKind, time.Now().Add(-signedPreKeyGracePeriod), activeID)
+	if err != nil {
+		return fmt.Errorf("failed to prune signed prekeys: %w", err)
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d old %v signed prekeys", deleted, uuidKind)
+	}
+
+	return maintainLastResortKyberPreKey(d, uuidKind)
+}
+
+// The last-resort kyber prekey is rotated and pruned on the same schedule as the signed prekey
+func maintainLastResortKyberPreKey(d *Device, uuidKind UUIDKind) error {
+	activeLastResort, err := d.KyberPreKeyStoreExtras.ActiveLastResortKyberPreKey(uuidKind)
+	if err != nil {
+		return fmt.Errorf("failed to get last-resort kyber prekey: %w", err)
+	}
+	needsRotation := activeLastResort == nil
+	if activeLastResort != nil {
+		generatedAt, err := activeLastResort.GetTimestamp()
+		if err != nil {
+			return err
+		}
+		needsRotation = time.Since(generatedAt) > signedPreKeyRotationInterval
+	}
+	if needsRotation {
+		log.Printf("Rotating %v last-resort kyber prekey", uuidKind)
+		activeLastResort, err = rotateLastResortKyberPreKey(d, uuidKind)
+		if err != nil {
+			return fmt.Errorf("failed to rotate last-resort kyber prekey: %w", err)
+		}
+	}
+
+	activeID, err := activeLastResort.GetID()
+	if err != nil {
+		return err
+	}
+	deleted, err := d.KyberPreKeyStoreExtras.DeleteLastResortKyberPreKeysOlderThan(uuidKind, time.Now().Add(-signedPreKeyGracePeriod), activeID)
+	if err != nil {
+		return fmt.Errorf("failed to prune last-resort kyber prekeys: %w", err)
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d old %v last-resort kyber prekeys", deleted, uuidKind)
+	}
+	return nil
+}
+
+func identityKeyPairForKind(d *Device, uuidKind UUIDKind) *libsignalgo.IdentityKeyPair {
+	if uuidKind == UUID_KIND_PNI {
+		return d.Data.PniIdentityKeyPair
+	}
+	return d.Data.AciIdentityKeyPair
+}
+
+// Uploads count one-time prekeys, reusing ones left over from a failed upload first
+func refillPreKeys(d *Device, uuidKind UUIDKind, count int) error {
+	preKeys, err := d.PreKeyStoreExtras.GetUnuploadedPreKeys(uuidKind)
+	if err != nil {
+		return err
+	}
+	if len(preKeys) > count {
+		preKeys = preKeys[:count]
+	} else if len(preKeys) < count {
+		nextID, err := d.PreKeyStoreExtras.GetNextPreKeyID(uuidKind)
+		if err != nil {
+			return err
+		}
+		newPreKeys := *GeneratePreKeys(uint32(nextID), uint32(count-len(preKeys)), uuidKind)
+		newPreKeyPointers := make([]*libsignalgo.PreKeyRecord, len(newPreKeys))
+		for i := range newPreKeys {
+			newPreKeyPointers[i] = &newPreKeys[i]
+		}
+		err = d.PreKeyStoreExtras.SavePreKeys(uuidKind, newPreKeyPointers)
+		if err != nil {
+			return err
+		}
+		preKeys = append(preKeys, newPreKeyPointers...)
+	}
+
+	err = uploadPreKeys(d, uuidKind, &preKeyUpload{PreKeys: preKeys})
+	if err != nil {
+		return err
+	}
+	lastID, err := preKeys[len(preKeys)-1].GetID()
+	if err != nil {
+		return err
+	}
+	return d.PreKeyStoreExtras.MarkPreKeysAsUploaded(uuidKind, lastID)
+}
+
+// Uploads count one-time kyber prekeys, reusing ones left over from a failed upload first
+func refillKyberPreKeys(d *Device, uuidKind UUIDKind, count int) error {
+	preKeys, err := d.KyberPreKeyStoreExtras.GetUnuploadedKyberPreKeys(uuidKind)
+	if err != nil {
+		return err
+	}
+	if len(preKeys) > count {
+		preKeys = preKeys[:count]
+	} else if len(preKeys) < count {
+		nextID, err := d.KyberPreKeyStoreExtras.GetNextKyberPreKeyID(uuidKind)
+		if err != nil {
+			return err
+		}
+		newPreKeys, err := GenerateKyberPreKeys(uint32(nextID), uint32(count-len(preKeys)), identityKeyPairForKind(d, uuidKind))
+		if err != nil {
+			return err
+		}
+		err = d.KyberPreKeyStoreExtras.SaveKyberPreKeys(uuidKind, newPreKeys, false)
+		if err != nil {
+			return err
+		}
+		preKeys = append(preKeys, newPreKeys...)
+	}
+
+	err = uploadPreKeys(d, uuidKind, &preKeyUpload{KyberPreKeys: preKeys})
+	if err != nil {
+		return err
+	}
+	lastID, err := preKeys[len(preKeys)-1].GetID()
+	if err != nil {
+		return err
+	}
+	return d.KyberPreKeyStoreExtras.MarkKyberPreKeysAsUploaded(uuidKind, lastID, false)
+}
+
+func rotateLastResortKyberPreKey(d *Device, uuidKind UUIDKind) (*libsignalgo.KyberPreKeyRecord, error) {
+	nextID, err := d.KyberPreKeyStoreExtras.GetNextKyberPreKeyID(uuidKind)
+	if err != nil {
+		return nil, err
+	}
+	preKeys, err := GenerateKyberPreKeys(uint32(nextID), 1, identityKeyPairForKind(d, uuidKind))
+	if err != nil {
+		return nil, err
+	}
+	err = d.KyberPreKeyStoreExtras.SaveKyberPreKeys(uuidKind, preKeys, true)
+	if err != nil {
+		return nil, err
+	}
+	err = uploadPreKeys(d, uuidKind, &preKeyUpload{KyberLastResortPreKey: preKeys[0]})
+	if err != nil {
+		return nil, err
+	}
+	return preKeys[0], d.KyberPreKeyStoreExtras.MarkKyberPreKeysAsUploaded(uuidKind, nextID, true)
+}
+
+func rotateSignedPreKey(d *Device, uuidKind UUIDKind) (*libsignalgo.SignedPreKeyRecord, error) {
+	identityKeyPair := identityKeyPairForKind(d, uuidKind)
+	nextID, err := d.PreKeyStoreExtras.GetSignedNextPreKeyID(uuidKind)
+	if err != nil {
+		return nil, err
+	}
+	signedPreKey := GenerateSignedPreKey(uint32(nextID), uuidKind, identityKeyPair)
+	err = d.PreKeyStoreExtras.SaveSignedPreKey(uuidKind, signedPreKey, false)
+	if err != nil {
+		return nil, err
+	}
+	err = uploadPreKeys(d, uuidKind, &preKeyUpload{SignedPreKey: signedPreKey})
+	if err != nil {
+		return nil, err
+	}
+	return signedPreKey, d.PreKeyStoreExtras.MarkSignedPreKeysAsUploaded(uuidKind, nextID)
+}
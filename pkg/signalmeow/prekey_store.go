@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
 )
@@ -31,6 +32,9 @@ type PreKeyStoreExtras interface {
 	GetUnuploadedSignedPreKeys(uuidKind UUIDKind) ([]*libsignalgo.SignedPreKeyRecord, error)
 	GetUploadedPreKeyCount(uuidKind UUIDKind) (int, error)
 	GetUploadedSignedPreKeyCount(uuidKind UUIDKind) (int, error)
+	SavePreKeys(uuidKind UUIDKind, preKeys []*libsignalgo.PreKeyRecord) error
+	ActiveSignedPreKey(uuidKind UUIDKind) (*libsignalgo.SignedPreKeyRecord, error)
+	DeleteSignedPreKeysOlderThan(uuidKind UUIDKind, cutoff time.Time, keepID uint) (int, error)
 }
 
 // libsignalgo.PreKeyStore implementation
@@ -60,10 +64,12 @@ const (
 	getPreKeyQuery              = `SELECT key_id, key_pair FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND key_id=$2 AND uuid_kind=$3 and is_signed=$4`
 	insertPreKeyQuery           = `INSERT INTO signalmeow_pre_keys (aci_uuid, key_id, uuid_kind, is_signed, key_pair, uploaded) VALUES ($1, $2, $3, $4, $5, $6)`
 	deletePreKeyQuery           = `DELETE FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND key_id=$2 AND uuid_kind=$3 AND is_signed=$4`
-	getLastPreKeyIDQuery        = `SELECT MAX(key_id) FROM signalmeow_pre_keys WHERE aci_uuid=$1, uuid_kind=$2 AND is_signed=$3`
+	getLastPreKeyIDQuery        = `SELECT MAX(key_id) FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=$3`
 	markPreKeysAsUploadedQuery  = `UPDATE signalmeow_pre_keys SET uploaded=true WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=$3 AND key_id<=$4`
 	getUnuploadedPreKeysQuery   = `SELECT key_id, key_pair FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=$3 AND uploaded=false ORDER BY key_id`
 	getUploadedPreKeyCountQuery = `SELECT COUNT(*) FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=$3 AND uploaded=true`
+	getActiveSignedPreKeyQuery  = `SELECT key_id, key_pair FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=$3 AND uploaded=true ORDER BY key_id DESC LIMIT 1`
+	getAllSignedPreKeysQuery    = `SELECT key_id, key_pair FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=$3`
 )
 
 func scanPreKey(row scannable) (*libsignalgo.PreKeyRecord, error) {
@@ -213,3 +219,83 @@ func (s *SQLStore) GetUploadedSignedPreKeyCount(uuidKind UUIDKind) (count int, e
 	err = s.db.QueryRow(getUploadedPreKeyCountQuery, s.AciUuid, uuidKind, true).Scan(&count)
 	return count, err
 }
+
+// SavePreKeys stores a batch of new one-time prekeys as not uploaded, either all of them or none
+func (s *SQLStore) SavePreKeys(uuidKind UUIDKind, preKeys []*libsignalgo.PreKeyRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, preKey := range preKeys {
+		id, err := preKey.GetID()
+		if err != nil {
+			return err
+		}
+		serialized, err := preKey.Serialize()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(insertPreKeyQuery, s.AciUuid, id, uuidKind, false, serialized, false)
+		if err != nil {
+			return fmt.Errorf("failed to insert prekey %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ActiveSignedPreKey returns the most recently uploaded signed prekey, or nil if there isn't one
+func (s *SQLStore) ActiveSignedPreKey(uuidKind UUIDKind) (*libsignalgo.SignedPreKeyRecord, error) {
+	return scanSignedPreKey(s.db.QueryRow(getActiveSignedPreKeyQuery, s.AciUuid, uuidKind, true))
+}
+
+// DeleteSignedPreKeysOlderThan removes signed prekeys generated before the cutoff, except the one with keepID.
+// Returns how many were deleted.
+func (s *SQLStore) DeleteSignedPreKeysOlderThan(uuidKind UUIDKind, cutoff time.Time, keepID uint) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(getAllSignedPreKeysQuery, s.AciUuid, uuidKind, true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query signed prekeys: %w", err)
+	}
+	var expired []uint
+	for rows.Next() {
+		var id uint
+		var record []byte
+		err = rows.Scan(&id, &record)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if id == keepID {
+			continue
+		}
+		signedPreKey, err := libsignalgo.DeserializeSignedPreKeyRecord(record)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		timestamp, err := signedPreKey.GetTimestamp()
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if timestamp.Before(cutoff) {
+			expired = append(expired, id)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, id := range expired {
+		_, err = tx.Exec(deletePreKeyQuery, s.AciUuid, id, uuidKind, true)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete signed prekey %d: %w", id, err)
+		}
+	}
+	return len(expired), tx.Commit()
+}
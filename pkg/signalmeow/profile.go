@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"sync"
 	"time"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
@@ -24,15 +25,21 @@ type Profile struct {
 	Name       string
 	About      string
 	AboutEmoji string
+	// Only set if the server issued one for the profile key we have
+	Credential *libsignalgo.ExpiringProfileKeyCredential `json:"-"`
 }
 
-func ProfileKeyCredentialRequest(ctx context.Context, d *Device, signalId string) ([]byte, error) {
+// ProfileKeyCredentialRequest returns the hex encoded request, and the context needed to read the credential in the response
+func ProfileKeyCredentialRequest(ctx context.Context, d *Device, signalId string) (*libsignalgo.ProfileKeyCredentialRequestContext, []byte, error) {
 	profileKey, err := ProfileKeyForSignalID(ctx, d, signalId)
 	if err != nil {
 		log.Printf("ProfileKey error: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 	uuid, err := convertUUIDToByteUUID(signalId)
+	if err != nil {
+		return nil, nil, err
+	}
 	serverPublicParams := serverPublicParams()
 
 	requestContext, err := libsignalgo.CreateProfileKeyCredentialRequestContext(
@@ -42,18 +49,18 @@ func ProfileKeyCredentialRequest(ctx context.Context, d *Device, signalId string
 	)
 	if err != nil {
 		log.Printf("CreateProfileKeyCredentialRequestContext error: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	request, err := requestContext.ProfileKeyCredentialRequestContextGetRequest()
 	if err != nil {
 		log.Printf("CreateProfileKeyCredentialRequest error: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// convert request bytes to hexidecimal representation
 	hexRequest := hex.EncodeToString(request[:])
-	return []byte(hexRequest), nil
+	return requestContext, []byte(hexRequest), nil
 }
 
 func ProfileKeyForSignalID(ctx context.Context, d *Device, signalId string) (*libsignalgo.ProfileKey, error) {
@@ -67,30 +74,71 @@ func ProfileKeyForSignalID(ctx context.Context, d *Device, signalId string) (*li
 }
 
 func RetrieveProfileByID(ctx context.Context, d *Device, signalID string) (*Profile, error) {
+	cache := profileCache(d)
+
+	cache.lock.RLock()
+	lastFetched, ok := cache.lastFetched[signalID]
+	profile, cached := cache.profiles[signalID]
+	cache.lock.RUnlock()
+	if ok && cached && time.Since(lastFetched) < 1*time.Hour {
+		return profile, nil
+	}
+	profile, err := fetchProfileByID(ctx, d, signalID)
+	if err != nil {
+		return nil, err
+	}
+	cache.put(signalID, profile)
+	return profile, nil
+}
+
+// Protects creating the caches on a connection, since any goroutine may be the first to use them
+var cacheInitLock sync.Mutex
+
+func profileCache(d *Device) *ProfileCache {
+	cacheInitLock.Lock()
+	defer cacheInitLock.Unlock()
 	if d.Connection.ProfileCache == nil {
 		d.Connection.ProfileCache = &ProfileCache{
 			profiles:    make(map[string]*Profile),
 			lastFetched: make(map[string]time.Time),
 		}
 	}
+	return d.Connection.ProfileCache
+}
 
-	lastFetched, ok := d.Connection.ProfileCache.lastFetched[string(signalID)]
-	if ok && time.Since(lastFetched) < 1*time.Hour {
-		group, ok := d.Connection.ProfileCache.profiles[string(signalID)]
-		if ok {
-			return group, nil
+func (cache *ProfileCache) put(signalID string, profile *Profile) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.profiles[signalID] = profile
+	cache.lastFetched[signalID] = time.Now()
+}
+
+// Returns nil if there's no valid credential, e.g. because we don't know the user's profile key
+func profileKeyCredentialForSignalID(ctx context.Context, d *Device, signalID string) (*libsignalgo.ExpiringProfileKeyCredential, error) {
+	cache := profileCache(d)
+	cache.lock.RLock()
+	profile := cache.profiles[signalID]
+	cache.lock.RUnlock()
+	if profile != nil && profile.Credential != nil {
+		expiration, err := profile.Credential.ExpirationTime()
+		if err == nil && time.Now().Before(expiration) {
+			return profile.Credential, nil
 		}
 	}
-	group, err := fetchProfileByID(ctx, d, signalID)
+	// The cached profile may have been fetched before we had the profile key, or the credential expired
+	profile, err := fetchProfileByID(ctx, d, signalID)
 	if err != nil {
 		return nil, err
 	}
-	d.Connection.ProfileCache.profiles[string(signalID)] = group
-	d.Connection.ProfileCache.lastFetched[string(signalID)] = time.Now()
-	return group, nil
+	cache.put(signalID, profile)
+	if profile == nil {
+		return nil, nil
+	}
+	return profile.Credential, nil
 }
 
 type ProfileCache struct {
+	lock        sync.RWMutex
 	profiles    map[string]*Profile
 	lastFetched map[string]time.Time
 }
@@ -126,7 +174,7 @@ func fetchProfileByID(ctx context.Context, d *Device, signalID string) (*Profile
 	}
 	base64AccessKey := base64.StdEncoding.EncodeToString(accessKey[:])
 
-	credentialRequest, err := ProfileKeyCredentialRequest(ctx, d, signalID)
+	credentialRequestContext, credentialRequest, err := ProfileKeyCredentialRequest(ctx, d, signalID)
 	if err != nil {
 		log.Printf("ProfileKeyCredentialRequest error: %v", err)
 		return nil, err
@@ -175,6 +223,22 @@ func fetchProfileByID(ctx context.Context, d *Device, signalID string) (*Profile
 		return nil, err
 	}
 	log.Printf("profile: %v", profile)
+	var credentialResponse struct {
+		Credential []byte `json:"credential"`
+	}
+	err = json.Unmarshal(resp.Body, &credentialResponse)
+	if err == nil && len(credentialResponse.Credential) > 0 {
+		profile.Credential, err = libsignalgo.ReceiveExpiringProfileKeyCredential(
+			serverPublicParams(),
+			credentialRequestContext,
+			libsignalgo.ProfileKeyCredentialResponse(credentialResponse.Credential),
+			time.Now(),
+		)
+		if err != nil {
+			log.Printf("ReceiveExpiringProfileKeyCredential error: %v", err)
+			profile.Credential = nil
+		}
+	}
 	if profile.Name != "" {
 		base64Name, err := base64.StdEncoding.DecodeString(profile.Name)
 		decryptedName, err := decryptString(*profileKey, base64Name)
@@ -3,6 +3,7 @@ package signalmeow
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -15,6 +16,7 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// StartReceiveLoops connects the websockets and keeps our prekeys topped up, until ctx is cancelled
 func StartReceiveLoops(ctx context.Context, d *Device) error {
 	handler := incomingRequestHandlerWithDevice(d)
 	err := d.Connection.ConnectAuthedWS(ctx, d.Data, handler)
@@ -25,6 +27,10 @@ func StartReceiveLoops(ctx context.Context, d *Device) error {
 	if err != nil {
 		return err
 	}
+	if !d.Connection.preKeyMaintenanceStarted {
+		d.Connection.preKeyMaintenanceStarted = true
+		go runPreKeyMaintenance(ctx, d)
+	}
 	return nil
 }
 
@@ -40,13 +46,17 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 				return nil, err
 			}
 			var result *DecryptionResult
+			// Set when we know who sent a message we couldn't decrypt, so we can ask them to send it again
+			var decryptionFailure *failedDecryption
+			// Envelopes addressed to our phone number have to be decrypted with our PNI identity
+			stores := device.storesForDestination(envelope.GetDestinationUuid())
 
 			if *envelope.Type == signalpb.Envelope_UNIDENTIFIED_SENDER {
 				log.Printf("Received envelope type UNIDENTIFIED_SENDER, verb: %v, path: %v", *req.Verb, *req.Path)
 				ctx := context.Background()
 				usmc, err := libsignalgo.SealedSenderDecryptToUSMC(
 					envelope.GetContent(),
-					device.IdentityStore,
+					stores.IdentityStore,
 					libsignalgo.NewCallbackContext(ctx),
 				)
 				if err != nil {
@@ -77,7 +87,20 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 				if err != nil {
 					log.Printf("GetContents error: %v", err)
 				}
+				usmcGroupID, err := usmc.GetGroupID()
+				if err != nil {
+					log.Printf("GetGroupID error: %v", err)
+				}
 				log.Printf("SealedSender senderUUID: %v, senderDeviceID: %v", senderUUID, senderDeviceID)
+				sealedSenderFailure := &failedDecryption{
+					senderAddress:   senderAddress,
+					ciphertext:      usmcContents,
+					messageType:     messageType,
+					timestamp:       envelope.GetTimestamp(),
+					groupIdentifier: usmcGroupID,
+					sessionStore:    stores.SessionStoreExtras,
+				}
+				droppedPlaintext := false
 
 				if messageType == libsignalgo.CiphertextMessageTypeSenderKey {
 					log.Printf("SealedSender messageType is CiphertextMessageTypeSenderKey ")
@@ -94,6 +117,7 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 							log.Printf("Duplicate message, ignoring")
 						} else {
 							log.Printf("GroupDecrypt error: %v", err)
+							decryptionFailure = sealedSenderFailure
 						}
 					} else {
 						err = stripPadding(&decryptedText)
@@ -115,15 +139,10 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 
 				} else if messageType == libsignalgo.CiphertextMessageTypePreKey {
 					log.Printf("SealedSender messageType is CiphertextMessageTypePreKey")
-					result, err = prekeyDecrypt(*senderAddress, usmcContents, device, ctx)
+					result, err = prekeyDecrypt(*senderAddress, usmcContents, stores, ctx)
 					if err != nil {
-						if strings.Contains(err.Error(), "null pointer") {
-							// TODO: actually fix this, but ignoring for now because they just build up without a 200
-							responseCode = 200
-							log.Printf("sealed sender prekey decrypt null pointer error, ignoring")
-						} else {
-							log.Printf("prekeyDecrypt error: %v", err)
-						}
+						log.Printf("prekeyDecrypt error: %v", err)
+						decryptionFailure = sealedSenderFailure
 					} else {
 						responseCode = 200
 					}
@@ -137,12 +156,13 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 					decryptedText, err := libsignalgo.Decrypt(
 						message,
 						senderAddress,
-						device.SessionStore,
-						device.IdentityStore,
+						stores.SessionStore,
+						stores.IdentityStore,
 						libsignalgo.NewCallbackContext(ctx),
 					)
 					if err != nil {
 						log.Printf("Sealed sender Whisper Decryption error: %v", err)
+						decryptionFailure = sealedSenderFailure
 					} else {
 						err = stripPadding(&decryptedText)
 						if err != nil {
@@ -163,20 +183,31 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 
 				} else if messageType == libsignalgo.CiphertextMessageTypePlaintext {
 					log.Printf("SealedSender messageType is CiphertextMessageTypePlaintext")
+					result, err = plaintextContentDecrypt(*senderAddress, usmcContents)
+					if errors.Is(err, errUnexpectedPlaintextContent) {
+						log.Printf("Dropping plaintext content from %v: %v", senderUUID, err)
+						responseCode = 200
+						droppedPlaintext = true
+					} else if err != nil {
+						log.Printf("plaintextContentDecrypt error: %v", err)
+					} else {
+						responseCode = 200
+					}
 
 				} else {
 					log.Printf("SealedSender messageType is unknown")
 				}
 
 				// If we couldn't decrypt with specific decryption methods, try sealedSenderDecrypt
-				if result == nil || responseCode != 200 {
+				if !droppedPlaintext && (result == nil || responseCode != 200) {
 					log.Printf("Trying sealedSenderDecrypt")
 					var err error
-					result, err = sealedSenderDecrypt(envelope, device, ctx)
+					result, err = sealedSenderDecrypt(envelope, device, stores, ctx)
 					if err != nil {
 						if strings.Contains(err.Error(), "self send of a sealed sender message") {
 							// Message sent by us, ignore
 							responseCode = 200
+							decryptionFailure = nil
 							log.Printf("Message sent by us, ignoring")
 						} else {
 							log.Printf("sealedSenderDecrypt error: %v", err)
@@ -184,6 +215,7 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 					} else {
 						log.Printf("-----> SealedSender decrypt result - address: %v, content: %v", result.SenderAddress, result.Content)
 						responseCode = 200
+						decryptionFailure = nil
 					}
 				}
 
@@ -196,14 +228,15 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 				if err != nil {
 					return nil, fmt.Errorf("NewAddress error: %v", err)
 				}
-				result, err := prekeyDecrypt(*sender, envelope.Content, device, ctx)
+				result, err = prekeyDecrypt(*sender, envelope.Content, stores, ctx)
 				if err != nil {
-					if strings.Contains(err.Error(), "null pointer") {
-						// TODO: actually fix this, but ignoring for now because they just build up without a 200
-						responseCode = 200
-						log.Printf("prekey decrypt null pointer error, ignoring")
-					} else {
-						log.Printf("prekeyDecrypt error: %v", err)
+					log.Printf("prekeyDecrypt error: %v", err)
+					decryptionFailure = &failedDecryption{
+						senderAddress: sender,
+						ciphertext:    envelope.Content,
+						messageType:   libsignalgo.CiphertextMessageTypePreKey,
+						timestamp:     envelope.GetTimestamp(),
+						sessionStore:  stores.SessionStoreExtras,
 					}
 				} else {
 					log.Printf("-----> PreKey decrypt result -  address: %v, data: %v", result.SenderAddress, result.Content)
@@ -212,6 +245,23 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 
 			} else if *envelope.Type == signalpb.Envelope_PLAINTEXT_CONTENT {
 				log.Printf("Received envelope type PLAINTEXT_CONTENT, verb: %v, path: %v", *req.Verb, *req.Path)
+				sender, err := libsignalgo.NewAddress(
+					*envelope.SourceUuid,
+					uint(*envelope.SourceDevice),
+				)
+				if err != nil {
+					return nil, fmt.Errorf("NewAddress error: %v", err)
+				}
+				result, err = plaintextContentDecrypt(*sender, envelope.Content)
+				if errors.Is(err, errUnexpectedPlaintextContent) {
+					// Acknowledge it so the server doesn't keep sending it
+					log.Printf("Dropping plaintext content from %v: %v", *envelope.SourceUuid, err)
+					responseCode = 200
+				} else if err != nil {
+					log.Printf("plaintextContentDecrypt error: %v", err)
+				} else {
+					responseCode = 200
+				}
 
 			} else if *envelope.Type == signalpb.Envelope_CIPHERTEXT {
 				log.Printf("Received envelope type CIPHERTEXT, verb: %v, path: %v", *req.Verb, *req.Path)
@@ -226,8 +276,8 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 				decryptedText, err := libsignalgo.Decrypt(
 					message,
 					senderAddress,
-					device.SessionStore,
-					device.IdentityStore,
+					stores.SessionStore,
+					stores.IdentityStore,
 					libsignalgo.NewCallbackContext(ctx),
 				)
 				if err != nil {
@@ -237,6 +287,13 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 						log.Printf("Duplicate message, ignoring")
 					} else {
 						log.Printf("Whisper Decryption error: %v", err)
+						decryptionFailure = &failedDecryption{
+							senderAddress: senderAddress,
+							ciphertext:    envelope.Content,
+							messageType:   libsignalgo.CiphertextMessageTypeWhisper,
+							timestamp:     envelope.GetTimestamp(),
+							sessionStore:  stores.SessionStoreExtras,
+						}
 					}
 				} else {
 					err = stripPadding(&decryptedText)
@@ -258,7 +315,10 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 
 			} else if *envelope.Type == signalpb.Envelope_RECEIPT {
 				log.Printf("Received envelope type RECEIPT, verb: %v, path: %v", *req.Verb, *req.Path)
-				// TODO: handle receipt
+				// These are delivery receipts generated by the server, for clients that still send them the old way
+				if envelope.SourceUuid != nil {
+					handleIncomingReceipt(device, []uint64{envelope.GetTimestamp()}, IncomingSignalMessageReceiptTypeDelivery, envelope.GetSourceUuid(), device.Data.AciUuid)
+				}
 				responseCode = 200
 
 			} else if *envelope.Type == signalpb.Envelope_KEY_EXCHANGE {
@@ -271,6 +331,12 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 				log.Printf("Received actual unknown envelope type, verb: %v, path: %v", *req.Verb, *req.Path)
 			}
 
+			if result == nil && decryptionFailure != nil {
+				// Acknowledge the envelope, the sender will send the message again once they get our retry receipt
+				go handleDecryptionFailure(ctx, device, decryptionFailure)
+				responseCode = 200
+			}
+
 			// Handle content that is now decrypted
 			if result != nil && result.Content != nil {
 				content := result.Content
@@ -302,7 +368,19 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 					return nil, err
 				}
 
+				// Someone who only knows our phone number needs proof that our ACI is the same account,
+				// and once they message our ACI they've got it
+				if theirUuid != device.Data.AciUuid {
+					err = device.PniSignatureStore.SetPniSignatureNeeded(theirUuid, stores.isPni, ctx)
+					if err != nil {
+						log.Printf("SetPniSignatureNeeded error: %v", err)
+					}
+				}
+
 				// TODO: handle more sync messages
+				if content.SyncMessage != nil && theirUuid == device.Data.AciUuid && content.SyncMessage.Verified != nil {
+					handleIncomingVerified(ctx, device, content.SyncMessage.Verified)
+				}
 				if content.SyncMessage != nil {
 					if content.SyncMessage.Sent != nil {
 						if content.SyncMessage.Sent.Message != nil {
@@ -333,6 +411,32 @@ func incomingRequestHandlerWithDevice(device *Device) web.RequestHandlerFunc {
 						return nil, err
 					}
 				}
+
+				if content.TypingMessage != nil {
+					handleIncomingTypingMessage(device, content.TypingMessage, theirUuid, device.Data.AciUuid)
+				}
+
+				if content.DecryptionErrorMessage != nil {
+					theirDeviceID, err := result.SenderAddress.DeviceID()
+					if err != nil {
+						log.Printf("DeviceID error: %v", err)
+						return nil, err
+					}
+					go handleIncomingDecryptionErrorMessage(ctx, device, content.DecryptionErrorMessage, theirUuid, theirDeviceID)
+				}
+
+				if content.ReceiptMessage != nil {
+					var receiptType IncomingSignalMessageReceiptType
+					switch content.ReceiptMessage.GetType() {
+					case signalpb.ReceiptMessage_DELIVERY:
+						receiptType = IncomingSignalMessageReceiptTypeDelivery
+					case signalpb.ReceiptMessage_READ:
+						receiptType = IncomingSignalMessageReceiptTypeRead
+					case signalpb.ReceiptMessage_VIEWED:
+						receiptType = IncomingSignalMessageReceiptTypeViewed
+					}
+					handleIncomingReceipt(device, content.ReceiptMessage.GetTimestamp(), receiptType, theirUuid, device.Data.AciUuid)
+				}
 			}
 
 		} else if *req.Verb == "PUT" && *req.Path == "/api/v1/queue/empty" {
@@ -359,39 +463,168 @@ func handleIncomingDataMessage(ctx context.Context, device *Device, dataMessage
 		}
 	}
 
-	if device.Connection.IncomingSignalMessageHandler != nil && dataMessage.Body != nil {
-		var groupID *GroupID
-		if dataMessage.GetGroupV2() != nil {
-			groupMasterKeyBytes := dataMessage.GetGroupV2().GetMasterKey()
+	if device.Connection.IncomingSignalMessageHandler == nil {
+		return nil
+	}
+
+	var groupID *GroupID
+	if dataMessage.GetGroupV2() != nil {
+		groupMasterKeyBytes := dataMessage.GetGroupV2().GetMasterKey()
 
-			// TODO: should we be using base64 masterkey as an ID????!?
-			groupIDValue := groupIDFromMasterKey(libsignalgo.GroupMasterKey(groupMasterKeyBytes))
-			groupID = &groupIDValue
+		// TODO: should we be using base64 masterkey as an ID????!?
+		groupIDValue := groupIDFromMasterKey(libsignalgo.GroupMasterKey(groupMasterKeyBytes))
+		groupID = &groupIDValue
 
-			log.Printf("********* GROUP FETCH TEST *********")
-			// TODO: is this the best place to always fetch the group?
-			group, err := RetrieveGroupByID(ctx, device, groupIDValue)
-			if err != nil {
-				log.Printf("RetrieveGroupById error: %v", err)
-				return err
-			}
-			printGroup(group) // TODO: debug log
+		// Catch up on anything that changed in the group since the revision we have
+		changes, err := updateGroupFromContext(ctx, device, dataMessage.GetGroupV2())
+		if err != nil {
+			log.Printf("updateGroupFromContext error: %v", err)
+			return err
+		}
+		// Log entries don't always say who made the change, those are passed on without a sender
+		for _, change := range changes {
+			device.Connection.IncomingSignalMessageHandler(IncomingSignalMessageGroupChange{
+				IncomingSignalMessageBase: IncomingSignalMessageBase{
+					SenderUUID:    change.SourceUUID,
+					RecipientUUID: recipientUUID,
+					GroupID:       groupID,
+				},
+				Timestamp: dataMessage.GetTimestamp(),
+				Change:    change,
+			})
+		}
+	}
+
+	isExpireTimerUpdate := dataMessage.GetFlags()&uint32(signalpb.DataMessage_EXPIRATION_TIMER_UPDATE) != 0
+	if dataMessage.Body == nil && len(dataMessage.GetAttachments()) == 0 && dataMessage.Reaction == nil && dataMessage.Delete == nil && !isExpireTimerUpdate {
+		return nil
+	}
+	incomingMessageBase := IncomingSignalMessageBase{
+		SenderUUID:    senderUUID,
+		RecipientUUID: recipientUUID,
+		GroupID:       groupID,
+	}
+
+	// Only the first part of the message gets the quote
+	var quote *IncomingSignalMessageQuote
+	if dataMessage.Quote != nil {
+		quote = &IncomingSignalMessageQuote{
+			TargetMessageTimestamp: dataMessage.GetQuote().GetId(),
+			TargetAuthorUUID:       dataMessage.GetQuote().GetAuthorUuid(),
+			Text:                   dataMessage.GetQuote().GetText(),
+		}
+		for _, quotedAttachment := range dataMessage.GetQuote().GetAttachments() {
+			quote.AttachmentFilenames = append(quote.AttachmentFilenames, quotedAttachment.GetFileName())
 		}
+	}
+
+	if dataMessage.Body != nil {
 		incomingMessage := IncomingSignalMessageText{
-			IncomingSignalMessageBase: IncomingSignalMessageBase{
-				SenderUUID:    senderUUID,
-				RecipientUUID: recipientUUID,
-				GroupID:       groupID,
-			},
-			Timestamp: dataMessage.GetTimestamp(),
-			Content:   dataMessage.GetBody(),
+			IncomingSignalMessageBase: incomingMessageBase,
+			Timestamp:                 dataMessage.GetTimestamp(),
+			Content:                   dataMessage.GetBody(),
+			BodyRanges:                dataMessage.GetBodyRanges(),
+			Quote:                     quote,
+			ExpiresIn:                 dataMessage.GetExpireTimer(),
+		}
+		device.Connection.IncomingSignalMessageHandler(incomingMessage)
+		quote = nil
+	}
+
+	for _, attachmentPointer := range dataMessage.GetAttachments() {
+		incomingMessage := IncomingSignalMessageAttachment{
+			IncomingSignalMessageBase: incomingMessageBase,
+			Timestamp:                 dataMessage.GetTimestamp(),
+			Pointer:                   attachmentPointer,
+			Filename:                  attachmentPointer.GetFileName(),
+			ContentType:               attachmentPointer.GetContentType(),
+			Caption:                   attachmentPointer.GetCaption(),
+			Size:                      uint64(attachmentPointer.GetSize()),
+			Width:                     attachmentPointer.GetWidth(),
+			Height:                    attachmentPointer.GetHeight(),
+			BlurHash:                  attachmentPointer.GetBlurHash(),
+			Flags:                     attachmentPointer.GetFlags(),
+			Quote:                     quote,
+			ExpiresIn:                 dataMessage.GetExpireTimer(),
 		}
+		device.Connection.IncomingSignalMessageHandler(incomingMessage)
+		quote = nil
+	}
+
+	if dataMessage.Reaction != nil {
+		incomingMessage := IncomingSignalMessageReaction{
+			IncomingSignalMessageBase: incomingMessageBase,
+			Timestamp:                 dataMessage.GetTimestamp(),
+			Emoji:                     dataMessage.GetReaction().GetEmoji(),
+			Remove:                    dataMessage.GetReaction().GetRemove(),
+			TargetAuthorUUID:          dataMessage.GetReaction().GetTargetAuthorUuid(),
+			TargetMessageTimestamp:    dataMessage.GetReaction().GetTargetSentTimestamp(),
+		}
+		device.Connection.IncomingSignalMessageHandler(incomingMessage)
+	}
 
+	if dataMessage.Delete != nil {
+		incomingMessage := IncomingSignalMessageDelete{
+			IncomingSignalMessageBase: incomingMessageBase,
+			Timestamp:                 dataMessage.GetTimestamp(),
+			TargetMessageTimestamp:    dataMessage.GetDelete().GetTargetSentTimestamp(),
+		}
+		device.Connection.IncomingSignalMessageHandler(incomingMessage)
+	}
+
+	if isExpireTimerUpdate {
+		incomingMessage := IncomingSignalMessageExpireTimerUpdate{
+			IncomingSignalMessageBase: incomingMessageBase,
+			Timestamp:                 dataMessage.GetTimestamp(),
+			ExpireTimer:               dataMessage.GetExpireTimer(),
+		}
 		device.Connection.IncomingSignalMessageHandler(incomingMessage)
 	}
 	return nil
 }
 
+func handleIncomingTypingMessage(device *Device, typingMessage *signalpb.TypingMessage, senderUUID string, recipientUUID string) {
+	if device.Connection.IncomingSignalMessageHandler == nil {
+		return
+	}
+	var groupID *GroupID
+	if typingMessage.GroupId != nil {
+		groupIDValue, ok := groupIDForIdentifier(device, typingMessage.GroupId)
+		if !ok {
+			// Typing messages don't include the master key, so we can't do anything with groups we don't know yet
+			log.Printf("Dropping typing message for unknown group")
+			return
+		}
+		groupID = &groupIDValue
+	}
+	incomingMessage := IncomingSignalMessageTyping{
+		IncomingSignalMessageBase: IncomingSignalMessageBase{
+			SenderUUID:    senderUUID,
+			RecipientUUID: recipientUUID,
+			GroupID:       groupID,
+		},
+		Timestamp: typingMessage.GetTimestamp(),
+		IsTyping:  typingMessage.GetAction() == signalpb.TypingMessage_STARTED,
+	}
+	device.Connection.IncomingSignalMessageHandler(incomingMessage)
+}
+
+// Receipts don't say which chat they're for, the timestamps are all there is to go on
+func handleIncomingReceipt(device *Device, timestamps []uint64, receiptType IncomingSignalMessageReceiptType, senderUUID string, recipientUUID string) {
+	if device.Connection.IncomingSignalMessageHandler == nil || len(timestamps) == 0 {
+		return
+	}
+	incomingMessage := IncomingSignalMessageReceipt{
+		IncomingSignalMessageBase: IncomingSignalMessageBase{
+			SenderUUID:    senderUUID,
+			RecipientUUID: recipientUUID,
+		},
+		Timestamps:  timestamps,
+		ReceiptType: receiptType,
+	}
+	device.Connection.IncomingSignalMessageHandler(incomingMessage)
+}
+
 type DecryptionResult struct {
 	SenderAddress libsignalgo.Address
 	Content       *signalpb.Content
@@ -414,10 +647,14 @@ func serverTrustRootKey() *libsignalgo.PublicKey {
 	return serverTrustRootKey
 }
 
-func sealedSenderDecrypt(envelope *signalpb.Envelope, device *Device, ctx context.Context) (*DecryptionResult, error) {
+func sealedSenderDecrypt(envelope *signalpb.Envelope, device *Device, stores *identityStores, ctx context.Context) (*DecryptionResult, error) {
+	localUuid := device.Data.AciUuid
+	if stores.isPni {
+		localUuid = device.Data.PniUuid
+	}
 	localAddress := libsignalgo.NewSealedSenderAddress(
 		device.Data.Number,
-		uuid.MustParse(device.Data.AciUuid),
+		uuid.MustParse(localUuid),
 		uint32(device.Data.DeviceId),
 	)
 	timestamp := time.Unix(0, int64(*envelope.Timestamp))
@@ -426,10 +663,10 @@ func sealedSenderDecrypt(envelope *signalpb.Envelope, device *Device, ctx contex
 		localAddress,
 		serverTrustRootKey(),
 		timestamp,
-		device.SessionStore,
-		device.IdentityStore,
-		device.PreKeyStore,
-		device.SignedPreKeyStore,
+		stores.SessionStore,
+		stores.IdentityStore,
+		stores.PreKeyStore,
+		stores.SignedPreKeyStore,
 		libsignalgo.NewCallbackContext(ctx),
 	)
 
@@ -461,7 +698,7 @@ func sealedSenderDecrypt(envelope *signalpb.Envelope, device *Device, ctx contex
 	return DecryptionResult, nil
 }
 
-func prekeyDecrypt(sender libsignalgo.Address, encryptedContent []byte, device *Device, ctx context.Context) (*DecryptionResult, error) {
+func prekeyDecrypt(sender libsignalgo.Address, encryptedContent []byte, stores *identityStores, ctx context.Context) (*DecryptionResult, error) {
 	preKeyMessage, err := libsignalgo.DeserializePreKeyMessage(encryptedContent)
 	if err != nil {
 		return nil, fmt.Errorf("DeserializePreKeyMessage error: %v", err)
@@ -473,10 +710,11 @@ func prekeyDecrypt(sender libsignalgo.Address, encryptedContent []byte, device *
 	data, err := libsignalgo.DecryptPreKey(
 		preKeyMessage,
 		&sender,
-		device.SessionStore,
-		device.IdentityStore,
-		device.PreKeyStore,
-		device.SignedPreKeyStore,
+		stores.SessionStore,
+		stores.IdentityStore,
+		stores.PreKeyStore,
+		stores.SignedPreKeyStore,
+		stores.KyberPreKeyStore,
 		libsignalgo.NewCallbackContext(ctx),
 	)
 	if err != nil {
@@ -0,0 +1,321 @@
+package signalmeow
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// How long we keep sent messages around in case a recipient asks for them again
+const sendLogRetention = 24 * time.Hour
+
+type sendLogKey struct {
+	recipientUuid string
+	timestamp     uint64
+}
+
+type sendLogEntry struct {
+	content *signalpb.Content
+	groupID *GroupID // Set if the content was sent to a group
+	sentAt  time.Time
+}
+
+// SendLog remembers recently sent messages, so they can be resent when a
+// recipient sends us a retry receipt saying they couldn't decrypt them
+type SendLog struct {
+	lock    sync.Mutex
+	entries map[sendLogKey]*sendLogEntry
+}
+
+func initSendLog(d *Device) {
+	if d.Connection.SendLog == nil {
+		d.Connection.SendLog = &SendLog{
+			entries: make(map[sendLogKey]*sendLogEntry),
+		}
+	}
+}
+
+func (l *SendLog) add(recipients []string, timestamp uint64, content *signalpb.Content, groupID *GroupID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for key, entry := range l.entries {
+		if now.Sub(entry.sentAt) > sendLogRetention {
+			delete(l.entries, key)
+		}
+	}
+	entry := &sendLogEntry{content: content, groupID: groupID, sentAt: now}
+	for _, recipientUuid := range recipients {
+		l.entries[sendLogKey{recipientUuid, timestamp}] = entry
+	}
+}
+
+func (l *SendLog) get(recipientUuid string, timestamp uint64) *sendLogEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry, ok := l.entries[sendLogKey{recipientUuid, timestamp}]
+	if !ok || time.Since(entry.sentAt) > sendLogRetention {
+		return nil
+	}
+	return entry
+}
+
+// Only DataMessages are worth resending, everything else is stale by the time a retry receipt arrives
+func addToSendLog(d *Device, recipients []string, timestamp uint64, content *signalpb.Content, groupID *GroupID) {
+	if content.DataMessage == nil || len(recipients) == 0 {
+		return
+	}
+	initSendLog(d)
+	d.Connection.SendLog.add(recipients, timestamp, content, groupID)
+}
+
+// A message we couldn't decrypt, with everything needed to ask the sender for it again
+type failedDecryption struct {
+	senderAddress   *libsignalgo.Address
+	ciphertext      []byte
+	messageType     libsignalgo.CiphertextMessageType
+	timestamp       uint64
+	groupIdentifier []byte // Only known for sealed sender messages
+	// The sessions of the identity (ACI or PNI) the message was sent to
+	sessionStore SessionStoreExtras
+}
+
+// Asks the sender to resend the message, archives the broken session and lets the user know
+func handleDecryptionFailure(ctx context.Context, device *Device, failure *failedDecryption) {
+	senderUuid, err := failure.senderAddress.Name()
+	if err != nil {
+		log.Printf("Name error: %v", err)
+		return
+	}
+	senderDeviceID, err := failure.senderAddress.DeviceID()
+	if err != nil {
+		log.Printf("DeviceID error: %v", err)
+		return
+	}
+	log.Printf("Couldn't decrypt message %v from %v.%v, sending retry receipt", failure.timestamp, senderUuid, senderDeviceID)
+
+	dem, err := libsignalgo.DecryptionErrorMessageForOriginalMessage(failure.ciphertext, uint8(failure.messageType), failure.timestamp, senderDeviceID)
+	if err != nil {
+		log.Printf("DecryptionErrorMessageForOriginalMessage error: %v", err)
+	} else {
+		err = sendRetryReceipt(ctx, device, senderUuid, dem)
+		if err != nil {
+			log.Printf("Failed to send retry receipt to %v: %v", senderUuid, err)
+		}
+	}
+
+	// Sender key failures don't mean anything is wrong with our session with them
+	if failure.messageType != libsignalgo.CiphertextMessageTypeSenderKey {
+		err = failure.sessionStore.RemoveSession(failure.senderAddress, ctx)
+		if err != nil {
+			log.Printf("RemoveSession error: %v", err)
+		}
+	}
+
+	if device.Connection.IncomingSignalMessageHandler == nil {
+		return
+	}
+	var groupID *GroupID
+	if failure.groupIdentifier != nil {
+		if groupIDValue, ok := groupIDForIdentifier(device, failure.groupIdentifier); ok {
+			groupID = &groupIDValue
+		}
+	}
+	device.Connection.IncomingSignalMessageHandler(IncomingSignalMessageDecryptionError{
+		IncomingSignalMessageBase: IncomingSignalMessageBase{
+			SenderUUID:    senderUuid,
+			RecipientUUID: device.Data.AciUuid,
+			GroupID:       groupID,
+		},
+		Timestamp: failure.timestamp,
+	})
+}
+
+func sendRetryReceipt(ctx context.Context, device *Device, recipientUuid string, dem *libsignalgo.DecryptionErrorMessage) error {
+	plaintextContent, err := libsignalgo.PlaintextContentFromDecryptionErrorMessage(*dem)
+	if err != nil {
+		return err
+	}
+	serialized, err := plaintextContent.Serialize()
+	if err != nil {
+		return err
+	}
+	return sendPlaintextContent(ctx, device, recipientUuid, serialized, 0)
+}
+
+// Plaintext content isn't encrypted, so every device of the recipient gets the same payload.
+// Devices the retry receipt isn't meant for ignore it.
+func sendPlaintextContent(ctx context.Context, d *Device, recipientUuid string, plaintextContent []byte, retryCount int) error {
+	if retryCount > 3 {
+		return fmt.Errorf("Too many retries")
+	}
+	addresses, sessionRecords, err := d.SessionStoreExtras.AllSessionsForUUID(recipientUuid, ctx)
+	if err != nil {
+		return err
+	}
+	messages := make([]MyMessage, 0, len(addresses))
+	for i, address := range addresses {
+		deviceID, err := address.DeviceID()
+		if err != nil {
+			return err
+		}
+		registrationID, err := sessionRecords[i].GetRemoteRegistrationID()
+		if err != nil {
+			return err
+		}
+		messages = append(messages, MyMessage{
+			Type:                      int(signalpb.Envelope_PLAINTEXT_CONTENT),
+			DestinationDeviceID:       int(deviceID),
+			DestinationRegistrationID: int(registrationID),
+			Content:                   base64.StdEncoding.EncodeToString(plaintextContent),
+		})
+	}
+	jsonBytes, err := json.Marshal(MyMessages{
+		Timestamp: int64(currentMessageTimestamp()),
+		Online:    false,
+		Urgent:    false,
+		Messages:  messages,
+	})
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/v1/messages/%v", recipientUuid)
+	request := web.CreateWSRequest("PUT", path, jsonBytes, nil, nil)
+	responseChan, err := d.Connection.AuthedWS.SendRequest(ctx, request)
+	if err != nil {
+		return err
+	}
+	response := <-responseChan
+
+	switch *response.Status {
+	case 200:
+		return nil
+	case 409, 410:
+		// Sessions with devices we didn't know about (or that re-registered) get fetched, then try again
+		err = handle409(ctx, d, recipientUuid, response)
+		if err != nil {
+			return err
+		}
+		return sendPlaintextContent(ctx, d, recipientUuid, plaintextContent, retryCount+1)
+	case 413, 429:
+		return &RateLimitedError{RetryAfter: retryAfterFromResponse(response)}
+	default:
+		return fmt.Errorf("Unexpected status code: %v", *response.Status)
+	}
+}
+
+// PLAINTEXT_CONTENT isn't end-to-end encrypted, so anything in it other than a retry receipt could be forged
+var errUnexpectedPlaintextContent = errors.New("plaintext content isn't just a decryption error message")
+
+// Decrypts PLAINTEXT_CONTENT, which is only used for retry receipts
+func plaintextContentDecrypt(sender libsignalgo.Address, contents []byte) (*DecryptionResult, error) {
+	plaintextContent, err := libsignalgo.DeserializePlaintextContent(contents)
+	if err != nil {
+		return nil, fmt.Errorf("DeserializePlaintextContent error: %v", err)
+	}
+	body, err := plaintextContent.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("GetBody error: %v", err)
+	}
+	err = stripPadding(&body)
+	if err != nil {
+		return nil, fmt.Errorf("stripPadding error: %v", err)
+	}
+	content := &signalpb.Content{}
+	err = proto.Unmarshal(body, content)
+	if err != nil {
+		return nil, err
+	}
+	fields := 0
+	content.ProtoReflect().Range(func(protoreflect.FieldDescriptor, protoreflect.Value) bool {
+		fields++
+		return true
+	})
+	if content.DecryptionErrorMessage == nil || fields != 1 {
+		return nil, errUnexpectedPlaintextContent
+	}
+	return &DecryptionResult{
+		SenderAddress: sender,
+		Content:       content,
+	}, nil
+}
+
+// Someone couldn't decrypt a message we sent them: start a new session if ours was broken,
+// and send them the message again if we still have it
+func handleIncomingDecryptionErrorMessage(ctx context.Context, device *Device, demBytes []byte, senderUuid string, senderDeviceID uint) {
+	dem, err := libsignalgo.DeserializeDecryptionErrorMessage(demBytes)
+	if err != nil {
+		log.Printf("DeserializeDecryptionErrorMessage error: %v", err)
+		return
+	}
+	deviceID, err := dem.GetDeviceID()
+	if err != nil {
+		log.Printf("GetDeviceID error: %v", err)
+		return
+	} else if deviceID != uint32(device.Data.DeviceId) {
+		// The failed message came from one of our other devices
+		return
+	}
+	sentAt, err := dem.GetTimestamp()
+	if err != nil {
+		log.Printf("GetTimestamp error: %v", err)
+		return
+	}
+	timestamp := uint64(sentAt.UnixMilli())
+	ratchetKey, err := dem.GetRatchetKey()
+	if err != nil {
+		log.Printf("GetRatchetKey error: %v", err)
+		return
+	}
+	log.Printf("%v.%v couldn't decrypt our message %v", senderUuid, senderDeviceID, timestamp)
+
+	initSendLog(device)
+	entry := device.Connection.SendLog.get(senderUuid, timestamp)
+
+	// A ratchet key means the 1:1 session is broken, so archive it and the resend will start a new one
+	if ratchetKey != nil {
+		address, err := libsignalgo.NewAddress(senderUuid, senderDeviceID)
+		if err != nil {
+			log.Printf("NewAddress error: %v", err)
+			return
+		}
+		err = device.SessionStoreExtras.RemoveSession(address, ctx)
+		if err != nil {
+			log.Printf("RemoveSession error: %v", err)
+			return
+		}
+	}
+	// Make sure our next group message includes the sender key again
+	if entry != nil && entry.groupID != nil {
+		err = device.SenderKeyDistributionStore.UnmarkSenderKeySharedWith(*entry.groupID, []SenderKeySharedDevice{{Uuid: senderUuid, DeviceID: int(senderDeviceID)}}, ctx)
+		if err != nil {
+			log.Printf("UnmarkSenderKeySharedWith error: %v", err)
+		}
+	}
+
+	if entry != nil {
+		_, err = sendContent(ctx, device, senderUuid, timestamp, entry.content, 0)
+		if err != nil {
+			log.Printf("Failed to resend message %v to %v: %v", timestamp, senderUuid, err)
+		}
+	} else if ratchetKey != nil {
+		// We don't have the message anymore, but a null message still gets the new session going
+		nullMessage := &signalpb.Content{NullMessage: &signalpb.NullMessage{}}
+		_, err = sendContent(ctx, device, senderUuid, currentMessageTimestamp(), nullMessage, 0)
+		if err != nil {
+			log.Printf("Failed to send null message to %v: %v", senderUuid, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package signalmeow
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/google/uuid"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// Same as the official apps, otherwise the safety numbers wouldn't match
+const fingerprintIterations = 5200
+
+// SafetyNumber is what two users compare to make sure nobody is intercepting their messages
+type SafetyNumber struct {
+	DisplayString string // 60 digits
+	Scannable     []byte // Contents of the QR code the official apps can scan
+	Verified      bool
+}
+
+func GetSafetyNumber(ctx context.Context, d *Device, theirUuid string) (*SafetyNumber, error) {
+	theirIdentityKey, verified, err := d.IdentityStoreExtras.IdentityKeyForUUID(theirUuid, ctx)
+	if err == nil && theirIdentityKey == nil {
+		// We've never talked to them, fetching a prekey stores their identity key
+		err = FetchAndProcessPreKey(ctx, d, theirUuid, -1)
+		if err == nil {
+			theirIdentityKey, verified, err = d.IdentityStoreExtras.IdentityKeyForUUID(theirUuid, ctx)
+		}
+	}
+	if err != nil {
+		return nil, err
+	} else if theirIdentityKey == nil {
+		return nil, fmt.Errorf("no identity key found for %v", theirUuid)
+	}
+
+	ourUuid, err := uuid.Parse(d.Data.AciUuid)
+	if err != nil {
+		return nil, err
+	}
+	theirParsedUuid, err := uuid.Parse(theirUuid)
+	if err != nil {
+		return nil, err
+	}
+	serializedKey, err := theirIdentityKey.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	theirPublicKey, err := libsignalgo.DeserializePublicKey(serializedKey)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := libsignalgo.NewFingerprint(
+		fingerprintIterations,
+		libsignalgo.FingerprintVersionV2,
+		ourUuid[:],
+		d.Data.AciIdentityKeyPair.GetPublicKey(),
+		theirParsedUuid[:],
+		theirPublicKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	displayString, err := fingerprint.DisplayString()
+	if err != nil {
+		return nil, err
+	}
+	scannable, err := fingerprint.ScannableEncoding()
+	if err != nil {
+		return nil, err
+	}
+	return &SafetyNumber{
+		DisplayString: displayString,
+		Scannable:     scannable,
+		Verified:      verified,
+	}, nil
+}
+
+// SetIdentityVerified marks the current identity key of the contact as verified (or not),
+// and tells our other devices so they show the same
+func SetIdentityVerified(ctx context.Context, d *Device, theirUuid string, verified bool) error {
+	theirIdentityKey, _, err := d.IdentityStoreExtras.IdentityKeyForUUID(theirUuid, ctx)
+	if err != nil {
+		return err
+	} else if theirIdentityKey == nil {
+		return fmt.Errorf("no identity key found for %v", theirUuid)
+	}
+	serializedKey, err := theirIdentityKey.Serialize()
+	if err != nil {
+		return err
+	}
+	_, err = d.IdentityStoreExtras.SetIdentityVerified(theirUuid, serializedKey, verified, ctx)
+	if err != nil {
+		return err
+	}
+
+	FetchAndProcessPreKey(ctx, d, d.Data.AciUuid, -1)
+	if howManyOtherDevicesDoWeHave(ctx, d) == 0 {
+		return nil
+	}
+	state := signalpb.Verified_DEFAULT
+	if verified {
+		state = signalpb.Verified_VERIFIED
+	}
+	// Random padding, so the size of the message doesn't give away what it is
+	paddingLength, err := rand.Int(rand.Reader, big.NewInt(140))
+	if err != nil {
+		return err
+	}
+	padding := make([]byte, paddingLength.Int64()+1)
+	_, err = rand.Read(padding)
+	if err != nil {
+		return err
+	}
+	syncContent := &signalpb.Content{
+		SyncMessage: &signalpb.SyncMessage{
+			Verified: &signalpb.Verified{
+				DestinationUuid: &theirUuid,
+				IdentityKey:     serializedKey,
+				State:           &state,
+				NullMessage:     padding,
+			},
+		},
+	}
+	_, err = sendContent(ctx, d, d.Data.AciUuid, currentMessageTimestamp(), syncContent, 0)
+	return err
+}
+
+// Another one of our devices verified (or unverified) a contact
+func handleIncomingVerified(ctx context.Context, d *Device, verified *signalpb.Verified) {
+	theirUuid := verified.GetDestinationUuid()
+	isVerified := verified.GetState() == signalpb.Verified_VERIFIED
+	updated, err := d.IdentityStoreExtras.SetIdentityVerified(theirUuid, verified.GetIdentityKey(), isVerified, ctx)
+	if err != nil {
+		log.Printf("SetIdentityVerified error: %v", err)
+	} else if !updated {
+		log.Printf("Ignoring verification state of %v, the identity key doesn't match the one we know", theirUuid)
+	}
+}
@@ -0,0 +1,147 @@
+package signalmeow
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+var _ SenderKeyDistributionStore = (*SQLStore)(nil)
+
+// SenderKeyDistribution is the sender key we use to send to a group
+type SenderKeyDistribution struct {
+	GroupID        GroupID
+	DistributionID uuid.UUID
+	// Group revision the member list was last checked at
+	Revision uint32
+}
+
+// SenderKeySharedDevice is a recipient device that already has our sender key for a group
+type SenderKeySharedDevice struct {
+	Uuid     string
+	DeviceID int
+}
+
+type SenderKeyDistributionStore interface {
+	// LoadSenderKeyDistribution loads the distribution we use in the group.
+	// If we haven't sent a sender key message to the group yet, nil is returned.
+	LoadSenderKeyDistribution(groupID GroupID, ctx context.Context) (*SenderKeyDistribution, error)
+	StoreSenderKeyDistribution(distribution *SenderKeyDistribution, ctx context.Context) error
+	// DeleteSenderKeyDistribution forgets the distribution, who it was shared with and our key for it,
+	// so that the next message to the group starts with a fresh key.
+	DeleteSenderKeyDistribution(groupID GroupID, ctx context.Context) error
+
+	SenderKeySharedWith(groupID GroupID, ctx context.Context) ([]SenderKeySharedDevice, error)
+	MarkSenderKeySharedWith(groupID GroupID, devices []SenderKeySharedDevice, ctx context.Context) error
+	// UnmarkSenderKeySharedWith makes the next message to the group include our sender key for these devices again
+	UnmarkSenderKeySharedWith(groupID GroupID, devices []SenderKeySharedDevice, ctx context.Context) error
+}
+
+const (
+	loadSenderKeyDistributionQuery   = `SELECT distribution_id, revision FROM signalmeow_sender_key_distributions WHERE our_aci_uuid=$1 AND group_id=$2`
+	storeSenderKeyDistributionQuery  = `INSERT OR REPLACE INTO signalmeow_sender_key_distributions (our_aci_uuid, group_id, distribution_id, revision) VALUES ($1, $2, $3, $4)` // SQLite specific
+	deleteSenderKeyDistributionQuery = `DELETE FROM signalmeow_sender_key_distributions WHERE our_aci_uuid=$1 AND group_id=$2`
+	deleteOwnSenderKeyQuery          = `DELETE FROM signalmeow_sender_keys WHERE our_aci_uuid=$1 AND sender_uuid=$1 AND distribution_id=$2`
+	loadSenderKeySharedWithQuery     = `SELECT their_aci_uuid, their_device_id FROM signalmeow_sender_key_shared_with WHERE our_aci_uuid=$1 AND group_id=$2`
+	storeSenderKeySharedWithQuery    = `INSERT OR IGNORE INTO signalmeow_sender_key_shared_with (our_aci_uuid, group_id, their_aci_uuid, their_device_id) VALUES ($1, $2, $3, $4)` // SQLite specific
+	deleteSenderKeySharedWithQuery   = `DELETE FROM signalmeow_sender_key_shared_with WHERE our_aci_uuid=$1 AND group_id=$2`
+	deleteSenderKeySharedDeviceQuery = `DELETE FROM signalmeow_sender_key_shared_with WHERE our_aci_uuid=$1 AND group_id=$2 AND their_aci_uuid=$3 AND their_device_id=$4`
+)
+
+func (s *SQLStore) LoadSenderKeyDistribution(groupID GroupID, ctx context.Context) (*SenderKeyDistribution, error) {
+	distribution := SenderKeyDistribution{GroupID: groupID}
+	var distributionID string
+	err := s.db.QueryRow(loadSenderKeyDistributionQuery, s.AciUuid, groupID).Scan(&distributionID, &distribution.Revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	distribution.DistributionID, err = uuid.Parse(distributionID)
+	if err != nil {
+		return nil, err
+	}
+	return &distribution, nil
+}
+
+func (s *SQLStore) StoreSenderKeyDistribution(distribution *SenderKeyDistribution, ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, storeSenderKeyDistributionQuery, s.AciUuid, distribution.GroupID, distribution.DistributionID.String(), distribution.Revision)
+	return err
+}
+
+func (s *SQLStore) DeleteSenderKeyDistribution(groupID GroupID, ctx context.Context) error {
+	distribution, err := s.LoadSenderKeyDistribution(groupID, ctx)
+	if err != nil || distribution == nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(deleteSenderKeySharedWithQuery, s.AciUuid, groupID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(deleteSenderKeyDistributionQuery, s.AciUuid, groupID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(deleteOwnSenderKeyQuery, s.AciUuid, distribution.DistributionID.String())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) SenderKeySharedWith(groupID GroupID, ctx context.Context) ([]SenderKeySharedDevice, error) {
+	rows, err := s.db.Query(loadSenderKeySharedWithQuery, s.AciUuid, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var devices []SenderKeySharedDevice
+	for rows.Next() {
+		var device SenderKeySharedDevice
+		err = rows.Scan(&device.Uuid, &device.DeviceID)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+func (s *SQLStore) MarkSenderKeySharedWith(groupID GroupID, devices []SenderKeySharedDevice, ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		_, err = tx.Exec(storeSenderKeySharedWithQuery, s.AciUuid, groupID, device.Uuid, device.DeviceID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) UnmarkSenderKeySharedWith(groupID GroupID, devices []SenderKeySharedDevice, ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		_, err = tx.Exec(deleteSenderKeySharedDeviceQuery, s.AciUuid, groupID, device.Uuid, device.DeviceID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
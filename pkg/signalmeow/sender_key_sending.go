@@ -0,0 +1,396 @@
+package signalmeow
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// Group messages are sent the way the official clients do it: each group has one sender key distribution ID,
+// members get our SenderKeyDistributionMessage (SKDM) once per device, and then every message is encrypted
+// once with the sender key and sent to all members in a single multi-recipient sealed sender request.
+
+func senderKeyDeviceKey(recipientUuid string, deviceID int) string {
+	return fmt.Sprintf("%s.%d", recipientUuid, deviceID)
+}
+
+// Throws away our sender key for the group, the next message will distribute a new one to everyone
+func rotateSenderKey(ctx context.Context, d *Device, groupID GroupID, reason string) error {
+	log.Printf("Rotating sender key for %v: %v", groupID, reason)
+	return d.SenderKeyDistributionStore.DeleteSenderKeyDistribution(groupID, ctx)
+}
+
+// Loads our distribution for the group, or creates one if there isn't any. If the group revision changed since the
+// last send and someone who has our key isn't a member anymore, the key is rotated so they can't read new messages.
+// Also returns the set of devices that already have the key.
+func senderKeyDistributionForGroup(ctx context.Context, d *Device, group *Group) (*SenderKeyDistribution, map[string]bool, error) {
+	store := d.SenderKeyDistributionStore
+	distribution, err := store.LoadSenderKeyDistribution(group.GroupID, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if distribution != nil && distribution.Revision != group.Revision {
+		members := make(map[string]bool, len(group.Members))
+		for _, member := range group.Members {
+			members[member.UserId] = true
+		}
+		sharedWith, err := store.SenderKeySharedWith(group.GroupID, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, device := range sharedWith {
+			if !members[device.Uuid] {
+				err = rotateSenderKey(ctx, d, group.GroupID, fmt.Sprintf("%v left at revision %d", device.Uuid, group.Revision))
+				if err != nil {
+					return nil, nil, err
+				}
+				distribution = nil
+				break
+			}
+		}
+		if distribution != nil {
+			distribution.Revision = group.Revision
+			err = store.StoreSenderKeyDistribution(distribution, ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if distribution == nil {
+		distribution = &SenderKeyDistribution{
+			GroupID:        group.GroupID,
+			DistributionID: uuid.New(),
+			Revision:       group.Revision,
+		}
+		err = store.StoreSenderKeyDistribution(distribution, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	sharedWith, err := store.SenderKeySharedWith(group.GroupID, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedDevices := make(map[string]bool, len(sharedWith))
+	for _, device := range sharedWith {
+		sharedDevices[senderKeyDeviceKey(device.Uuid, device.DeviceID)] = true
+	}
+	return distribution, sharedDevices, nil
+}
+
+// SenderKeyDistributionState is what we know about our sender key in a group, for debugging
+type SenderKeyDistributionState struct {
+	DistributionID uuid.UUID
+	Revision       uint32
+	SharedWith     []SenderKeySharedDevice
+}
+
+// GetSenderKeyDistributionState returns nil if we haven't sent to the group with a sender key yet
+func GetSenderKeyDistributionState(ctx context.Context, d *Device, groupID GroupID) (*SenderKeyDistributionState, error) {
+	distribution, err := d.SenderKeyDistributionStore.LoadSenderKeyDistribution(groupID, ctx)
+	if err != nil || distribution == nil {
+		return nil, err
+	}
+	sharedWith, err := d.SenderKeyDistributionStore.SenderKeySharedWith(groupID, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &SenderKeyDistributionState{
+		DistributionID: distribution.DistributionID,
+		Revision:       distribution.Revision,
+		SharedWith:     sharedWith,
+	}, nil
+}
+
+// Sessions of every device of the recipient, creating them from prekeys if we don't have any yet
+func sessionAddressesForRecipient(ctx context.Context, d *Device, recipientUuid string) ([]*libsignalgo.Address, error) {
+	addresses, sessionRecords, err := d.SessionStoreExtras.AllSessionsForUUID(recipientUuid, ctx)
+	if err == nil && (len(addresses) == 0 || len(sessionRecords) == 0) {
+		FetchAndProcessPreKey(ctx, d, recipientUuid, -1)
+		addresses, sessionRecords, err = d.SessionStoreExtras.AllSessionsForUUID(recipientUuid, ctx)
+	}
+	err = checkForErrorWithSessions(err, addresses, sessionRecords)
+	if err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+func accessKeyForRecipient(ctx context.Context, d *Device, recipientUuid string) (*libsignalgo.AccessKey, error) {
+	profileKey, err := ProfileKeyForSignalID(ctx, d, recipientUuid)
+	if err != nil {
+		return nil, err
+	} else if profileKey == nil {
+		return nil, fmt.Errorf("no profile key for %v", recipientUuid)
+	}
+	return profileKey.DeriveAccessKey()
+}
+
+// Sends our SKDM to every recipient that has a device which doesn't have it yet.
+// Returns the recipients it failed to send to.
+func distributeSenderKey(ctx context.Context, d *Device, distribution *SenderKeyDistribution, sharedDevices map[string]bool, recipientAddresses map[string][]*libsignalgo.Address) ([]string, error) {
+	var needsSKDM []string
+	for recipientUuid, addresses := range recipientAddresses {
+		for _, address := range addresses {
+			deviceID, err := address.DeviceID()
+			if err != nil {
+				return nil, err
+			}
+			if !sharedDevices[senderKeyDeviceKey(recipientUuid, int(deviceID))] {
+				needsSKDM = append(needsSKDM, recipientUuid)
+				break
+			}
+		}
+	}
+	if len(needsSKDM) == 0 {
+		return nil, nil
+	}
+
+	ourAddress, err := libsignalgo.NewAddress(d.Data.AciUuid, uint(d.Data.DeviceId))
+	if err != nil {
+		return nil, err
+	}
+	skdm, err := libsignalgo.NewSenderKeyDistributionMessage(ourAddress, distribution.DistributionID, d.SenderKeyStore, libsignalgo.NewCallbackContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	serializedSKDM, err := skdm.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	skdmContent := &signalpb.Content{
+		SenderKeyDistributionMessage: serializedSKDM,
+	}
+
+	var failed []string
+	for _, recipientUuid := range needsSKDM {
+		_, err := sendContent(ctx, d, recipientUuid, currentMessageTimestamp(), skdmContent, 0)
+		if err != nil {
+			log.Printf("Failed to send sender key to %v: %v", recipientUuid, err)
+			failed = append(failed, recipientUuid)
+			continue
+		}
+		// Sending may have fixed up the device list, so mark whatever sessions we have now
+		addresses, _, err := d.SessionStoreExtras.AllSessionsForUUID(recipientUuid, ctx)
+		if err != nil {
+			failed = append(failed, recipientUuid)
+			continue
+		}
+		devices := make([]SenderKeySharedDevice, 0, len(addresses))
+		for _, address := range addresses {
+			deviceID, err := address.DeviceID()
+			if err != nil {
+				return nil, err
+			}
+			devices = append(devices, SenderKeySharedDevice{Uuid: recipientUuid, DeviceID: int(deviceID)})
+		}
+		err = d.SenderKeyDistributionStore.MarkSenderKeySharedWith(distribution.GroupID, devices, ctx)
+		if err != nil {
+			return nil, err
+		}
+		recipientAddresses[recipientUuid] = addresses
+	}
+	return failed, nil
+}
+
+type multiRecipientMismatchedDevices struct {
+	Uuid    string            `json:"uuid"`
+	Devices mismatchedDevices `json:"devices"`
+}
+
+type multiRecipientSendResponse struct {
+	Uuids404 []string `json:"uuids404"`
+}
+
+// sendGroupContentWithSenderKey sends the content to the recipients with a single multi-recipient request.
+// Recipients this can't be done for (e.g. no access key or no sessions) are returned in fallback,
+// so the caller can send to them one by one. If err is set nothing was sent.
+func sendGroupContentWithSenderKey(
+	ctx context.Context,
+	d *Device,
+	group *Group,
+	recipients []string,
+	messageTimestamp uint64,
+	content *signalpb.Content,
+	retryCount int, // For ending recursive retries
+) (sentTo []string, fallback []string, err error) {
+	if retryCount > 3 {
+		return nil, nil, fmt.Errorf("Too many retries")
+	}
+	groupID := group.GroupID
+
+	// Only recipients we can send sealed sender to can be part of a multi-recipient message
+	recipientAddresses := make(map[string][]*libsignalgo.Address)
+	accessKeys := make(map[string]*libsignalgo.AccessKey)
+	for _, recipientUuid := range recipients {
+		accessKey, err := accessKeyForRecipient(ctx, d, recipientUuid)
+		if err != nil {
+			log.Printf("Can't send to %v with sender key, no access key: %v", recipientUuid, err)
+			fallback = append(fallback, recipientUuid)
+			continue
+		}
+		addresses, err := sessionAddressesForRecipient(ctx, d, recipientUuid)
+		if err != nil {
+			log.Printf("Can't send to %v with sender key, no sessions: %v", recipientUuid, err)
+			fallback = append(fallback, recipientUuid)
+			continue
+		}
+		recipientAddresses[recipientUuid] = addresses
+		accessKeys[recipientUuid] = accessKey
+	}
+
+	distribution, sharedDevices, err := senderKeyDistributionForGroup(ctx, d, group)
+	if err != nil {
+		return nil, nil, err
+	}
+	failedSKDM, err := distributeSenderKey(ctx, d, distribution, sharedDevices, recipientAddresses)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, recipientUuid := range failedSKDM {
+		delete(recipientAddresses, recipientUuid)
+		fallback = append(fallback, recipientUuid)
+	}
+	if len(recipientAddresses) == 0 {
+		return nil, fallback, nil
+	}
+	// The server checks the access keys of all recipients XORed together
+	var combinedAccessKey libsignalgo.AccessKey
+	for recipientUuid := range recipientAddresses {
+		for i, b := range accessKeys[recipientUuid] {
+			combinedAccessKey[i] ^= b
+		}
+	}
+
+	// Encrypt once with the sender key, then seal it for every recipient device
+	ourAddress, err := libsignalgo.NewAddress(d.Data.AciUuid, uint(d.Data.DeviceId))
+	if err != nil {
+		return nil, nil, err
+	}
+	groupIdentifier, err := groupIdentifierFromGroupID(groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := senderCertificate(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	serializedMessage, err := proto.Marshal(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	paddedMessage, err := addPadding(3, serializedMessage)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertextMessage, err := libsignalgo.GroupEncrypt(paddedMessage, ourAddress, distribution.DistributionID, d.SenderKeyStore, libsignalgo.NewCallbackContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	contentHint := libsignalgo.UnidentifiedSenderMessageContentHintImplicit
+	if content.DataMessage != nil {
+		contentHint = libsignalgo.UnidentifiedSenderMessageContentHintResendable
+	}
+	usmc, err := libsignalgo.NewUnidentifiedSenderMessageContent(ciphertextMessage, cert, contentHint, groupIdentifier[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	var allAddresses []*libsignalgo.Address
+	for _, addresses := range recipientAddresses {
+		allAddresses = append(allAddresses, addresses...)
+	}
+	multiRecipientMessage, err := libsignalgo.SealedSenderMultiRecipientEncrypt(usmc, allAddresses, d.IdentityStore, d.SessionStore, libsignalgo.NewCallbackContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path := fmt.Sprintf(
+		"/v1/messages/multi_recipient?ts=%d&online=%t&urgent=%t&story=false",
+		messageTimestamp, isOnlineOnlyContent(content), isUrgentContent(content),
+	)
+	request := web.CreateWSRequest("PUT", path, multiRecipientMessage, nil, nil)
+	request.Headers = []string{
+		"content-type:application/vnd.signal-messenger.mrm",
+		"unidentified-access-key:" + base64.StdEncoding.EncodeToString(combinedAccessKey[:]),
+	}
+	log.Printf("Sending message to %d members of %v with sender key", len(recipientAddresses), groupID)
+	responseChan, err := d.Connection.UnauthedWS.SendRequest(ctx, request)
+	if err != nil {
+		return nil, nil, err
+	}
+	response := <-responseChan
+	log.Printf("Received a multi-recipient RESPONSE! id: %v, code: %v", *response.Id, *response.Status)
+
+	switch *response.Status {
+	case 200:
+		var body multiRecipientSendResponse
+		if len(response.Body) > 0 {
+			err = json.Unmarshal(response.Body, &body)
+			if err != nil {
+				log.Printf("Unmarshal error: %v", err)
+			}
+		}
+		unregistered := make(map[string]bool, len(body.Uuids404))
+		for _, recipientUuid := range body.Uuids404 {
+			unregistered[recipientUuid] = true
+		}
+		for recipientUuid := range recipientAddresses {
+			if unregistered[recipientUuid] {
+				fallback = append(fallback, recipientUuid)
+			} else {
+				sentTo = append(sentTo, recipientUuid)
+			}
+		}
+		return sentTo, fallback, nil
+	case 409, 410:
+		var body []multiRecipientMismatchedDevices
+		err = json.Unmarshal(response.Body, &body)
+		if err != nil {
+			log.Printf("Unmarshal error: %v", err)
+			return nil, nil, err
+		}
+		needsRotation := false
+		for _, recipient := range body {
+			err = fixMismatchedDevices(ctx, d, recipient.Uuid, recipient.Devices)
+			if err != nil {
+				return nil, nil, err
+			}
+			// Removed and re-registered devices may still have our key, so don't let them read anything new
+			if len(recipient.Devices.ExtraDevices) > 0 || len(recipient.Devices.StaleDevices) > 0 {
+				needsRotation = true
+			}
+		}
+		if needsRotation {
+			err = rotateSenderKey(ctx, d, groupID, fmt.Sprintf("device list changed (status %d)", *response.Status))
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		// Try to send again (**RECURSIVELY**), any devices without our key will get the SKDM first
+		retryRecipients := make([]string, 0, len(recipientAddresses))
+		for recipientUuid := range recipientAddresses {
+			retryRecipients = append(retryRecipients, recipientUuid)
+		}
+		retrySentTo, retryFallback, err := sendGroupContentWithSenderKey(ctx, d, group, retryRecipients, messageTimestamp, content, retryCount+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return retrySentTo, append(fallback, retryFallback...), nil
+	case 413, 429:
+		return nil, nil, &RateLimitedError{RetryAfter: retryAfterFromResponse(response)}
+	default:
+		// 401 means at least one of the access keys is wrong, the caller will have to send one by one
+		log.Printf("Unexpected multi-recipient status code: %v", *response.Status)
+		return nil, nil, fmt.Errorf("Unexpected status code: %v", *response.Status)
+	}
+}
@@ -9,8 +9,10 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
@@ -20,6 +22,9 @@ import (
 // Sending
 
 func senderCertificate(d *Device) (*libsignalgo.SenderCertificate, error) {
+	// Parallel sends all need the certificate, only one of them should fetch it
+	d.Connection.senderCertificateLock.Lock()
+	defer d.Connection.senderCertificateLock.Unlock()
 	if d.Connection.SenderCertificate != nil {
 		// TODO: check for expired certificate
 		return d.Connection.SenderCertificate, nil
@@ -148,7 +153,10 @@ func buildMessagesToSend(ctx context.Context, d *Device, recipientUuid string, c
 	addresses, sessionRecords, err := d.SessionStoreExtras.AllSessionsForUUID(recipientUuid, ctx)
 	if err == nil && (len(addresses) == 0 || len(sessionRecords) == 0) {
 		// No sessions, make one with prekey
-		FetchAndProcessPreKey(ctx, d, recipientUuid, -1)
+		err = fetchPreKeyUnlessUntrusted(ctx, d, recipientUuid, -1)
+		if err != nil {
+			return nil, err
+		}
 		addresses, sessionRecords, err = d.SessionStoreExtras.AllSessionsForUUID(recipientUuid, ctx)
 	}
 	err = checkForErrorWithSessions(err, addresses, sessionRecords)
@@ -177,6 +185,9 @@ func buildMessagesToSend(ctx context.Context, d *Device, recipientUuid string, c
 		} else {
 			envelopeType, encryptedPayload, err = buildAuthedMessageToSend(ctx, d, recipientAddress, paddedMessage)
 		}
+		if err != nil {
+			return nil, checkUntrustedIdentity(err, recipientUuid)
+		}
 
 		destinationRegistrationID, err := sessionRecord.GetRemoteRegistrationID()
 		if err != nil {
@@ -238,6 +249,47 @@ func buildSSMessageToSend(ctx context.Context, d *Device, recipientAddress *libs
 	return envelopeType, encryptedPayload, nil
 }
 
+// RateLimitedError is returned when the server refuses to take any more messages for a while
+type RateLimitedError struct {
+	RetryAfter time.Duration // Zero if the server didn't say
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited, retry after %v", e.RetryAfter)
+	}
+	return "rate limited"
+}
+
+// UntrustedIdentityError is returned when the recipient's identity key changed and
+// the change has to be acknowledged with AcknowledgeIdentityChange before sending to them
+type UntrustedIdentityError struct {
+	RecipientUuid string
+}
+
+func (e *UntrustedIdentityError) Error() string {
+	return fmt.Sprintf("identity key of %v changed and hasn't been acknowledged", e.RecipientUuid)
+}
+
+func checkUntrustedIdentity(err error, recipientUuid string) error {
+	var signalErr *libsignalgo.SignalError
+	if errors.As(err, &signalErr) && signalErr.Code == libsignalgo.ErrorCodeUntrustedIdentity {
+		return &UntrustedIdentityError{RecipientUuid: recipientUuid}
+	}
+	return err
+}
+
+// Like FetchAndProcessPreKey, but only fails if the recipient's changed identity isn't trusted.
+// Other errors show up later when there turns out to be no session.
+func fetchPreKeyUnlessUntrusted(ctx context.Context, d *Device, recipientUuid string, specificDeviceID int) error {
+	err := checkUntrustedIdentity(FetchAndProcessPreKey(ctx, d, recipientUuid, specificDeviceID), recipientUuid)
+	var untrustedErr *UntrustedIdentityError
+	if errors.As(err, &untrustedErr) {
+		return err
+	}
+	return nil
+}
+
 type SuccessfulSendResult struct {
 	RecipientUuid string
 	Unidentified  bool
@@ -248,156 +300,390 @@ type FailedSendResult struct {
 }
 type SendMessageResult struct {
 	WasSuccessful bool
+	Timestamp     uint64 // The sent timestamp, which is how Signal identifies the message
 	*SuccessfulSendResult
 	*FailedSendResult
 }
 type GroupMessageSendResult struct {
+	Timestamp          uint64 // The sent timestamp, which is how Signal identifies the message
 	SuccessfullySentTo []SuccessfulSendResult
 	FailedToSendTo     []FailedSendResult
 }
 
-func dataMessageFromText(text string, timestamp uint64) *signalpb.DataMessage {
+func DataMessageForText(text string) *signalpb.DataMessage {
+	timestamp := currentMessageTimestamp()
 	return &signalpb.DataMessage{
 		Body:      proto.String(text),
 		Timestamp: &timestamp,
 	}
 }
+
+// DataMessageForAttachment wraps an uploaded attachment in a DataMessage,
+// Signal clients show the body of the message as the caption
+func DataMessageForAttachment(attachmentPointer *signalpb.AttachmentPointer, caption string) *signalpb.DataMessage {
+	timestamp := currentMessageTimestamp()
+	dataMessage := &signalpb.DataMessage{
+		Attachments: []*signalpb.AttachmentPointer{attachmentPointer},
+		Timestamp:   &timestamp,
+	}
+	if caption != "" {
+		dataMessage.Body = proto.String(caption)
+	}
+	return dataMessage
+}
+
+func DataMessageForReaction(emoji string, targetAuthorUUID string, targetMessageTimestamp uint64, remove bool) *signalpb.DataMessage {
+	timestamp := currentMessageTimestamp()
+	return &signalpb.DataMessage{
+		Timestamp: &timestamp,
+		Reaction: &signalpb.DataMessage_Reaction{
+			Emoji:               proto.String(emoji),
+			Remove:              proto.Bool(remove),
+			TargetAuthorUuid:    proto.String(targetAuthorUUID),
+			TargetSentTimestamp: proto.Uint64(targetMessageTimestamp),
+		},
+		RequiredProtocolVersion: proto.Uint32(uint32(signalpb.DataMessage_REACTIONS)),
+	}
+}
+
+func DataMessageForDelete(targetMessageTimestamp uint64) *signalpb.DataMessage {
+	timestamp := currentMessageTimestamp()
+	return &signalpb.DataMessage{
+		Timestamp: &timestamp,
+		Delete: &signalpb.DataMessage_Delete{
+			TargetSentTimestamp: proto.Uint64(targetMessageTimestamp),
+		},
+	}
+}
+
+// DataMessageForExpireTimerUpdate changes the disappearing message timer of a 1:1 chat, 0 turns it off
+func DataMessageForExpireTimerUpdate(expireTimer uint32) *signalpb.DataMessage {
+	timestamp := currentMessageTimestamp()
+	return &signalpb.DataMessage{
+		Timestamp:   &timestamp,
+		ExpireTimer: proto.Uint32(expireTimer),
+		Flags:       proto.Uint32(uint32(signalpb.DataMessage_EXPIRATION_TIMER_UPDATE)),
+	}
+}
+
+// QuoteForMessage builds the quote for replying to a message, any quoted attachments can be appended after
+func QuoteForMessage(targetAuthorUUID string, targetMessageTimestamp uint64, text string) *signalpb.DataMessage_Quote {
+	quote := &signalpb.DataMessage_Quote{
+		Id:         proto.Uint64(targetMessageTimestamp),
+		AuthorUuid: proto.String(targetAuthorUUID),
+		Type:       signalpb.DataMessage_Quote_NORMAL.Enum(),
+	}
+	if text != "" {
+		quote.Text = proto.String(text)
+	}
+	return quote
+}
+
+// TypingMessageForAction builds a typing start or stop message, the group ID gets filled in when sending to a group
+func TypingMessageForAction(isTyping bool) *signalpb.TypingMessage {
+	action := signalpb.TypingMessage_STOPPED
+	if isTyping {
+		action = signalpb.TypingMessage_STARTED
+	}
+	return &signalpb.TypingMessage{
+		Timestamp: proto.Uint64(currentMessageTimestamp()),
+		Action:    &action,
+	}
+}
+
+// ReadReceiptForTimestamps marks the given messages as read, they must all be from the same author
+func ReadReceiptForTimestamps(timestamps []uint64) *signalpb.ReceiptMessage {
+	return &signalpb.ReceiptMessage{
+		Type:      signalpb.ReceiptMessage_READ.Enum(),
+		Timestamp: timestamps,
+	}
+}
+
+// Messages are identified by their timestamp, so use the one in the DataMessage if there is one
+func timestampForContent(content *signalpb.Content) uint64 {
+	if content.GetDataMessage().GetTimestamp() != 0 {
+		return content.GetDataMessage().GetTimestamp()
+	} else if content.GetTypingMessage().GetTimestamp() != 0 {
+		return content.GetTypingMessage().GetTimestamp()
+	}
+	return currentMessageTimestamp()
+}
+
+// Typing messages are only useful right now, so the server shouldn't queue them for offline devices
+func isOnlineOnlyContent(content *signalpb.Content) bool {
+	return content.TypingMessage != nil
+}
+
+// Non-urgent messages don't wake up the recipient's device with a push notification
+func isUrgentContent(content *signalpb.Content) bool {
+	return content.TypingMessage == nil && content.ReceiptMessage == nil
+}
 func contentFromDataMessage(dataMessage *signalpb.DataMessage) *signalpb.Content {
 	return &signalpb.Content{
 		DataMessage: dataMessage,
 	}
 }
-func syncMessageFromGroupDataMessage(dataMessage *signalpb.DataMessage, results []SuccessfulSendResult) *signalpb.Content {
-	unidentifiedStatuses := []*signalpb.SyncMessage_Sent_UnidentifiedDeliveryStatus{}
+func syncMessageFromDataMessage(dataMessage *signalpb.DataMessage, results []SuccessfulSendResult) *signalpb.Content {
+	unidentifiedStatuses := make([]*signalpb.SyncMessage_Sent_UnidentifiedDeliveryStatus, 0, len(results))
 	for _, result := range results {
+		recipientUuid, unidentified := result.RecipientUuid, result.Unidentified
 		unidentifiedStatuses = append(unidentifiedStatuses, &signalpb.SyncMessage_Sent_UnidentifiedDeliveryStatus{
-			DestinationUuid: &result.RecipientUuid,
-			Unidentified:    &result.Unidentified,
+			DestinationUuid: &recipientUuid,
+			Unidentified:    &unidentified,
 		})
 	}
+	sent := &signalpb.SyncMessage_Sent{
+		Message:            dataMessage,
+		Timestamp:          dataMessage.Timestamp,
+		UnidentifiedStatus: unidentifiedStatuses,
+	}
+	// Group transcripts don't have a destination, the group is in the DataMessage
+	if dataMessage.GroupV2 == nil && len(results) == 1 {
+		sent.DestinationUuid = unidentifiedStatuses[0].DestinationUuid
+	}
+	// The timer of our own messages starts when they're sent
+	if dataMessage.GetExpireTimer() > 0 {
+		sent.ExpirationStartTimestamp = dataMessage.Timestamp
+	}
 	return &signalpb.Content{
 		SyncMessage: &signalpb.SyncMessage{
-			Sent: &signalpb.SyncMessage_Sent{
-				Message:            dataMessage,
-				Timestamp:          dataMessage.Timestamp,
-				UnidentifiedStatus: unidentifiedStatuses,
-			},
+			Sent: sent,
 		},
 	}
 }
 
-func syncMessageFromSoloDataMessage(dataMessage *signalpb.DataMessage, result SuccessfulSendResult) *signalpb.Content {
-	return &signalpb.Content{
-		SyncMessage: &signalpb.SyncMessage{
-			Sent: &signalpb.SyncMessage_Sent{
-				Message:         dataMessage,
-				DestinationUuid: &result.RecipientUuid,
-				Timestamp:       dataMessage.Timestamp,
-				UnidentifiedStatus: []*signalpb.SyncMessage_Sent_UnidentifiedDeliveryStatus{
-					{
-						DestinationUuid: &result.RecipientUuid,
-						Unidentified:    &result.Unidentified,
-					},
-				},
-			},
-		},
+// How many recipients sendToRecipients sends to at the same time
+const maxConcurrentSends = 8
+
+// Sends the content to each recipient separately, a few at a time. Results are in the order of recipients.
+func sendToRecipients(ctx context.Context, d *Device, recipients []string, messageTimestamp uint64, content *signalpb.Content) ([]SuccessfulSendResult, []FailedSendResult) {
+	type sendResult struct {
+		unidentified bool
+		err          error
+	}
+	results := make([]sendResult, len(recipients))
+	semaphore := make(chan struct{}, maxConcurrentSends)
+	var wg sync.WaitGroup
+	for i, recipientUuid := range recipients {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, recipientUuid string) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			results[i].unidentified, results[i].err = sendContent(ctx, d, recipientUuid, messageTimestamp, content, 0)
+		}(i, recipientUuid)
+	}
+	wg.Wait()
+
+	var successful []SuccessfulSendResult
+	var failed []FailedSendResult
+	for i, result := range results {
+		if result.err != nil {
+			log.Printf("Failed to send to %v: %v", recipients[i], result.err)
+			failed = append(failed, FailedSendResult{
+				RecipientUuid: recipients[i],
+				Error:         result.err,
+			})
+		} else {
+			log.Printf("Successfully sent to %v", recipients[i])
+			successful = append(successful, SuccessfulSendResult{
+				RecipientUuid: recipients[i],
+				Unidentified:  result.unidentified,
+			})
+		}
+	}
+	return successful, failed
+}
+
+// Sends one transcript of a sent DataMessage to our other devices, listing everyone it was delivered to.
+// Recipient updates tell them about more recipients of a message they already have.
+func sendSyncTranscript(ctx context.Context, d *Device, messageTimestamp uint64, dataMessage *signalpb.DataMessage, results []SuccessfulSendResult, isRecipientUpdate bool) {
+	if len(results) == 0 {
+		return
+	}
+
+	// TODO: don't fetch every time
+	// (But for now this makes sure we know about all our other devices)
+	FetchAndProcessPreKey(ctx, d, d.Data.AciUuid, -1)
+
+	// No need to send to ourselves if we don't have any other devices
+	if howManyOtherDevicesDoWeHave(ctx, d) == 0 {
+		return
+	}
+	syncContent := syncMessageFromDataMessage(dataMessage, results)
+	if isRecipientUpdate {
+		syncContent.SyncMessage.Sent.IsRecipientUpdate = &isRecipientUpdate
+	}
+	_, err := sendContent(ctx, d, d.Data.AciUuid, messageTimestamp, syncContent, 0)
+	if err != nil {
+		log.Printf("Failed to send sync message to myself: %v", err)
 	}
 }
 
-func SendGroupMessage(ctx context.Context, device *Device, groupID GroupID, text string) (*GroupMessageSendResult, error) {
+func SendGroupMessage(ctx context.Context, device *Device, groupID GroupID, content *signalpb.Content) (*GroupMessageSendResult, error) {
+	return sendGroupMessage(ctx, device, groupID, content, nil)
+}
+
+// SendGroupMessageToMembers sends the content again to only some members of the group,
+// e.g. to retry the ones that failed before. The content must have the same timestamp as the first send.
+func SendGroupMessageToMembers(ctx context.Context, device *Device, groupID GroupID, content *signalpb.Content, members []string) (*GroupMessageSendResult, error) {
+	if members == nil {
+		members = []string{}
+	}
+	return sendGroupMessage(ctx, device, groupID, content, members)
+}
+
+// If onlyTo isn't nil, members not in it are skipped
+func sendGroupMessage(ctx context.Context, device *Device, groupID GroupID, content *signalpb.Content, onlyTo []string) (*GroupMessageSendResult, error) {
 	group, err := RetrieveGroupByID(ctx, device, groupID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Assemble the content to send
-	messageTimestamp := currentMessageTimestamp()
-	dataMessage := dataMessageFromText(text, messageTimestamp)
-	dataMessage.GroupV2 = groupMetadataForDataMessage(*group)
-	content := &signalpb.Content{
-		DataMessage: dataMessage,
+	// Add the group context to the content to send
+	messageTimestamp := timestampForContent(content)
+	dataMessage := content.DataMessage
+	if dataMessage != nil {
+		// Keep the signed change if this message announces one
+		groupChange := dataMessage.GetGroupV2().GetGroupChange()
+		dataMessage.GroupV2 = groupMetadataForDataMessage(*group)
+		dataMessage.GroupV2.GroupChange = groupChange
+	}
+	if content.TypingMessage != nil {
+		groupIdentifier, err := groupIdentifierFromGroupID(groupID)
+		if err != nil {
+			return nil, err
+		}
+		content.TypingMessage.GroupId = groupIdentifier[:]
 	}
 
-	// Send to each member of the group
+	// Send to the whole group at once with our sender key where possible
 	result := &GroupMessageSendResult{
+		Timestamp:          messageTimestamp,
 		SuccessfullySentTo: []SuccessfulSendResult{},
 		FailedToSendTo:     []FailedSendResult{},
 	}
+	var includedMembers map[string]bool
+	if onlyTo != nil {
+		includedMembers = make(map[string]bool, len(onlyTo))
+		for _, member := range onlyTo {
+			includedMembers[member] = true
+		}
+	}
+	var recipients []string
 	for _, member := range group.Members {
 		if member.UserId == device.Data.AciUuid {
 			// Don't send normal DataMessages to ourselves
 			continue
+		} else if includedMembers != nil && !includedMembers[member.UserId] {
+			continue
 		}
-		sentUnidentified, err := sendContent(ctx, device, member.UserId, messageTimestamp, content, 0)
-		if err != nil {
+		recipients = append(recipients, member.UserId)
+	}
+	sentWithSenderKey, fallbackRecipients, err := sendGroupContentWithSenderKey(ctx, device, group, recipients, messageTimestamp, content, 0)
+	var rateLimitErr *RateLimitedError
+	if errors.As(err, &rateLimitErr) {
+		// Sending to each member would just get rate limited too
+		for _, recipientUuid := range recipients {
 			result.FailedToSendTo = append(result.FailedToSendTo, FailedSendResult{
-				RecipientUuid: member.UserId,
+				RecipientUuid: recipientUuid,
 				Error:         err,
 			})
-			log.Printf("Failed to send to %v: %v", member.UserId, err)
-		} else {
-			result.SuccessfullySentTo = append(result.SuccessfullySentTo, SuccessfulSendResult{
-				RecipientUuid: member.UserId,
-				Unidentified:  sentUnidentified,
-			})
-			log.Printf("Successfully sent to %v", member.UserId)
 		}
+		return result, nil
+	} else if err != nil {
+		log.Printf("Failed to send to %v with sender key, sending to each member instead: %v", groupID, err)
+		sentWithSenderKey, fallbackRecipients = nil, recipients
+	}
+	for _, recipientUuid := range sentWithSenderKey {
+		result.SuccessfullySentTo = append(result.SuccessfullySentTo, SuccessfulSendResult{
+			RecipientUuid: recipientUuid,
+			Unidentified:  true,
+		})
+	}
 
-		// No need to send to ourselves if we don't have any other devices
-		if howManyOtherDevicesDoWeHave(ctx, device) > 0 {
-			syncContent := syncMessageFromGroupDataMessage(dataMessage, result.SuccessfullySentTo)
-			_, selfSendErr := sendContent(ctx, device, device.Data.AciUuid, messageTimestamp, syncContent, 0)
-			if selfSendErr != nil {
-				log.Printf("Failed to send sync message to myself (%v): %v", member.UserId, selfSendErr)
-			}
-		}
+	// Members who can't receive sender key messages get their own copy
+	successful, failed := sendToRecipients(ctx, device, fallbackRecipients, messageTimestamp, content)
+	result.SuccessfullySentTo = append(result.SuccessfullySentTo, successful...)
+	result.FailedToSendTo = append(result.FailedToSendTo, failed...)
+
+	// Keep it around in case someone can't decrypt it and asks for it again
+	sentTo := make([]string, 0, len(result.SuccessfullySentTo))
+	for _, success := range result.SuccessfullySentTo {
+		sentTo = append(sentTo, success.RecipientUuid)
+	}
+	addToSendLog(device, sentTo, messageTimestamp, content, &groupID)
+
+	// Only DataMessages need a sync transcript, and only one once everyone has been sent to
+	if dataMessage != nil {
+		sendSyncTranscript(ctx, device, messageTimestamp, dataMessage, result.SuccessfullySentTo, onlyTo != nil)
 	}
 
 	return result, nil
 }
 
-func SendMessage(ctx context.Context, device *Device, recipientUuid string, text string) SendMessageResult {
-	// Assemble the content to send
-	messageTimestamp := currentMessageTimestamp()
-	dataMessage := dataMessageFromText(text, messageTimestamp)
-	content := &signalpb.Content{
-		DataMessage: dataMessage,
-	}
+func SendMessage(ctx context.Context, device *Device, recipientUuid string, content *signalpb.Content) SendMessageResult {
+	messageTimestamp := timestampForContent(content)
+	content = withPniSignatureIfNeeded(ctx, device, recipientUuid, content)
+	dataMessage := content.DataMessage
 
 	// Send to the recipient
-	sentUnidentified, err := sendContent(ctx, device, recipientUuid, messageTimestamp, content, 0)
-	if err != nil {
+	successful, failed := sendToRecipients(ctx, device, []string{recipientUuid}, messageTimestamp, content)
+	if len(failed) > 0 {
 		return SendMessageResult{
-			WasSuccessful: false,
-			FailedSendResult: &FailedSendResult{
-				RecipientUuid: recipientUuid,
-				Error:         err,
-			},
+			WasSuccessful:    false,
+			Timestamp:        messageTimestamp,
+			FailedSendResult: &failed[0],
 		}
 	}
 	result := SendMessageResult{
-		WasSuccessful: true,
-		SuccessfulSendResult: &SuccessfulSendResult{
-			RecipientUuid: recipientUuid,
-			Unidentified:  sentUnidentified,
-		},
+		WasSuccessful:        true,
+		Timestamp:            messageTimestamp,
+		SuccessfulSendResult: &successful[0],
 	}
+	addToSendLog(device, []string{recipientUuid}, messageTimestamp, content, nil)
 
-	// TODO: don't fetch every time
-	// (But for now this makes sure we know about all our other devices)
-	FetchAndProcessPreKey(ctx, device, device.Data.AciUuid, -1)
-
-	// If we have other devices, send to them too
-	if howManyOtherDevicesDoWeHave(ctx, device) > 0 {
-		syncContent := syncMessageFromSoloDataMessage(dataMessage, *result.SuccessfulSendResult)
-		_, selfSendErr := sendContent(ctx, device, device.Data.AciUuid, messageTimestamp, syncContent, 0)
-		if selfSendErr != nil {
-			log.Printf("Failed to send sync message to myself: %v", selfSendErr)
-		}
+	// Only DataMessages need a sync transcript
+	if dataMessage != nil {
+		sendSyncTranscript(ctx, device, messageTimestamp, dataMessage, successful, false)
 	}
 	return result
 }
 
+// Adds a PniSignatureMessage to messages for contacts who have only messaged our PNI,
+// so their client can tell our ACI and PNI are the same account and merge them
+func withPniSignatureIfNeeded(ctx context.Context, device *Device, recipientUuid string, content *signalpb.Content) *signalpb.Content {
+	if content.DataMessage == nil || device.Data.PniIdentityKeyPair == nil {
+		return content
+	}
+	needed, err := device.PniSignatureStore.IsPniSignatureNeeded(recipientUuid, ctx)
+	if err != nil {
+		log.Printf("IsPniSignatureNeeded error: %v", err)
+		return content
+	} else if !needed {
+		return content
+	}
+	pni, err := uuid.Parse(device.Data.PniUuid)
+	if err != nil {
+		log.Printf("Failed to parse our PNI: %v", err)
+		return content
+	}
+	signature, err := device.Data.PniIdentityKeyPair.SignAlternateIdentity(device.Data.AciIdentityKeyPair.GetIdentityKey())
+	if err != nil {
+		log.Printf("SignAlternateIdentity error: %v", err)
+		return content
+	}
+	// Don't modify the caller's content, it may be stored for resending
+	content = proto.Clone(content).(*signalpb.Content)
+	content.PniSignatureMessage = &signalpb.PniSignatureMessage{
+		Pni:       pni[:],
+		Signature: signature,
+	}
+	return content
+}
+
 func currentMessageTimestamp() uint64 {
 	return uint64(time.Now().UnixMilli())
 }
@@ -433,7 +719,7 @@ func sendContent(
 	}
 	// TODO: JUST FOR DEBUGGING
 	if content.DataMessage != nil {
-		if *content.DataMessage.Body == "UNSEAL" {
+		if content.DataMessage.GetBody() == "UNSEAL" {
 			useUnidentifiedSender = false
 		}
 	}
@@ -442,13 +728,13 @@ func sendContent(
 	var messages []MyMessage
 	messages, err = buildMessagesToSend(ctx, d, recipientUuid, content, useUnidentifiedSender)
 	if err != nil {
-		return false, fmt.Errorf("Error building messages to send: %v", err)
+		return false, fmt.Errorf("Error building messages to send: %w", err)
 	}
 
 	outgoingMessages := MyMessages{
 		Timestamp: int64(messageTimestamp),
-		Online:    false,
-		Urgent:    true,
+		Online:    isOnlineOnlyContent(content),
+		Urgent:    isUrgentContent(content),
 		Messages:  messages,
 	}
 	jsonBytes, err := json.Marshal(outgoingMessages)
@@ -476,7 +762,11 @@ func sendContent(
 	response := <-responseChan
 	log.Printf("Received a RESPONSE! id: %v, code: %v", *response.Id, *response.Status)
 
-	retryableStatuses := []uint32{409, 428, 500, 503}
+	if *response.Status == 413 || *response.Status == 429 {
+		return sentUnidentified, &RateLimitedError{RetryAfter: retryAfterFromResponse(response)}
+	}
+
+	retryableStatuses := []uint32{409, 410, 428, 500, 503}
 
 	// Check to see if our status is retryable
 	needToRetry := false
@@ -489,7 +779,7 @@ func sendContent(
 
 	if needToRetry {
 		var err error
-		if *response.Status == 409 {
+		if *response.Status == 409 || *response.Status == 410 {
 			err = handle409(ctx, d, recipientUuid, response)
 		} else if *response.Status == 428 {
 			err = handle428(ctx, d, recipientUuid, response)
@@ -513,47 +803,55 @@ func sendContent(
 	return sentUnidentified, nil
 }
 
-// A 409 means our device list was out of date, so we will fix it up
+type mismatchedDevices struct {
+	MissingDevices []int `json:"missingDevices"`
+	ExtraDevices   []int `json:"extraDevices"`
+	StaleDevices   []int `json:"staleDevices"`
+}
+
+// A 409 means our device list was out of date, and a 410 means some devices re-registered
+// (e.g. the contact reinstalled Signal) so their sessions are stale. Either way we will fix it up.
 func handle409(ctx context.Context, device *Device, recipientUuid string, response *signalpb.WebSocketResponseMessage) error {
 	// Decode json body
-	var body map[string]interface{}
+	var body mismatchedDevices
 	err := json.Unmarshal(response.Body, &body)
 	if err != nil {
 		log.Printf("Unmarshal error: %v", err)
 		return err
 	}
-	// check for missingDevices and extraDevices
-	if body["missingDevices"] != nil {
-		missingDevices := body["missingDevices"].([]interface{})
-		log.Printf("-----> missingDevices: %v", missingDevices)
-		// TODO: establish session with missing devices
-		for _, missingDevice := range missingDevices {
-			//do the thing
-			log.Printf("-----> missingDevice: %v", missingDevice)
-			FetchAndProcessPreKey(ctx, device, recipientUuid, int(missingDevice.(float64)))
+	return fixMismatchedDevices(ctx, device, recipientUuid, body)
+}
+
+func fixMismatchedDevices(ctx context.Context, device *Device, recipientUuid string, devices mismatchedDevices) error {
+	// Establish sessions with missing devices
+	for _, missingDevice := range devices.MissingDevices {
+		log.Printf("-----> missingDevice: %v", missingDevice)
+		err := fetchPreKeyUnlessUntrusted(ctx, device, recipientUuid, missingDevice)
+		if err != nil {
+			return err
 		}
 	}
-	if body["extraDevices"] != nil {
-		extraDevices := body["extraDevices"].([]interface{})
-		log.Printf("-----> extraDevices: %v", extraDevices)
-		for _, extraDevice := range extraDevices {
-			// Remove extra device from the sessionstore
-			recipient, err := libsignalgo.NewAddress(
-				recipientUuid,
-				uint(extraDevice.(float64)),
-			)
-			if err != nil {
-				log.Printf("NewAddress error: %v", err)
-				return err
-			}
-			err = device.SessionStoreExtras.RemoveSession(recipient, ctx)
-			if err != nil {
-				log.Printf("RemoveSession error: %v", err)
-				return err
-			}
+	// Remove extra devices from the sessionstore, and replace the sessions of stale (re-registered) devices
+	for _, extraDevice := range append(devices.ExtraDevices, devices.StaleDevices...) {
+		log.Printf("-----> extra or stale device: %v", extraDevice)
+		recipient, err := libsignalgo.NewAddress(recipientUuid, uint(extraDevice))
+		if err != nil {
+			log.Printf("NewAddress error: %v", err)
+			return err
+		}
+		err = device.SessionStoreExtras.RemoveSession(recipient, ctx)
+		if err != nil {
+			log.Printf("RemoveSession error: %v", err)
+			return err
 		}
 	}
-	return err
+	for _, staleDevice := range devices.StaleDevices {
+		err := fetchPreKeyUnlessUntrusted(ctx, device, recipientUuid, staleDevice)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // We got rate limited. We will try sending a "pushChallenge" response, but if that doesn't work
@@ -572,19 +870,8 @@ func handle428(ctx context.Context, device *Device, recipientUuid string, respon
 	//id:25 status:428 message:"Precondition Required" headers:"Retry-After:86400"
 	//headers:"Content-Type:application/json" headers:"Content-Length:88"
 	//body:"{\"token\":\"07af0d73-e05d-42c3-9634-634922061966\",\"options\":[\"recaptcha\",\"pushChallenge\"]}"
-	var retryAfterSeconds uint64 = 0
-	// Find retry after header
-	for _, header := range response.Headers {
-		key, value := strings.Split(header, ":")[0], strings.Split(header, ":")[1]
-		if key == "Retry-After" {
-			retryAfterSeconds, err = strconv.ParseUint(value, 10, 64)
-			if err != nil {
-				log.Printf("ParseUint error: %v", err)
-			}
-		}
-	}
-	if retryAfterSeconds > 0 {
-		log.Printf("Got rate limited, need to wait %v seconds", retryAfterSeconds)
+	if retryAfter := retryAfterFromResponse(response); retryAfter > 0 {
+		log.Printf("Got rate limited, need to wait %v", retryAfter)
 	}
 	if body["options"] != nil {
 		options := body["options"].([]interface{})
@@ -617,3 +904,34 @@ func handle428(ctx context.Context, device *Device, recipientUuid string, respon
 	}
 	return nil
 }
+
+// Finds the Retry-After header of the response, returns 0 if there isn't one
+func retryAfterFromResponse(response *signalpb.WebSocketResponseMessage) time.Duration {
+	for _, header := range response.Headers {
+		key, value, found := strings.Cut(header, ":")
+		if !found || !strings.EqualFold(key, "Retry-After") {
+			continue
+		}
+		retryAfterSeconds, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			log.Printf("ParseUint error: %v", err)
+			return 0
+		}
+		return time.Duration(retryAfterSeconds) * time.Second
+	}
+	return 0
+}
+
+// SerializeContent and DeserializeContent let callers store content to send it again later
+func SerializeContent(content *signalpb.Content) ([]byte, error) {
+	return proto.Marshal(content)
+}
+
+func DeserializeContent(data []byte) (*signalpb.Content, error) {
+	var content signalpb.Content
+	err := proto.Unmarshal(data, &content)
+	if err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
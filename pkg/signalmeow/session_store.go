@@ -16,6 +16,21 @@ const (
 	storeSessionQuery  = `INSERT OR REPLACE INTO signalmeow_sessions (our_aci_uuid, their_aci_uuid, their_device_id, record) VALUES ($1, $2, $3, $4)` // SQLite specific
 	allSessionsQuery   = `SELECT their_device_id, record FROM signalmeow_sessions WHERE our_aci_uuid=$1 AND their_aci_uuid=$2`
 	removeSessionQuery = `DELETE FROM signalmeow_sessions WHERE our_aci_uuid=$1 AND their_aci_uuid=$2 AND their_device_id=$3`
+
+	loadPniSessionQuery   = `SELECT their_device_id, record FROM signalmeow_pni_sessions WHERE our_aci_uuid=$1 AND their_aci_uuid=$2 AND their_device_id=$3`
+	storePniSessionQuery  = `INSERT OR REPLACE INTO signalmeow_pni_sessions (our_aci_uuid, their_aci_uuid, their_device_id, record) VALUES ($1, $2, $3, $4)` // SQLite specific
+	allPniSessionsQuery   = `SELECT their_device_id, record FROM signalmeow_pni_sessions WHERE our_aci_uuid=$1 AND their_aci_uuid=$2`
+	removePniSessionQuery = `DELETE FROM signalmeow_pni_sessions WHERE our_aci_uuid=$1 AND their_aci_uuid=$2 AND their_device_id=$3`
+)
+
+// Sessions started with our ACI and our PNI identity are kept apart, since they use different identity keys
+type sessionQueries struct {
+	load, store, all, remove string
+}
+
+var (
+	aciSessionQueries = sessionQueries{loadSessionQuery, storeSessionQuery, allSessionsQuery, removeSessionQuery}
+	pniSessionQueries = sessionQueries{loadPniSessionQuery, storePniSessionQuery, allPniSessionsQuery, removePniSessionQuery}
 )
 
 type SessionStoreExtras interface {
@@ -39,6 +54,22 @@ func scanRecord(row scannable) (int, *libsignalgo.SessionRecord, error) {
 }
 
 func (s *SQLStore) RemoveSession(address *libsignalgo.Address, ctx context.Context) error {
+	return s.removeSession(aciSessionQueries, address)
+}
+
+func (s *SQLStore) AllSessionsForUUID(theirUuid string, ctx context.Context) ([]*libsignalgo.Address, []*libsignalgo.SessionRecord, error) {
+	return s.allSessionsForUUID(aciSessionQueries, theirUuid)
+}
+
+func (s *SQLStore) LoadSession(address *libsignalgo.Address, ctx context.Context) (*libsignalgo.SessionRecord, error) {
+	return s.loadSession(aciSessionQueries, address)
+}
+
+func (s *SQLStore) StoreSession(address *libsignalgo.Address, record *libsignalgo.SessionRecord, ctx context.Context) error {
+	return s.storeSession(aciSessionQueries, address, record, ctx)
+}
+
+func (s *SQLStore) removeSession(queries sessionQueries, address *libsignalgo.Address) error {
 	theirUuid, err := address.Name()
 	if err != nil {
 		return err
@@ -47,12 +78,12 @@ func (s *SQLStore) RemoveSession(address *libsignalgo.Address, ctx context.Conte
 	if err != nil {
 		return err
 	}
-	_, err = s.db.Exec(removeSessionQuery, s.AciUuid, theirUuid, deviceId)
+	_, err = s.db.Exec(queries.remove, s.AciUuid, theirUuid, deviceId)
 	return err
 }
 
-func (s *SQLStore) AllSessionsForUUID(theirUuid string, ctx context.Context) ([]*libsignalgo.Address, []*libsignalgo.SessionRecord, error) {
-	rows, err := s.db.Query(allSessionsQuery, s.AciUuid, theirUuid)
+func (s *SQLStore) allSessionsForUUID(queries sessionQueries, theirUuid string) ([]*libsignalgo.Address, []*libsignalgo.SessionRecord, error) {
+	rows, err := s.db.Query(queries.all, s.AciUuid, theirUuid)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -74,7 +105,7 @@ func (s *SQLStore) AllSessionsForUUID(theirUuid string, ctx context.Context) ([]
 	return addresses, records, nil
 }
 
-func (s *SQLStore) LoadSession(address *libsignalgo.Address, ctx context.Context) (*libsignalgo.SessionRecord, error) {
+func (s *SQLStore) loadSession(queries sessionQueries, address *libsignalgo.Address) (*libsignalgo.SessionRecord, error) {
 	theirUuid, err := address.Name()
 	if err != nil {
 		return nil, err
@@ -83,11 +114,11 @@ func (s *SQLStore) LoadSession(address *libsignalgo.Address, ctx context.Context
 	if err != nil {
 		return nil, err
 	}
-	_, record, err := scanRecord(s.db.QueryRow(loadSessionQuery, s.AciUuid, theirUuid, deviceId))
+	_, record, err := scanRecord(s.db.QueryRow(queries.load, s.AciUuid, theirUuid, deviceId))
 	return record, err
 }
 
-func (s *SQLStore) StoreSession(address *libsignalgo.Address, record *libsignalgo.SessionRecord, ctx context.Context) error {
+func (s *SQLStore) storeSession(queries sessionQueries, address *libsignalgo.Address, record *libsignalgo.SessionRecord, ctx context.Context) error {
 	theirUuid, err := address.Name()
 	if err != nil {
 		return err
@@ -105,7 +136,7 @@ func (s *SQLStore) StoreSession(address *libsignalgo.Address, record *libsignalg
 		tx.Rollback()
 		return err
 	}
-	_, err = tx.Exec(storeSessionQuery, s.AciUuid, theirUuid, deviceId, serialized)
+	_, err = tx.Exec(queries.store, s.AciUuid, theirUuid, deviceId, serialized)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
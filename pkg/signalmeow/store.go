@@ -23,6 +23,8 @@ type StoreContainer struct {
 	log     log.Logger
 
 	DatabaseErrorHandler func(device *DeviceData, action string, attemptIndex int, err error) (retry bool)
+	// IdentityTrustPolicy decides whether we keep sending to contacts whose identity key changed
+	IdentityTrustPolicy IdentityTrustPolicy
 }
 
 // Device is a wrapper for a signalmeow session, including device data,
@@ -40,11 +42,25 @@ type Device struct {
 	IdentityStore     libsignalgo.IdentityKeyStore
 	SessionStore      libsignalgo.SessionStore
 	SenderKeyStore    libsignalgo.SenderKeyStore
+	KyberPreKeyStore  libsignalgo.KyberPreKeyStore
+
+	// libsignalgo store interfaces for our PNI identity, used for messages sent to our phone number
+	PniPreKeyStore        libsignalgo.PreKeyStore
+	PniSignedPreKeyStore  libsignalgo.SignedPreKeyStore
+	PniKyberPreKeyStore   libsignalgo.KyberPreKeyStore
+	PniIdentityStore      libsignalgo.IdentityKeyStore
+	PniSessionStore       libsignalgo.SessionStore
+	PniSessionStoreExtras SessionStoreExtras
 
 	// internal store interfaces
-	PreKeyStoreExtras  PreKeyStoreExtras
-	SessionStoreExtras SessionStoreExtras
-	ProfileKeyStore    ProfileKeyStore
+	PreKeyStoreExtras      PreKeyStoreExtras
+	KyberPreKeyStoreExtras KyberPreKeyStoreExtras
+	SessionStoreExtras     SessionStoreExtras
+	IdentityStoreExtras    IdentityStoreExtras
+	ProfileKeyStore        ProfileKeyStore
+	PniSignatureStore      PniSignatureStore
+
+	SenderKeyDistributionStore SenderKeyDistributionStore
 }
 
 // New connects to the given SQL database and wraps it in a StoreContainer.
@@ -123,11 +139,24 @@ func (c *StoreContainer) scanDevice(row scannable) (*Device, error) {
 	device.PreKeyStore = innerStore
 	device.PreKeyStoreExtras = innerStore
 	device.SignedPreKeyStore = innerStore
+	device.KyberPreKeyStore = innerStore
+	device.KyberPreKeyStoreExtras = innerStore
 	device.IdentityStore = innerStore
+	device.IdentityStoreExtras = innerStore
 	device.SessionStore = innerStore
 	device.SessionStoreExtras = innerStore
 	device.ProfileKeyStore = innerStore
 	device.SenderKeyStore = innerStore
+	device.SenderKeyDistributionStore = innerStore
+	device.PniSignatureStore = innerStore
+	pniStore := &pniSQLStore{innerStore}
+	device.PniPreKeyStore = pniStore
+	device.PniSignedPreKeyStore = pniStore
+	device.PniKyberPreKeyStore = pniStore
+	device.PniIdentityStore = pniStore
+	device.PniSessionStore = pniStore
+	device.PniSessionStoreExtras = pniStore
+	innerStore.identityChangeHandler = device.handleIdentityChange
 
 	return &device, nil
 }
@@ -217,6 +246,8 @@ func (c *StoreContainer) DeleteDevice(device *DeviceData) error {
 type SQLStore struct {
 	*StoreContainer
 	AciUuid string
+
+	identityChangeHandler func(theirUuid string)
 }
 
 func newSQLStore(container *StoreContainer, aciUuid string) *SQLStore {
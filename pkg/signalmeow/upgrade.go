@@ -10,7 +10,7 @@ type upgradeFunc func(*sql.Tx, *StoreContainer) error
 //
 // This may be of use if you want to manage the database fully manually, but in most cases you
 // should just call StoreContainer.Upgrade to let the library handle everything.
-var Upgrades = [...]upgradeFunc{upgradeV1}
+var Upgrades = [...]upgradeFunc{upgradeV1, upgradeV2, upgradeV3, upgradeV4}
 
 func (c *StoreContainer) getVersion() (int, error) {
 	_, err := c.db.Exec("CREATE TABLE IF NOT EXISTS signalmeow_version (version INTEGER)")
@@ -155,3 +155,69 @@ func upgradeV1(tx *sql.Tx, _ *StoreContainer) error {
 	}
 	return nil
 }
+
+func upgradeV2(tx *sql.Tx, _ *StoreContainer) error {
+	_, err := tx.Exec(`CREATE TABLE signalmeow_sender_key_distributions (
+		our_aci_uuid		TEXT	NOT NULL,
+		group_id			TEXT	NOT NULL,
+		distribution_id		TEXT	NOT NULL,
+		revision			INTEGER	NOT NULL,
+
+		PRIMARY KEY (our_aci_uuid, group_id),
+		FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device(aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE TABLE signalmeow_sender_key_shared_with (
+		our_aci_uuid		TEXT	NOT NULL,
+		group_id			TEXT	NOT NULL,
+		their_aci_uuid		TEXT	NOT NULL,
+		their_device_id		INTEGER	NOT NULL,
+
+		PRIMARY KEY (our_aci_uuid, group_id, their_aci_uuid, their_device_id),
+		FOREIGN KEY (our_aci_uuid, group_id) REFERENCES signalmeow_sender_key_distributions(our_aci_uuid, group_id) ON DELETE CASCADE ON UPDATE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func upgradeV3(tx *sql.Tx, _ *StoreContainer) error {
+	_, err := tx.Exec(`CREATE TABLE signalmeow_kyber_pre_keys (
+		aci_uuid		TEXT	NOT NULL,
+		key_id			INTEGER	NOT NULL,
+		uuid_kind		TEXT	NOT NULL,
+		key_pair		bytea	NOT NULL,
+		is_last_resort	BOOLEAN	NOT NULL,
+		uploaded		BOOLEAN	NOT NULL,
+
+		PRIMARY KEY (aci_uuid, uuid_kind, key_id),
+		FOREIGN KEY (aci_uuid) REFERENCES signalmeow_device(aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`)
+	return err
+}
+
+func upgradeV4(tx *sql.Tx, _ *StoreContainer) error {
+	_, err := tx.Exec(`CREATE TABLE signalmeow_pni_sessions (
+		our_aci_uuid	TEXT	NOT NULL,
+		their_aci_uuid	TEXT	NOT NULL,
+		their_device_id	INTEGER	NOT NULL,
+		record			bytea   NOT NULL,
+
+		PRIMARY KEY (our_aci_uuid, their_aci_uuid, their_device_id),
+		FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device(aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE TABLE signalmeow_pni_signature_needed (
+		our_aci_uuid	TEXT	NOT NULL,
+		their_aci_uuid	TEXT	NOT NULL,
+
+		PRIMARY KEY (our_aci_uuid, their_aci_uuid),
+		FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device(aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`)
+	return err
+}
@@ -15,6 +15,9 @@ const caCertPath = "/Users/sweber/.mitmproxy/mitmproxy-ca-cert.pem"
 
 const UrlHost = "chat.signal.org"
 const StorageUrlHost = "storage.signal.org"
+const CDN1UrlHost = "cdn.signal.org"
+const CDN2UrlHost = "cdn2.signal.org"
+const CDN3UrlHost = "cdn3.signal.org"
 
 // TODO: embed Signal's self-signed cert, and turn off InsecureSkipVerify
 func proxiedHTTPClient() *http.Client {
@@ -55,11 +58,13 @@ func proxiedHTTPClient() *http.Client {
 }
 
 type HTTPReqOpt struct {
-	Body      []byte
-	Username  *string
-	Password  *string
-	RequestPB bool
-	Host      string
+	Body        []byte
+	Username    *string
+	Password    *string
+	RequestPB   bool
+	Host        string
+	Headers     map[string]string // Extra headers, these take precedence over the defaults
+	OverrideURL string            // Full URL to use instead of Host and path (e.g. signed CDN upload URLs)
 }
 
 func SendHTTPRequest(method string, path string, opt *HTTPReqOpt) (*http.Response, error) {
@@ -72,6 +77,9 @@ func SendHTTPRequest(method string, path string, opt *HTTPReqOpt) (*http.Respons
 	}
 
 	urlStr := "https://" + opt.Host + path
+	if opt.OverrideURL != "" {
+		urlStr = opt.OverrideURL
+	}
 	req, err := http.NewRequest(method, urlStr, bytes.NewBuffer(opt.Body))
 	if err != nil {
 		log.Fatalf("Error creating request: %v", err)
@@ -86,6 +94,9 @@ func SendHTTPRequest(method string, path string, opt *HTTPReqOpt) (*http.Respons
 	if opt.Username != nil && opt.Password != nil {
 		req.SetBasicAuth(*opt.Username, *opt.Password)
 	}
+	for key, value := range opt.Headers {
+		req.Header.Set(key, value)
+	}
 
 	log.Printf("Sending HTTP request: %v", req)
 	client := proxiedHTTPClient()
@@ -4,7 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html"
+	"mime"
+	"net/http"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,16 +20,40 @@ import (
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/crypto/attachment"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util"
 
 	"go.mau.fi/mautrix-signal/database"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+var (
+	errUnexpectedParsedContentType = errors.New("unexpected parsed content type")
+	errUnknownMsgType              = errors.New("unknown msgtype")
+	errMediaDownloadFailed         = errors.New("failed to download media")
+	errMediaDecryptFailed          = errors.New("failed to decrypt media")
+	errTargetNotFound              = errors.New("target event not found")
+	errDuplicateReaction           = errors.New("duplicate reaction")
+	errRedactOtherUsersMessage     = errors.New("can't delete other users' messages on Signal")
+	errDeleteWindowExpired         = errors.New("message is too old to be deleted for everyone on Signal")
+)
+
+const (
+	// Signal clients only let you delete your own messages for everyone within this window...
+	signalDeleteSendWindow = 24 * time.Hour
+	// ...and are a bit more lenient when receiving deletes to account for delays
+	signalDeleteReceiveWindow = 48 * time.Hour
+	// Signal clients resend typing started every few seconds, and give up on it after 15 seconds
+	signalTypingTimeout = 15 * time.Second
+	// How far back to look for unread messages when we don't know where the user's last read receipt was
+	readReceiptLookback = 24 * time.Hour
 )
 
 type portalSignalMessage struct {
-	msg    string
+	msg    signalmeow.IncomingSignalMessage
 	user   *User
 	sender *Puppet
 }
@@ -35,6 +63,14 @@ type portalMatrixMessage struct {
 	user *User
 }
 
+type portalOutboxRetry struct {
+	entry  *database.OutboxMessage
+	msg    *signalpb.Content
+	sender *User
+	// Gets how long the outbox has to pause for, if Signal rate limited the send
+	result chan time.Duration
+}
+
 type Portal struct {
 	*database.Portal
 
@@ -46,11 +82,15 @@ type Portal struct {
 
 	signalMessages chan portalSignalMessage
 	matrixMessages chan portalMatrixMessage
+	outboxRetries  chan portalOutboxRetry
 
 	recentMessages *util.RingBuffer[string, *signalmeow.Message]
 
 	currentlyTyping     []id.UserID
 	currentlyTypingLock sync.Mutex
+
+	// Serializes updating the last read timestamps, so each message is only marked as read once
+	lastReadLock sync.Mutex
 }
 
 const recentMessageBufferSize = 32
@@ -63,12 +103,13 @@ func init() {
 //** Interfaces that Portal implements **
 
 var _ bridge.Portal = (*Portal)(nil)
+var _ bridge.TypingPortal = (*Portal)(nil)
+var _ bridge.ReadReceiptHandlingPortal = (*Portal)(nil)
+var _ bridge.DisappearingPortal = (*Portal)(nil)
+
+var _ bridge.MetaHandlingPortal = (*Portal)(nil)
 
-//var _ bridge.ReadReceiptHandlingPortal = (*Portal)(nil)
 //var _ bridge.MembershipHandlingPortal = (*Portal)(nil)
-//var _ bridge.TypingPortal = (*Portal)(nil)
-//var _ bridge.MetaHandlingPortal = (*Portal)(nil)
-//var _ bridge.DisappearingPortal = (*Portal)(nil)
 
 // ** bridge.Portal Interface **
 
@@ -194,6 +235,7 @@ func (br *SignalBridge) NewPortal(dbPortal *database.Portal) *Portal {
 
 		signalMessages: make(chan portalSignalMessage, br.Config.Bridge.PortalMessageBuffer),
 		matrixMessages: make(chan portalMatrixMessage, br.Config.Bridge.PortalMessageBuffer),
+		outboxRetries:  make(chan portalOutboxRetry),
 
 		//recentMessages: util.NewRingBuffer[string, *discordgo.Message](recentMessageBufferSize),
 		//commands: make(map[string]*discordgo.ApplicationCommand),
@@ -214,6 +256,11 @@ func (portal *Portal) messageLoop() {
 		case msg := <-portal.signalMessages:
 			portal.log.Debug().Msg("Got message from signal")
 			portal.handleSignalMessages(msg)
+		case retry := <-portal.outboxRetries:
+			portal.log.Debug().Msg("Got outbox retry")
+			ctx, cancel := context.WithTimeout(context.Background(), outboxSendTimeout)
+			retry.result <- portal.attemptOutboxSend(ctx, retry.sender, retry.entry, retry.msg, nil)
+			cancel()
 		}
 	}
 }
@@ -223,9 +270,19 @@ func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
 	case event.EventMessage: //, event.EventSticker:
 		portal.handleMatrixMessage(msg.user, msg.evt)
 	case event.EventRedaction:
-		//portal.handleMatrixRedaction(msg.user, msg.evt)
+		portal.handleMatrixRedaction(msg.user, msg.evt)
 	case event.EventReaction:
-		//portal.handleMatrixReaction(msg.user, msg.evt)
+		portal.handleMatrixReaction(msg.user, msg.evt)
+	case event.StateRoomName:
+		portal.handleMatrixRoomName(msg.user, msg.evt)
+	case event.StateTopic:
+		portal.handleMatrixRoomTopic(msg.user, msg.evt)
+	case event.StateRoomAvatar:
+		portal.handleMatrixRoomAvatar(msg.user, msg.evt)
+	case event.StatePowerLevels:
+		portal.handleMatrixPowerLevels(msg.user, msg.evt)
+	case event.StateMember:
+		portal.handleMatrixMembership(msg.user, msg.evt)
 	default:
 		portal.log.Warn().Str("type", msg.evt.Type.String()).Msg("Unhandled matrix message type")
 	}
@@ -250,7 +307,7 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		totalReceive: time.Since(evtTS),
 	}
 	implicitRRStart := time.Now()
-	//portal.handleMatrixReadReceipt(msg.user, "", evtTS, false)
+	portal.handleMatrixReadReceipt(sender, "", evtTS, false)
 	timings.implicitRR = time.Since(implicitRRStart)
 	start := time.Now()
 
@@ -307,7 +364,12 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	timings.preproc = time.Since(start)
 	start = time.Now()
 	//msg, sender, extraMeta, err := portal.convertMatrixMessage(ctx, sender, evt)
-	msg := evt.Content.AsMessage().Body
+	msg, err := portal.convertMatrixMessage(ctx, sender, evt)
+	if err != nil {
+		portal.log.Error().Err(err).Msgf("Failed to convert event %s to Signal message", evt.ID)
+		go portal.sendMessageMetrics(evt, err, "Error converting")
+		return
+	}
 	recipientSignalID := portal.ChatID
 	timings.convert = time.Since(start)
 	//if msg == nil {
@@ -334,48 +396,470 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	portal.log.Debug().Msgf("Sending event %s to Signal %s", evt.ID, recipientSignalID)
 	start = time.Now()
 
+	if portal.ExpirationTime > 0 && msg.DataMessage != nil {
+		expireTimer := uint32(portal.ExpirationTime)
+		msg.DataMessage.ExpireTimer = &expireTimer
+	}
+	// The message goes in the outbox first, so it isn't lost if sending fails or the bridge restarts
+	entry, err := portal.addToOutbox(sender, evt.ID, msg)
+	if err != nil {
+		portal.log.Error().Err(err).Msgf("Failed to add event %s to outbox", evt.ID)
+		go portal.sendMessageMetrics(evt, err, "Error sending")
+		return
+	}
+	portal.attemptOutboxSend(ctx, sender, entry, msg, evt)
+	timings.totalSend = time.Since(start)
+}
+
+// Sends the content to the Signal chat of this portal, whether that's a DM or a group
+// and returns the timestamp it was sent with
+func (portal *Portal) sendSignalMessage(ctx context.Context, msg *signalpb.Content, sender *User, evtID id.EventID) (uint64, error) {
+	recipientSignalID := portal.ChatID
+
 	// Check to see if recipientSignalID is a standard UUID (with dashes)
-	var err error
 	if _, uuidErr := uuid.Parse(recipientSignalID); uuidErr == nil {
 		// this is a 1:1 chat
 		result := signalmeow.SendMessage(ctx, sender.SignalDevice, recipientSignalID, msg)
 		if !result.WasSuccessful {
-			err = result.FailedSendResult.Error
-			portal.log.Error().Msgf("Error sending event %s to Signal %s: %s", evt.ID, recipientSignalID, err)
+			err := result.FailedSendResult.Error
+			portal.log.Error().Msgf("Error sending event %s to Signal %s: %s", evtID, recipientSignalID, err)
+			return 0, err
 		}
+		return result.Timestamp, nil
+	}
+
+	// this is a group chat
+	groupID := signalmeow.GroupID(recipientSignalID)
+	result, err := signalmeow.SendGroupMessage(ctx, sender.SignalDevice, groupID, msg)
+	if err != nil {
+		portal.log.Error().Msgf("Error sending event %s to Signal group %s: %s", evtID, recipientSignalID, err)
+		return 0, err
+	}
+	totalRecipients := len(result.FailedToSendTo) + len(result.SuccessfullySentTo)
+	if len(result.FailedToSendTo) > 0 {
+		portal.log.Error().Msgf("Failed to send event %s to %d of %d members of Signal group %s", evtID, len(result.FailedToSendTo), totalRecipients, recipientSignalID)
+	}
+	if len(result.SuccessfullySentTo) == 0 {
+		portal.log.Error().Msgf("Failed to send event %s to all %d members of Signal group %s", evtID, totalRecipients, recipientSignalID)
+		return 0, errors.New("failed to send to any members of Signal group")
+	} else if len(result.SuccessfullySentTo) < totalRecipients {
+		portal.log.Warn().Msgf("Only sent event %s to %d of %d members of Signal group %s", evtID, len(result.SuccessfullySentTo), totalRecipients, recipientSignalID)
 	} else {
-		// this is a group chat
-		groupID := signalmeow.GroupID(recipientSignalID)
-		result, err := signalmeow.SendGroupMessage(ctx, sender.SignalDevice, groupID, msg)
-		if err != nil {
-			portal.log.Error().Msgf("Error sending event %s to Signal group %s: %s", evt.ID, recipientSignalID, err)
+		portal.log.Debug().Msgf("Sent event %s to all %d members of Signal group %s", evtID, totalRecipients, recipientSignalID)
+	}
+	return result.Timestamp, nil
+}
+
+func (portal *Portal) HandleMatrixReadReceipt(brSender bridge.User, eventID id.EventID, receipt event.ReadReceipt) {
+	portal.handleMatrixReadReceipt(brSender.(*User), eventID, receipt.Timestamp, true)
+}
+
+// Sends read receipts to Signal for all the messages up to the given event, or up to the given time if there's no event
+func (portal *Portal) handleMatrixReadReceipt(sender *User, eventID id.EventID, receiptTimestamp time.Time, isExplicit bool) {
+	if !sender.IsLoggedIn() || sender.SignalDevice == nil {
+		return
+	}
+	// Reading the chat starts the timers of any disappearing messages in it, sending a message doesn't
+	if isExplicit {
+		portal.ScheduleDisappearing()
+	}
+	upTo := receiptTimestamp
+	if eventID != "" {
+		targetMsg := portal.bridge.DB.Message.GetByMXID(eventID)
+		if targetMsg != nil && targetMsg.MXRoom == portal.MXID {
+			upTo = targetMsg.Timestamp
+		} else if isExplicit {
+			portal.log.Debug().Msgf("Read receipt for unknown event %s, using receipt timestamp instead", eventID)
 		}
-		totalRecipients := len(result.FailedToSendTo) + len(result.SuccessfullySentTo)
-		if len(result.FailedToSendTo) > 0 {
-			portal.log.Error().Msgf("Failed to send event %s to %d of %d members of Signal group %s", evt.ID, len(result.FailedToSendTo), totalRecipients, recipientSignalID)
+	}
+	if upTo.IsZero() {
+		return
+	}
+
+	portal.lastReadLock.Lock()
+	defer portal.lastReadLock.Unlock()
+	after := portal.bridge.DB.LastRead.Get(sender.MXID, portal.Key())
+	if after.IsZero() {
+		after = upTo.Add(-readReceiptLookback)
+	}
+	if !upTo.After(after) {
+		return
+	}
+	portal.bridge.DB.LastRead.Set(sender.MXID, portal.Key(), upTo)
+
+	// Signal receipts go to the author of each message, and list all the timestamps from that author
+	timestampsByAuthor := map[string][]uint64{}
+	for _, msg := range portal.bridge.DB.Message.GetAllBetween(portal.ChatID, portal.Receiver, after, upTo) {
+		// Other parts are the same Signal message as the first one
+		if msg.Sender == sender.SignalID || msg.PartIndex > 0 {
+			continue
 		}
-		if len(result.SuccessfullySentTo) == 0 {
-			portal.log.Error().Msgf("Failed to send event %s to all %d members of Signal group %s", evt.ID, totalRecipients, recipientSignalID)
-			err = errors.New("failed to send to any members of Signal group")
-		} else if len(result.SuccessfullySentTo) < totalRecipients {
-			portal.log.Warn().Msgf("Only sent event %s to %d of %d members of Signal group %s", evt.ID, len(result.SuccessfullySentTo), totalRecipients, recipientSignalID)
+		timestampsByAuthor[msg.Sender] = append(timestampsByAuthor[msg.Sender], uint64(msg.Timestamp.UnixMilli()))
+	}
+	// Sending can take a while, and shouldn't hold up the Matrix event or the portal
+	if len(timestampsByAuthor) > 0 {
+		go portal.sendReadReceipts(sender.SignalDevice, timestampsByAuthor)
+	}
+}
+
+func (portal *Portal) sendReadReceipts(device *signalmeow.Device, timestampsByAuthor map[string][]uint64) {
+	for author, timestamps := range timestampsByAuthor {
+		content := &signalpb.Content{
+			ReceiptMessage: signalmeow.ReadReceiptForTimestamps(timestamps),
+		}
+		result := signalmeow.SendMessage(context.Background(), device, author, content)
+		if !result.WasSuccessful {
+			portal.log.Warn().Err(result.FailedSendResult.Error).Msgf("Failed to send read receipt for %d messages to %s", len(timestamps), author)
 		} else {
-			portal.log.Debug().Msgf("Sent event %s to all %d members of Signal group %s", evt.ID, totalRecipients, recipientSignalID)
+			portal.log.Debug().Msgf("Sent read receipt for %d messages to %s", len(timestamps), author)
 		}
 	}
-	timings.totalSend = time.Since(start)
-	//go ms.sendMessageMetrics(evt, err, "Error sending", true)
-	if err == nil {
-		//dbMsg.MarkSent(resp.Timestamp)
-		dbMessage := portal.bridge.DB.Message.New()
-		dbMessage.MXID = evt.ID
-		dbMessage.MXRoom = portal.MXID
-		dbMessage.Sender = sender.SignalID
-		dbMessage.Timestamp = start // TODO: get timestamp from signal
-		dbMessage.SignalChatID = portal.ChatID
-		dbMessage.SignalReceiver = portal.Receiver
-		dbMessage.Insert(nil)
+}
+
+func typingDiff(prev, new []id.UserID) (started, stopped []id.UserID) {
+OuterNew:
+	for _, userID := range new {
+		for _, previousUserID := range prev {
+			if userID == previousUserID {
+				continue OuterNew
+			}
+		}
+		started = append(started, userID)
+	}
+OuterPrev:
+	for _, userID := range prev {
+		for _, newUserID := range new {
+			if userID == newUserID {
+				continue OuterPrev
+			}
+		}
+		stopped = append(stopped, userID)
+	}
+	return
+}
+
+func (portal *Portal) HandleMatrixTyping(newTyping []id.UserID) {
+	portal.currentlyTypingLock.Lock()
+	defer portal.currentlyTypingLock.Unlock()
+	startedTyping, stoppedTyping := typingDiff(portal.currentlyTyping, newTyping)
+	portal.currentlyTyping = newTyping
+	portal.setSignalTyping(startedTyping, true)
+	portal.setSignalTyping(stoppedTyping, false)
+}
+
+func (portal *Portal) setSignalTyping(userIDs []id.UserID, isTyping bool) {
+	for _, userID := range userIDs {
+		user := portal.bridge.GetUserByMXIDIfExists(userID)
+		if user == nil || !user.IsLoggedIn() || user.SignalDevice == nil {
+			continue
+		}
+		content := &signalpb.Content{
+			TypingMessage: signalmeow.TypingMessageForAction(isTyping),
+		}
+		// Sending can take a while, and typing notifications aren't important enough to hold up the portal.
+		// This runs alongside the portal loop, which is fine because signalmeow locks the group and profile caches.
+		go func(user *User) {
+			_, err := portal.sendSignalMessage(context.Background(), content, user, "")
+			if err != nil {
+				portal.log.Warn().Err(err).Msgf("Failed to send typing %v of %s to Signal", isTyping, user.MXID)
+			}
+		}(user)
+	}
+}
+
+func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, evt *event.Event) (*signalpb.Content, error) {
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return nil, fmt.Errorf("%w %T", errUnexpectedParsedContentType, evt.Content.Parsed)
+	}
+	replyTo := content.GetReplyTo()
+	content.RemoveReplyFallback()
+
+	var dataMessage *signalpb.DataMessage
+	switch content.MsgType {
+	case event.MsgText, event.MsgNotice, event.MsgEmote:
+		body := content.Body
+		var bodyRanges []*signalpb.BodyRange
+		if content.Format == event.FormatHTML && content.FormattedBody != "" {
+			var err error
+			body, bodyRanges, err = portal.parseMatrixFormatting(content.FormattedBody)
+			if err != nil {
+				portal.log.Warn().Err(err).Msgf("Failed to parse formatted body of %s, sending plain body", evt.ID)
+				body, bodyRanges = content.Body, nil
+			}
+		}
+		if content.MsgType == event.MsgEmote {
+			const emotePrefix = "/me "
+			body = emotePrefix + body
+			for _, bodyRange := range bodyRanges {
+				shiftedStart := bodyRange.GetStart() + uint32(len(emotePrefix))
+				bodyRange.Start = &shiftedStart
+			}
+		}
+		dataMessage = signalmeow.DataMessageForText(body)
+		dataMessage.BodyRanges = bodyRanges
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		attachmentPointer, err := portal.uploadMatrixAttachment(ctx, sender, evt, content)
+		if err != nil {
+			return nil, err
+		}
+		// The body is only a caption if there's a separate file name
+		caption := ""
+		if content.FileName != "" && content.FileName != content.Body {
+			caption = content.Body
+		}
+		dataMessage = signalmeow.DataMessageForAttachment(attachmentPointer, caption)
+	default:
+		return nil, fmt.Errorf("%w %s", errUnknownMsgType, content.MsgType)
+	}
+	if replyTo != "" {
+		dataMessage.Quote = portal.quoteForMatrixReply(ctx, sender, replyTo)
+	}
+	return &signalpb.Content{DataMessage: dataMessage}, nil
+}
+
+// Signal quotes carry a copy of what's being replied to, so fetch the original event to fill that in
+func (portal *Portal) quoteForMatrixReply(ctx context.Context, sender *User, replyTo id.EventID) *signalpb.DataMessage_Quote {
+	targetMsg := portal.bridge.DB.Message.GetByMXID(replyTo)
+	if targetMsg == nil || targetMsg.MXRoom != portal.MXID {
+		portal.log.Warn().Msgf("Reply target %s not found, sending without quote", replyTo)
+		return nil
+	}
+	targetTimestamp := uint64(targetMsg.Timestamp.UnixMilli())
+	targetContent := portal.getMatrixMessageContent(replyTo)
+	if targetContent == nil {
+		return signalmeow.QuoteForMessage(targetMsg.Sender, targetTimestamp, "")
+	}
+	targetContent.RemoveReplyFallback()
+
+	switch targetContent.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		caption := ""
+		fileName := targetContent.Body
+		if targetContent.FileName != "" && targetContent.FileName != targetContent.Body {
+			caption = targetContent.Body
+			fileName = targetContent.FileName
+		}
+		quote := signalmeow.QuoteForMessage(targetMsg.Sender, targetTimestamp, caption)
+		quotedAttachment := &signalpb.DataMessage_Quote_QuotedAttachment{
+			FileName:  &fileName,
+			Thumbnail: portal.thumbnailForQuote(ctx, sender, targetContent),
+		}
+		if targetContent.Info != nil && targetContent.Info.MimeType != "" {
+			quotedAttachment.ContentType = &targetContent.Info.MimeType
+		}
+		quote.Attachments = append(quote.Attachments, quotedAttachment)
+		return quote
+	default:
+		return signalmeow.QuoteForMessage(targetMsg.Sender, targetTimestamp, targetContent.Body)
+	}
+}
+
+func (portal *Portal) getMatrixMessageContent(eventID id.EventID) *event.MessageEventContent {
+	evt, err := portal.MainIntent().GetEvent(portal.MXID, eventID)
+	if err != nil {
+		portal.log.Warn().Err(err).Msgf("Failed to get event %s", eventID)
+		return nil
+	}
+	err = evt.Content.ParseRaw(evt.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		portal.log.Warn().Err(err).Msgf("Failed to parse event %s", eventID)
+		return nil
+	}
+	if evt.Type == event.EventEncrypted {
+		if portal.bridge.Crypto == nil {
+			return nil
+		}
+		evt, err = portal.bridge.Crypto.Decrypt(evt)
+		if err != nil {
+			portal.log.Warn().Err(err).Msgf("Failed to decrypt event %s", eventID)
+			return nil
+		}
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return nil
+	}
+	return content
+}
+
+// Images small enough to be their own thumbnail are used as is
+const maxQuoteThumbnailSize = 256 * 1024
+
+// Uses the Matrix thumbnail of the quoted media if there is one, so Signal can show a preview in the quote
+func (portal *Portal) thumbnailForQuote(ctx context.Context, sender *User, content *event.MessageEventContent) *signalpb.AttachmentPointer {
+	var data []byte
+	var mimeType string
+	var err error
+	info := content.Info
+	if info != nil && (info.ThumbnailFile != nil || info.ThumbnailURL != "") {
+		data, err = portal.downloadMatrixAttachment(info.ThumbnailURL, info.ThumbnailFile)
+		if info.ThumbnailInfo != nil {
+			mimeType = info.ThumbnailInfo.MimeType
+		}
+	} else if content.MsgType == event.MsgImage && info != nil && info.Size > 0 && info.Size <= maxQuoteThumbnailSize {
+		data, err = portal.downloadMatrixAttachment(content.URL, content.File)
+		mimeType = info.MimeType
+	} else {
+		return nil
+	}
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to download thumbnail for quote")
+		return nil
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	thumbnail, err := signalmeow.UploadAttachment(ctx, sender.SignalDevice, data, signalmeow.AttachmentUploadOptions{ContentType: mimeType})
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to upload thumbnail for quote")
+		return nil
+	}
+	return thumbnail
+}
+
+func (portal *Portal) uploadMatrixAttachment(ctx context.Context, sender *User, evt *event.Event, content *event.MessageEventContent) (*signalpb.AttachmentPointer, error) {
+	data, err := portal.downloadMatrixAttachment(content.URL, content.File)
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := content.FileName
+	if fileName == "" {
+		fileName = content.Body
+	}
+	opts := signalmeow.AttachmentUploadOptions{
+		FileName: fileName,
+	}
+	if content.Info != nil {
+		opts.ContentType = content.Info.MimeType
+		opts.Width = uint32(content.Info.Width)
+		opts.Height = uint32(content.Info.Height)
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = http.DetectContentType(data)
+	}
+	if _, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]; isVoice {
+		opts.Flags |= uint32(signalpb.AttachmentPointer_VOICE_MESSAGE)
 	}
+	return signalmeow.UploadAttachment(ctx, sender.SignalDevice, data, opts)
+}
+
+func (portal *Portal) downloadMatrixAttachment(rawMXC id.ContentURIString, file *event.EncryptedFileInfo) ([]byte, error) {
+	if file != nil {
+		rawMXC = file.URL
+	}
+	mxc, err := rawMXC.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("malformed content URL: %w", err)
+	}
+	data, err := portal.MainIntent().DownloadBytes(mxc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errMediaDownloadFailed, err)
+	}
+	if file != nil {
+		err = file.DecryptInPlace(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errMediaDecryptFailed, err)
+		}
+	}
+	return data, nil
+}
+
+func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.ReactionEventContent)
+	if !ok {
+		go portal.sendMessageMetrics(evt, fmt.Errorf("%w %T", errUnexpectedParsedContentType, evt.Content.Parsed), "Error converting")
+		return
+	}
+	targetMsg := portal.bridge.DB.Message.GetByMXID(content.RelatesTo.EventID)
+	if targetMsg == nil || targetMsg.MXRoom != portal.MXID {
+		go portal.sendMessageMetrics(evt, errTargetNotFound, "Ignoring")
+		return
+	}
+	emoji := content.RelatesTo.Key
+	existing := portal.bridge.DB.Reaction.GetBySignalID(targetMsg.Sender, targetMsg.Timestamp, sender.SignalID, portal.ChatID, portal.Receiver)
+	if existing != nil && existing.Emoji == emoji {
+		go portal.sendMessageMetrics(evt, errDuplicateReaction, "Ignoring")
+		return
+	}
+
+	portal.log.Debug().Msgf("Sending reaction %s to %s/%d to Signal", evt.ID, targetMsg.Sender, targetMsg.Timestamp.UnixMilli())
+	msg := signalmeow.DataMessageForReaction(emoji, targetMsg.Sender, uint64(targetMsg.Timestamp.UnixMilli()), false)
+	_, err := portal.sendSignalMessage(context.Background(), &signalpb.Content{DataMessage: msg}, sender, evt.ID)
+	go portal.sendMessageMetrics(evt, err, "Error sending")
+	if err != nil {
+		return
+	}
+
+	// Signal only allows one reaction per user per message, so the new one replaces the old one
+	if existing != nil {
+		_, err = portal.MainIntent().RedactEvent(portal.MXID, existing.MXID)
+		if err != nil {
+			portal.log.Warn().Err(err).Msgf("Failed to redact replaced reaction %s", existing.MXID)
+		}
+		existing.Delete(nil)
+	}
+	dbReaction := portal.bridge.DB.Reaction.New()
+	dbReaction.MXID = evt.ID
+	dbReaction.MXRoom = portal.MXID
+	dbReaction.SignalChatID = portal.ChatID
+	dbReaction.SignalReceiver = portal.Receiver
+	dbReaction.Author = sender.SignalID
+	dbReaction.MsgAuthor = targetMsg.Sender
+	dbReaction.MsgTimestamp = targetMsg.Timestamp
+	dbReaction.Emoji = emoji
+	dbReaction.Insert(nil)
+}
+
+func (portal *Portal) handleMatrixRedaction(sender *User, evt *event.Event) {
+	// Redacting a message deletes it for everyone
+	if targetMsg := portal.bridge.DB.Message.GetByMXID(evt.Redacts); targetMsg != nil && targetMsg.MXRoom == portal.MXID {
+		if targetMsg.Sender != sender.SignalID {
+			go portal.sendMessageMetrics(evt, errRedactOtherUsersMessage, "Ignoring")
+			return
+		}
+		if time.Since(targetMsg.Timestamp) > signalDeleteSendWindow {
+			go portal.sendMessageMetrics(evt, errDeleteWindowExpired, "Error sending")
+			return
+		}
+		portal.log.Debug().Msgf("Sending redaction %s of %s/%d to Signal", evt.ID, targetMsg.Sender, targetMsg.Timestamp.UnixMilli())
+		msg := signalmeow.DataMessageForDelete(uint64(targetMsg.Timestamp.UnixMilli()))
+		_, err := portal.sendSignalMessage(context.Background(), &signalpb.Content{DataMessage: msg}, sender, evt.ID)
+		go portal.sendMessageMetrics(evt, err, "Error sending")
+		if err != nil {
+			return
+		}
+		// The whole Signal message is gone now, so clean up any other parts of it too
+		for _, part := range portal.bridge.DB.Message.GetAllPartsBySignalID(targetMsg.Sender, targetMsg.Timestamp, portal.ChatID, portal.Receiver) {
+			if part.MXID != targetMsg.MXID {
+				_, err = portal.MainIntent().RedactEvent(portal.MXID, part.MXID)
+				if err != nil {
+					portal.log.Warn().Err(err).Msgf("Failed to redact other part %s of deleted message", part.MXID)
+				}
+			}
+			part.Delete(nil)
+		}
+		return
+	}
+
+	// Redacting a reaction removes it
+	if targetReaction := portal.bridge.DB.Reaction.GetByMXID(evt.Redacts); targetReaction != nil && targetReaction.MXRoom == portal.MXID {
+		if targetReaction.Author != sender.SignalID {
+			go portal.sendMessageMetrics(evt, errRedactOtherUsersMessage, "Ignoring")
+			return
+		}
+		portal.log.Debug().Msgf("Sending removal of reaction %s to %s/%d to Signal", evt.Redacts, targetReaction.MsgAuthor, targetReaction.MsgTimestamp.UnixMilli())
+		msg := signalmeow.DataMessageForReaction(targetReaction.Emoji, targetReaction.MsgAuthor, uint64(targetReaction.MsgTimestamp.UnixMilli()), true)
+		_, err := portal.sendSignalMessage(context.Background(), &signalpb.Content{DataMessage: msg}, sender, evt.ID)
+		go portal.sendMessageMetrics(evt, err, "Error sending")
+		if err == nil {
+			targetReaction.Delete(nil)
+		}
+		return
+	}
+
+	go portal.sendMessageMetrics(evt, errTargetNotFound, "Ignoring")
 }
 
 func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part string) {
@@ -418,7 +902,7 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 		//	}
 		//	portal.sendErrorMessage(msgType, humanMessage, isCertain)
 		//}
-		//portal.sendStatusEvent(evt.ID, err)
+		portal.sendStatusEvent(evt.ID, err)
 	} else {
 		logEvt.Err(err).Msg("Matrix event handled successfully")
 		portal.sendDeliveryReceipt(evt.ID)
@@ -439,6 +923,10 @@ func (portal *Portal) sendDeliveryReceipt(eventID id.EventID) {
 }
 
 func (portal *Portal) sendStatusEvent(evtID id.EventID, err error) {
+	portal.sendStatusEventWithStatus(evtID, event.MessageStatusSuccess, err)
+}
+
+func (portal *Portal) sendStatusEventWithStatus(evtID id.EventID, status event.MessageStatus, err error) {
 	if !portal.bridge.Config.Bridge.MessageStatusEvents {
 		return
 	}
@@ -454,7 +942,7 @@ func (portal *Portal) sendStatusEvent(evtID id.EventID, err error) {
 			Type:    event.RelReference,
 			EventID: evtID,
 		},
-		Status: event.MessageStatusSuccess,
+		Status: status,
 	}
 	if err == nil {
 		content.Status = event.MessageStatusSuccess
@@ -466,6 +954,10 @@ func (portal *Portal) sendStatusEvent(evtID id.EventID, err error) {
 		} else {
 			content.Error = err.Error()
 		}
+		if errors.Is(err, signalmeow.ErrGroupChangeForbidden) {
+			content.Reason = event.MessageStatusNoPermission
+			content.Message = groupChangeErrorMessage(err)
+		}
 	}
 	_, err = intent.SendMessageEvent(portal.MXID, event.BeeperMessageStatus, &content)
 	if err != nil {
@@ -473,7 +965,50 @@ func (portal *Portal) sendStatusEvent(evtID id.EventID, err error) {
 	}
 }
 
+// Signal delivery receipts don't have a Matrix equivalent, so they're only shown in message status events
+func (portal *Portal) sendDeliveredStatus(evtID id.EventID, deliveredTo *Puppet) {
+	if !portal.bridge.Config.Bridge.MessageStatusEvents {
+		return
+	}
+	intent := portal.bridge.Bot
+	if !portal.Encrypted {
+		// Bridge bot isn't present in unencrypted DMs
+		intent = portal.MainIntent()
+	}
+	stateKey, _ := portal.getBridgeInfo()
+	content := event.Content{
+		Parsed: &event.BeeperMessageStatusEventContent{
+			Network: stateKey,
+			RelatesTo: event.RelatesTo{
+				Type:    event.RelReference,
+				EventID: evtID,
+			},
+			Status: event.MessageStatusSuccess,
+		},
+		Raw: map[string]interface{}{
+			"delivered_to_users": []id.UserID{deliveredTo.MXID},
+		},
+	}
+	_, err := intent.SendMessageEvent(portal.MXID, event.BeeperMessageStatus, &content)
+	if err != nil {
+		portal.log.Err(err).Str("event_id", evtID.String()).Msg("Failed to send delivered message status event")
+	}
+}
+
 func (portal *Portal) handleSignalMessages(msg portalSignalMessage) {
+	// Typing notifications and receipts aren't worth creating a room for
+	switch msg.msg.MessageType() {
+	case signalmeow.IncomingSignalMessageTypeTyping:
+		portal.handleSignalTyping(msg.sender, msg.msg.(signalmeow.IncomingSignalMessageTyping))
+		return
+	case signalmeow.IncomingSignalMessageTypeReceipt:
+		portal.handleSignalReceipt(msg.user, msg.sender, msg.msg.(signalmeow.IncomingSignalMessageReceipt))
+		return
+	case signalmeow.IncomingSignalMessageTypeIdentityChange:
+		portal.handleSignalIdentityChange(msg.sender, msg.msg.(signalmeow.IncomingSignalMessageIdentityChange))
+		return
+	}
+
 	if portal.MXID == "" {
 		portal.log.Debug().Msg("Creating Matrix room from incoming message")
 		if err := portal.CreateMatrixRoom(msg.user, nil); err != nil {
@@ -484,6 +1019,12 @@ func (portal *Portal) handleSignalMessages(msg portalSignalMessage) {
 		}
 	}
 
+	// Group changes don't always have a known sender, so they pick their own intent
+	if msg.msg.MessageType() == signalmeow.IncomingSignalMessageTypeGroupChange {
+		portal.handleSignalGroupChange(msg.user, msg.sender, msg.msg.(signalmeow.IncomingSignalMessageGroupChange))
+		return
+	}
+
 	//intent := portal.getMessageIntent(msg.user, msg.sender)
 	intent := msg.sender.IntentFor(portal)
 	if intent == nil {
@@ -491,41 +1032,56 @@ func (portal *Portal) handleSignalMessages(msg portalSignalMessage) {
 		return
 	}
 
-	timestamp := time.Now() //TODO get this from signal message
-	content := &event.MessageEventContent{
-		Body:    msg.msg,
-		MsgType: event.MsgText,
+	var eventID id.EventID
+	var timestamp uint64
+	var expiresIn uint32
+	var err error
+	switch msg.msg.MessageType() {
+	case signalmeow.IncomingSignalMessageTypeText:
+		m := msg.msg.(signalmeow.IncomingSignalMessageText)
+		timestamp = m.Timestamp
+		expiresIn = m.ExpiresIn
+		eventID, err = portal.handleSignalTextMessage(intent, m)
+	case signalmeow.IncomingSignalMessageTypeAttachment:
+		m := msg.msg.(signalmeow.IncomingSignalMessageAttachment)
+		timestamp = m.Timestamp
+		expiresIn = m.ExpiresIn
+		eventID, err = portal.handleSignalAttachmentMessage(intent, m)
+	case signalmeow.IncomingSignalMessageTypeReaction:
+		portal.handleSignalReaction(intent, msg.sender, msg.msg.(signalmeow.IncomingSignalMessageReaction))
+		return
+	case signalmeow.IncomingSignalMessageTypeDelete:
+		portal.handleSignalDelete(intent, msg.sender, msg.msg.(signalmeow.IncomingSignalMessageDelete))
+		return
+	case signalmeow.IncomingSignalMessageTypeExpireTimerUpdate:
+		portal.handleSignalExpireTimerUpdate(intent, msg.msg.(signalmeow.IncomingSignalMessageExpireTimerUpdate))
+		return
+	case signalmeow.IncomingSignalMessageTypeDecryptionError:
+		portal.handleSignalDecryptionError(intent, msg.msg.(signalmeow.IncomingSignalMessageDecryptionError))
+		return
+	default:
+		portal.log.Warn().Msgf("Unhandled signal message type %v", msg.msg.MessageType())
+		return
 	}
-	resp, err := portal.sendMessage(
-		intent,
-		event.EventMessage,
-		content,
-		nil,
-		timestamp.UnixMilli(), // TODO: message timestamp from Signal
-	)
 	if err != nil {
 		portal.log.Error().Err(err).Msg("Failed to send message")
 		return
 	}
-	eventID := resp.EventID
 	if eventID == "" {
-		portal.log.Error().Err(err).Msg("Failed to send message, no event ID")
+		portal.log.Error().Msg("Failed to send message, no event ID")
 		return
 	}
 
-	portal.log.Info().Msgf("**** sender: %v", msg.sender)
-	portal.log.Info().Msgf("**** sender.signalid: %v", msg.sender.SignalID)
-	dbMessage := portal.bridge.DB.Message.New()
-	dbMessage.MXID = eventID
-	dbMessage.MXRoom = portal.MXID
-	dbMessage.Sender = msg.sender.SignalID
-	dbMessage.Timestamp = timestamp
-	dbMessage.SignalChatID = portal.ChatID
-	dbMessage.SignalReceiver = portal.Receiver
-	dbMessage.Insert(nil)
+	portal.storeMessageInDB(eventID, msg.sender.SignalID, timestamp)
+
+	// Our own messages start disappearing right away, others only once they've been read
+	var startsAt time.Time
+	if msg.sender.SignalID == msg.user.SignalID {
+		startsAt = time.Now()
+	}
+	portal.MarkDisappearing(nil, eventID, time.Duration(expiresIn)*time.Second, startsAt)
 
 	// TODO: send receipt
-	// TODO: expire if it's an expiring message
 
 	//switch convertedMsg := msg.msg.(type) {
 	//case *discordgo.MessageCreate:
@@ -543,6 +1099,375 @@ func (portal *Portal) handleSignalMessages(msg portalSignalMessage) {
 	//}
 }
 
+// Signal identifies messages by (author, sent timestamp), but a single Signal message can
+// become several Matrix events (e.g. a caption and a few attachments), so each one gets a part index
+func (portal *Portal) storeMessageInDB(eventID id.EventID, senderSignalID string, timestamp uint64) {
+	sentTimestamp := time.UnixMilli(int64(timestamp))
+	existingParts := portal.bridge.DB.Message.GetAllPartsBySignalID(senderSignalID, sentTimestamp, portal.ChatID, portal.Receiver)
+	dbMessage := portal.bridge.DB.Message.New()
+	dbMessage.MXID = eventID
+	dbMessage.MXRoom = portal.MXID
+	dbMessage.Sender = senderSignalID
+	dbMessage.Timestamp = sentTimestamp
+	dbMessage.PartIndex = len(existingParts)
+	dbMessage.SignalChatID = portal.ChatID
+	dbMessage.SignalReceiver = portal.Receiver
+	dbMessage.Insert(nil)
+}
+
+func (portal *Portal) handleSignalTextMessage(intent *appservice.IntentAPI, msg signalmeow.IncomingSignalMessageText) (id.EventID, error) {
+	content := &event.MessageEventContent{
+		Body:    msg.Content,
+		MsgType: event.MsgText,
+	}
+	portal.applySignalFormatting(content, msg.BodyRanges)
+	portal.addSignalQuote(content, msg.Quote)
+	resp, err := portal.sendMessage(intent, event.EventMessage, content, nil, int64(msg.Timestamp))
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// Turns a Signal quote into a Matrix reply, or into a plain text quote if we don't know the original message
+func (portal *Portal) addSignalQuote(content *event.MessageEventContent, quote *signalmeow.IncomingSignalMessageQuote) {
+	if quote == nil {
+		return
+	}
+	targetMsg := portal.bridge.DB.Message.GetBySignalID(quote.TargetAuthorUUID, time.UnixMilli(int64(quote.TargetMessageTimestamp)), portal.ChatID, portal.Receiver)
+	if targetMsg != nil {
+		content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(targetMsg.MXID)
+		return
+	}
+
+	portal.log.Debug().Msgf("Quoted message %s/%d not found, using text fallback", quote.TargetAuthorUUID, quote.TargetMessageTimestamp)
+	authorName := quote.TargetAuthorUUID
+	if puppet := portal.bridge.GetPuppetBySignalID(quote.TargetAuthorUUID); puppet != nil && puppet.Name != "" {
+		authorName = puppet.Name
+	}
+	quotedText := quote.Text
+	if quotedText == "" && len(quote.AttachmentFilenames) > 0 {
+		quotedText = strings.Join(quote.AttachmentFilenames, ", ")
+	}
+	lines := strings.Split(quotedText, "\n")
+	lines[0] = "<" + authorName + "> " + lines[0]
+	for i := range lines {
+		lines[i] = "> " + lines[i]
+	}
+	fallback := strings.Join(lines, "\n")
+	if content.Format == event.FormatHTML {
+		htmlFallback := "<blockquote><strong>" + html.EscapeString(authorName) + "</strong><br/>" +
+			strings.ReplaceAll(html.EscapeString(quotedText), "\n", "<br/>") + "</blockquote>"
+		content.FormattedBody = htmlFallback + content.FormattedBody
+	}
+
+	isMedia := content.MsgType == event.MsgImage || content.MsgType == event.MsgVideo || content.MsgType == event.MsgAudio || content.MsgType == event.MsgFile
+	if isMedia && content.FileName == "" {
+		// The body of media is the file name, so the fallback becomes the caption
+		content.FileName = content.Body
+		content.Body = fallback
+	} else {
+		content.Body = fallback + "\n\n" + content.Body
+	}
+}
+
+func (portal *Portal) handleSignalAttachmentMessage(intent *appservice.IntentAPI, msg signalmeow.IncomingSignalMessageAttachment) (id.EventID, error) {
+	// Downloading here instead of when receiving means a big file only holds up this chat
+	data, err := signalmeow.DownloadAttachment(context.Background(), msg.Pointer)
+	if err != nil {
+		return "", fmt.Errorf("failed to download attachment: %w", err)
+	}
+	mimeType := msg.ContentType
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	fileName := msg.Filename
+	if fileName == "" {
+		fileName = "attachment"
+		if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+			fileName += exts[0]
+		}
+	}
+	content := &event.MessageEventContent{
+		Body: fileName,
+		Info: &event.FileInfo{
+			MimeType: mimeType,
+			Width:    int(msg.Width),
+			Height:   int(msg.Height),
+			Size:     len(data),
+		},
+	}
+	if msg.Caption != "" {
+		content.Body = msg.Caption
+		content.FileName = fileName
+	}
+	switch strings.Split(mimeType, "/")[0] {
+	case "image":
+		content.MsgType = event.MsgImage
+	case "video":
+		content.MsgType = event.MsgVideo
+	case "audio":
+		content.MsgType = event.MsgAudio
+	default:
+		content.MsgType = event.MsgFile
+	}
+	portal.addSignalQuote(content, msg.Quote)
+
+	err = portal.uploadMedia(intent, data, fileName, content)
+	if err != nil {
+		return "", err
+	}
+
+	var extraContent map[string]interface{}
+	if msg.IsVoiceMessage() {
+		extraContent = map[string]interface{}{
+			"org.matrix.msc1767.audio": map[string]interface{}{},
+			"org.matrix.msc3245.voice": map[string]interface{}{},
+		}
+	}
+	resp, err := portal.sendMessage(intent, event.EventMessage, content, extraContent, int64(msg.Timestamp))
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+func (portal *Portal) handleSignalReaction(intent *appservice.IntentAPI, sender *Puppet, msg signalmeow.IncomingSignalMessageReaction) {
+	targetTimestamp := time.UnixMilli(int64(msg.TargetMessageTimestamp))
+	existing := portal.bridge.DB.Reaction.GetBySignalID(msg.TargetAuthorUUID, targetTimestamp, sender.SignalID, portal.ChatID, portal.Receiver)
+
+	if msg.Remove {
+		if existing == nil {
+			portal.log.Debug().Msgf("Ignoring removal of unknown reaction to %s/%d from %s", msg.TargetAuthorUUID, msg.TargetMessageTimestamp, sender.SignalID)
+			return
+		}
+		_, err := intent.RedactEvent(portal.MXID, existing.MXID)
+		if err != nil {
+			portal.log.Error().Err(err).Msgf("Failed to redact reaction %s", existing.MXID)
+		}
+		existing.Delete(nil)
+		return
+	}
+	if existing != nil && existing.Emoji == msg.Emoji {
+		portal.log.Debug().Msgf("Ignoring duplicate reaction to %s/%d from %s", msg.TargetAuthorUUID, msg.TargetMessageTimestamp, sender.SignalID)
+		return
+	}
+
+	targetMsg := portal.bridge.DB.Message.GetBySignalID(msg.TargetAuthorUUID, targetTimestamp, portal.ChatID, portal.Receiver)
+	if targetMsg == nil {
+		portal.log.Warn().Msgf("Dropping reaction to unknown message %s/%d", msg.TargetAuthorUUID, msg.TargetMessageTimestamp)
+		return
+	}
+
+	// Signal only allows one reaction per user per message, so the new one replaces the old one
+	if existing != nil {
+		_, err := intent.RedactEvent(portal.MXID, existing.MXID)
+		if err != nil {
+			portal.log.Error().Err(err).Msgf("Failed to redact replaced reaction %s", existing.MXID)
+		}
+		existing.Delete(nil)
+	}
+
+	content := &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{
+			Type:    event.RelAnnotation,
+			EventID: targetMsg.MXID,
+			Key:     msg.Emoji,
+		},
+	}
+	resp, err := portal.sendMessage(intent, event.EventReaction, content, nil, int64(msg.Timestamp))
+	if err != nil {
+		portal.log.Error().Err(err).Msgf("Failed to send reaction to %s", targetMsg.MXID)
+		return
+	}
+	dbReaction := portal.bridge.DB.Reaction.New()
+	dbReaction.MXID = resp.EventID
+	dbReaction.MXRoom = portal.MXID
+	dbReaction.SignalChatID = portal.ChatID
+	dbReaction.SignalReceiver = portal.Receiver
+	dbReaction.Author = sender.SignalID
+	dbReaction.MsgAuthor = msg.TargetAuthorUUID
+	dbReaction.MsgTimestamp = targetTimestamp
+	dbReaction.Emoji = msg.Emoji
+	dbReaction.Insert(nil)
+}
+
+func (portal *Portal) handleSignalDelete(intent *appservice.IntentAPI, sender *Puppet, msg signalmeow.IncomingSignalMessageDelete) {
+	targetTimestamp := time.UnixMilli(int64(msg.TargetMessageTimestamp))
+	if time.UnixMilli(int64(msg.Timestamp)).Sub(targetTimestamp) > signalDeleteReceiveWindow {
+		portal.log.Warn().Msgf("Ignoring delete of %s/%d as it's outside the deletion window", sender.SignalID, msg.TargetMessageTimestamp)
+		return
+	}
+	// Senders can only delete their own messages, so the author is always the sender
+	targetParts := portal.bridge.DB.Message.GetAllPartsBySignalID(sender.SignalID, targetTimestamp, portal.ChatID, portal.Receiver)
+	if len(targetParts) == 0 {
+		portal.log.Warn().Msgf("Ignoring delete of unknown message %s/%d", sender.SignalID, msg.TargetMessageTimestamp)
+		return
+	}
+	for _, targetMsg := range targetParts {
+		_, err := intent.RedactEvent(portal.MXID, targetMsg.MXID)
+		if err != nil {
+			portal.log.Error().Err(err).Msgf("Failed to redact %s", targetMsg.MXID)
+			continue
+		}
+		targetMsg.Delete(nil)
+	}
+}
+
+func (portal *Portal) handleSignalExpireTimerUpdate(intent *appservice.IntentAPI, msg signalmeow.IncomingSignalMessageExpireTimerUpdate) {
+	if uint32(portal.ExpirationTime) == msg.ExpireTimer {
+		return
+	}
+	portal.ExpirationTime = int(msg.ExpireTimer)
+	err := portal.Update()
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to save disappearing message timer")
+	}
+	portal.sendDisappearingTimerNotice(intent, int64(msg.Timestamp))
+}
+
+func (portal *Portal) sendDisappearingTimerNotice(intent *appservice.IntentAPI, timestamp int64) {
+	body := "Turned off disappearing messages"
+	if portal.ExpirationTime > 0 {
+		body = fmt.Sprintf("Set the disappearing message timer to %s", formatDisappearingTimer(uint32(portal.ExpirationTime)))
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    body,
+	}
+	_, err := portal.sendMessage(intent, event.EventMessage, content, nil, timestamp)
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to send disappearing message timer notice")
+	}
+}
+
+func (portal *Portal) handleSignalDecryptionError(intent *appservice.IntentAPI, msg signalmeow.IncomingSignalMessageDecryptionError) {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    "Message could not be decrypted. It should arrive once the sender's device sends it again.",
+	}
+	_, err := portal.sendMessage(intent, event.EventMessage, content, nil, int64(msg.Timestamp))
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to send decryption error notice")
+	}
+}
+
+func (portal *Portal) handleSignalIdentityChange(sender *Puppet, msg signalmeow.IncomingSignalMessageIdentityChange) {
+	if portal.MXID == "" {
+		return
+	}
+	intent := sender.IntentFor(portal)
+	if intent == nil {
+		portal.log.Error().Msg("Failed to get identity change intent")
+		return
+	}
+	body := "Your safety number with this contact has changed, most likely because they reinstalled Signal."
+	if portal.bridge.Config.Bridge.BlockOnIdentityChange() {
+		body += fmt.Sprintf(" Messages won't be sent to them until you accept the change with `%s accept-safety-number`.", portal.bridge.Config.Bridge.CommandPrefix)
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    body,
+	}
+	_, err := portal.sendMessage(intent, event.EventMessage, content, nil, int64(msg.Timestamp))
+	if err != nil {
+		portal.log.Error().Err(err).Msg("Failed to send safety number change notice")
+	}
+}
+
+func (portal *Portal) handleSignalTyping(sender *Puppet, msg signalmeow.IncomingSignalMessageTyping) {
+	if portal.MXID == "" {
+		return
+	}
+	intent := sender.IntentFor(portal)
+	if intent == nil {
+		portal.log.Error().Msg("Failed to get typing intent")
+		return
+	}
+	err := intent.EnsureJoined(portal.MXID)
+	if err != nil {
+		portal.log.Error().Err(err).Msgf("Failed to ensure %s is joined before setting typing", intent.UserID)
+		return
+	}
+	var timeout time.Duration
+	if msg.IsTyping {
+		timeout = signalTypingTimeout
+	}
+	_, err = intent.UserTyping(portal.MXID, msg.IsTyping, timeout)
+	if err != nil {
+		portal.log.Warn().Err(err).Msgf("Failed to set typing of %s to %v", intent.UserID, msg.IsTyping)
+	}
+}
+
+func (portal *Portal) handleSignalReceipt(user *User, sender *Puppet, msg signalmeow.IncomingSignalMessageReceipt) {
+	if portal.MXID == "" {
+		return
+	}
+	// Receipts are always for our messages, so look them up with us as the sender
+	var newestParts []*database.Message
+	for _, timestamp := range msg.Timestamps {
+		parts := portal.bridge.DB.Message.GetAllPartsBySignalID(user.SignalID, time.UnixMilli(int64(timestamp)), portal.ChatID, portal.Receiver)
+		if len(parts) == 0 {
+			continue
+		}
+		if msg.ReceiptType == signalmeow.IncomingSignalMessageReceiptTypeDelivery {
+			// In groups, one member getting the message doesn't say much about the others
+			if portal.IsPrivateChat() {
+				for _, part := range parts {
+					portal.sendDeliveredStatus(part.MXID, sender)
+				}
+			}
+		} else if len(newestParts) == 0 || parts[0].Timestamp.After(newestParts[0].Timestamp) {
+			newestParts = parts
+		}
+	}
+	if len(newestParts) == 0 {
+		return
+	}
+	// Matrix read receipts cover everything before them, so marking the last part of the newest message is enough
+	intent := sender.IntentFor(portal)
+	if intent == nil {
+		portal.log.Error().Msg("Failed to get read receipt intent")
+		return
+	}
+	lastPart := newestParts[len(newestParts)-1]
+	err := intent.MarkRead(portal.MXID, lastPart.MXID)
+	if err != nil {
+		portal.log.Warn().Err(err).Msgf("Failed to mark %s as read by %s", lastPart.MXID, intent.UserID)
+	}
+}
+
+// Uploads the given data to the media repo, encrypting it first if the portal is encrypted,
+// and sets the URL or file info on the content accordingly
+func (portal *Portal) uploadMedia(intent *appservice.IntentAPI, data []byte, fileName string, content *event.MessageEventContent) error {
+	uploadMimeType := content.Info.MimeType
+	var file *event.EncryptedFileInfo
+	if portal.Encrypted {
+		file = &event.EncryptedFileInfo{
+			EncryptedFile: *attachment.NewEncryptedFile(),
+		}
+		file.EncryptInPlace(data)
+		uploadMimeType = "application/octet-stream"
+		fileName = ""
+	}
+	req := mautrix.ReqUploadMedia{
+		ContentBytes: data,
+		ContentType:  uploadMimeType,
+		FileName:     fileName,
+	}
+	uploaded, err := intent.UploadMedia(req)
+	if err != nil {
+		return err
+	}
+	content.URL = uploaded.ContentURI.CUString()
+	if file != nil {
+		file.URL = content.URL
+		content.File = file
+		content.URL = ""
+	}
+	return nil
+}
+
 func (portal *Portal) sendMainIntentMessage(content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
 	return portal.sendMessage(portal.MainIntent(), event.EventMessage, content, nil, 0)
 }
@@ -562,7 +1487,7 @@ func (portal *Portal) encrypt(intent *appservice.IntentAPI, content *event.Conte
 	return event.EventEncrypted, nil
 }
 
-func (portal *Portal) sendMessage(intent *appservice.IntentAPI, eventType event.Type, content *event.MessageEventContent, extraContent map[string]interface{}, timestamp int64) (*mautrix.RespSendEvent, error) {
+func (portal *Portal) sendMessage(intent *appservice.IntentAPI, eventType event.Type, content interface{}, extraContent map[string]interface{}, timestamp int64) (*mautrix.RespSendEvent, error) {
 	wrappedContent := event.Content{Parsed: content, Raw: extraContent}
 	var err error
 	eventType, err = portal.encrypt(intent, &wrappedContent, eventType)
@@ -724,7 +1649,9 @@ func (portal *Portal) CreateMatrixRoom(user *User, meta *any) error {
 	user.ensureInvited(portal.MainIntent(), portal.MXID, portal.IsPrivateChat())
 	user.syncChatDoublePuppetDetails(portal, true)
 
-	//portal.syncParticipants(user, channel.Recipients)
+	if !portal.IsPrivateChat() {
+		portal.syncSignalGroup(user)
+	}
 
 	if portal.IsPrivateChat() {
 		portal.log.Debug().Msgf("Portal is private chat, updating direct chats: %s", portal.MXID)
@@ -80,7 +80,7 @@ func (br *SignalBridge) ParsePuppetMXID(mxid id.UserID) (string, bool) {
 	if userIDRegex == nil {
 		pattern := fmt.Sprintf(
 			"^@%s:%s$",
-			br.Config.Bridge.FormatUsername("([0-9]+)"),
+			br.Config.Bridge.FormatUsername("([0-9a-f-]+)"),
 			br.Config.Homeserver.Domain,
 		)
 
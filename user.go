@@ -37,6 +37,8 @@ type User struct {
 	PermissionLevel bridgeconfig.PermissionLevel
 
 	SignalDevice *signalmeow.Device
+	// Stops the receive loops and prekey maintenance of the current connection
+	cancelConnection context.CancelFunc
 
 	BridgeState     *bridge.BridgeStateQueue
 	bridgeStateLock sync.Mutex
@@ -138,6 +140,15 @@ func (br *SignalBridge) loadUser(dbUser *database.User, mxid *id.UserID) *User {
 }
 
 func (br *SignalBridge) GetUserByMXID(userID id.UserID) *User {
+	return br.getUserByMXID(userID, false)
+}
+
+// Like GetUserByMXID, but doesn't create a new user for people who have never used the bridge
+func (br *SignalBridge) GetUserByMXIDIfExists(userID id.UserID) *User {
+	return br.getUserByMXID(userID, true)
+}
+
+func (br *SignalBridge) getUserByMXID(userID id.UserID, onlyIfExists bool) *User {
 	if userID == br.Bot.UserID || br.IsGhost(userID) {
 		return nil
 	}
@@ -146,7 +157,11 @@ func (br *SignalBridge) GetUserByMXID(userID id.UserID) *User {
 
 	user, ok := br.usersByMXID[userID]
 	if !ok {
-		return br.loadUser(br.DB.User.GetByMXID(userID), &userID)
+		userIDPtr := &userID
+		if onlyIfExists {
+			userIDPtr = nil
+		}
+		return br.loadUser(br.DB.User.GetByMXID(userID), userIDPtr)
 	}
 	return user
 }
@@ -357,7 +372,11 @@ func (user *User) Connect() error {
 	// TODO: hook up remote-netework handlers here
 	device.Connection.IncomingSignalMessageHandler = user.incomingMessageHandler
 
-	ctx := context.Background()
+	if user.cancelConnection != nil {
+		user.cancelConnection()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	user.cancelConnection = cancel
 	connectErr := signalmeow.StartReceiveLoops(ctx, user.SignalDevice)
 
 	return connectErr
@@ -367,91 +386,167 @@ func (user *User) incomingMessageHandler(incomingMessage signalmeow.IncomingSign
 	switch incomingMessage.MessageType() {
 	case signalmeow.IncomingSignalMessageTypeText:
 		m := incomingMessage.(signalmeow.IncomingSignalMessageText)
-		var chatID string
-		var senderPuppet *Puppet
-
-		// Get and update the puppet for this message
-		if m.SenderUUID == user.SignalID {
-			// This is a message sent by us on another device
-			log.Printf("Text message received to %s (group: %v) at %v: %s\n", m.RecipientUUID, m.GroupID, m.Timestamp, m.Content)
-			chatID = m.RecipientUUID
-			senderPuppet = user.bridge.GetPuppetByCustomMXID(user.MXID)
-		} else {
-			log.Printf("Text message received from %s (group: %v) at %v: %s\n", m.SenderUUID, m.GroupID, m.Timestamp, m.Content)
-			chatID = m.SenderUUID
-			senderPuppet = user.bridge.GetPuppetBySignalID(m.SenderUUID)
-			profile, err := signalmeow.RetrieveProfileByID(context.Background(), user.SignalDevice, m.SenderUUID)
+		log.Printf("Text message received from %s to %s (group: %v) at %v: %s\n", m.SenderUUID, m.RecipientUUID, m.GroupID, m.Timestamp, m.Content)
+	case signalmeow.IncomingSignalMessageTypeAttachment:
+		m := incomingMessage.(signalmeow.IncomingSignalMessageAttachment)
+		log.Printf("Attachment received from %s to %s (group: %v) at %v: %s (%s, %d bytes)\n", m.SenderUUID, m.RecipientUUID, m.GroupID, m.Timestamp, m.Filename, m.ContentType, m.Size)
+	case signalmeow.IncomingSignalMessageTypeReaction:
+		m := incomingMessage.(signalmeow.IncomingSignalMessageReaction)
+		log.Printf("Reaction received from %s to %s (group: %v) at %v: %s on %s/%v (remove: %v)\n", m.SenderUUID, m.RecipientUUID, m.GroupID, m.Timestamp, m.Emoji, m.TargetAuthorUUID, m.TargetMessageTimestamp, m.Remove)
+	case signalmeow.IncomingSignalMessageTypeDelete:
+		m := incomingMessage.(signalmeow.IncomingSignalMessageDelete)
+		log.Printf("Delete received from %s to %s (group: %v) at %v for %v\n", m.SenderUUID, m.RecipientUUID, m.GroupID, m.Timestamp, m.TargetMessageTimestamp)
+	case signalmeow.IncomingSignalMessageTypeTyping:
+		m := incomingMessage.(signalmeow.IncomingSignalMessageTyping)
+		log.Printf("Typing received from %s to %s (group: %v) at %v: %v\n", m.SenderUUID, m.RecipientUUID, m.GroupID, m.Timestamp, m.IsTyping)
+	case signalmeow.IncomingSignalMessageTypeReceipt:
+		m := incomingMessage.(signalmeow.IncomingSignalMessageReceipt)
+		log.Printf("Receipt (type %v) received from %s to %s for %v\n", m.ReceiptType, m.SenderUUID, m.RecipientUUID, m.Timestamps)
+		user.handleReceipt(m)
+		return nil
+	case signalmeow.IncomingSignalMessageTypeExpireTimerUpdate:
+		m := incomingMessage.(signalmeow.IncomingSignalMessageExpireTimerUpdate)
+		log.Printf("Expire timer update received from %s to %s (group: %v) at %v: %v\n", m.SenderUUID, m.RecipientUUID, m.GroupID, m.Timestamp, m.ExpireTimer)
+	case signalmeow.IncomingSignalMessageTypeDecryptionError:
+		m := incomingMessage.(signalmeow.IncomingSignalMessageDecryptionError)
+		log.Printf("Failed to decrypt message from %s to %s (group: %v) at %v\n", m.SenderUUID, m.RecipientUUID, m.GroupID, m.Timestamp)
+	case signalmeow.IncomingSignalMessageTypeIdentityChange:
+		m := incomingMessage.(signalmeow.IncomingSignalMessageIdentityChange)
+		log.Printf("Identity key of %s changed\n", m.SenderUUID)
+	case signalmeow.IncomingSignalMessageTypeGroupChange:
+		m := incomingMessage.(signalmeow.IncomingSignalMessageGroupChange)
+		log.Printf("Group change to revision %v received from %s in group %v\n", m.Change.Revision, m.SenderUUID, m.GroupID)
+	default:
+		log.Printf("Unknown message type received %v", incomingMessage.MessageType())
+		return nil
+	}
+
+	// Group changes update the room info themselves, as the puppet that made the change
+	syncGroupInfo := incomingMessage.MessageType() != signalmeow.IncomingSignalMessageTypeGroupChange
+	portal, senderPuppet, err := user.portalAndSenderForIncomingMessage(incomingMessage.Base(), syncGroupInfo)
+	if err != nil {
+		return err
+	}
+	portal.signalMessages <- portalSignalMessage{
+		user:   user,
+		msg:    incomingMessage,
+		sender: senderPuppet,
+	}
+	return nil
+}
+
+// Receipts don't say which chat they're for, so send them to every portal that has one of the messages they mention
+func (user *User) handleReceipt(m signalmeow.IncomingSignalMessageReceipt) {
+	if m.SenderUUID == user.SignalID {
+		return
+	}
+	portals := map[database.PortalKey]*Portal{}
+	for _, timestamp := range m.Timestamps {
+		msg := user.bridge.DB.Message.FindBySenderAndTimestamp(user.SignalID, time.UnixMilli(int64(timestamp)))
+		if msg == nil {
+			continue
+		}
+		key := database.NewPortalKey(msg.SignalChatID, msg.SignalReceiver)
+		if _, ok := portals[key]; !ok {
+			portals[key] = user.bridge.GetPortalByChatID(key)
+		}
+	}
+	if len(portals) == 0 {
+		log.Printf("Ignoring receipt from %s for unknown messages %v", m.SenderUUID, m.Timestamps)
+		return
+	}
+	senderPuppet := user.bridge.GetPuppetBySignalID(m.SenderUUID)
+	if senderPuppet == nil {
+		log.Printf("No puppet found for receipt sender %s", m.SenderUUID)
+		return
+	}
+	for _, portal := range portals {
+		portal.signalMessages <- portalSignalMessage{
+			user:   user,
+			msg:    m,
+			sender: senderPuppet,
+		}
+	}
+}
+
+// Finds the portal and sender puppet for an incoming message, updating their metadata along the way
+func (user *User) portalAndSenderForIncomingMessage(m signalmeow.IncomingSignalMessageBase, syncGroupInfo bool) (*Portal, *Puppet, error) {
+	var chatID string
+	var senderPuppet *Puppet
+
+	// Get and update the puppet for this message
+	if m.SenderUUID == user.SignalID {
+		// This is a message sent by us on another device
+		chatID = m.RecipientUUID
+		senderPuppet = user.bridge.GetPuppetByCustomMXID(user.MXID)
+		if senderPuppet == nil {
+			// No double puppeting, so fall back to our own ghost
+			senderPuppet = user.bridge.GetPuppetBySignalID(user.SignalID)
+		}
+	} else if m.SenderUUID != "" {
+		chatID = m.SenderUUID
+		senderPuppet = user.bridge.GetPuppetBySignalID(m.SenderUUID)
+		profile, err := signalmeow.RetrieveProfileByID(context.Background(), user.SignalDevice, m.SenderUUID)
+		if err != nil {
+			log.Printf("error retrieving profile: %v", err)
+		}
+		if profile != nil && profile.Name != senderPuppet.Name {
+			senderPuppet.Name = profile.Name
+			err = senderPuppet.DefaultIntent().SetDisplayName(profile.Name)
 			if err != nil {
-				log.Printf("error retrieving profile: %v", err)
-			}
-			if profile.Name != senderPuppet.Name {
-				senderPuppet.Name = profile.Name
-				err = senderPuppet.DefaultIntent().SetDisplayName(profile.Name)
+				log.Printf("error setting display name: %v", err)
+			} else {
+				senderPuppet.NameSet = true
+				err = senderPuppet.Update()
 				if err != nil {
-					log.Printf("error setting display name: %v", err)
-				} else {
-					senderPuppet.NameSet = true
-					err = senderPuppet.Update()
-					if err != nil {
-						log.Printf("error updating puppet: %v", err)
-					}
+					log.Printf("error updating puppet: %v", err)
 				}
 			}
-			if m.GroupID != nil {
-				chatID = string(*m.GroupID)
-			}
 		}
+	}
+	if m.GroupID != nil {
+		chatID = string(*m.GroupID)
+	}
 
-		// Get and update the portal for this message
-		portal := user.GetPortalByChatID(chatID)
-		if portal == nil {
-			log.Printf("no portal found for chatID %s", chatID)
-			return errors.New("no portal found for chatID")
-		}
-		updatePortal := false
-		if m.GroupID != nil {
-			group, err := signalmeow.RetrieveGroupByID(context.Background(), user.SignalDevice, *m.GroupID)
-			if err != nil {
-				log.Printf("error retrieving group: %v", err)
-			}
-			if portal.Name != group.Title || portal.Topic != group.Description {
-				portal.Name = group.Title
-				portal.Topic = group.Description
-				updatePortal = true
-			}
-		} else {
-			if portal.shouldSetDMRoomMetadata() {
-				portal.Name = senderPuppet.Name
-				_, err := portal.MainIntent().SetRoomName(portal.MXID, portal.Name)
-				portal.NameSet = err == nil
-			}
+	// Get and update the portal for this message
+	portal := user.GetPortalByChatID(chatID)
+	if portal == nil {
+		log.Printf("no portal found for chatID %s", chatID)
+		return nil, nil, errors.New("no portal found for chatID")
+	}
+	updatePortal := false
+	if m.GroupID != nil && syncGroupInfo {
+		group, err := signalmeow.RetrieveGroupByID(context.Background(), user.SignalDevice, *m.GroupID)
+		if err != nil {
+			log.Printf("error retrieving group: %v", err)
+		} else if portal.Name != group.Title || portal.Topic != group.Description {
+			portal.Name = group.Title
+			portal.Topic = group.Description
+			updatePortal = true
 		}
-		if updatePortal {
+	} else if m.GroupID == nil {
+		if portal.shouldSetDMRoomMetadata() && m.SenderUUID != user.SignalID {
+			portal.Name = senderPuppet.Name
 			_, err := portal.MainIntent().SetRoomName(portal.MXID, portal.Name)
-			if err != nil {
-				log.Printf("error setting room name: %v", err)
-			}
-			_, err = portal.MainIntent().SetRoomTopic(portal.MXID, portal.Topic)
-			if err != nil {
-				log.Printf("error setting room topic: %v", err)
-			}
-			err = portal.Update()
-			if err != nil {
-				log.Printf("error updating portal: %v", err)
-			}
-			portal.UpdateBridgeInfo()
+			portal.NameSet = err == nil
 		}
-		portalSignalMessage := portalSignalMessage{
-			user:   user,
-			msg:    m.Content,
-			sender: senderPuppet,
+	}
+	if updatePortal {
+		_, err := portal.MainIntent().SetRoomName(portal.MXID, portal.Name)
+		if err != nil {
+			log.Printf("error setting room name: %v", err)
 		}
-		portal.signalMessages <- portalSignalMessage
-	default:
-		log.Printf("Unknown message type received %v", incomingMessage.MessageType())
+		_, err = portal.MainIntent().SetRoomTopic(portal.MXID, portal.Topic)
+		if err != nil {
+			log.Printf("error setting room topic: %v", err)
+		}
+		err = portal.Update()
+		if err != nil {
+			log.Printf("error updating portal: %v", err)
+		}
+		portal.UpdateBridgeInfo()
 	}
-
-	return nil
+	return portal, senderPuppet, nil
 }
 
 func (user *User) GetPortalByChatID(signalID string) *Portal {
@@ -470,6 +565,10 @@ func (user *User) Disconnect() error {
 	}
 
 	user.log.Info().Msg("Disconnecting session manually")
+	if user.cancelConnection != nil {
+		user.cancelConnection()
+		user.cancelConnection = nil
+	}
 	// TODO: don't reach in so far to disconnect user
 	err := user.SignalDevice.Connection.AuthedWS.Close()
 	if err != nil {